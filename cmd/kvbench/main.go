@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kvschool/internal/lsm"
+	"kvschool/internal/stream"
+)
+
+// benchmarks — нагрузки по именам.
+var benchmarks = map[string]func(b *bench) workload{
+	"fillseq":          fillSeq,
+	"fillrandom":       fillRandom,
+	"readrandom":       readRandom,
+	"readwhilewriting": readWhileWriting,
+	"scan":             scan,
+}
+
+type config struct {
+	dir        string
+	benchmarks string
+	num        int
+	reads      int
+	valueSize  int
+	threads    int
+	scanLength int
+	seed       uint64
+
+	blockSize         int
+	memtableSize      int
+	valueLogThreshold int
+	syncWrites        bool
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.dir, "dir", "", "директория движка (пусто — временная, удаляется после запуска)")
+	flag.StringVar(&cfg.benchmarks, "benchmarks", "fillseq,fillrandom,readrandom,readwhilewriting,scan",
+		"нагрузки через запятую: fillseq, fillrandom, readrandom, readwhilewriting, scan")
+	flag.IntVar(&cfg.num, "num", 100000, "число ключей")
+	flag.IntVar(&cfg.reads, "reads", -1, "число чтений и сканирований (меньше 0 — равно -num)")
+	flag.IntVar(&cfg.valueSize, "value-size", 100, "размер значения в байтах")
+	flag.IntVar(&cfg.threads, "threads", 1, "число потоков")
+	flag.IntVar(&cfg.scanLength, "scan-length", 100, "ключей за одно сканирование")
+	flag.Uint64Var(&cfg.seed, "seed", 1, "начальное значение генератора случайных ключей")
+	flag.IntVar(&cfg.blockSize, "block-size", 0, "Options.BlockSize (0 — по умолчанию)")
+	flag.IntVar(&cfg.memtableSize, "memtable-size", 0, "Options.MemtableFlushThreshold (0 — по умолчанию)")
+	flag.IntVar(&cfg.valueLogThreshold, "value-log-threshold", 0, "Options.ValueLogThreshold (0 — value log выключен)")
+	flag.BoolVar(&cfg.syncWrites, "sync", false, "Options.SyncWrites")
+	flag.Parse()
+
+	if err := run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "ошибка:", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg config) error {
+	if cfg.num <= 0 || cfg.threads <= 0 || cfg.valueSize < 0 || cfg.scanLength <= 0 {
+		return errors.New("-num, -threads и -scan-length должны быть положительными, -value-size — неотрицательным")
+	}
+	if cfg.reads < 0 {
+		cfg.reads = cfg.num
+	}
+	names := strings.Split(cfg.benchmarks, ",")
+	for _, name := range names {
+		if _, ok := benchmarks[name]; !ok {
+			return fmt.Errorf("неизвестная нагрузка %q", name)
+		}
+	}
+
+	dir := cfg.dir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "kvbench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	e, err := lsm.Open(lsm.Options{
+		Dir:                    dir,
+		BlockSize:              cfg.blockSize,
+		MemtableFlushThreshold: cfg.memtableSize,
+		ValueLogThreshold:      cfg.valueLogThreshold,
+		SyncWrites:             cfg.syncWrites,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Ключи:      %d байт, %d шт.\n", keySize, cfg.num)
+	fmt.Printf("Значения:   %d байт\n", cfg.valueSize)
+	fmt.Printf("Потоки:     %d\n", cfg.threads)
+	fmt.Printf("Директория: %s\n", dir)
+	fmt.Println(strings.Repeat("-", 80))
+
+	b := &bench{cfg: cfg, e: e, values: newValueSource(cfg.seed, cfg.valueSize)}
+	var results []result
+	for _, name := range names {
+		res, err := b.run(name, benchmarks[name](b))
+		if err != nil {
+			_ = e.Close()
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Println(res)
+		results = append(results, res)
+	}
+
+	fmt.Println(strings.Repeat("-", 80))
+	report(e.Stats(), results)
+	return e.Close()
+}
+
+// keySize — длина ключа: номер, дополненный нулями, так что порядок ключей —
+// порядок номеров.
+const keySize = 16
+
+func key(n int) []byte {
+	return fmt.Appendf(make([]byte, 0, keySize), "%016d", n)
+}
+
+// valueSource выдает значения заданного размера — срезы заранее заполненного
+// случайными байтами буфера.
+type valueSource struct {
+	buf  []byte
+	size int
+}
+
+func newValueSource(seed uint64, size int) *valueSource {
+	r := rand.New(rand.NewPCG(seed, 0))
+	buf := make([]byte, max(1<<20, 2*size))
+	for i := range buf {
+		buf[i] = byte(r.Uint32())
+	}
+	return &valueSource{buf: buf, size: size}
+}
+
+func (v *valueSource) next(r *rand.Rand) []byte {
+	off := r.IntN(len(v.buf) - v.size + 1)
+	return v.buf[off : off+v.size]
+}
+
+type bench struct {
+	cfg    config
+	e      *lsm.Engine
+	values *valueSource
+}
+
+// workload — нагрузка: ops операций, поделенных между потоками; op выполняет
+// операцию i потока и возвращает число обработанных байт и нашлось ли значение.
+// background, если задан, работает параллельно до окончания потоков.
+type workload struct {
+	ops        int
+	op         func(r *rand.Rand, i int) (bytes int, found bool, err error)
+	background func(r *rand.Rand, stop <-chan struct{}) error
+}
+
+func fillSeq(b *bench) workload {
+	per := (b.cfg.num + b.cfg.threads - 1) / b.cfg.threads
+	return workload{
+		ops: b.cfg.num,
+		// Потоки пишут по возрастанию свои непрерывные участки ключей.
+		op: func(r *rand.Rand, i int) (int, bool, error) {
+			k := key(i%b.cfg.threads*per + i/b.cfg.threads)
+			v := b.values.next(r)
+			return len(k) + len(v), true, b.e.Put(k, v)
+		},
+	}
+}
+
+func fillRandom(b *bench) workload {
+	return workload{ops: b.cfg.num, op: b.put}
+}
+
+func (b *bench) put(r *rand.Rand, _ int) (int, bool, error) {
+	k := key(r.IntN(b.cfg.num))
+	v := b.values.next(r)
+	return len(k) + len(v), true, b.e.Put(k, v)
+}
+
+func readRandom(b *bench) workload {
+	return workload{ops: b.cfg.reads, op: b.get}
+}
+
+func (b *bench) get(r *rand.Rand, _ int) (int, bool, error) {
+	k := key(r.IntN(b.cfg.num))
+	v, err := b.e.Get(k)
+	if errors.Is(err, lsm.ErrNotFound) {
+		return len(k), false, nil
+	}
+	return len(k) + len(v), true, err
+}
+
+func readWhileWriting(b *bench) workload {
+	return workload{
+		ops: b.cfg.reads,
+		op:  b.get,
+		background: func(r *rand.Rand, stop <-chan struct{}) error {
+			for {
+				select {
+				case <-stop:
+					return nil
+				default:
+				}
+				if _, _, err := b.put(r, 0); err != nil {
+					return err
+				}
+			}
+		},
+	}
+}
+
+func scan(b *bench) workload {
+	return workload{
+		ops: b.cfg.reads,
+		op: func(r *rand.Rand, _ int) (int, bool, error) {
+			it := b.e.Scan(key(r.IntN(b.cfg.num)), nil)
+			defer it.Close()
+			n := 0
+			for range b.cfg.scanLength {
+				k, v, ok, err := it.Next()
+				if err != nil || !ok {
+					return n, n > 0, err
+				}
+				n += len(k) + len(v)
+			}
+			return n, true, nil
+		},
+	}
+}
+
+// result — итог нагрузки.
+type result struct {
+	name    string
+	ops     int
+	found   int
+	bytes   int64
+	elapsed time.Duration
+	latency *stream.QuantileSketch // задержки операций в микросекундах
+}
+
+func (r result) String() string {
+	perOp := r.elapsed.Seconds() * 1e6 / float64(max(r.ops, 1))
+	s := fmt.Sprintf("%-16s : %10.3f мкс/оп; %9.0f оп/с; %7.1f МБ/с; p50 %.1f мкс, p99 %.1f мкс, max %.1f мкс",
+		r.name, perOp, float64(r.ops)/r.elapsed.Seconds(), float64(r.bytes)/r.elapsed.Seconds()/(1<<20),
+		r.latency.Quantile(0.5), r.latency.Quantile(0.99), r.latency.Quantile(1))
+	if r.found != r.ops {
+		s += fmt.Sprintf(" (найдено %d из %d)", r.found, r.ops)
+	}
+	return s
+}
+
+// run выполняет нагрузку w в b.cfg.threads потоков.
+func (b *bench) run(name string, w workload) (result, error) {
+	threads := b.cfg.threads
+	results := make([]result, threads)
+	errs := make([]error, threads+1)
+	stop := make(chan struct{})
+	var bg sync.WaitGroup
+	if w.background != nil {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			errs[threads] = w.background(rand.New(rand.NewPCG(b.cfg.seed, uint64(threads))), stop)
+		}()
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for t := range threads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(b.cfg.seed, uint64(t)))
+			res := &results[t]
+			res.latency = stream.NewQuantileSketch(0.01)
+			// Операции распределены между потоками по кругу: поток t выполняет t, t+threads, ...
+			for i := t; i < w.ops; i += threads {
+				opStart := time.Now()
+				n, found, err := w.op(r, i)
+				if err != nil {
+					errs[t] = err
+					return
+				}
+				_ = res.latency.Add(float64(time.Since(opStart).Nanoseconds()) / 1e3)
+				res.ops++
+				res.bytes += int64(n)
+				if found {
+					res.found++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(stop)
+	bg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return result{}, err
+	}
+
+	total := result{name: name, elapsed: elapsed, latency: stream.NewQuantileSketch(0.01)}
+	for _, res := range results {
+		total.ops += res.ops
+		total.found += res.found
+		total.bytes += res.bytes
+		if err := total.latency.Merge(res.latency); err != nil {
+			return result{}, err
+		}
+	}
+	return total, nil
+}
+
+// report печатает итог: нагрузки и счетчики движка, по которым видно влияние
+// настроек — write amplification, число таблиц по уровням, задержки записи.
+func report(st lsm.Stats, results []result) {
+	fmt.Printf("%-16s %12s %12s %12s\n", "Нагрузка", "оп/с", "p50, мкс", "p99, мкс")
+	for _, r := range results {
+		fmt.Printf("%-16s %12.0f %12.1f %12.1f\n", r.name, float64(r.ops)/r.elapsed.Seconds(),
+			r.latency.Quantile(0.5), r.latency.Quantile(0.99))
+	}
+	fmt.Println()
+	fmt.Printf("Flush: %d, compaction: %d, задержано записей: %d (%v)\n",
+		st.Flushes, st.Compactions, st.StalledWrites, st.StallTime.Round(time.Millisecond))
+	if st.WALBytesWritten > 0 {
+		fmt.Printf("Write amplification: %.2f (записано в SSTable %d МБ, в WAL %d МБ)\n",
+			float64(st.BytesWritten)/float64(st.WALBytesWritten), st.BytesWritten>>20, st.WALBytesWritten>>20)
+	}
+	fmt.Print("Таблиц по уровням:")
+	for level, n := range st.LevelTables {
+		fmt.Printf(" L%d=%d", level, n)
+	}
+	fmt.Println()
+	fmt.Printf("Кэш таблиц: попаданий %d, промахов %d\n", st.TableCacheHits, st.TableCacheMisses)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"kvschool/internal/lsm"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	commands := map[string]func([]string) error{
+		"get":     runGet,
+		"put":     runPut,
+		"delete":  runDelete,
+		"scan":    runScan,
+		"flush":   runFlush,
+		"compact": runCompact,
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "ошибка:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "kvcli <команда> [-dir <директория>] [аргументы]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Команды:")
+	fmt.Fprintln(os.Stderr, "  get      <ключ>                                 вывести значение ключа")
+	fmt.Fprintln(os.Stderr, "  put      <ключ> <значение>                      записать значение")
+	fmt.Fprintln(os.Stderr, "  delete   <ключ>                                 удалить ключ")
+	fmt.Fprintln(os.Stderr, "  scan     [-start <ключ>] [-end <ключ>] [-limit <N>]  вывести ключи диапазона [start, end)")
+	fmt.Fprintln(os.Stderr, "  flush                                           сбросить Memtable в SSTable")
+	fmt.Fprintln(os.Stderr, "  compact  [-start <ключ>] [-end <ключ>]          выполнить compaction диапазона")
+}
+
+// command разбирает флаги команды name, открывает движок в -dir и вызывает run
+// с позиционными аргументами; nargs — их ожидаемое число.
+func command(name string, args []string, nargs int, setup func(*flag.FlagSet), run func(e *lsm.Engine, args []string) error) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	dir := fs.String("dir", ".", "директория движка")
+	if setup != nil {
+		setup(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != nargs {
+		return fmt.Errorf("%s: ожидается аргументов: %d, передано: %d", name, nargs, fs.NArg())
+	}
+	e, err := lsm.Open(lsm.Options{Dir: *dir})
+	if err != nil {
+		return err
+	}
+	if err := run(e, fs.Args()); err != nil {
+		_ = e.Close()
+		return err
+	}
+	return e.Close()
+}
+
+func runGet(args []string) error {
+	return command("get", args, 1, nil, func(e *lsm.Engine, args []string) error {
+		v, err := e.Get([]byte(args[0]))
+		if errors.Is(err, lsm.ErrNotFound) {
+			return fmt.Errorf("ключ %q не найден", args[0])
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", v)
+		return nil
+	})
+}
+
+func runPut(args []string) error {
+	return command("put", args, 2, nil, func(e *lsm.Engine, args []string) error {
+		return e.Put([]byte(args[0]), []byte(args[1]))
+	})
+}
+
+func runDelete(args []string) error {
+	return command("delete", args, 1, nil, func(e *lsm.Engine, args []string) error {
+		return e.Delete([]byte(args[0]))
+	})
+}
+
+func runScan(args []string) error {
+	var start, end *string
+	var limit *int
+	setup := func(fs *flag.FlagSet) {
+		start = fs.String("start", "", "начало диапазона (включительно); пусто — с начала")
+		end = fs.String("end", "", "конец диапазона (не включительно); пусто — до конца")
+		limit = fs.Int("limit", 0, "вывести не больше N ключей (0 — все)")
+	}
+	return command("scan", args, 0, setup, func(e *lsm.Engine, _ []string) error {
+		it := e.Scan(optionalKey(*start), optionalKey(*end))
+		defer it.Close()
+		for n := 0; *limit <= 0 || n < *limit; n++ {
+			key, value, ok, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			fmt.Printf("%s\t%s\n", key, value)
+		}
+		return nil
+	})
+}
+
+func runFlush(args []string) error {
+	return command("flush", args, 0, nil, func(e *lsm.Engine, _ []string) error {
+		tables, err := e.Flush()
+		if err != nil {
+			return err
+		}
+		for _, t := range tables {
+			fmt.Printf("%s\tL%d\t%d байт\n", t.Path, t.Level, t.Size)
+		}
+		return nil
+	})
+}
+
+func runCompact(args []string) error {
+	var start, end *string
+	setup := func(fs *flag.FlagSet) {
+		start = fs.String("start", "", "начало диапазона (включительно); пусто — с начала")
+		end = fs.String("end", "", "конец диапазона (не включительно); пусто — до конца")
+	}
+	return command("compact", args, 0, setup, func(e *lsm.Engine, _ []string) error {
+		return e.CompactRange(optionalKey(*start), optionalKey(*end))
+	})
+}
+
+// optionalKey возвращает nil для пустой строки: границы диапазона не задано.
+func optionalKey(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return []byte(s)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultCDRLayout — поля строки CDR фиксированной ширины: те же, что в testdata/cdr_sample.csv,
+// время — YYYYMMDDhhmmss. Значения дополняются пробелами справа.
+const defaultCDRLayout = "timestamp:14,imsi:15,msisdn:11,call_type:12,duration_sec:6,cell_id:6,tower_lat:9,tower_lon:9"
+
+// recordReader читает записи входа как наборы полей.
+type recordReader struct {
+	// names — имена полей: из заголовка CSV, раскладки CDR или номера столбцов.
+	names []string
+	read  func() ([]string, error)
+	line  func() int
+}
+
+func newRecordReader(cfg config, in io.Reader) (*recordReader, error) {
+	switch cfg.format {
+	case "csv":
+		return newCSVReader(cfg, in)
+	case "cdr":
+		return newCDRReader(cfg.layout, in)
+	}
+	return nil, fmt.Errorf("неизвестный формат %q", cfg.format)
+}
+
+func newCSVReader(cfg config, in io.Reader) (*recordReader, error) {
+	comma, size := utf8.DecodeRuneInString(cfg.comma)
+	if size == 0 || size != len(cfg.comma) {
+		return nil, fmt.Errorf("-comma: нужен один символ, задано %q", cfg.comma)
+	}
+	cr := csv.NewReader(bufio.NewReaderSize(in, 1<<20))
+	cr.Comma = comma
+	cr.ReuseRecord = true
+	first, err := cr.Read()
+	if err == io.EOF {
+		return &recordReader{read: func() ([]string, error) { return nil, io.EOF }, line: func() int { return 0 }}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &recordReader{
+		read: cr.Read,
+		line: func() int { line, _ := cr.FieldPos(0); return line },
+	}
+	if cfg.header {
+		r.names = slices.Clone(first)
+		return r, nil
+	}
+	for i := range first {
+		r.names = append(r.names, strconv.Itoa(i))
+	}
+	// Первая строка — уже запись: она возвращается первым read.
+	pending := slices.Clone(first)
+	r.read = func() ([]string, error) {
+		if pending != nil {
+			rec := pending
+			pending = nil
+			return rec, nil
+		}
+		return cr.Read()
+	}
+	return r, nil
+}
+
+// cdrField — поле раскладки CDR.
+type cdrField struct {
+	name  string
+	width int
+}
+
+func parseLayout(layout string) ([]cdrField, error) {
+	var fields []cdrField
+	for _, part := range strings.Split(layout, ",") {
+		name, width, ok := strings.Cut(strings.TrimSpace(part), ":")
+		w, err := strconv.Atoi(width)
+		if !ok || name == "" || err != nil || w <= 0 {
+			return nil, fmt.Errorf("-layout: некорректное поле %q, нужно имя:ширина", part)
+		}
+		fields = append(fields, cdrField{name, w})
+	}
+	return fields, nil
+}
+
+func newCDRReader(layout string, in io.Reader) (*recordReader, error) {
+	fields, err := parseLayout(layout)
+	if err != nil {
+		return nil, err
+	}
+	width := 0
+	r := &recordReader{}
+	for _, f := range fields {
+		r.names = append(r.names, f.name)
+		width += f.width
+	}
+	sc := bufio.NewScanner(bufio.NewReaderSize(in, 1<<20))
+	line := 0
+	rec := make([]string, len(fields))
+	r.line = func() int { return line }
+	r.read = func() ([]string, error) {
+		for sc.Scan() {
+			line++
+			b := bytes.TrimRight(sc.Bytes(), "\r")
+			if len(bytes.TrimSpace(b)) == 0 {
+				continue
+			}
+			if len(b) < width {
+				return nil, fmt.Errorf("строка %d: длина %d, а по раскладке нужно %d", line, len(b), width)
+			}
+			off := 0
+			for i, f := range fields {
+				rec[i] = string(bytes.TrimSpace(b[off : off+f.width]))
+				off += f.width
+			}
+			return rec, nil
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return r, nil
+}
+
+// columns разбирает список столбцов spec — имен или номеров через запятую;
+// пустой spec — def.
+func (r *recordReader) columns(spec string, def []int) ([]int, error) {
+	if spec == "" {
+		return def, nil
+	}
+	var cols []int
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.Index(r.names, name)
+		if i < 0 {
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 0 || n >= len(r.names) {
+				return nil, fmt.Errorf("нет столбца %q (есть: %s)", name, strings.Join(r.names, ", "))
+			}
+			i = n
+		}
+		cols = append(cols, i)
+	}
+	return cols, nil
+}
+
+// valueEncoder собирает значение — строку CSV из выбранных полей записи.
+type valueEncoder struct {
+	buf bytes.Buffer
+	w   *csv.Writer
+	rec []string
+}
+
+func newValueEncoder() *valueEncoder {
+	v := &valueEncoder{}
+	v.w = csv.NewWriter(&v.buf)
+	return v
+}
+
+// encode возвращает значение записи fields из столбцов cols. Срез действителен
+// до следующего вызова.
+func (v *valueEncoder) encode(fields []string, cols []int) ([]byte, error) {
+	v.rec = v.rec[:0]
+	for _, c := range cols {
+		v.rec = append(v.rec, fields[c])
+	}
+	v.buf.Reset()
+	if err := v.w.Write(v.rec); err != nil {
+		return nil, err
+	}
+	v.w.Flush()
+	if err := v.w.Error(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(v.buf.Bytes(), []byte("\n")), nil
+}
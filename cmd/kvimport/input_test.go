@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readAll возвращает имена полей и все записи входа в виде "поле|поле".
+func readAll(cfg config, in string) ([]string, []string, error) {
+	r, err := newRecordReader(cfg, strings.NewReader(in))
+	if err != nil {
+		return nil, nil, err
+	}
+	var recs []string
+	for {
+		fields, err := r.read()
+		if err == io.EOF {
+			return r.names, recs, nil
+		}
+		if err != nil {
+			return r.names, recs, err
+		}
+		recs = append(recs, strings.Join(fields, "|"))
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		comma  string
+		header bool
+		in     string
+		names  []string
+		recs   []string
+		err    bool
+	}{
+		{name: "заголовок", header: true, in: "imsi,dur\n1,60\n2,30\n",
+			names: []string{"imsi", "dur"}, recs: []string{"1|60", "2|30"}},
+		{name: "без заголовка", in: "1,60\n2,30\n",
+			names: []string{"0", "1"}, recs: []string{"1|60", "2|30"}},
+		{name: "кавычки", header: true, in: "k,v\n\"a,b\",\"say \"\"hi\"\"\"\n\"x\ny\",z\n",
+			names: []string{"k", "v"}, recs: []string{"a,b|say \"hi\"", "x\ny|z"}},
+		{name: "разделитель", comma: ";", header: true, in: "k;v\na;1,5\n",
+			names: []string{"k", "v"}, recs: []string{"a|1,5"}},
+		{name: "пустой вход", header: true, in: ""},
+		{name: "незакрытая кавычка", header: true, in: "k,v\n\"a,1\n", err: true},
+		{name: "лишнее поле", header: true, in: "k,v\na,1\nb,2,3\n", err: true},
+		{name: "недостающее поле", header: true, in: "k,v\na\n", err: true},
+		{name: "разделитель из двух символов", comma: ";;", in: "a\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config{format: "csv", comma: ",", header: tt.header}
+			if tt.comma != "" {
+				cfg.comma = tt.comma
+			}
+			names, recs, err := readAll(cfg, tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ожидалась ошибка, прочитано %q", recs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%q", names) != fmt.Sprintf("%q", tt.names) || fmt.Sprintf("%q", recs) != fmt.Sprintf("%q", tt.recs) {
+				t.Fatalf("имена %q, записи %q; ожидались %q, %q", names, recs, tt.names, tt.recs)
+			}
+		})
+	}
+}
+
+func TestCDRReader(t *testing.T) {
+	const layout = "ts:4,imsi:5,type:3"
+	tests := []struct {
+		name string
+		in   string
+		recs []string
+		err  string
+	}{
+		{name: "точная длина", in: "202425001in \n202425002out\n",
+			recs: []string{"2024|25001|in", "2024|25002|out"}},
+		{name: "длинная строка", in: "202425001out-extra\n",
+			recs: []string{"2024|25001|out"}},
+		{name: "пустые строки и CRLF", in: "\n202425001in \r\n   \n",
+			recs: []string{"2024|25001|in"}},
+		{name: "без перевода строки в конце", in: "202425001in ",
+			recs: []string{"2024|25001|in"}},
+		{name: "короткая строка", in: "202425001in \n20242500\n",
+			recs: []string{"2024|25001|in"}, err: "строка 2: длина 8, а по раскладке нужно 12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, recs, err := readAll(config{format: "cdr", layout: layout}, tt.in)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("ошибка = %v, ожидалась %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(names) != "[ts imsi type]" || fmt.Sprint(recs) != fmt.Sprint(tt.recs) {
+				t.Fatalf("имена %v, записи %q, ожидались %q", names, recs, tt.recs)
+			}
+		})
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	if fields, err := parseLayout(defaultCDRLayout); err != nil || len(fields) != 8 || fields[1] != (cdrField{"imsi", 15}) {
+		t.Fatalf("parseLayout(defaultCDRLayout) = %v, %v", fields, err)
+	}
+	for _, layout := range []string{"", "imsi", "imsi:", ":15", "imsi:0", "imsi:-1", "imsi:x", "a:1,,b:2"} {
+		if _, err := parseLayout(layout); err == nil {
+			t.Fatalf("parseLayout(%q) без ошибки", layout)
+		}
+	}
+	if _, err := newRecordReader(config{format: "xml"}, strings.NewReader("")); err == nil {
+		t.Fatal("неизвестный формат принят")
+	}
+}
+
+func TestReadFile_Keys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "in.csv")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	collect := func(cfg config) ([]string, error) {
+		var got []string
+		_, err := readFile(cfg, path, func(key, value []byte) error {
+			got = append(got, string(key)+"="+string(value))
+			return nil
+		})
+		return got, err
+	}
+
+	write("imsi,ts,dur,cell\n25001,0900,60,\"a,b\"\n25002,0901,30,c\n")
+	cfg := config{format: "csv", comma: ",", header: true, key: "imsi,ts", keySep: ":"}
+	got, err := collect(cfg)
+	if err != nil || fmt.Sprint(got) != `[25001:0900=60,"a,b" 25002:0901=30,c]` {
+		t.Fatalf("записи = %q, %v", got, err)
+	}
+	cfg.value = "3"
+	if got, err = collect(cfg); err != nil || fmt.Sprint(got) != `[25001:0900="a,b" 25002:0901=c]` {
+		t.Fatalf("записи с -value 3 = %q, %v", got, err)
+	}
+	cfg.key = "msisdn"
+	if _, err := collect(cfg); err == nil || !strings.Contains(err.Error(), "-key") {
+		t.Fatalf("неизвестный столбец ключа: %v", err)
+	}
+
+	write("imsi,dur\n25001,60\n,30\n")
+	cfg = config{format: "csv", comma: ",", header: true, keySep: ":"}
+	if _, err := collect(cfg); err == nil || err.Error() != "строка 3: пустой ключ" {
+		t.Fatalf("пустой ключ: %v", err)
+	}
+
+	errStop := errors.New("стоп")
+	write("k,v\na,1\n")
+	if _, err := readFile(cfg, path, func(_, _ []byte) error { return errStop }); !errors.Is(err, errStop) {
+		t.Fatalf("ошибка add: %v", err)
+	}
+}
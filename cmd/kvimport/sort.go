@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"kvschool/internal/lsm"
+)
+
+// sorter упорядочивает записи по ключу внешней сортировкой: записи копятся в памяти
+// до chunkSize байт, сортируются и сбрасываются во временный файл (run), а в finish
+// файлы сливаются. Из записей с одинаковым ключом остается последняя по порядку входа.
+type sorter struct {
+	dir       string
+	chunkSize int64
+
+	arena []byte // ключи и значения записей буфера подряд
+	pairs []pair
+	paths []string // временные файлы по порядку входа
+}
+
+// pair — запись буфера: ключ arena[off:off+klen], затем значение длины vlen.
+type pair struct {
+	off, klen, vlen int
+}
+
+// pairOverhead — учитываемый расход памяти на запись сверх ключа и значения.
+const pairOverhead = 24
+
+func newSorter(dir string, chunkSize int64) *sorter {
+	return &sorter{dir: dir, chunkSize: chunkSize}
+}
+
+func (s *sorter) key(p pair) []byte   { return s.arena[p.off : p.off+p.klen] }
+func (s *sorter) value(p pair) []byte { return s.arena[p.off+p.klen : p.off+p.klen+p.vlen] }
+
+// add копирует запись в буфер и сбрасывает его во временный файл, если он заполнен.
+func (s *sorter) add(key, value []byte) error {
+	s.pairs = append(s.pairs, pair{off: len(s.arena), klen: len(key), vlen: len(value)})
+	s.arena = append(append(s.arena, key...), value...)
+	if int64(len(s.arena)+pairOverhead*len(s.pairs)) >= s.chunkSize {
+		return s.spill()
+	}
+	return nil
+}
+
+// sortChunk сортирует буфер по ключу и оставляет у каждого ключа последнюю запись.
+func (s *sorter) sortChunk() {
+	// Устойчивая сортировка сохраняет порядок входа среди записей с одним ключом.
+	slices.SortStableFunc(s.pairs, func(a, b pair) int { return bytes.Compare(s.key(a), s.key(b)) })
+	out := s.pairs[:0]
+	for _, p := range s.pairs {
+		if n := len(out); n > 0 && bytes.Equal(s.key(out[n-1]), s.key(p)) {
+			out[n-1] = p
+			continue
+		}
+		out = append(out, p)
+	}
+	s.pairs = out
+}
+
+// spill сортирует буфер и записывает его во временный файл: длина ключа (uvarint),
+// ключ, длина значения, значение.
+func (s *sorter) spill() error {
+	s.sortChunk()
+	path := filepath.Join(s.dir, fmt.Sprintf("run-%06d", len(s.paths)))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, 1<<20)
+	var buf []byte
+	for _, p := range s.pairs {
+		buf = appendBytes(buf[:0], s.key(p))
+		buf = appendBytes(buf, s.value(p))
+		if _, err := bw.Write(buf); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.paths = append(s.paths, path)
+	s.arena, s.pairs = s.arena[:0], s.pairs[:0]
+	return nil
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// runs возвращает число временных файлов.
+func (s *sorter) runs() int { return len(s.paths) }
+
+// finish передает записи в emit по возрастанию ключей и возвращает их число.
+// Если весь вход поместился в буфер, временных файлов нет и записи берутся из памяти.
+func (s *sorter) finish(emit func(key, value []byte) error) (int64, error) {
+	if len(s.paths) == 0 {
+		s.sortChunk()
+		for _, p := range s.pairs {
+			if err := emit(s.key(p), s.value(p)); err != nil {
+				return 0, err
+			}
+		}
+		return int64(len(s.pairs)), nil
+	}
+	if len(s.pairs) > 0 {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+	s.arena, s.pairs = nil, nil
+
+	h := runHeap{}
+	defer func() {
+		for _, r := range h {
+			_ = r.f.Close()
+		}
+	}()
+	for i, path := range s.paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		r := &runFile{f: f, r: bufio.NewReaderSize(f, 1<<20), seq: i}
+		ok, err := r.next()
+		if err != nil {
+			_ = f.Close()
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		if ok {
+			h = append(h, r)
+		} else {
+			_ = f.Close()
+		}
+	}
+	heap.Init(&h)
+
+	var n int64
+	var last []byte
+	for len(h) > 0 {
+		r := h[0]
+		// Среди равных ключей первым выходит более поздний файл; остальные пропускаются.
+		if n == 0 || !bytes.Equal(r.key, last) {
+			if err := emit(r.key, r.value); err != nil {
+				return n, err
+			}
+			last = append(last[:0], r.key...)
+			n++
+		}
+		ok, err := r.next()
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", s.paths[r.seq], err)
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			_ = r.f.Close()
+			heap.Pop(&h)
+		}
+	}
+	return n, nil
+}
+
+// runFile — временный файл, читаемый при слиянии.
+type runFile struct {
+	f          *os.File
+	r          *bufio.Reader
+	seq        int // номер файла: чем больше, тем позже записи во входе
+	key, value []byte
+}
+
+// next читает следующую запись файла; false — файл кончился.
+func (r *runFile) next() (bool, error) {
+	klen, err := binary.ReadUvarint(r.r)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if r.key, err = readBytes(r.r, klen, r.key); err != nil {
+		return false, err
+	}
+	vlen, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return false, io.ErrUnexpectedEOF
+	}
+	r.value, err = readBytes(r.r, vlen, r.value)
+	return err == nil, err
+}
+
+func readBytes(r io.Reader, n uint64, buf []byte) ([]byte, error) {
+	buf = slices.Grow(buf[:0], int(n))[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+type runHeap []*runFile
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].key, h[j].key); c != 0 {
+		return c < 0
+	}
+	return h[i].seq > h[j].seq
+}
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.(*runFile)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// tableWriter пишет упорядоченные записи в SSTable движка, начиная новую таблицу,
+// когда в текущую записано около size байт. Таблицы не пересекаются по ключам,
+// поэтому Ingest кладет их сразу на нижний свободный уровень.
+type tableWriter struct {
+	dir  string
+	size int64
+
+	f       *os.File
+	b       *lsm.TableBuilder
+	written int64
+	total   int64
+	paths   []string
+}
+
+func (w *tableWriter) add(key, value []byte) error {
+	if w.b == nil {
+		path := filepath.Join(w.dir, fmt.Sprintf("%06d.sst", len(w.paths)))
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		w.f, w.b, w.written = f, lsm.NewTableBuilder(f), 0
+		w.paths = append(w.paths, path)
+	}
+	if err := w.b.Put(key, value); err != nil {
+		return fmt.Errorf("ключ %q: %w", key, err)
+	}
+	w.written += int64(len(key) + len(value))
+	if w.written >= w.size {
+		return w.finish()
+	}
+	return nil
+}
+
+// finish дописывает текущую таблицу.
+func (w *tableWriter) finish() error {
+	if w.b == nil {
+		return nil
+	}
+	err := w.b.Finish()
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.total += w.written
+	w.f, w.b = nil, nil
+	return err
+}
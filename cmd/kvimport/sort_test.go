@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"kvschool/internal/lsm"
+)
+
+func TestSorter_Runs(t *testing.T) {
+	// Маленький буфер: вход расходится по многим временным файлам, и ключи
+	// повторяются как внутри одного файла, так и в разных.
+	s := newSorter(t.TempDir(), 256)
+	rnd := rand.New(rand.NewSource(1))
+	want := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%03d", rnd.Intn(300))
+		value := fmt.Sprintf("v%d", i)
+		want[key] = value
+		if err := s.add([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	if s.runs() < 10 {
+		t.Fatalf("временных файлов %d, ожидалось много", s.runs())
+	}
+
+	var keys []string
+	n, err := s.finish(func(key, value []byte) error {
+		if w := want[string(key)]; string(value) != w {
+			t.Fatalf("ключ %s: значение %s, последнее во входе %s", key, value, w)
+		}
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if n != int64(len(want)) || len(keys) != len(want) || !sort.StringsAreSorted(keys) {
+		t.Fatalf("finish: %d ключей из %d, по порядку: %v", n, len(want), sort.StringsAreSorted(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i] == keys[i-1] {
+			t.Fatalf("ключ %s выдан дважды", keys[i])
+		}
+	}
+}
+
+func TestSorter_InMemory(t *testing.T) {
+	s := newSorter(t.TempDir(), 1<<20)
+	for _, kv := range [][2]string{{"b", "1"}, {"a", "2"}, {"b", "3"}, {"c", "4"}, {"a", "5"}} {
+		if err := s.add([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	var got bytes.Buffer
+	n, err := s.finish(func(key, value []byte) error {
+		fmt.Fprintf(&got, "%s=%s ", key, value)
+		return nil
+	})
+	if err != nil || n != 3 || s.runs() != 0 || got.String() != "a=5 b=3 c=4 " {
+		t.Fatalf("finish = %d, %v, файлов %d: %s", n, err, s.runs(), got.String())
+	}
+}
+
+func TestRun_Import(t *testing.T) {
+	// Полный путь: CSV с повторами ключей, несколько временных файлов и таблиц.
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "in.csv")
+	var b bytes.Buffer
+	b.WriteString("imsi,seq\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&b, "%05d,%d\n", i%200, i)
+	}
+	if err := os.WriteFile(in, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(tmp, "db")
+	cfg := config{dir: dir, format: "csv", comma: ",", header: true, keySep: ":",
+		chunkSize: 512, tableSize: 1024, tmp: tmp}
+	if err := run(cfg, []string{in}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	e, err := lsm.Open(lsm.Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	it := e.Scan(nil, nil)
+	defer it.Close()
+	n := 0
+	for {
+		key, value, ok, err := it.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		// Последняя запись ключа n во входе — строка с наибольшим i < 500, где i%200 == n.
+		last := n + 400
+		if last >= 500 {
+			last -= 200
+		}
+		if want := fmt.Sprintf("%05d=%d", n, last); string(key)+"="+string(value) != want {
+			t.Fatalf("запись %d: %s=%s, ожидалось %s", n, key, value, want)
+		}
+		n++
+	}
+	if n != 200 {
+		t.Fatalf("ключей %d, ожидалось 200", n)
+	}
+}
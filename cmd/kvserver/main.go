@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kvschool/internal/kvhttp"
+	"kvschool/internal/kvrpc"
+	"kvschool/internal/lsm"
+	"kvschool/internal/memcache"
+	"kvschool/internal/metrics"
+	"kvschool/internal/replication"
+	"kvschool/internal/resp"
+)
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.dir, "dir", ".", "директория движка")
+	flag.StringVar(&cfg.addr, "addr", ":7070", "адрес gRPC-сервера")
+	flag.StringVar(&cfg.httpAddr, "http", "", "адрес HTTP API (пусто — без него)")
+	flag.BoolVar(&cfg.metrics, "metrics", false, "отдавать метрики Prometheus на /metrics HTTP-сервера")
+	flag.BoolVar(&cfg.replication, "replication", false, "отдавать записи и копии базы репликам на /replication/ HTTP-сервера")
+	flag.StringVar(&cfg.respAddr, "resp", "", "адрес фронтенда протокола Redis (пусто — без него)")
+	flag.StringVar(&cfg.memcacheAddr, "memcache", "", "адрес фронтенда протокола memcached (пусто — без него)")
+	flag.Parse()
+
+	if err := run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "ошибка:", err)
+		os.Exit(1)
+	}
+}
+
+// frontend — сервер протокола поверх TCP: resp.Server, memcache.Server.
+type frontend interface {
+	Serve(l net.Listener) error
+	Close() error
+}
+
+type config struct {
+	dir          string
+	addr         string
+	httpAddr     string
+	metrics      bool
+	replication  bool
+	respAddr     string
+	memcacheAddr string
+}
+
+// run обслуживает движок в cfg.dir по gRPC (а также по HTTP и протоколам Redis и
+// memcached, если их адреса заданы) до SIGINT или SIGTERM, затем дожидается
+// завершения текущих запросов и закрывает движок.
+func run(cfg config) error {
+	if (cfg.metrics || cfg.replication) && cfg.httpAddr == "" {
+		return errors.New("-metrics и -replication требуют -http")
+	}
+	e, err := lsm.Open(lsm.Options{Dir: cfg.dir})
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", cfg.addr)
+	if err != nil {
+		_ = e.Close()
+		return err
+	}
+	srv := kvrpc.NewServer(e)
+	// Ошибка любого фронтенда останавливает сервер целиком.
+	fail := func(name string, err error) {
+		log.Printf("kvserver: %s: %v", name, err)
+		srv.GracefulStop()
+	}
+
+	var hsrv *http.Server
+	if cfg.httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/v1/", kvhttp.NewHandler(e))
+		if cfg.metrics {
+			reg := metrics.NewRegistry()
+			reg.Register(metrics.Engine(e))
+			mux.Handle("/metrics", reg)
+		}
+		if cfg.replication {
+			mux.Handle("/replication/", http.StripPrefix("/replication", replication.NewLeader(e)))
+		}
+		hsrv = &http.Server{Addr: cfg.httpAddr, Handler: mux}
+		go func() {
+			log.Printf("kvserver: HTTP %s", cfg.httpAddr)
+			if err := hsrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				fail("HTTP", err)
+			}
+		}()
+	}
+	var frontends []frontend
+	serve := func(name, addr string, f frontend, closed error) {
+		frontends = append(frontends, f)
+		go func() {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				fail(name, err)
+				return
+			}
+			log.Printf("kvserver: %s %s", name, l.Addr())
+			if err := f.Serve(l); !errors.Is(err, closed) {
+				fail(name, err)
+			}
+		}()
+	}
+	if cfg.respAddr != "" {
+		serve("RESP", cfg.respAddr, resp.NewServer(e), resp.ErrServerClosed)
+	}
+	if cfg.memcacheAddr != "" {
+		serve("memcached", cfg.memcacheAddr, memcache.NewServer(e), memcache.ErrServerClosed)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Print("kvserver: остановка")
+		srv.GracefulStop()
+	}()
+
+	log.Printf("kvserver: gRPC %s, директория %s", lis.Addr(), cfg.dir)
+	err = srv.Serve(lis)
+	if hsrv != nil {
+		_ = hsrv.Shutdown(context.Background())
+	}
+	for _, f := range frontends {
+		_ = f.Close()
+	}
+	if err != nil {
+		_ = e.Close()
+		return err
+	}
+	return e.Close()
+}
@@ -0,0 +1,118 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PropFilterBlock — свойство SSTable с блоком фильтров, который пишет BlockBuilder.
+const PropFilterBlock = "bloom.filter-block"
+
+// filterBlockVersion — версия формата блока фильтров: версия (1 байт), число фильтров
+// (uvarint), затем фильтры, каждый — длина (uvarint) и MarshalBinary.
+const filterBlockVersion = 1
+
+// BlockBuilder строит секционированный блок фильтров SSTable: по фильтру Блума на каждый
+// блок данных, чтобы Get проверял только фильтр того блока, где мог бы лежать ключ.
+// Реализует sstable.BlockCollector: подключается через Writer.AddPropertyCollector
+// и записывает блок фильтров свойством PropFilterBlock. Границы блоков данных
+// сообщает сам Writer (FinishBlock), поэтому фильтры совпадают с блоками при любом
+// их размере.
+type BlockBuilder struct {
+	p    float64
+	opts []Option
+
+	keys    [][]byte // ключи текущего блока данных
+	filters [][]byte
+}
+
+// NewBlockBuilder создает BlockBuilder с долей false positive каждого фильтра
+// falsePositiveRate. opts задают хеширование фильтров, как у New; читать блок нужно
+// с теми же opts.
+func NewBlockBuilder(falsePositiveRate float64, opts ...Option) *BlockBuilder {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		panic(fmt.Sprintf("bloom: доля false positive %v вне интервала (0, 1)", falsePositiveRate))
+	}
+	return &BlockBuilder{p: falsePositiveRate, opts: opts}
+}
+
+// Add учитывает запись таблицы.
+func (b *BlockBuilder) Add(key, _ []byte) {
+	b.keys = append(b.keys, append([]byte(nil), key...))
+}
+
+// FinishBlock строит фильтр по ключам законченного блока данных.
+func (b *BlockBuilder) FinishBlock() {
+	if len(b.keys) == 0 {
+		return
+	}
+	f := NewOptimal(uint64(len(b.keys)), b.p, b.opts...)
+	_ = f.AddMany(b.keys)
+	data, _ := f.MarshalBinary()
+	b.filters = append(b.filters, data)
+	b.keys = b.keys[:0]
+}
+
+// Properties возвращает блок фильтров. Последний блок данных Writer заканчивает
+// в Finish до вызова Properties.
+func (b *BlockBuilder) Properties() map[string][]byte {
+	if len(b.filters) == 0 {
+		return nil
+	}
+	out := []byte{filterBlockVersion}
+	out = binary.AppendUvarint(out, uint64(len(b.filters)))
+	for _, f := range b.filters {
+		out = binary.AppendUvarint(out, uint64(len(f)))
+		out = append(out, f...)
+	}
+	return map[string][]byte{PropFilterBlock: out}
+}
+
+// FilterBlock — прочитанный блок фильтров: i-й фильтр относится к i-му блоку
+// данных таблицы (i-й записи SSTable.SparseIndexs).
+type FilterBlock struct {
+	filters []*Filter
+}
+
+// DecodeFilterBlock разбирает свойство PropFilterBlock. opts должны совпадать
+// с переданными NewBlockBuilder.
+func DecodeFilterBlock(data []byte, opts ...Option) (*FilterBlock, error) {
+	if len(data) == 0 || data[0] != filterBlockVersion {
+		return nil, fmt.Errorf("%w: неизвестная версия блока фильтров", ErrBadEncoding)
+	}
+	data = data[1:]
+	n, sz := binary.Uvarint(data)
+	if sz <= 0 || n > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: число фильтров", ErrBadEncoding)
+	}
+	data = data[sz:]
+	fb := &FilterBlock{filters: make([]*Filter, n)}
+	for i := range fb.filters {
+		l, sz := binary.Uvarint(data)
+		if sz <= 0 || l > uint64(len(data)-sz) {
+			return nil, fmt.Errorf("%w: фильтр %d оборван", ErrBadEncoding, i)
+		}
+		f := New(0, 0, opts...)
+		if err := f.UnmarshalBinary(data[sz : sz+int(l)]); err != nil {
+			return nil, fmt.Errorf("фильтр %d: %w", i, err)
+		}
+		fb.filters[i] = f
+		data = data[sz+int(l):]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%w: данные после последнего фильтра", ErrBadEncoding)
+	}
+	return fb, nil
+}
+
+// Len возвращает число фильтров — блоков данных таблицы.
+func (fb *FilterBlock) Len() int { return len(fb.filters) }
+
+// MayContain проверяет ключ по фильтру блока данных block. Для блока, которого
+// нет в таблице, возвращается false.
+func (fb *FilterBlock) MayContain(block int, key []byte) (bool, error) {
+	if block < 0 || block >= len(fb.filters) {
+		return false, nil
+	}
+	return fb.filters[block].MayContain(key)
+}
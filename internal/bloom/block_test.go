@@ -0,0 +1,78 @@
+package bloom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kvschool/internal/sstable"
+)
+
+var _ sstable.BlockCollector = (*BlockBuilder)(nil)
+
+func TestBlockBuilder_SSTable(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "table.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Границы блоков задает только Writer: размер блока BlockBuilder не знает,
+	// а значения разной длины делят блоки неравномерно.
+	w := sstable.NewWriterSize(f, 512)
+	w.AddPropertyCollector(NewBlockBuilder(0.01))
+	for i := 0; i < 1000; i++ {
+		if err := w.Add([]byte(fmt.Sprintf("key-%04d", i)), bytes.Repeat([]byte("v"), i%97)); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := sstable.Open(f.Name())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	fb, err := DecodeFilterBlock(s.Properties()[PropFilterBlock])
+	if err != nil {
+		t.Fatalf("DecodeFilterBlock: %v", err)
+	}
+	if fb.Len() != len(s.SparseIndexs()) || fb.Len() < 2 {
+		t.Fatalf("фильтров %d, блоков данных %d", fb.Len(), len(s.SparseIndexs()))
+	}
+	// Каждый ключ проходит фильтр своего блока, а чужие блоки его почти всегда отсекают.
+	fp := 0
+	for i, sp := range s.SparseIndexs() {
+		block, err := s.ReadBlockFromOffset(sp.Offset())
+		if err != nil {
+			t.Fatalf("ReadBlockFromOffset: %v", err)
+		}
+		for _, kv := range block {
+			if ok, _ := fb.MayContain(i, kv.Key); !ok {
+				t.Fatalf("false negative для %q в блоке %d", kv.Key, i)
+			}
+			if ok, _ := fb.MayContain((i+1)%fb.Len(), kv.Key); ok {
+				fp++
+			}
+		}
+	}
+	if fp > 30 {
+		t.Fatalf("false positive в соседних блоках: %d из 1000", fp)
+	}
+
+	for name, data := range map[string][]byte{
+		"пусто":   nil,
+		"версия":  {2, 0},
+		"оборван": s.Properties()[PropFilterBlock][:20],
+	} {
+		if _, err := DecodeFilterBlock(data); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%s: DecodeFilterBlock = %v, ожидалась ErrBadEncoding", name, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package bloom
+
+// blockWords — слов в блоке BlockedFilter: 8 × 64 бит = 64 байта, линия кеша.
+const blockWords = 8
+
+// BlockedFilter — фильтр Блума, разбитый на блоки по 512 бит: первый хеш выбирает
+// блок, и все k битов ключа ставятся и проверяются внутри него. Проверка читает
+// одну линию кеша вместо k случайных — для горячих точечных чтений; плата —
+// немного больше false positive, чем у Filter того же размера, из-за неравномерной
+// загрузки блоков.
+type BlockedFilter struct {
+	bits   []uint64
+	blocks uint64
+	k      uint8
+	h      hashing
+}
+
+// NewBlocked создает блочный фильтр.
+// size (m) — размер битового массива, округляется вверх до целого числа блоков.
+// hashes (k) — количество хеш-функций.
+// opts задают базовую хеш-функцию и seed, как у New.
+func NewBlocked(size uint64, hashesc uint8, opts ...Option) *BlockedFilter {
+	blocks := max((size+blockWords*64-1)/(blockWords*64), 1)
+	return &BlockedFilter{
+		bits:   make([]uint64, blocks*blockWords),
+		blocks: blocks,
+		k:      hashesc,
+		h:      newHashing(opts),
+	}
+}
+
+// Add добавляет ключ в фильтр.
+func (f *BlockedFilter) Add(key []byte) error {
+	block, a, b := f.probe(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		j := (a + i*b) % (blockWords * 64)
+		block[j/64] |= 1 << (j % 64)
+	}
+	return nil
+}
+
+// MayContain проверяет наличие ключа.
+// Возвращает false, если ключа точно нет.
+// Возвращает true, если ключ возможно есть (или произошел false positive).
+func (f *BlockedFilter) MayContain(key []byte) (bool, error) {
+	block, a, b := f.probe(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		j := (a + i*b) % (blockWords * 64)
+		if block[j/64]&(1<<(j%64)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// probe возвращает блок ключа и начало и шаг его индексов внутри блока: блок выбирает
+// h1, индексы — половины h2, так что они не зависят от номера блока.
+func (f *BlockedFilter) probe(key []byte) (block []uint64, a, b uint64) {
+	h1, h2 := f.h.base(key)
+	n := h1 % f.blocks * blockWords
+	return f.bits[n : n+blockWords], h2 & 0xffffffff, h2>>32 | 1
+}
@@ -0,0 +1,49 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockedBloom(t *testing.T) {
+	// Все биты ключа — в одном блоке из 8 слов.
+	one := NewBlocked(1<<16, 7)
+	if err := one.Add([]byte("key")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	blocks := make(map[int]bool)
+	for i, w := range one.bits {
+		if w != 0 {
+			blocks[i/blockWords] = true
+		}
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("биты ключа в %d блоках", len(blocks))
+	}
+
+	const n = 10000
+	f := NewBlocked(10*n, 7)
+	if len(f.bits) != (10*n+511)/512*blockWords {
+		t.Fatalf("слов: %d", len(f.bits))
+	}
+	for i := 0; i < n; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("key-%d", i))); !ok {
+			t.Fatalf("false negative для key-%d", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("other-%d", i))); ok {
+			fp++
+		}
+	}
+	// У обычного фильтра с теми же m/n и k около 0.8%.
+	if rate := float64(fp) / n; rate > 0.03 {
+		t.Fatalf("доля false positive %.4f", rate)
+	}
+}
@@ -1,49 +1,83 @@
 package bloom
 
 import (
+	"encoding/binary"
 	"errors"
-	"hash"
-	"hash/fnv"
+	"fmt"
+	"math"
+	"math/bits"
 )
 
 // ErrNotImplemented используется в заготовке практики третьего дня.
 var ErrNotImplemented = errors.New("bloom: функция не реализована")
 
+// ErrBadEncoding возвращает UnmarshalBinary для данных, которые не являются фильтром.
+var ErrBadEncoding = errors.New("bloom: некорректное представление фильтра")
+
+// ErrIncompatible возвращают Merge и Intersect для фильтров с разными параметрами.
+var ErrIncompatible = errors.New("bloom: фильтры с разными параметрами")
+
+// Сериализованный фильтр: magic, версия формата (1 байт), k (1 байт), size (8 байт, BE),
+// затем слова битового массива по 8 байт (LE).
+const (
+	encodingMagic   = "BLMF"
+	encodingVersion = 1
+	headerLen       = len(encodingMagic) + 1 + 1 + 8
+)
+
 // Filter — вероятностный фильтр Блума ("Охранник диска").
 // Позволяет мгновенно сказать "НЕТ, ключа здесь нет" с вероятностью 100%.
 // Если говорит "ВОЗМОЖНО ЕСТЬ", придется проверять диск.
 type Filter struct {
-	bitSet []bool
-	size   int
-	hashes []hash.Hash64
+	// bits — битовый массив из size бит, по 64 в слове: []bool занимал бы байт на бит.
+	bits []uint64
+	size int
+	// k — число индексов на ключ. Индексы не считаются k разными хеш-функциями:
+	// i-й получается из двух базовых хешей как h1 + i*h2 (Kirsch–Mitzenmacher),
+	// что дает ту же вероятность false positive.
+	k uint8
+	h hashing
 }
 
 // New создает новый фильтр.
 // size (m) — размер битового массива.
 // hashes (k) — количество хеш-функций.
-func New(size uint64, hashesc uint8) *Filter {
+// opts задают базовую хеш-функцию и seed (по умолчанию FNV с seed 0).
+func New(size uint64, hashesc uint8, opts ...Option) *Filter {
 
-	bitSet := make([]bool, size)
-	hashes := make([]hash.Hash64, hashesc)
-	for i := 0; i < int(hashesc); i++ {
-		hashes[i] = fnv.New64a()
+	return &Filter{
+		bits: make([]uint64, (size+63)/64),
+		size: int(size),
+		k:    hashesc,
+		h:    newHashing(opts),
 	}
+}
 
-	return &Filter{
-		bitSet: bitSet,
-		size:   int(size),
-		hashes: hashes,
+// NewOptimal создает фильтр под expectedItems ключей с долей false positive
+// не выше falsePositiveRate: m = -n·ln p / ln²2, k = m/n·ln 2.
+// falsePositiveRate должен быть в интервале (0, 1).
+func NewOptimal(expectedItems uint64, falsePositiveRate float64, opts ...Option) *Filter {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		panic(fmt.Sprintf("bloom: доля false positive %v вне интервала (0, 1)", falsePositiveRate))
 	}
+	m, k := optimalParams(expectedItems, falsePositiveRate)
+	return New(m, k, opts...)
+}
+
+// optimalParams возвращает размер m и число хешей k для n ключей и доли false positive p.
+func optimalParams(n uint64, p float64) (m uint64, k uint8) {
+	n = max(n, 1)
+	m = uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k = uint8(min(max(math.Round(float64(m)/float64(n)*math.Ln2), 1), math.MaxUint8))
+	return m, k
 }
 
 // Add добавляет ключ в фильтр.
 func (f *Filter) Add(Str []byte) error {
 
-	for _, b := range f.hashes {
-		b.Reset()
-		b.Write([]byte(Str))
-		index := b.Sum64() % uint64(f.size)
-		f.bitSet[index] = true
+	h1, h2 := f.h.base(Str)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		f.set((h1 + i*h2) % uint64(f.size))
 	}
 	return nil
 }
@@ -52,13 +86,171 @@ func (f *Filter) Add(Str []byte) error {
 // Возвращает false, если ключа точно нет.
 // Возвращает true, если ключ возможно есть (или произошел false positive).
 func (f *Filter) MayContain(Str []byte) (bool, error) {
-	for _, fun := range f.hashes {
-		fun.Reset()
-		fun.Write(Str)
-		index := fun.Sum64() % uint64(f.size)
-		if !f.bitSet[index] {
+	h1, h2 := f.h.base(Str)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !f.test((h1 + i*h2) % uint64(f.size)) {
 			return false, nil
 		}
 	}
 	return true, nil
 }
+
+// AddMany добавляет ключи в фильтр, например все ключи Memtable при Flush.
+// Сначала считаются хеши всех ключей, затем ставятся биты: циклы короче и
+// не перемежают хеширование с обращениями к случайным словам массива.
+func (f *Filter) AddMany(keys [][]byte) error {
+	for _, h := range f.hashMany(keys) {
+		for i := uint64(0); i < uint64(f.k); i++ {
+			f.set((h[0] + i*h[1]) % uint64(f.size))
+		}
+	}
+	return nil
+}
+
+// ContainsMany проверяет наличие ключей: i-й результат — MayContain(keys[i]).
+func (f *Filter) ContainsMany(keys [][]byte) ([]bool, error) {
+	res := make([]bool, len(keys))
+	for j, h := range f.hashMany(keys) {
+		res[j] = true
+		for i := uint64(0); i < uint64(f.k); i++ {
+			if !f.test((h[0] + i*h[1]) % uint64(f.size)) {
+				res[j] = false
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// hashMany возвращает базовые хеши ключей.
+func (f *Filter) hashMany(keys [][]byte) [][2]uint64 {
+	hs := make([][2]uint64, len(keys))
+	for i, key := range keys {
+		hs[i][0], hs[i][1] = f.h.base(key)
+	}
+	return hs
+}
+
+// FillRatio возвращает долю установленных битов.
+func (f *Filter) FillRatio() float64 {
+	if f.size == 0 {
+		return 0
+	}
+	set := 0
+	for _, w := range f.bits {
+		set += bits.OnesCount64(w)
+	}
+	return float64(set) / float64(f.size)
+}
+
+// EstimatedFalsePositiveRate оценивает текущую долю false positive по заполненности:
+// ключ, которого нет, проходит, если установлены все k его битов. Когда оценка
+// намного выше расчетной, фильтр переполнен и его стоит перестроить большего размера.
+func (f *Filter) EstimatedFalsePositiveRate() float64 {
+	return math.Pow(f.FillRatio(), float64(f.k))
+}
+
+// Count оценивает число различных добавленных ключей по заполненности
+// (Swamidass–Baldi): n ≈ -m/k · ln(1 - X/m), где X — число установленных битов.
+// Счетчик не хранится, поэтому оценка верна и после Merge и UnmarshalBinary; сравнив
+// ее с расчетной емкостью, можно проверить, что фильтр таблицы выбран по размеру.
+// Если установлены все биты, оценка бесконечна — возвращается math.MaxUint64.
+func (f *Filter) Count() uint64 {
+	fill := f.FillRatio()
+	if f.k == 0 || fill == 0 {
+		return 0
+	}
+	if fill == 1 {
+		return math.MaxUint64
+	}
+	return uint64(math.Round(-float64(f.size) / float64(f.k) * math.Log1p(-fill)))
+}
+
+// Merge добавляет в f все ключи other (побитовое ИЛИ): так при компакции объединяются
+// фильтры входных таблиц без повторного добавления ключей. Фильтры должны быть
+// созданы с одинаковыми size, k, хеш-функцией и seed; хеш-функцию сравнить нельзя,
+// ее совпадение — забота вызывающего.
+func (f *Filter) Merge(other *Filter) error {
+	if err := f.compatible(other); err != nil {
+		return err
+	}
+	for i, w := range other.bits {
+		f.bits[i] |= w
+	}
+	return nil
+}
+
+// Intersect оставляет в f только ключи, которые могут быть и в other (побитовое И).
+// Результат может давать больше false positive, чем фильтр, построенный по пересечению
+// множеств ключей, но false negative в нем нет.
+func (f *Filter) Intersect(other *Filter) error {
+	if err := f.compatible(other); err != nil {
+		return err
+	}
+	for i, w := range other.bits {
+		f.bits[i] &= w
+	}
+	return nil
+}
+
+func (f *Filter) compatible(other *Filter) error {
+	if f.size != other.size || f.k != other.k || f.h.seed != other.h.seed {
+		return fmt.Errorf("%w: m=%d k=%d seed=%d и m=%d k=%d seed=%d", ErrIncompatible,
+			f.size, f.k, f.h.seed, other.size, other.k, other.h.seed)
+	}
+	return nil
+}
+
+// MarshalBinary сериализует фильтр, чтобы сохранить его (например, в SSTable)
+// и восстановить через UnmarshalBinary без повторного добавления ключей.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, headerLen+8*len(f.bits))
+	b = append(b, encodingMagic...)
+	b = append(b, encodingVersion, f.k)
+	b = binary.BigEndian.AppendUint64(b, uint64(f.size))
+	for _, w := range f.bits {
+		b = binary.LittleEndian.AppendUint64(b, w)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary восстанавливает фильтр, сериализованный MarshalBinary. Хеш-функция
+// и seed не сериализуются: f должен быть создан с теми же опциями, что и исходный
+// фильтр (нулевой Filter — с FNV и seed 0).
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < headerLen || string(data[:len(encodingMagic)]) != encodingMagic {
+		return ErrBadEncoding
+	}
+	data = data[len(encodingMagic):]
+	if v := data[0]; v != encodingVersion {
+		return fmt.Errorf("%w: неизвестная версия формата %d", ErrBadEncoding, v)
+	}
+	k := data[1]
+	size := binary.BigEndian.Uint64(data[2:10])
+	data = data[10:]
+	// size проверяется до арифметики: (size+63) переполнился бы при size около 2^64.
+	if size == 0 || size > math.MaxInt || size > uint64(len(data))*8 ||
+		len(data)%8 != 0 || uint64(len(data)/8) != (size-1)/64+1 {
+		return fmt.Errorf("%w: %d бит в %d байтах", ErrBadEncoding, size, len(data))
+	}
+	bits := make([]uint64, len(data)/8)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	h := f.h
+	if h.fn == nil {
+		h = newHashing(nil)
+	}
+	*f = Filter{bits: bits, size: int(size), k: k, h: h}
+	return nil
+}
+
+// set устанавливает бит i.
+func (f *Filter) set(i uint64) {
+	f.bits[i/64] |= 1 << (i % 64)
+}
+
+// test сообщает, установлен ли бит i.
+func (f *Filter) test(i uint64) bool {
+	return f.bits[i/64]&(1<<(i%64)) != 0
+}
@@ -0,0 +1,289 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestBloom_Bitset(t *testing.T) {
+	// 1000 бит — 16 слов по 64 бита, а не 1000 байт.
+	f := New(1000, 3)
+	if len(f.bits) != 16 {
+		t.Fatalf("слов в битовом массиве: %d", len(f.bits))
+	}
+	for i := uint64(0); i < 1000; i += 7 {
+		f.set(i)
+	}
+	for i := uint64(0); i < 1000; i++ {
+		if f.test(i) != (i%7 == 0) {
+			t.Fatalf("бит %d: %v", i, f.test(i))
+		}
+	}
+}
+
+func TestBloom_DistinctIndexes(t *testing.T) {
+	// Одна хеш-функция k раз ставила бы один бит на ключ.
+	f := New(1<<16, 4)
+	if err := f.Add([]byte("key")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	set := 0
+	for _, w := range f.bits {
+		for ; w != 0; w &= w - 1 {
+			set++
+		}
+	}
+	if set != 4 {
+		t.Fatalf("установлено бит: %d, ожидалось 4", set)
+	}
+}
+
+func TestBloom_FalsePositiveRate(t *testing.T) {
+	// m/n = 10, k = 7: теоретически около 0.8%.
+	const n = 10000
+	f := New(10*n, 7)
+	for i := 0; i < n; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		ok, err := f.MayContain([]byte(fmt.Sprintf("other-%d", i)))
+		if err != nil {
+			t.Fatalf("MayContain: %v", err)
+		}
+		if ok {
+			fp++
+		}
+	}
+	if rate := float64(fp) / n; rate > 0.02 {
+		t.Fatalf("доля false positive %.4f, ожидалось около 0.008", rate)
+	}
+}
+
+func TestBloom_MarshalBinary(t *testing.T) {
+	f := New(1000, 5)
+	for i := 0; i < 100; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	b, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	var g Filter
+	if err := g.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		want, _ := f.MayContain(key)
+		got, _ := g.MayContain(key)
+		if got != want {
+			t.Fatalf("MayContain(%q) после восстановления = %v, ожидалось %v", key, got, want)
+		}
+	}
+
+	bad := append([]byte(nil), b...)
+	bad[4] = 99
+	for name, data := range map[string][]byte{
+		"пусто":        nil,
+		"чужие данные": []byte("not a bloom filter"),
+		"версия":       bad,
+		"обрезан":      b[:len(b)-1],
+		"лишние байты": append(append([]byte(nil), b...), 0),
+	} {
+		if err := g.UnmarshalBinary(data); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%s: UnmarshalBinary = %v, ожидалась ErrBadEncoding", name, err)
+		}
+	}
+}
+
+func TestBloom_UnmarshalBinarySizeOverflow(t *testing.T) {
+	// Заголовок с size = 2^64-1 и без битового массива: (size+63)/64*8
+	// переполняется в 0 и совпадает с длиной пустых данных.
+	data := append([]byte(encodingMagic), encodingVersion, 3)
+	data = binary.BigEndian.AppendUint64(data, ^uint64(0))
+	var f Filter
+	if err := f.UnmarshalBinary(data); !errors.Is(err, ErrBadEncoding) {
+		t.Fatalf("UnmarshalBinary = %v, ожидалась ErrBadEncoding", err)
+	}
+
+	// Слов больше, чем нужно для size бит.
+	data = append([]byte(encodingMagic), encodingVersion, 3)
+	data = binary.BigEndian.AppendUint64(data, 64)
+	data = append(data, make([]byte, 16)...)
+	if err := f.UnmarshalBinary(data); !errors.Is(err, ErrBadEncoding) {
+		t.Fatalf("UnmarshalBinary с лишним словом = %v, ожидалась ErrBadEncoding", err)
+	}
+}
+
+func TestBloom_NewOptimal(t *testing.T) {
+	for _, tc := range []struct {
+		n uint64
+		p float64
+		m uint64
+		k uint8
+	}{
+		{n: 1000, p: 0.01, m: 9586, k: 7},
+		{n: 1000000, p: 0.001, m: 14377588, k: 10},
+		{n: 0, p: 0.5, m: 2, k: 1},
+	} {
+		f := NewOptimal(tc.n, tc.p)
+		if uint64(f.size) != tc.m || f.k != tc.k {
+			t.Errorf("NewOptimal(%d, %v): m=%d k=%d, ожидалось m=%d k=%d", tc.n, tc.p, f.size, f.k, tc.m, tc.k)
+		}
+	}
+
+	const n = 10000
+	f := NewOptimal(n, 0.01)
+	for i := 0; i < n; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("other-%d", i))); ok {
+			fp++
+		}
+	}
+	if rate := float64(fp) / n; rate > 0.02 {
+		t.Fatalf("доля false positive %.4f при цели 0.01", rate)
+	}
+}
+
+func TestBloom_MergeIntersect(t *testing.T) {
+	build := func(keys ...string) *Filter {
+		f := New(4096, 4)
+		for _, k := range keys {
+			if err := f.Add([]byte(k)); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+		}
+		return f
+	}
+
+	union := build("a", "b")
+	if err := union.Merge(build("c", "d")); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if want := build("a", "b", "c", "d"); fmt.Sprint(union.bits) != fmt.Sprint(want.bits) {
+		t.Fatal("Merge не совпадает с фильтром, построенным по объединению")
+	}
+
+	inter := build("a", "b", "c")
+	if err := inter.Intersect(build("b", "c", "d")); err != nil {
+		t.Fatalf("Intersect: %v", err)
+	}
+	for _, k := range []string{"b", "c"} {
+		if ok, _ := inter.MayContain([]byte(k)); !ok {
+			t.Fatalf("false negative для %q после Intersect", k)
+		}
+	}
+
+	if err := union.Merge(New(4096, 3)); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Merge с другим k = %v, ожидалась ErrIncompatible", err)
+	}
+	if err := union.Intersect(New(2048, 4)); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Intersect с другим size = %v, ожидалась ErrIncompatible", err)
+	}
+}
+
+func TestBloom_FillRatio(t *testing.T) {
+	f := New(1000, 3)
+	if r := f.FillRatio(); r != 0 {
+		t.Fatalf("FillRatio пустого фильтра: %v", r)
+	}
+	for i := uint64(0); i < 500; i++ {
+		f.set(i)
+	}
+	if r := f.FillRatio(); r != 0.5 {
+		t.Fatalf("FillRatio: %v, ожидалось 0.5", r)
+	}
+	if p := f.EstimatedFalsePositiveRate(); p != 0.125 {
+		t.Fatalf("EstimatedFalsePositiveRate: %v, ожидалось 0.125", p)
+	}
+
+	// Оценка близка к измеренной доле false positive.
+	const n = 10000
+	g := New(10*n, 7)
+	for i := 0; i < n; i++ {
+		if err := g.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	fp := 0
+	for i := 0; i < 10*n; i++ {
+		if ok, _ := g.MayContain([]byte(fmt.Sprintf("other-%d", i))); ok {
+			fp++
+		}
+	}
+	est, got := g.EstimatedFalsePositiveRate(), float64(fp)/(10*n)
+	if got < est/2 || got > est*2 {
+		t.Fatalf("оценка %.4f, измерено %.4f", est, got)
+	}
+}
+
+func TestBloom_AddMany(t *testing.T) {
+	var keys, others [][]byte
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+		others = append(others, []byte(fmt.Sprintf("other-%d", i)))
+	}
+	one, many := New(8192, 5), New(8192, 5)
+	for _, k := range keys {
+		if err := one.Add(k); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if err := many.AddMany(keys); err != nil {
+		t.Fatalf("AddMany: %v", err)
+	}
+	if fmt.Sprint(one.bits) != fmt.Sprint(many.bits) {
+		t.Fatal("AddMany и Add по одному ставят разные биты")
+	}
+
+	got, err := many.ContainsMany(append(keys, others...))
+	if err != nil {
+		t.Fatalf("ContainsMany: %v", err)
+	}
+	for i, k := range append(keys, others...) {
+		if want, _ := many.MayContain(k); got[i] != want {
+			t.Fatalf("ContainsMany[%d] = %v, MayContain(%q) = %v", i, got[i], k, want)
+		}
+	}
+}
+
+func TestBloom_Count(t *testing.T) {
+	f := NewOptimal(10000, 0.01)
+	if c := f.Count(); c != 0 {
+		t.Fatalf("Count пустого фильтра: %d", c)
+	}
+	for i := 0; i < 5000; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	// Повторы не считаются.
+	for i := 0; i < 5000; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if c := f.Count(); c < 4900 || c > 5100 {
+		t.Fatalf("Count: %d, ожидалось около 5000", c)
+	}
+
+	full := New(64, 2)
+	full.bits[0] = math.MaxUint64
+	if c := full.Count(); c != math.MaxUint64 {
+		t.Fatalf("Count заполненного фильтра: %d", c)
+	}
+}
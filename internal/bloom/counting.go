@@ -0,0 +1,87 @@
+package bloom
+
+import "errors"
+
+// ErrNotPresent возвращает Remove для ключа, которого в фильтре точно нет.
+var ErrNotPresent = errors.New("bloom: ключа нет в фильтре")
+
+// counterMax — предел 4-битного счетчика. Насыщенный счетчик больше не уменьшается:
+// сколько ключей на него пришлось, уже неизвестно, и обнулять его нельзя.
+const counterMax = 15
+
+// CountingFilter — фильтр Блума со счетчиками вместо битов: поддерживает Remove,
+// например, для учета живых ключей Memtable, где удаления часты.
+// Счетчик занимает 4 бита, в четыре раза больше памяти, чем у Filter того же размера.
+type CountingFilter struct {
+	// counters — size счетчиков по 16 в слове.
+	counters []uint64
+	size     int
+	k        uint8
+	h        hashing
+}
+
+// NewCounting создает фильтр со счетчиками.
+// size (m) — число счетчиков.
+// hashes (k) — количество хеш-функций.
+// opts задают базовую хеш-функцию и seed, как у New.
+func NewCounting(size uint64, hashesc uint8, opts ...Option) *CountingFilter {
+	return &CountingFilter{
+		counters: make([]uint64, (size+15)/16),
+		size:     int(size),
+		k:        hashesc,
+		h:        newHashing(opts),
+	}
+}
+
+// Add добавляет ключ в фильтр.
+func (f *CountingFilter) Add(key []byte) error {
+	h1, h2 := f.h.base(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		j := (h1 + i*h2) % uint64(f.size)
+		if c := f.get(j); c < counterMax {
+			f.put(j, c+1)
+		}
+	}
+	return nil
+}
+
+// Remove удаляет ранее добавленный ключ. Удаление ключа, который не добавлялся,
+// но дает false positive, испортит фильтр: MayContain начнет отвечать "НЕТ"
+// для добавленных ключей. Ключ, которого точно нет, не удаляется — ErrNotPresent.
+func (f *CountingFilter) Remove(key []byte) error {
+	if ok, _ := f.MayContain(key); !ok {
+		return ErrNotPresent
+	}
+	h1, h2 := f.h.base(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		j := (h1 + i*h2) % uint64(f.size)
+		if c := f.get(j); c < counterMax {
+			f.put(j, c-1)
+		}
+	}
+	return nil
+}
+
+// MayContain проверяет наличие ключа.
+// Возвращает false, если ключа точно нет.
+// Возвращает true, если ключ возможно есть (или произошел false positive).
+func (f *CountingFilter) MayContain(key []byte) (bool, error) {
+	h1, h2 := f.h.base(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if f.get((h1+i*h2)%uint64(f.size)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// get возвращает счетчик i.
+func (f *CountingFilter) get(i uint64) uint64 {
+	return f.counters[i/16] >> (i % 16 * 4) & 0xf
+}
+
+// put записывает в счетчик i значение c.
+func (f *CountingFilter) put(i, c uint64) {
+	shift := i % 16 * 4
+	f.counters[i/16] = f.counters[i/16]&^(0xf<<shift) | c<<shift
+}
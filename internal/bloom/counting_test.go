@@ -0,0 +1,60 @@
+package bloom
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCountingBloom_Remove(t *testing.T) {
+	f := NewCounting(1000, 4)
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	for _, k := range keys {
+		if err := f.Add(k); err != nil {
+			t.Fatalf("Add(%q): %v", k, err)
+		}
+	}
+	// Ключ, добавленный дважды, остается после одного удаления.
+	if err := f.Add([]byte("a")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	for _, k := range [][]byte{[]byte("a"), []byte("b")} {
+		if err := f.Remove(k); err != nil {
+			t.Fatalf("Remove(%q): %v", k, err)
+		}
+	}
+	for k, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if ok, _ := f.MayContain([]byte(k)); ok != want {
+			t.Errorf("MayContain(%q) = %v, ожидалось %v", k, ok, want)
+		}
+	}
+	if err := f.Remove([]byte("b")); !errors.Is(err, ErrNotPresent) {
+		t.Fatalf("повторный Remove = %v, ожидалась ErrNotPresent", err)
+	}
+}
+
+func TestCountingBloom_Saturation(t *testing.T) {
+	f := NewCounting(64, 1)
+	key := []byte("k")
+	for i := 0; i < counterMax+5; i++ {
+		if err := f.Add(key); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	// Насыщенный счетчик не уменьшается: ключ не пропадет, сколько его ни удаляй.
+	for i := 0; i < counterMax+5; i++ {
+		if err := f.Remove(key); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+	}
+	if ok, _ := f.MayContain(key); !ok {
+		t.Fatal("ключ пропал после насыщения счетчика")
+	}
+	for i, w := range f.counters {
+		for j := 0; j < 16; j++ {
+			if c := w >> (j * 4) & 0xf; c != 0 && c != counterMax {
+				t.Fatalf("счетчик %d: %d", i*16+j, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package bloom
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// ErrFull возвращает CuckooFilter.Add, когда для ключа не нашлось места.
+var ErrFull = errors.New("bloom: фильтр переполнен")
+
+const (
+	// cuckooBucketSize — отпечатков в корзине.
+	cuckooBucketSize = 4
+	// cuckooMaxKicks — сколько отпечатков Add вытесняет, прежде чем сдаться.
+	cuckooMaxKicks = 500
+)
+
+// CuckooFilter — фильтр кукушки (Fan et al., "Cuckoo Filter: Practically Better Than Bloom"):
+// хранит 16-битные отпечатки ключей в корзинах по 4, каждому ключу положены две корзины.
+// В отличие от Filter поддерживает Remove, а при доле false positive ниже ~3% занимает
+// меньше места. Доля false positive — около 8/2^16 и от заполненности почти не зависит,
+// но заполнить фильтр можно лишь примерно на 95%: дальше Add возвращает ErrFull.
+type CuckooFilter struct {
+	buckets [][cuckooBucketSize]uint16
+	mask    uint64
+	// victim — отпечаток, вытесненный последним неудачным Add: он остается в фильтре,
+	// чтобы не было false negative, а следующие Add возвращают ErrFull.
+	victim      uint16
+	victimIndex uint64
+	h           hashing
+	// rnd — состояние xorshift для выбора вытесняемого отпечатка.
+	rnd uint64
+}
+
+// NewCuckoo создает фильтр кукушки примерно на capacity ключей.
+// opts задают базовую хеш-функцию и seed, как у New.
+func NewCuckoo(capacity uint64, opts ...Option) *CuckooFilter {
+	n := max((capacity+cuckooBucketSize-1)/cuckooBucketSize, 1)
+	// Число корзин — степень двойки: вторая корзина получается из первой через XOR.
+	n = 1 << bits.Len64(n-1)
+	return &CuckooFilter{
+		buckets: make([][cuckooBucketSize]uint16, n),
+		mask:    n - 1,
+		h:       newHashing(opts),
+		rnd:     0x9e3779b97f4a7c15,
+	}
+}
+
+// Add добавляет ключ в фильтр. Если места нет, возвращается ErrFull.
+func (f *CuckooFilter) Add(key []byte) error {
+	if f.victim != 0 {
+		return ErrFull
+	}
+	fp, i1, i2 := f.index(key)
+	if f.insert(i1, fp) || f.insert(i2, fp) {
+		return nil
+	}
+	i := i1
+	if f.random()&1 == 1 {
+		i = i2
+	}
+	for n := 0; n < cuckooMaxKicks; n++ {
+		slot := f.random() % cuckooBucketSize
+		fp, f.buckets[i][slot] = f.buckets[i][slot], fp
+		i = f.altIndex(i, fp)
+		if f.insert(i, fp) {
+			return nil
+		}
+	}
+	f.victim, f.victimIndex = fp, i
+	return nil
+}
+
+// MayContain проверяет наличие ключа.
+// Возвращает false, если ключа точно нет.
+// Возвращает true, если ключ возможно есть (или произошел false positive).
+func (f *CuckooFilter) MayContain(key []byte) (bool, error) {
+	fp, i1, i2 := f.index(key)
+	if f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		return true, nil
+	}
+	return f.find(i1, fp) >= 0 || f.find(i2, fp) >= 0, nil
+}
+
+// Remove удаляет ранее добавленный ключ. Как и у CountingFilter, удалять можно только
+// добавленные ключи: удаление ключа, давшего false positive, сотрет чужой отпечаток.
+// Ключ, которого точно нет, не удаляется — ErrNotPresent.
+func (f *CuckooFilter) Remove(key []byte) error {
+	fp, i1, i2 := f.index(key)
+	for _, i := range []uint64{i1, i2} {
+		if slot := f.find(i, fp); slot >= 0 {
+			f.buckets[i][slot] = 0
+			f.reinsertVictim()
+			return nil
+		}
+	}
+	if f.victim == fp && (f.victimIndex == i1 || f.victimIndex == i2) {
+		f.victim = 0
+		return nil
+	}
+	return ErrNotPresent
+}
+
+// index возвращает отпечаток ключа и две его корзины. Отпечаток 0 обозначает
+// пустое место, поэтому не используется.
+func (f *CuckooFilter) index(key []byte) (fp uint16, i1, i2 uint64) {
+	h1, h2 := f.h.base(key)
+	fp = uint16(h2 >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	i1 = h1 & f.mask
+	return fp, i1, f.altIndex(i1, fp)
+}
+
+// altIndex возвращает другую корзину отпечатка fp, лежащего в корзине i:
+// вычисляется без ключа, и altIndex(altIndex(i, fp), fp) == i.
+func (f *CuckooFilter) altIndex(i uint64, fp uint16) uint64 {
+	return (i ^ uint64(fp)*0x5bd1e995) & f.mask
+}
+
+func (f *CuckooFilter) insert(i uint64, fp uint16) bool {
+	if slot := f.find(i, 0); slot >= 0 {
+		f.buckets[i][slot] = fp
+		return true
+	}
+	return false
+}
+
+func (f *CuckooFilter) find(i uint64, fp uint16) int {
+	for slot, v := range f.buckets[i] {
+		if v == fp {
+			return slot
+		}
+	}
+	return -1
+}
+
+// reinsertVictim пробует вернуть вытесненный отпечаток на освободившееся место.
+func (f *CuckooFilter) reinsertVictim() {
+	if f.victim == 0 {
+		return
+	}
+	if f.insert(f.victimIndex, f.victim) || f.insert(f.altIndex(f.victimIndex, f.victim), f.victim) {
+		f.victim = 0
+	}
+}
+
+func (f *CuckooFilter) random() uint64 {
+	f.rnd ^= f.rnd << 13
+	f.rnd ^= f.rnd >> 7
+	f.rnd ^= f.rnd << 17
+	return f.rnd
+}
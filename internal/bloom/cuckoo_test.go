@@ -0,0 +1,75 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCuckooFilter(t *testing.T) {
+	const n = 10000
+	var set ProbabilisticSet = NewCuckoo(n)
+	f := set.(*CuckooFilter)
+	for i := 0; i < n; i++ {
+		if err := set.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add(key-%d): %v", i, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if ok, _ := set.MayContain([]byte(fmt.Sprintf("key-%d", i))); !ok {
+			t.Fatalf("false negative для key-%d", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := set.MayContain([]byte(fmt.Sprintf("other-%d", i))); ok {
+			fp++
+		}
+	}
+	if rate := float64(fp) / n; rate > 0.001 {
+		t.Fatalf("доля false positive %.4f", rate)
+	}
+
+	for i := 0; i < n; i += 2 {
+		if err := f.Remove([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Remove(key-%d): %v", i, err)
+		}
+	}
+	for i := 1; i < n; i += 2 {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("key-%d", i))); !ok {
+			t.Fatalf("false negative для key-%d после удаления соседей", i)
+		}
+	}
+	if err := f.Remove([]byte("missing")); !errors.Is(err, ErrNotPresent) {
+		t.Fatalf("Remove отсутствующего = %v, ожидалась ErrNotPresent", err)
+	}
+}
+
+func TestCuckooFilter_Full(t *testing.T) {
+	f := NewCuckoo(16)
+	added := 0
+	var err error
+	for ; added < 100; added++ {
+		if err = f.Add([]byte(fmt.Sprintf("key-%d", added))); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("Add в переполненный фильтр = %v, ожидалась ErrFull", err)
+	}
+	// Ни один принятый ключ, включая вытесненный последним, не потерян.
+	for i := 0; i < added; i++ {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("key-%d", i))); !ok {
+			t.Fatalf("false negative для key-%d", i)
+		}
+	}
+	// Удаление освобождает место: вытесненный отпечаток возвращается в корзину.
+	for i := 0; f.victim != 0; i++ {
+		if err := f.Remove([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Remove(key-%d): %v", i, err)
+		}
+	}
+	if err := f.Add([]byte("fresh")); err != nil {
+		t.Fatalf("Add после Remove: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package bloom
+
+import "kvschool/internal/murmur3"
+
+// HashFunc — базовая хеш-функция фильтра: возвращает два независимых 64-битных
+// хеша ключа (например, половины 128-битного хеша), из которых получаются все k индексов.
+type HashFunc func(key []byte, seed uint64) (h1, h2 uint64)
+
+// Option настраивает хеширование фильтра.
+type Option func(*hashing)
+
+// WithHash задает базовую хеш-функцию вместо FNV.
+func WithHash(fn HashFunc) Option {
+	return func(h *hashing) { h.fn = fn }
+}
+
+// WithSeed задает seed хеш-функции.
+func WithSeed(seed uint64) Option {
+	return func(h *hashing) { h.seed = seed }
+}
+
+// hashing — хеш-функция и seed фильтра. Оба в сериализованный фильтр не попадают:
+// читать и объединять фильтры нужно с теми же параметрами, с которыми их строили.
+type hashing struct {
+	fn   HashFunc
+	seed uint64
+}
+
+func newHashing(opts []Option) hashing {
+	h := hashing{fn: FNV}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	return h
+}
+
+// base возвращает два базовых хеша ключа. h2 делается нечетным, чтобы при
+// размере-степени двойки шаг h1 + i*h2 не вырождался в 0.
+func (h hashing) base(key []byte) (h1, h2 uint64) {
+	h1, h2 = h.fn(key, h.seed)
+	return h1, h2 | 1
+}
+
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// FNV — хеш-функция по умолчанию: FNV-1a и FNV-1, seed смешивается с начальным значением.
+// Проста, но на коротких последовательных ключах (IMSI, счетчики) индексы группируются,
+// и false positive больше расчетного: для таких ключей лучше Murmur3.
+func FNV(key []byte, seed uint64) (h1, h2 uint64) {
+	h1, h2 = fnvOffset^seed, fnvOffset^seed
+	for _, c := range key {
+		h1 ^= uint64(c)
+		h1 *= fnvPrime
+		h2 *= fnvPrime
+		h2 ^= uint64(c)
+	}
+	return h1, h2
+}
+
+// Murmur3 — MurmurHash3 x64 128: хорошо перемешивает и короткие похожие ключи.
+func Murmur3(key []byte, seed uint64) (h1, h2 uint64) { return murmur3.Sum128(key, seed) }
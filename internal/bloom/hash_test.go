@@ -0,0 +1,58 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+func TestBloom_HashFunc(t *testing.T) {
+	// FNV без seed совпадает с FNV-1a и FNV-1 из hash/fnv.
+	key := []byte("250991234567890")
+	a, b := fnv.New64a(), fnv.New64()
+	a.Write(key)
+	b.Write(key)
+	if h1, h2 := FNV(key, 0); h1 != a.Sum64() || h2 != b.Sum64() {
+		t.Fatalf("FNV: %x %x, ожидалось %x %x", h1, h2, a.Sum64(), b.Sum64())
+	}
+
+	// Короткие последовательные ключи: с Murmur3 доля false positive близка к расчетной.
+	const n = 10000
+	f := NewOptimal(n, 0.01, WithHash(Murmur3), WithSeed(42))
+	for i := 0; i < n; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("25099%010d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	fp := 0
+	for i := n; i < 2*n; i++ {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("25099%010d", i))); ok {
+			fp++
+		}
+	}
+	if rate := float64(fp) / n; rate > 0.02 {
+		t.Fatalf("доля false positive %.4f при цели 0.01", rate)
+	}
+
+	// Фильтры с разным seed ставят разные биты и не объединяются.
+	g, h := New(4096, 4, WithSeed(1)), New(4096, 4, WithSeed(2))
+	_ = g.Add(key)
+	_ = h.Add(key)
+	if fmt.Sprint(g.bits) == fmt.Sprint(h.bits) {
+		t.Fatal("seed не влияет на индексы")
+	}
+	if err := g.Merge(h); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Merge с другим seed = %v, ожидалась ErrIncompatible", err)
+	}
+
+	// UnmarshalBinary сохраняет хеширование фильтра, в который читает.
+	data, _ := g.MarshalBinary()
+	r := New(0, 0, WithSeed(1))
+	if err := r.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if ok, _ := r.MayContain(key); !ok {
+		t.Fatal("false negative после UnmarshalBinary с тем же seed")
+	}
+}
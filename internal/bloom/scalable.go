@@ -0,0 +1,66 @@
+package bloom
+
+import "fmt"
+
+// Параметры роста ScalableFilter (Almeida et al., "Scalable Bloom Filters").
+const (
+	// scalableGrowth — во сколько раз емкость нового среза больше предыдущего.
+	scalableGrowth = 2
+	// scalableTightening — во сколько раз доля false positive нового среза меньше предыдущего:
+	// сумма p0·r^i по всем срезам не превышает p0/(1-r) = p.
+	scalableTightening = 0.8
+)
+
+// ScalableFilter — фильтр Блума, который растет вместе с числом ключей: когда текущий
+// срез заполнен, добавляется новый, больше и строже прежнего, так что общая доля
+// false positive остается ниже заданной. Для потоков, где число ключей заранее неизвестно.
+type ScalableFilter struct {
+	slices []*Filter
+	// capacity — емкость последнего среза, count — сколько ключей в него добавлено.
+	capacity uint64
+	count    uint64
+	// p — доля false positive последнего среза.
+	p float64
+	// opts — хеширование срезов.
+	opts []Option
+}
+
+// NewScalable создает растущий фильтр: первый срез рассчитан на initialCapacity ключей,
+// общая доля false positive — не выше falsePositiveRate из интервала (0, 1).
+// opts задают базовую хеш-функцию и seed всех срезов, как у New.
+func NewScalable(initialCapacity uint64, falsePositiveRate float64, opts ...Option) *ScalableFilter {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		panic(fmt.Sprintf("bloom: доля false positive %v вне интервала (0, 1)", falsePositiveRate))
+	}
+	f := &ScalableFilter{capacity: max(initialCapacity, 1), p: falsePositiveRate * (1 - scalableTightening), opts: opts}
+	f.slices = []*Filter{NewOptimal(f.capacity, f.p, opts...)}
+	return f
+}
+
+// Add добавляет ключ в фильтр, при необходимости добавляя новый срез.
+func (f *ScalableFilter) Add(key []byte) error {
+	if f.count >= f.capacity {
+		f.capacity *= scalableGrowth
+		f.p *= scalableTightening
+		f.count = 0
+		f.slices = append(f.slices, NewOptimal(f.capacity, f.p, f.opts...))
+	}
+	if err := f.slices[len(f.slices)-1].Add(key); err != nil {
+		return err
+	}
+	f.count++
+	return nil
+}
+
+// MayContain проверяет наличие ключа во всех срезах.
+// Возвращает false, если ключа точно нет.
+// Возвращает true, если ключ возможно есть (или произошел false positive).
+func (f *ScalableFilter) MayContain(key []byte) (bool, error) {
+	for _, s := range f.slices {
+		ok, err := s.MayContain(key)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,35 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScalableBloom(t *testing.T) {
+	// Ключей в сто раз больше начальной емкости.
+	const n = 100000
+	f := NewScalable(1000, 0.01)
+	for i := 0; i < n; i++ {
+		if err := f.Add([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	// 1000 + 2000 + ... + 32000 < 100000 <= ... + 64000.
+	if len(f.slices) != 7 {
+		t.Fatalf("срезов: %d, ожидалось 7", len(f.slices))
+	}
+	for i := 0; i < n; i++ {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("key-%d", i))); !ok {
+			t.Fatalf("false negative для key-%d", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := f.MayContain([]byte(fmt.Sprintf("other-%d", i))); ok {
+			fp++
+		}
+	}
+	if rate := float64(fp) / n; rate > 0.01 {
+		t.Fatalf("доля false positive %.4f при цели 0.01", rate)
+	}
+}
@@ -0,0 +1,19 @@
+package bloom
+
+// ProbabilisticSet — вероятностное множество ключей: отвечает "точно нет" или
+// "возможно есть". Общий интерфейс фильтров пакета, чтобы фильтр для блока SSTable
+// можно было выбирать: Filter, BlockedFilter, CountingFilter, ScalableFilter или CuckooFilter.
+type ProbabilisticSet interface {
+	// Add добавляет ключ.
+	Add(key []byte) error
+	// MayContain возвращает false, если ключа точно нет, и true, если он возможно есть.
+	MayContain(key []byte) (bool, error)
+}
+
+var (
+	_ ProbabilisticSet = (*Filter)(nil)
+	_ ProbabilisticSet = (*BlockedFilter)(nil)
+	_ ProbabilisticSet = (*CountingFilter)(nil)
+	_ ProbabilisticSet = (*ScalableFilter)(nil)
+	_ ProbabilisticSet = (*CuckooFilter)(nil)
+)
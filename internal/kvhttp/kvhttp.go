@@ -0,0 +1,162 @@
+// Package kvhttp — HTTP API движка в формате JSON:
+//
+//	GET    /v1/keys/{key}               значение ключа: {"key": ..., "value": ...}
+//	PUT    /v1/keys/{key}               записать значение из тела {"value": ...}
+//	DELETE /v1/keys/{key}               удалить ключ
+//	GET    /v1/scan?start=&end=&limit=  ключи диапазона [start, end): {"items": [...], "next": ...}
+//
+// Ключ в пути и границы диапазона в запросе — строки (с URL-экранированием), ключи
+// и значения в JSON — base64. Ошибка — статус и тело {"error": ...}.
+//
+// Scan отдает диапазон страницами по limit ключей: без limit или при limit=0 —
+// defaultScanLimit, и не больше maxScanLimit за запрос. Если в диапазоне остались
+// ключи, next — ключ, с которого начинается следующая страница: его передают в start.
+package kvhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"kvschool/internal/lsm"
+)
+
+// maxBodySize ограничивает тело PUT.
+const maxBodySize = 64 << 20
+
+// Размер страницы Scan: ответ собирается в памяти целиком, поэтому он ограничен.
+const (
+	defaultScanLimit = 1000
+	maxScanLimit     = 10000
+)
+
+// KeyValue — ключ и значение в ответах.
+type KeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// NewHandler возвращает обработчик API над e. Пути начинаются с /v1/, так что его
+// можно смонтировать на любой mux: mux.Handle("/v1/", kvhttp.NewHandler(e)).
+func NewHandler(e *lsm.Engine) http.Handler {
+	h := &handler{e: e}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/keys/{key...}", h.get)
+	mux.HandleFunc("PUT /v1/keys/{key...}", h.put)
+	mux.HandleFunc("DELETE /v1/keys/{key...}", h.delete)
+	mux.HandleFunc("GET /v1/scan", h.scan)
+	return mux
+}
+
+type handler struct {
+	e *lsm.Engine
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	v, err := h.e.GetContext(r.Context(), key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyValue{Key: key, Value: v})
+}
+
+func (h *handler) put(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Value []byte `json:"value"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody{fmt.Sprintf("kvhttp: тело запроса: %v", err)})
+		return
+	}
+	if err := h.e.Put([]byte(r.PathValue("key")), body.Value); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.e.Delete([]byte(r.PathValue("key"))); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) scan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultScanLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, errorBody{fmt.Sprintf("kvhttp: некорректный limit %q", s)})
+			return
+		}
+		if n > 0 {
+			limit = min(n, maxScanLimit)
+		}
+	}
+	it := h.e.ScanContext(r.Context(), optionalKey(q.Get("start")), optionalKey(q.Get("end")))
+	defer it.Close()
+	items := []KeyValue{}
+	var next []byte
+	for {
+		key, value, ok, err := it.Next()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !ok {
+			break
+		}
+		if len(items) == limit {
+			next = key
+			break
+		}
+		items = append(items, KeyValue{Key: key, Value: value})
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Items []KeyValue `json:"items"`
+		Next  []byte     `json:"next,omitempty"`
+	}{items, next})
+}
+
+// optionalKey возвращает nil для пустой строки: границы диапазона не задано.
+func optionalKey(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return []byte(s)
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// writeError отвечает статусом, соответствующим ошибке движка.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, lsm.ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, lsm.ErrEmptyKey):
+		code = http.StatusBadRequest
+	case errors.Is(err, lsm.ErrReadOnly), errors.Is(err, lsm.ErrClosed):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, lsm.ErrLockTimeout), errors.Is(err, lsm.ErrDeadlock):
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, errorBody{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
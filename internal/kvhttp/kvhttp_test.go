@@ -0,0 +1,159 @@
+package kvhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"kvschool/internal/lsm"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *lsm.Engine) {
+	t.Helper()
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", NewHandler(e))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		_ = e.Close()
+	})
+	return srv, e
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestKeys(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	if code, _ := do(t, "GET", srv.URL+"/v1/keys/a", ""); code != http.StatusNotFound {
+		t.Fatalf("GET отсутствующего ключа: %d", code)
+	}
+	// "aGVsbG8=" — base64 от "hello".
+	if code, body := do(t, "PUT", srv.URL+"/v1/keys/user%2F1", `{"value":"aGVsbG8="}`); code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", code, body)
+	}
+	code, body := do(t, "GET", srv.URL+"/v1/keys/user%2F1", "")
+	var kv KeyValue
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &kv) != nil || string(kv.Key) != "user/1" || string(kv.Value) != "hello" {
+		t.Fatalf("GET: %d %s", code, body)
+	}
+	if code, _ := do(t, "DELETE", srv.URL+"/v1/keys/user%2F1", ""); code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", code)
+	}
+	if code, _ := do(t, "GET", srv.URL+"/v1/keys/user%2F1", ""); code != http.StatusNotFound {
+		t.Fatalf("GET после DELETE: %d", code)
+	}
+
+	if code, _ := do(t, "PUT", srv.URL+"/v1/keys/a", `{"value":"не base64"}`); code != http.StatusBadRequest {
+		t.Fatalf("PUT с некорректным телом: %d", code)
+	}
+	if code, _ := do(t, "PUT", srv.URL+"/v1/keys/", `{"value":""}`); code != http.StatusBadRequest {
+		t.Fatalf("PUT пустого ключа: %d", code)
+	}
+}
+
+func TestScan(t *testing.T) {
+	srv, e := newTestServer(t)
+	for i := 0; i < 10; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scan := func(query string) []string {
+		t.Helper()
+		code, body := do(t, "GET", srv.URL+"/v1/scan"+query, "")
+		var resp struct{ Items []KeyValue }
+		if code != http.StatusOK || json.Unmarshal([]byte(body), &resp) != nil {
+			t.Fatalf("GET /v1/scan%s: %d %s", query, code, body)
+		}
+		keys := []string{}
+		for _, kv := range resp.Items {
+			keys = append(keys, string(kv.Key)+"="+string(kv.Value))
+		}
+		return keys
+	}
+	if got := fmt.Sprint(scan("?start=k2&end=k5")); got != "[k2=v2 k3=v3 k4=v4]" {
+		t.Fatalf("scan [k2, k5) = %s", got)
+	}
+	if got := fmt.Sprint(scan("?limit=2")); got != "[k0=v0 k1=v1]" {
+		t.Fatalf("scan limit=2 = %s", got)
+	}
+	if got := fmt.Sprint(scan("?start=z")); got != "[]" {
+		t.Fatalf("scan пустого диапазона = %s", got)
+	}
+	if code, _ := do(t, "GET", srv.URL+"/v1/scan?limit=-1", ""); code != http.StatusBadRequest {
+		t.Fatalf("scan с limit=-1: %d", code)
+	}
+}
+
+func TestScan_Pages(t *testing.T) {
+	srv, e := newTestServer(t)
+	for i := 0; i <= defaultScanLimit; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%04d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type page struct {
+		Items []KeyValue
+		Next  []byte
+	}
+	scan := func(query string) page {
+		t.Helper()
+		code, body := do(t, "GET", srv.URL+"/v1/scan"+query, "")
+		var p page
+		if code != http.StatusOK || json.Unmarshal([]byte(body), &p) != nil {
+			t.Fatalf("GET /v1/scan%s: %d %s", query, code, body)
+		}
+		return p
+	}
+
+	// Без limit отдается страница по умолчанию и ключ продолжения.
+	p := scan("")
+	if len(p.Items) != defaultScanLimit || string(p.Next) != fmt.Sprintf("k%04d", defaultScanLimit) {
+		t.Fatalf("страница по умолчанию: %d ключей, next %q", len(p.Items), p.Next)
+	}
+
+	// Обход страницами по next проходит диапазон ровно один раз.
+	var keys []string
+	query := "?end=k0010&limit=3"
+	for {
+		p := scan(query)
+		for _, kv := range p.Items {
+			keys = append(keys, string(kv.Key))
+		}
+		if p.Next == nil {
+			break
+		}
+		query = "?end=k0010&limit=3&start=" + url.QueryEscape(string(p.Next))
+	}
+	if len(keys) != 10 || keys[0] != "k0000" || keys[9] != "k0009" || !sort.StringsAreSorted(keys) {
+		t.Fatalf("ключи по страницам: %v", keys)
+	}
+}
@@ -0,0 +1,94 @@
+package kvrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+)
+
+// ErrNotFound возвращает Client.Get, если ключа нет.
+var ErrNotFound = errors.New("kvrpc: ключ не найден")
+
+// Client — клиент сервиса KV.
+type Client struct {
+	cc *grpc.ClientConn
+}
+
+// Dial создает клиент сервера target ("host:port"). opts передаются grpc.NewClient:
+// как минимум нужны учетные данные транспорта, например
+// grpc.WithTransportCredentials(insecure.NewCredentials()).
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	cc, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cc: cc}, nil
+}
+
+// Close закрывает соединение.
+func (c *Client) Close() error { return c.cc.Close() }
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp message) error {
+	return c.cc.Invoke(ctx, "/"+serviceName+"/"+method, req, resp)
+}
+
+// Get возвращает значение ключа или ErrNotFound.
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
+	var resp getResponse
+	if err := c.invoke(ctx, "Get", &getRequest{key: key}, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.found {
+		return nil, ErrNotFound
+	}
+	if resp.value == nil {
+		resp.value = []byte{}
+	}
+	return resp.value, nil
+}
+
+// Put записывает значение ключа.
+func (c *Client) Put(ctx context.Context, key, value []byte) error {
+	return c.invoke(ctx, "Put", &putRequest{key: key, value: value}, &empty{})
+}
+
+// Delete удаляет ключ.
+func (c *Client) Delete(ctx context.Context, key []byte) error {
+	return c.invoke(ctx, "Delete", &deleteRequest{key: key}, &empty{})
+}
+
+// Batch атомарно применяет изменения.
+func (c *Client) Batch(ctx context.Context, mutations []Mutation) error {
+	return c.invoke(ctx, "Batch", &batchRequest{mutations: mutations}, &empty{})
+}
+
+// Scan вызывает fn для ключей диапазона [start, end) по возрастанию, не больше limit
+// (0 — без ограничения). nil или пустая граница — без ограничения с этой стороны.
+// Ошибка fn прерывает Scan и возвращается.
+func (c *Client) Scan(ctx context.Context, start, end []byte, limit int, fn func(key, value []byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[0], "/"+serviceName+"/Scan")
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&scanRequest{start: start, end: end, limit: uint64(max(limit, 0))}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		var kv keyValue
+		if err := stream.RecvMsg(&kv); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package kvrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	protocodec "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"kvschool/internal/lsm"
+)
+
+func newTestClient(t *testing.T) (*Client, *lsm.Engine) {
+	c, e, _ := newTestServer(t)
+	return c, e
+}
+
+// newTestServer дополнительно регистрирует на сервере KV сервис health
+// и возвращает его.
+func newTestServer(t *testing.T) (*Client, *lsm.Engine, *health.Server) {
+	t.Helper()
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	lis := bufconn.Listen(1 << 20)
+	srv := NewServer(e)
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+	c, err := Dial("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+		srv.Stop()
+		_ = e.Close()
+	})
+	return c, e, hs
+}
+
+func TestGetPutDelete(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, []byte("a")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get отсутствующего ключа: %v, ожидалась ErrNotFound", err)
+	}
+	if err := c.Put(ctx, []byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.Put(ctx, []byte("empty"), nil); err != nil {
+		t.Fatalf("Put пустого значения: %v", err)
+	}
+	if v, err := c.Get(ctx, []byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	if v, err := c.Get(ctx, []byte("empty")); err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("Get пустого значения = %q, %v", v, err)
+	}
+	if err := c.Delete(ctx, []byte("a")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := c.Get(ctx, []byte("a")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get после Delete: %v", err)
+	}
+	if err := c.Put(ctx, nil, []byte("x")); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Put пустого ключа: %v, ожидался InvalidArgument", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, e := newTestClient(t)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	err := c.Scan(ctx, []byte("k2"), []byte("k8"), 0, func(key, value []byte) error {
+		if string(value) != "v"+string(key[1:]) {
+			t.Errorf("значение %q у ключа %q", value, key)
+		}
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[k2 k3 k4 k5 k6 k7]" {
+		t.Fatalf("Scan [k2, k8) = %v, %v", keys, err)
+	}
+
+	keys = nil
+	err = c.Scan(ctx, nil, nil, 3, func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[k0 k1 k2]" {
+		t.Fatalf("Scan с limit 3 = %v, %v", keys, err)
+	}
+
+	stop := errors.New("стоп")
+	n := 0
+	err = c.Scan(ctx, nil, nil, 0, func(_, _ []byte) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Fatalf("Scan с ошибкой fn: %v после %d ключей", err, n)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c, e := newTestClient(t)
+	ctx := context.Background()
+	if err := e.Put([]byte("old"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Batch(ctx, []Mutation{
+		{Op: OpPut, Key: []byte("a"), Value: []byte("1")},
+		{Op: OpPut, Key: []byte("b"), Value: []byte("2")},
+		{Op: OpDelete, Key: []byte("old")},
+	})
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if v, err := e.Get([]byte(key)); err != nil || string(v) != want {
+			t.Fatalf("Get(%q) = %q, %v", key, v, err)
+		}
+	}
+	if _, err := e.Get([]byte("old")); !errors.Is(err, lsm.ErrNotFound) {
+		t.Fatalf("Get удалённого ключа: %v", err)
+	}
+
+	// Пакет с ошибкой не применяется целиком.
+	err = c.Batch(ctx, []Mutation{
+		{Op: OpPut, Key: []byte("c"), Value: []byte("3")},
+		{Op: OpPut, Key: nil, Value: []byte("x")},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Batch с пустым ключом: %v, ожидался InvalidArgument", err)
+	}
+	if _, err := e.Get([]byte("c")); !errors.Is(err, lsm.ErrNotFound) {
+		t.Fatalf("Get(c) после отменённого пакета: %v", err)
+	}
+}
+
+func TestBatch_Concurrent(t *testing.T) {
+	// Пакеты с общими ключами не блокируют друг друга и не прерываются с Aborted.
+	c, e := newTestClient(t)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				muts := []Mutation{
+					{Op: OpPut, Key: []byte("a"), Value: []byte(fmt.Sprint(g))},
+					{Op: OpPut, Key: []byte("b"), Value: []byte(fmt.Sprint(g))},
+				}
+				if g%2 == 1 {
+					muts[0], muts[1] = muts[1], muts[0]
+				}
+				if err := c.Batch(ctx, muts); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Batch: %v", err)
+	}
+	a, _ := e.Get([]byte("a"))
+	b, _ := e.Get([]byte("b"))
+	if string(a) != string(b) {
+		t.Fatalf("a = %q, b = %q: пакеты применились не целиком", a, b)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	in := &batchRequest{mutations: []Mutation{
+		{Op: OpPut, Key: []byte("k"), Value: []byte("v")},
+		{Op: OpDelete, Key: []byte("d")},
+	}}
+	var out batchRequest
+	if err := unmarshal(in.marshal(nil), &out); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if fmt.Sprint(out.mutations) != fmt.Sprint(in.mutations) {
+		t.Fatalf("mutations = %v, ожидалось %v", out.mutations, in.mutations)
+	}
+	if err := unmarshal([]byte{0x0a, 0x05, 'x'}, &out); !errors.Is(err, errBadMessage) {
+		t.Fatalf("unmarshal обрезанного сообщения: %v", err)
+	}
+}
+
+func TestOtherServices(t *testing.T) {
+	// Сервер KV не навязывает свой кодек: сервис со сгенерированными сообщениями
+	// работает на нем, а KV — через то же соединение.
+	c, _, hs := newTestServer(t)
+	ctx := context.Background()
+	hs.SetServingStatus(serviceName, healthpb.HealthCheckResponse_SERVING)
+	resp, err := healthpb.NewHealthClient(c.cc).Check(ctx, &healthpb.HealthCheckRequest{Service: serviceName})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Check = %v, %v", resp, err)
+	}
+	if err := c.Put(ctx, []byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+}
+
+func TestMessageProtoCodec(t *testing.T) {
+	// Кодек "proto", которым пользуются gRPC-клиенты из kv.proto, кодирует
+	// сообщения их методами marshal и unmarshal.
+	pc := encoding.GetCodecV2(protocodec.Name)
+	in := &batchRequest{mutations: []Mutation{
+		{Op: OpPut, Key: []byte("k"), Value: []byte("v")},
+		{Op: OpDelete, Key: []byte("d")},
+	}}
+	data, err := pc.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Equal(data.Materialize(), in.marshal(nil)) {
+		t.Fatalf("Marshal = %x, ожидалось %x", data.Materialize(), in.marshal(nil))
+	}
+	out := &batchRequest{mutations: []Mutation{{Key: []byte("old")}}}
+	if err := pc.Unmarshal(data, out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if fmt.Sprint(out.mutations) != fmt.Sprint(in.mutations) {
+		t.Fatalf("mutations = %v, ожидалось %v", out.mutations, in.mutations)
+	}
+}
@@ -0,0 +1,316 @@
+package kvrpc
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// Сообщения сервиса KV (kv.proto) в формате protobuf. Кодируются вручную через
+// protowire, без сгенерированного кода: так клиенты на других языках, собранные
+// из kv.proto, понимают сервер, а пакет не требует protoc при сборке.
+
+var errBadMessage = errors.New("kvrpc: некорректное сообщение")
+
+// message — сообщение, которое кодируется через protowire.
+type message interface {
+	marshal(b []byte) []byte
+	// field разбирает поле num типа typ из b и возвращает число прочитанных байт;
+	// 0 — поле неизвестно и пропускается.
+	field(num protowire.Number, typ protowire.Type, b []byte) (int, error)
+}
+
+func unmarshal(b []byte, m message) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %w", errBadMessage, protowire.ParseError(n))
+		}
+		b = b[n:]
+		n, err := m.field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: поле %d: %w", errBadMessage, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// consumeBytes читает поле bytes; копия нужна, потому что буфер сообщения переиспользуется.
+func consumeBytes(typ protowire.Type, b []byte, dst *[]byte) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, nil
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, fmt.Errorf("%w: %w", errBadMessage, protowire.ParseError(n))
+	}
+	*dst = append([]byte(nil), v...)
+	return n, nil
+}
+
+func consumeVarint(typ protowire.Type, b []byte, dst *uint64) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, nil
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, fmt.Errorf("%w: %w", errBadMessage, protowire.ParseError(n))
+	}
+	*dst = v
+	return n, nil
+}
+
+type getRequest struct{ key []byte }
+
+func (m *getRequest) marshal(b []byte) []byte { return appendBytes(b, 1, m.key) }
+
+func (m *getRequest) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		return consumeBytes(typ, b, &m.key)
+	}
+	return 0, nil
+}
+
+type getResponse struct {
+	value []byte
+	found bool
+}
+
+func (m *getResponse) marshal(b []byte) []byte {
+	b = appendBytes(b, 1, m.value)
+	return appendVarint(b, 2, protowire.EncodeBool(m.found))
+}
+
+func (m *getResponse) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeBytes(typ, b, &m.value)
+	case 2:
+		var v uint64
+		n, err := consumeVarint(typ, b, &v)
+		m.found = v != 0
+		return n, err
+	}
+	return 0, nil
+}
+
+type putRequest struct{ key, value []byte }
+
+func (m *putRequest) marshal(b []byte) []byte {
+	return appendBytes(appendBytes(b, 1, m.key), 2, m.value)
+}
+
+func (m *putRequest) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeBytes(typ, b, &m.key)
+	case 2:
+		return consumeBytes(typ, b, &m.value)
+	}
+	return 0, nil
+}
+
+type deleteRequest struct{ key []byte }
+
+func (m *deleteRequest) marshal(b []byte) []byte { return appendBytes(b, 1, m.key) }
+
+func (m *deleteRequest) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num == 1 {
+		return consumeBytes(typ, b, &m.key)
+	}
+	return 0, nil
+}
+
+// empty — PutResponse, DeleteResponse и BatchResponse.
+type empty struct{}
+
+func (*empty) marshal(b []byte) []byte { return b }
+
+func (*empty) field(protowire.Number, protowire.Type, []byte) (int, error) { return 0, nil }
+
+type scanRequest struct {
+	start, end []byte
+	limit      uint64
+}
+
+func (m *scanRequest) marshal(b []byte) []byte {
+	b = appendBytes(b, 1, m.start)
+	b = appendBytes(b, 2, m.end)
+	return appendVarint(b, 3, m.limit)
+}
+
+func (m *scanRequest) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeBytes(typ, b, &m.start)
+	case 2:
+		return consumeBytes(typ, b, &m.end)
+	case 3:
+		return consumeVarint(typ, b, &m.limit)
+	}
+	return 0, nil
+}
+
+type keyValue struct{ key, value []byte }
+
+func (m *keyValue) marshal(b []byte) []byte {
+	return appendBytes(appendBytes(b, 1, m.key), 2, m.value)
+}
+
+func (m *keyValue) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		return consumeBytes(typ, b, &m.key)
+	case 2:
+		return consumeBytes(typ, b, &m.value)
+	}
+	return 0, nil
+}
+
+// Op — вид изменения в Batch.
+type Op int
+
+const (
+	OpPut    Op = 0
+	OpDelete Op = 1
+)
+
+// Mutation — изменение в Batch.
+type Mutation struct {
+	Op    Op
+	Key   []byte
+	Value []byte // только для OpPut
+}
+
+func (m *Mutation) marshal(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(m.Op))
+	b = appendBytes(b, 2, m.Key)
+	return appendBytes(b, 3, m.Value)
+}
+
+func (m *Mutation) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	switch num {
+	case 1:
+		var v uint64
+		n, err := consumeVarint(typ, b, &v)
+		m.Op = Op(v)
+		return n, err
+	case 2:
+		return consumeBytes(typ, b, &m.Key)
+	case 3:
+		return consumeBytes(typ, b, &m.Value)
+	}
+	return 0, nil
+}
+
+type batchRequest struct{ mutations []Mutation }
+
+func (m *batchRequest) marshal(b []byte) []byte {
+	for i := range m.mutations {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.mutations[i].marshal(nil))
+	}
+	return b
+}
+
+func (m *batchRequest) field(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	if num != 1 || typ != protowire.BytesType {
+		return 0, nil
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, fmt.Errorf("%w: %w", errBadMessage, protowire.ParseError(n))
+	}
+	var mut Mutation
+	if err := unmarshal(v, &mut); err != nil {
+		return 0, err
+	}
+	m.mutations = append(m.mutations, mut)
+	return n, nil
+}
+
+// protoMessage — старый интерфейс proto.Message с методами Marshal и Unmarshal.
+// Стандартный кодек gRPC "proto" кодирует такие сообщения их же методами, то есть
+// через marshal и unmarshal: своего кодека серверу и клиенту не нужно, и другие
+// сервисы на том же grpc.Server работают как обычно.
+type protoMessage interface {
+	protoadapt.MessageV1
+	Marshal() ([]byte, error)
+	Unmarshal(b []byte) error
+}
+
+var _ = []protoMessage{(*getRequest)(nil), (*getResponse)(nil), (*putRequest)(nil),
+	(*deleteRequest)(nil), (*empty)(nil), (*scanRequest)(nil), (*keyValue)(nil), (*batchRequest)(nil)}
+
+func (m *getRequest) Reset()                   { *m = getRequest{} }
+func (m *getRequest) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*getRequest) ProtoMessage()              {}
+func (m *getRequest) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *getRequest) Unmarshal(b []byte) error { return unmarshal(b, m) }
+
+func (m *getResponse) Reset()                   { *m = getResponse{} }
+func (m *getResponse) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*getResponse) ProtoMessage()              {}
+func (m *getResponse) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *getResponse) Unmarshal(b []byte) error { return unmarshal(b, m) }
+
+func (m *putRequest) Reset()                   { *m = putRequest{} }
+func (m *putRequest) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*putRequest) ProtoMessage()              {}
+func (m *putRequest) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *putRequest) Unmarshal(b []byte) error { return unmarshal(b, m) }
+
+func (m *deleteRequest) Reset()                   { *m = deleteRequest{} }
+func (m *deleteRequest) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*deleteRequest) ProtoMessage()              {}
+func (m *deleteRequest) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *deleteRequest) Unmarshal(b []byte) error { return unmarshal(b, m) }
+
+func (m *empty) Reset()                   { *m = empty{} }
+func (m *empty) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*empty) ProtoMessage()              {}
+func (m *empty) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *empty) Unmarshal(b []byte) error { return unmarshal(b, m) }
+
+func (m *scanRequest) Reset()                   { *m = scanRequest{} }
+func (m *scanRequest) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*scanRequest) ProtoMessage()              {}
+func (m *scanRequest) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *scanRequest) Unmarshal(b []byte) error { return unmarshal(b, m) }
+
+func (m *keyValue) Reset()                   { *m = keyValue{} }
+func (m *keyValue) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*keyValue) ProtoMessage()              {}
+func (m *keyValue) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *keyValue) Unmarshal(b []byte) error { return unmarshal(b, m) }
+
+func (m *batchRequest) Reset()                   { *m = batchRequest{} }
+func (m *batchRequest) String() string           { return fmt.Sprintf("%+v", *m) }
+func (*batchRequest) ProtoMessage()              {}
+func (m *batchRequest) Marshal() ([]byte, error) { return m.marshal(nil), nil }
+func (m *batchRequest) Unmarshal(b []byte) error { return unmarshal(b, m) }
@@ -0,0 +1,158 @@
+// Package kvrpc — gRPC-сервис KV (kv.proto) над lsm.Engine и клиент к нему.
+package kvrpc
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"kvschool/internal/lsm"
+)
+
+const serviceName = "kvschool.kv.v1.KV"
+
+// NewServer создает gRPC-сервер с сервисом KV над e. opts передаются grpc.NewServer.
+func NewServer(e *lsm.Engine, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&serviceDesc, &service{e: e})
+	return s
+}
+
+type service struct {
+	e *lsm.Engine
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("Get", func() message { return new(getRequest) }, (*service).get),
+		unary("Put", func() message { return new(putRequest) }, (*service).put),
+		unary("Delete", func() message { return new(deleteRequest) }, (*service).delete),
+		unary("Batch", func() message { return new(batchRequest) }, (*service).batch),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Scan",
+		Handler:       scanHandler,
+		ServerStreams: true,
+	}},
+	Metadata: "kv.proto",
+}
+
+// unary описывает метод: newReq создает пустой запрос, call его обрабатывает.
+func unary(method string, newReq func() message, call func(*service, context.Context, message) (message, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := newReq()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				resp, err := call(srv.(*service), ctx, req.(message))
+				return resp, statusError(err)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + method}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+func (s *service) get(ctx context.Context, m message) (message, error) {
+	v, err := s.e.GetContext(ctx, m.(*getRequest).key)
+	if errors.Is(err, lsm.ErrNotFound) {
+		return &getResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &getResponse{value: v, found: true}, nil
+}
+
+func (s *service) put(_ context.Context, m message) (message, error) {
+	req := m.(*putRequest)
+	return &empty{}, s.e.Put(req.key, req.value)
+}
+
+func (s *service) delete(_ context.Context, m message) (message, error) {
+	return &empty{}, s.e.Delete(m.(*deleteRequest).key)
+}
+
+// batch применяет изменения одной записью WAL без блокировок ключей: пакет только
+// пишет, и параллельные пакеты с общими ключами не должны прерывать друг друга.
+func (s *service) batch(ctx context.Context, m message) (message, error) {
+	req := m.(*batchRequest)
+	muts := make([]lsm.Mutation, 0, len(req.mutations))
+	for _, mut := range req.mutations {
+		switch mut.Op {
+		case OpPut:
+			muts = append(muts, lsm.Mutation{Kind: lsm.MutationPut, Key: mut.Key, Value: mut.Value})
+		case OpDelete:
+			muts = append(muts, lsm.Mutation{Kind: lsm.MutationDelete, Key: mut.Key})
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "неизвестная операция %d", mut.Op)
+		}
+	}
+	return &empty{}, s.e.WriteBatch(ctx, muts)
+}
+
+func scanHandler(srv any, stream grpc.ServerStream) error {
+	req := new(scanRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	it := srv.(*service).e.ScanContext(stream.Context(), optional(req.start), optional(req.end))
+	defer it.Close()
+	for n := uint64(0); req.limit == 0 || n < req.limit; n++ {
+		key, value, ok, err := it.Next()
+		if err != nil {
+			return statusError(err)
+		}
+		if !ok {
+			return nil
+		}
+		if err := stream.SendMsg(&keyValue{key: key, value: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optional возвращает nil для пустой границы диапазона: в proto3 пустое и
+// незаданное поле bytes неразличимы.
+func optional(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// statusError переводит ошибку движка в статус gRPC.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, lsm.ErrEmptyKey):
+		code = codes.InvalidArgument
+	case errors.Is(err, lsm.ErrClosed):
+		code = codes.Unavailable
+	case errors.Is(err, lsm.ErrReadOnly):
+		code = codes.FailedPrecondition
+	case errors.Is(err, lsm.ErrLockTimeout), errors.Is(err, lsm.ErrDeadlock):
+		code = codes.Aborted
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,253 @@
+package lsm
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"kvschool/internal/vfs"
+)
+
+// backupName — допустимые имена файлов в архиве резервной копии.
+var backupName = regexp.MustCompile(`^(data_[0-9]+\.sst|(wal|vlog)_[0-9]+\.log|` + manifestName + `)$`)
+
+// Backup пишет в w согласованную резервную копию базы одним tar-архивом:
+// SSTable, живые сегменты WAL, value log и последним — MANIFEST. Архив разворачивается через Restore.
+// Запись блокируется только на время снимка WAL; таблицы читаются уже без блокировки,
+// а compaction на это время не удаляет их с диска.
+func (e *Engine) Backup(w io.Writer) error {
+	e.mu.Lock()
+	m := e.manifest()
+	var tables []*table
+	for _, cf := range e.cfs {
+		for _, level := range cf.levels {
+			for _, t := range level {
+				t.refs++
+				tables = append(tables, t)
+			}
+		}
+	}
+	wals, err := e.snapshotWALs()
+	var vlogs []vlogSnapshot
+	if err == nil {
+		vlogs, err = e.snapshotValueLogs()
+	}
+	e.mu.Unlock()
+
+	defer func() {
+		e.mu.Lock()
+		for _, t := range tables {
+			e.unrefTable(t)
+		}
+		e.mu.Unlock()
+		for _, s := range vlogs {
+			_ = s.f.Close()
+		}
+	}()
+	if err != nil {
+		return fmt.Errorf("lsm: backup: %w", err)
+	}
+	if err := writeBackup(e.options.FS, e.options.Dir, w, m, tables, wals, vlogs); err != nil {
+		return fmt.Errorf("lsm: backup: %w", err)
+	}
+	return nil
+}
+
+type walSnapshot struct {
+	num  uint64
+	data []byte
+}
+
+// snapshotWALs читает живые сегменты WAL целиком. Вызывается под e.mu,
+// поэтому снимок заканчивается на границе записи.
+func (e *Engine) snapshotWALs() ([]walSnapshot, error) {
+	logs, err := listWALs(e.options.FS, e.options.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var wals []walSnapshot
+	for _, num := range logs {
+		if num < e.minLogNum {
+			continue
+		}
+		data, err := readFile(e.options.FS, walPath(e.options.Dir, num))
+		if err != nil {
+			return nil, err
+		}
+		wals = append(wals, walSnapshot{num: num, data: data})
+	}
+	return wals, nil
+}
+
+// readFile читает файл name целиком через fs.
+func readFile(fs vfs.FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+type vlogSnapshot struct {
+	num  uint64
+	f    vfs.File
+	size int64
+}
+
+// snapshotValueLogs открывает файлы value log и запоминает их длину: дописываются они
+// только в конец, а открытый файл можно дочитать, даже если его удалят.
+// Вызывается под e.mu.
+func (e *Engine) snapshotValueLogs() ([]vlogSnapshot, error) {
+	nums, err := listValueLogs(e.options.FS, e.options.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var vlogs []vlogSnapshot
+	for _, num := range nums {
+		f, err := e.options.FS.Open(valueLogPath(e.options.Dir, num))
+		if err == nil {
+			var st os.FileInfo
+			if st, err = f.Stat(); err == nil {
+				size := st.Size()
+				if e.vlog.f != nil && num == e.vlog.num {
+					size = e.vlog.off
+				}
+				vlogs = append(vlogs, vlogSnapshot{num: num, f: f, size: size})
+				continue
+			}
+			_ = f.Close()
+		}
+		for _, s := range vlogs {
+			_ = s.f.Close()
+		}
+		return nil, err
+	}
+	return vlogs, nil
+}
+
+func writeBackup(fs vfs.FS, dir string, w io.Writer, m manifest, tables []*table, wals []walSnapshot, vlogs []vlogSnapshot) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	add := func(name string, size int64, r io.Reader) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.CopyN(tw, r, size)
+		return err
+	}
+
+	// Файлы открываются заново, чтобы не занимать tableCache; refs не дают их удалить.
+	for _, t := range tables {
+		f, err := fs.Open(tablePath(dir, t.num))
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(tablePath("", t.num))
+		err = add(name, t.size, f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range wals {
+		name := filepath.Base(walPath("", s.num))
+		if err := add(name, int64(len(s.data)), bytes.NewReader(s.data)); err != nil {
+			return err
+		}
+	}
+	for _, s := range vlogs {
+		name := filepath.Base(valueLogPath("", s.num))
+		if err := add(name, s.size, io.NewSectionReader(s.f, 0, s.size)); err != nil {
+			return err
+		}
+	}
+	b, err := marshalManifest(m)
+	if err != nil {
+		return err
+	}
+	if err := add(manifestName, int64(len(b)), bytes.NewReader(b)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Restore разворачивает архив Backup в dir. Директория должна отсутствовать или быть пустой;
+// движок открывается на ней обычным Open. Архив без MANIFEST считается неполным,
+// и Restore возвращает ошибку.
+func Restore(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("lsm: restore: %w", err)
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("lsm: restore: %w", err)
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("lsm: restore: директория %s не пуста", dir)
+	}
+
+	tr := tar.NewReader(r)
+	var manifestData []byte
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("lsm: restore: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !backupName.MatchString(hdr.Name) {
+			return fmt.Errorf("lsm: restore: неожиданный файл %q в архиве", hdr.Name)
+		}
+		if hdr.Name == manifestName {
+			// MANIFEST пишется последним, атомарно — после всех файлов, на которые он ссылается.
+			if manifestData, err = io.ReadAll(tr); err != nil {
+				return fmt.Errorf("lsm: restore: %w", err)
+			}
+			continue
+		}
+		if err := writeFileSync(filepath.Join(dir, hdr.Name), tr); err != nil {
+			return fmt.Errorf("lsm: restore: %s: %w", hdr.Name, err)
+		}
+	}
+	if manifestData == nil {
+		return fmt.Errorf("lsm: restore: в архиве нет %s", manifestName)
+	}
+	m, err := unmarshalManifest(manifestData)
+	if err != nil {
+		return fmt.Errorf("lsm: restore: %w", err)
+	}
+	for _, mt := range m.Tables {
+		if _, err := os.Stat(tablePath(dir, mt.Num)); err != nil {
+			return fmt.Errorf("lsm: restore: таблица %d из %s: %w", mt.Num, manifestName, err)
+		}
+	}
+	if err := writeManifest(vfs.Default, dir, m); err != nil {
+		return fmt.Errorf("lsm: restore: %w", err)
+	}
+	return nil
+}
+
+func writeFileSync(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
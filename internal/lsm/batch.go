@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"kvschool/internal/wal"
+)
+
+// WriteBatch атомарно применяет изменения одной записью WAL: после сбоя
+// восстанавливаются либо все, либо ни одно. В отличие от Txn, ключи не блокируются:
+// пакет только пишет, поэтому параллельные пакеты с общими ключами не ждут друг друга
+// и не получают ErrLockTimeout или ErrDeadlock — из них побеждает записанный последним.
+// Изменения одного ключа внутри пакета применяются по порядку.
+//
+// Пустое ColumnFamily — пространство default; неизвестное пространство — ошибка
+// ErrUnknownColumnFamily. Ожидание при остановке записи прерывается отменой ctx.
+func (e *Engine) WriteBatch(ctx context.Context, mutations []Mutation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+
+	recs := make([]wal.Record, 0, len(mutations))
+	for i, m := range mutations {
+		rec, err := e.mutationRecord(m)
+		if err != nil {
+			return fmt.Errorf("lsm: изменение %d: %w", i, err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	for _, rec := range recs {
+		switch rec.Type {
+		case wal.OpDelete:
+			e.stats.deletes++
+		case wal.OpMerge:
+			e.stats.merges++
+		default:
+			e.stats.puts++
+		}
+	}
+	return e.writeBatchLocked(ctx, recs)
+}
+
+// mutationRecord переводит изменение пакета в запись WAL. Вызывается под e.mu.
+func (e *Engine) mutationRecord(m Mutation) (wal.Record, error) {
+	if len(m.Key) == 0 {
+		return wal.Record{}, ErrEmptyKey
+	}
+	name := m.ColumnFamily
+	if name == "" {
+		name = DefaultColumnFamilyName
+	}
+	cf := e.findColumnFamily(name)
+	if cf == nil || strings.HasPrefix(name, indexColumnFamilyPrefix) {
+		return wal.Record{}, fmt.Errorf("%w: %q", ErrUnknownColumnFamily, name)
+	}
+	rec := wal.Record{ColumnFamily: cf.id, Key: m.Key, Value: m.Value}
+	switch m.Kind {
+	case MutationPut:
+		rec.Type = wal.OpPut
+		if !m.ExpiresAt.IsZero() {
+			rec.Type, rec.ExpiresAt = wal.OpPutTTL, m.ExpiresAt.UnixNano()
+		}
+	case MutationDelete:
+		rec.Type, rec.Value = wal.OpDelete, nil
+	case MutationMerge:
+		rec.Type = wal.OpMerge
+	default:
+		return wal.Record{}, fmt.Errorf("lsm: неизвестный вид изменения %v", m.Kind)
+	}
+	return rec, e.checkRecord(rec)
+}
@@ -0,0 +1,286 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"kvschool/internal/vfs"
+	"kvschool/internal/wal"
+)
+
+// ErrUpdatesUnavailable возвращается GetUpdatesSince, если запрошенные записи уже
+// сброшены в SSTable и их сегменты WAL удалены. Потребителю остаётся начать заново
+// со снимка (Checkpoint или Scan).
+var ErrUpdatesUnavailable = errors.New("lsm: изменения уже удалены из WAL")
+
+// MutationKind — вид изменения в Update.
+type MutationKind int
+
+const (
+	MutationPut MutationKind = iota + 1
+	MutationDelete
+	MutationMerge
+)
+
+func (k MutationKind) String() string {
+	switch k {
+	case MutationPut:
+		return "put"
+	case MutationDelete:
+		return "delete"
+	case MutationMerge:
+		return "merge"
+	}
+	return fmt.Sprintf("MutationKind(%d)", int(k))
+}
+
+// Mutation — одно изменение ключа.
+type Mutation struct {
+	Kind         MutationKind
+	ColumnFamily string
+	Key          []byte
+	Value        []byte    // для Put — значение, для Merge — операнд
+	ExpiresAt    time.Time // для Put с TTL; нулевое время — без срока
+}
+
+// Update — зафиксированная запись: одна операция или атомарный пакет (WriteBatch, Txn).
+// Seq — её номер; номера возрастают на единицу с каждой записью.
+type Update struct {
+	Seq       uint64
+	Mutations []Mutation
+}
+
+// LatestSequence возвращает номер последней зафиксированной записи.
+func (e *Engine) LatestSequence() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastSeq
+}
+
+// UpdateIterator — результат GetUpdatesSince.
+type UpdateIterator struct {
+	e     *Engine // чей value log держит итератор; nil — не держит
+	since uint64
+	last  uint64   // номер последней записи на момент GetUpdatesSince
+	cfs   []string // имена пространств по id; "" — служебное пространство индекса
+	segs  []vfs.File
+	sizes []int64
+
+	r        *wal.Reader
+	seq      uint64 // номер последней прочитанной записи
+	numbered bool   // встречена запись OpSequence, и seq известен
+	err      error
+
+	// Позиция в WAL сразу после записи last: сегмент и смещение. С неё продолжает
+	// чтение хвоста Watch.
+	logNum uint64
+	logOff int64
+}
+
+// GetUpdatesSince возвращает итератор по записям с номерами больше seq, по возрастанию
+// номеров, — чтобы вторичные индексаторы и реплики могли следовать за движком.
+// Записи читаются из сегментов WAL; итератор видит записи, зафиксированные до вызова.
+// Изменения служебных пространств вторичных индексов не выдаются.
+// Если часть записей уже удалена вместе с сегментами WAL, первый Next вернёт ErrUpdatesUnavailable.
+func (e *Engine) GetUpdatesSince(seq uint64) (*UpdateIterator, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	it := &UpdateIterator{since: seq, last: e.lastSeq, cfs: e.updateColumnFamilies(),
+		logNum: e.logNum, logOff: e.wal.Offset()}
+	if seq >= e.lastSeq {
+		return it, nil
+	}
+	logs, err := listWALs(e.options.FS, e.options.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("lsm: changefeed: %w", err)
+	}
+	for _, num := range logs {
+		if num < e.minLogNum {
+			continue
+		}
+		f, err := e.options.FS.Open(walPath(e.options.Dir, num))
+		if err != nil {
+			_ = it.Close()
+			return nil, fmt.Errorf("lsm: changefeed: %w", err)
+		}
+		// Размер фиксируется сейчас: записи после вызова в итератор не попадают,
+		// и недописанный хвост активного сегмента не читается.
+		st, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			_ = it.Close()
+			return nil, fmt.Errorf("lsm: changefeed: %w", err)
+		}
+		size := st.Size()
+		if num == e.logNum {
+			// Файл может быть предвыделен: записано в нём столько, сколько знает Writer.
+			size = e.wal.Offset()
+		}
+		it.segs = append(it.segs, f)
+		it.sizes = append(it.sizes, size)
+	}
+	// Сегменты могут ссылаться на value log: он не удаляется до Close.
+	it.e = e
+	e.vlog.pins++
+	return it, nil
+}
+
+// Next возвращает следующую запись. ok == false означает, что записи кончились.
+func (it *UpdateIterator) Next() (u Update, ok bool, err error) {
+	for it.err == nil {
+		if it.r == nil {
+			if len(it.segs) == 0 {
+				if max(it.seq, it.since) < it.last {
+					// Записи сброшены в SSTable, а новых, по номерам которых это видно, нет.
+					it.err = fmt.Errorf("%w: запрошены записи после %d, в WAL их нет", ErrUpdatesUnavailable, it.since)
+					break
+				}
+				return Update{}, false, nil
+			}
+			it.r = wal.NewReader(io.NewSectionReader(it.segs[0], 0, it.sizes[0]))
+			_, err := it.r.ReadHeader()
+			if err == io.EOF {
+				// Пустой сегмент: сбой сразу после его создания.
+				_ = it.segs[0].Close()
+				it.segs, it.sizes, it.r = it.segs[1:], it.sizes[1:], nil
+				continue
+			}
+			if err != nil {
+				it.err = fmt.Errorf("lsm: changefeed: %w", err)
+				break
+			}
+		}
+		rec, ok, err := it.r.Next()
+		if err != nil {
+			it.err = fmt.Errorf("lsm: changefeed: %w", err)
+			break
+		}
+		if !ok {
+			_ = it.segs[0].Close()
+			it.segs, it.sizes, it.r = it.segs[1:], it.sizes[1:], nil
+			continue
+		}
+		if rec.Type == wal.OpSequence {
+			seq, err := rec.Sequence()
+			if err != nil {
+				it.err = fmt.Errorf("lsm: changefeed: %w", err)
+				break
+			}
+			if !it.numbered && seq > it.since+1 {
+				it.err = fmt.Errorf("%w: запрошены записи после %d, в WAL — начиная с %d", ErrUpdatesUnavailable, it.since, seq)
+				break
+			}
+			it.seq, it.numbered = seq-1, true
+			continue
+		}
+		if rec.Type == wal.OpCheckpoint {
+			continue
+		}
+		if !it.numbered {
+			// Сегмент записан без OpSequence (до появления номеров).
+			it.err = fmt.Errorf("%w: в сегменте WAL нет номеров записей", ErrUpdatesUnavailable)
+			break
+		}
+		it.seq++
+		if it.seq <= it.since {
+			continue
+		}
+		u, err := it.update(rec)
+		if err != nil {
+			it.err = fmt.Errorf("lsm: changefeed: запись %d: %w", it.seq, err)
+			break
+		}
+		if len(u.Mutations) > 0 {
+			return u, true, nil
+		}
+	}
+	return Update{}, false, it.err
+}
+
+func (it *UpdateIterator) update(rec wal.Record) (Update, error) {
+	return it.e.recordUpdate(it.cfs, it.seq, rec)
+}
+
+// updateColumnFamilies возвращает имена пространств по id для recordUpdate;
+// у служебных пространств индексов имя пустое. Вызывается под e.mu.
+func (e *Engine) updateColumnFamilies() []string {
+	cfs := make([]string, 0, len(e.cfs))
+	for _, cf := range e.cfs {
+		name := cf.name
+		if strings.HasPrefix(name, indexColumnFamilyPrefix) {
+			name = ""
+		}
+		cfs = append(cfs, name)
+	}
+	return cfs
+}
+
+// recordUpdate переводит запись WAL с номером seq в Update; cfs — имена пространств
+// по id из updateColumnFamilies. Ссылки на value log читаются, поэтому он должен
+// быть закреплён (e.vlog.pins).
+func (e *Engine) recordUpdate(cfs []string, seq uint64, rec wal.Record) (Update, error) {
+	recs := []wal.Record{rec}
+	if rec.Type == wal.OpBatch {
+		var err error
+		if recs, err = wal.DecodeBatch(rec.Value); err != nil {
+			return Update{}, err
+		}
+	}
+	u := Update{Seq: seq}
+	for _, r := range recs {
+		if int(r.ColumnFamily) >= len(cfs) {
+			return Update{}, fmt.Errorf("%w: id %d", ErrUnknownColumnFamily, r.ColumnFamily)
+		}
+		cf := cfs[r.ColumnFamily]
+		if cf == "" {
+			continue
+		}
+		m := Mutation{ColumnFamily: cf, Key: r.Key, Value: r.Value}
+		switch r.Type {
+		case wal.OpPut:
+			m.Kind = MutationPut
+		case wal.OpPutRef:
+			v, err := e.readValueLog(r.Value)
+			if err != nil {
+				return Update{}, err
+			}
+			m.Kind, m.Value = MutationPut, v
+		case wal.OpPutTTL:
+			m.Kind = MutationPut
+			m.ExpiresAt = time.Unix(0, r.ExpiresAt)
+		case wal.OpDelete:
+			m.Kind = MutationDelete
+		case wal.OpMerge:
+			m.Kind = MutationMerge
+		default:
+			return Update{}, fmt.Errorf("неизвестный тип записи WAL %d", r.Type)
+		}
+		u.Mutations = append(u.Mutations, m)
+	}
+	return u, nil
+}
+
+// Close закрывает сегменты WAL, которые итератор ещё не дочитал.
+func (it *UpdateIterator) Close() error {
+	if it.e != nil {
+		it.e.mu.Lock()
+		it.e.vlog.pins--
+		it.e.mu.Unlock()
+		it.e = nil
+	}
+	var firstErr error
+	for _, f := range it.segs {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.segs, it.sizes, it.r = nil, nil, nil
+	return firstErr
+}
@@ -0,0 +1,95 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"kvschool/internal/vfs"
+)
+
+// Checkpoint создаёт в dir согласованную копию базы, которую можно открыть через Open.
+// SSTable неизменяемы, поэтому они подключаются жёсткими ссылками (или копируются,
+// если dir на другой ФС); живые сегменты WAL и value log копируются до текущего конца.
+// Запись блокируется только на время создания ссылок и копирования WAL.
+// Директория dir не должна существовать.
+func (e *Engine) Checkpoint(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("lsm: checkpoint: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.checkpointLocked(dir); err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("lsm: checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (e *Engine) checkpointLocked(dir string) error {
+	m := e.manifest()
+	for _, mt := range m.Tables {
+		if err := linkOrCopy(e.options.FS, tablePath(e.options.Dir, mt.Num), tablePath(dir, mt.Num)); err != nil {
+			return err
+		}
+	}
+
+	logs, err := listWALs(e.options.FS, e.options.Dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range logs {
+		if num < e.minLogNum {
+			continue
+		}
+		if err := copyFile(e.options.FS, walPath(e.options.Dir, num), walPath(dir, num)); err != nil {
+			return err
+		}
+	}
+	vlogs, err := listValueLogs(e.options.FS, e.options.Dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range vlogs {
+		// Value log живого сегмента WAL ещё дописывается, остальные уже не меняются.
+		src, dst := valueLogPath(e.options.Dir, num), valueLogPath(dir, num)
+		if num >= e.minLogNum {
+			err = copyFile(e.options.FS, src, dst)
+		} else {
+			err = linkOrCopy(e.options.FS, src, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// MANIFEST пишется последним: без него директория не считается базой.
+	return writeManifest(e.options.FS, dir, m)
+}
+
+// copyFile копирует содержимое src на момент вызова. Запись в WAL идёт под e.mu,
+// поэтому копия заканчивается на границе записи.
+func copyFile(fs vfs.FS, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, in, st.Size()); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,177 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"kvschool/internal/skiplist"
+)
+
+// DefaultColumnFamilyName — имя пространства ключей, с которым работают методы Engine без handle.
+const DefaultColumnFamilyName = "default"
+
+// ErrUnknownColumnFamily возвращается при обращении к несуществующему пространству ключей.
+var ErrUnknownColumnFamily = errors.New("lsm: неизвестное пространство ключей")
+
+// columnFamily — именованное пространство ключей: своя Memtable и свои SSTable.
+// WAL общий для всех пространств, поэтому Flush сбрасывает их все сразу.
+type columnFamily struct {
+	id       uint32
+	name     string
+	cmp      Comparator
+	memtable *skiplist.SkipList
+	memSize  int
+
+	// building — пространство вторичного индекса, заполнение которого не завершено.
+	building bool
+
+	// levels[0] — свежие таблицы после Flush (могут пересекаться, упорядочены от старых к новым).
+	// levels[1:] — результат compaction: таблицы уровня не пересекаются и упорядочены по ключам.
+	levels [numLevels][]*table
+}
+
+func newColumnFamily(id uint32, name string, cmp Comparator) *columnFamily {
+	cf := &columnFamily{id: id, name: name, cmp: cmp}
+	cf.resetMemtable()
+	return cf
+}
+
+func (cf *columnFamily) resetMemtable() {
+	cf.memtable = skiplist.NewWithCompare(1, cf.cmp.Compare)
+}
+
+func (cf *columnFamily) levelSize(level int) int64 {
+	var n int64
+	for _, t := range cf.levels[level] {
+		n += t.size
+	}
+	return n
+}
+
+// ColumnFamily — handle пространства ключей (например, "subscribers", "cdr", "sessions").
+// Handle остаётся действительным до Close движка.
+type ColumnFamily struct {
+	e  *Engine
+	cf *columnFamily
+}
+
+// Name возвращает имя пространства ключей.
+func (h *ColumnFamily) Name() string { return h.cf.name }
+
+func (h *ColumnFamily) Put(key, value []byte) error {
+	return h.e.put(context.Background(), h.cf, key, value)
+}
+
+// PutWithTTL — как Engine.PutWithTTL, но в этом пространстве ключей.
+func (h *ColumnFamily) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return h.e.putWithTTL(h.cf, key, value, ttl)
+}
+
+func (h *ColumnFamily) Get(key []byte) ([]byte, error) { return h.e.get(h.cf, key) }
+
+// MultiGet — как Engine.MultiGet, но в этом пространстве ключей.
+func (h *ColumnFamily) MultiGet(keys [][]byte) ([][]byte, []error) { return h.e.multiGet(h.cf, keys) }
+
+func (h *ColumnFamily) Delete(key []byte) error { return h.e.delete(h.cf, key) }
+
+// Merge — как Engine.Merge, но в этом пространстве ключей.
+func (h *ColumnFamily) Merge(key, operand []byte) error { return h.e.merge(h.cf, key, operand) }
+
+// Scan возвращает итератор по ключам пространства в диапазоне [start, end).
+func (h *ColumnFamily) Scan(start, end []byte) *Iterator {
+	return h.e.scan(context.Background(), h.cf, start, end)
+}
+
+// ScanWithOptions — Engine.ScanWithOptions по пространству.
+func (h *ColumnFamily) ScanWithOptions(opts ScanOptions) *Iterator {
+	return h.e.scanWithOptions(h.cf, opts)
+}
+
+// DefaultColumnFamily возвращает handle пространства ключей по умолчанию.
+func (e *Engine) DefaultColumnFamily() *ColumnFamily {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return &ColumnFamily{e: e, cf: e.cfs[0]}
+}
+
+// ColumnFamily возвращает handle существующего пространства ключей.
+func (e *Engine) ColumnFamily(name string) (*ColumnFamily, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cf := e.findColumnFamily(name)
+	if cf == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownColumnFamily, name)
+	}
+	return &ColumnFamily{e: e, cf: cf}, nil
+}
+
+// CreateColumnFamily создаёт пространство ключей или возвращает уже существующее.
+// Новое пространство сразу записывается в MANIFEST, чтобы записи WAL
+// с его идентификатором можно было восстановить после сбоя.
+func (e *Engine) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, fmt.Errorf("lsm: пустое имя пространства ключей")
+	}
+	if strings.HasPrefix(name, indexColumnFamilyPrefix) {
+		return nil, fmt.Errorf("lsm: префикс %q зарезервирован за вторичными индексами", indexColumnFamilyPrefix)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if cf := e.findColumnFamily(name); cf != nil {
+		return &ColumnFamily{e: e, cf: cf}, nil
+	}
+	cf, err := e.createColumnFamilyLocked(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &ColumnFamily{e: e, cf: cf}, nil
+}
+
+// createColumnFamilyLocked добавляет пространство ключей и записывает MANIFEST.
+// Вызывается под e.mu.
+func (e *Engine) createColumnFamilyLocked(name string, building bool) (*columnFamily, error) {
+	if e.readOnlyErr != nil {
+		return nil, e.readOnlyErr
+	}
+	cf := newColumnFamily(uint32(len(e.cfs)), name, e.comparatorFor(name))
+	cf.building = building
+	e.cfs = append(e.cfs, cf)
+	if err := writeManifest(e.options.FS, e.options.Dir, e.manifest()); err != nil {
+		e.cfs = e.cfs[:len(e.cfs)-1]
+		return nil, fmt.Errorf("lsm: создание пространства ключей %q: %w", name, err)
+	}
+	return cf, nil
+}
+
+// ColumnFamilies возвращает имена всех пространств ключей в порядке создания.
+func (e *Engine) ColumnFamilies() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, len(e.cfs))
+	for i, cf := range e.cfs {
+		names[i] = cf.name
+	}
+	return names
+}
+
+// comparatorFor возвращает порядок ключей пространства: пользовательский из Options
+// или побайтовый для вторичных индексов, ключи которых строит сам движок.
+func (e *Engine) comparatorFor(name string) Comparator {
+	if strings.HasPrefix(name, indexColumnFamilyPrefix) {
+		return BytewiseComparator
+	}
+	return e.options.Comparator
+}
+
+func (e *Engine) findColumnFamily(name string) *columnFamily {
+	for _, cf := range e.cfs {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
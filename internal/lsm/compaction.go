@@ -0,0 +1,443 @@
+package lsm
+
+import (
+	"fmt"
+	"time"
+
+	"kvschool/internal/skiplist"
+	"kvschool/internal/sstable"
+	"kvschool/internal/vfs"
+)
+
+const (
+	// numLevels — количество уровней: L0 (после Flush) и L1..L3 (после compaction).
+	numLevels = 4
+
+	// l0CompactionTrigger — сколько таблиц L0 накапливаем перед слиянием в L1.
+	// Каждая таблица L0 — лишнее чтение на Get (read amplification).
+	l0CompactionTrigger = 4
+
+	// levelBaseBytes — целевой размер L1; каждый следующий уровень в levelMultiplier раз больше.
+	levelBaseBytes  = 8 << 20
+	levelMultiplier = 10
+
+	// targetFileSize — размер, по достижении которого compaction начинает новый выходной файл.
+	targetFileSize = 2 << 20
+)
+
+func maxBytesForLevel(level int) int64 {
+	b := int64(levelBaseBytes)
+	for l := 1; l < level; l++ {
+		b *= levelMultiplier
+	}
+	return b
+}
+
+// compaction описывает одно слияние: inputs уровня level плюс пересекающиеся
+// с ними таблицы уровня level+1 превращаются в новые таблицы level+1.
+type compaction struct {
+	cf         *columnFamily
+	level      int
+	inputs     []*table
+	overlapped []*table
+	// deeper — снимок уровней ниже выходного на момент выбора compaction,
+	// по нему решается, можно ли выбросить tombstone.
+	deeper [][]*table
+}
+
+func (c *compaction) outLevel() int { return c.level + 1 }
+
+func (c *compaction) tables() []*table {
+	return append(append([]*table(nil), c.inputs...), c.overlapped...)
+}
+
+// CompactRange принудительно сливает все таблицы, пересекающиеся с диапазоном [start, end),
+// уровень за уровнем до последнего, во всех пространствах ключей. Перед этим сбрасывается Memtable.
+// После вызова в диапазоне не остаётся ни перезаписанных версий, ни tombstone —
+// например, место после массового Delete освобождается сразу, а не при очередной автоматической compaction.
+// Если start == nil, считается -∞. Если end == nil, считается +∞.
+func (e *Engine) CompactRange(start, end []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.flushLocked(); err != nil {
+		return err
+	}
+
+	// Фоновые compaction на время ручной приостанавливаются и дожидаются завершения.
+	e.manualCompaction = true
+	defer func() {
+		e.manualCompaction = false
+		e.maybeScheduleCompaction()
+	}()
+	for e.runningCompactions > 0 {
+		e.compactionDone.Wait()
+	}
+
+	for _, cf := range e.cfs {
+		for level := 0; level < numLevels-1; level++ {
+			inputs := cf.overlappingInputs(level, start, end)
+			if len(inputs) == 0 {
+				continue
+			}
+			if err := e.runCompaction(cf.newCompaction(level, inputs)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overlappingInputs возвращает таблицы уровня, пересекающиеся с [start, end).
+// Таблицы L0 пересекаются друг с другом, поэтому из L0 берутся все таблицы сразу:
+// иначе более старая версия ключа могла бы остаться выше более новой.
+func (cf *columnFamily) overlappingInputs(level int, start, end []byte) []*table {
+	var inputs []*table
+	for _, t := range cf.levels[level] {
+		if overlapsRange(cf.cmp, t, start, end) {
+			inputs = append(inputs, t)
+		}
+	}
+	if level == 0 && len(inputs) > 0 {
+		return append([]*table(nil), cf.levels[0]...)
+	}
+	return inputs
+}
+
+// overlapsRange проверяет пересечение таблицы с полуинтервалом [start, end).
+func overlapsRange(cmp Comparator, t *table, start, end []byte) bool {
+	if end != nil && cmp.Compare(t.smallest(), end) >= 0 {
+		return false
+	}
+	if start != nil && cmp.Compare(t.largest(), start) < 0 {
+		return false
+	}
+	return true
+}
+
+// overlapsKeys проверяет пересечение таблицы с отрезком [smallest, largest].
+func overlapsKeys(cmp Comparator, t *table, smallest, largest []byte) bool {
+	return cmp.Compare(t.smallest(), largest) <= 0 && cmp.Compare(t.largest(), smallest) >= 0
+}
+
+// newCompaction дополняет inputs пересекающимися таблицами уровня level+1.
+// Возвращает nil, если какая-то из таблиц уже занята другой compaction.
+// Вызывается под e.mu.
+func (cf *columnFamily) newCompaction(level int, inputs []*table) *compaction {
+	c := &compaction{cf: cf, level: level, inputs: inputs}
+
+	smallest, largest := inputs[0].smallest(), inputs[0].largest()
+	for _, t := range inputs[1:] {
+		if cf.cmp.Compare(t.smallest(), smallest) < 0 {
+			smallest = t.smallest()
+		}
+		if cf.cmp.Compare(t.largest(), largest) > 0 {
+			largest = t.largest()
+		}
+	}
+	for _, t := range cf.levels[c.outLevel()] {
+		if overlapsKeys(cf.cmp, t, smallest, largest) {
+			c.overlapped = append(c.overlapped, t)
+		}
+	}
+	for _, t := range c.tables() {
+		if t.compacting {
+			return nil
+		}
+	}
+	for l := c.outLevel() + 1; l < numLevels; l++ {
+		c.deeper = append(c.deeper, append([]*table(nil), cf.levels[l]...))
+	}
+	return c
+}
+
+// pickCompaction выбирает очередную автоматическую compaction или возвращает nil.
+// Вызывается под e.mu.
+func (e *Engine) pickCompaction() *compaction {
+	for _, cf := range e.cfs {
+		if c := cf.pickCompaction(); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func (cf *columnFamily) pickCompaction() *compaction {
+	if len(cf.levels[0]) >= l0CompactionTrigger {
+		if c := cf.newCompaction(0, append([]*table(nil), cf.levels[0]...)); c != nil {
+			return c
+		}
+	}
+	if c := cf.pickTombstoneCompaction(); c != nil {
+		return c
+	}
+	for level := 1; level < numLevels-1; level++ {
+		if cf.levelSize(level) <= maxBytesForLevel(level) {
+			continue
+		}
+		for _, t := range cf.levels[level] {
+			if c := cf.newCompaction(level, []*table{t}); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// maybeScheduleCompaction будит фоновый планировщик, не блокируясь.
+func (e *Engine) maybeScheduleCompaction() {
+	select {
+	case e.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// compactionLoop — фоновый планировщик: после каждого Flush (или завершения compaction)
+// проверяет уровни и запускает не больше MaxBackgroundCompactions слияний одновременно.
+func (e *Engine) compactionLoop() {
+	defer e.bgWG.Done()
+	for {
+		select {
+		case <-e.closing:
+			return
+		case <-e.compactCh:
+		}
+		e.scheduleCompactions()
+	}
+}
+
+func (e *Engine) scheduleCompactions() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for e.runningCompactions < e.options.MaxBackgroundCompactions && !e.manualCompaction && !e.closed {
+		c := e.pickCompaction()
+		if c == nil {
+			return
+		}
+		e.runningCompactions++
+		e.bgWG.Add(1)
+		go func() {
+			defer e.bgWG.Done()
+			e.mu.Lock()
+			err := e.runCompaction(c)
+			e.runningCompactions--
+			e.compactionDone.Broadcast()
+			if err != nil {
+				e.options.Logger.Printf("%v", err)
+			}
+			e.mu.Unlock()
+			if err == nil {
+				e.maybeScheduleCompaction()
+			}
+		}()
+	}
+}
+
+// isBaseLevelForKey сообщает, что ниже выходного уровня ключ нигде не встречается.
+// Только тогда tombstone можно выбросить: ему больше нечего закрывать.
+func (c *compaction) isBaseLevelForKey(key []byte) bool {
+	for _, tables := range c.deeper {
+		if findTable(c.cf.cmp, tables, key) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// runCompaction выполняет compaction. Вызывается под e.mu; на время слияния
+// блокировка отпускается, а таблицы помечаются занятыми, чтобы их не взяла другая compaction.
+func (e *Engine) runCompaction(c *compaction) error {
+	if e.readOnlyErr != nil {
+		return e.readOnlyErr
+	}
+	cf, level, outLevel := c.cf, c.level, c.outLevel()
+	all := c.tables()
+	for _, t := range all {
+		t.compacting = true
+	}
+	defer func() {
+		for _, t := range all {
+			t.compacting = false
+		}
+	}()
+
+	info := CompactionInfo{
+		ColumnFamily: cf.name,
+		Level:        level,
+		OutputLevel:  outLevel,
+		Inputs:       append(e.tableInfos(cf, level, c.inputs), e.tableInfos(cf, outLevel, c.overlapped)...),
+	}
+	e.notify(func(l EventListener) { l.OnCompactionBegin(info) })
+	start := time.Now()
+	outputs, err := e.compact(c)
+	info.Outputs = e.tableInfos(cf, outLevel, outputs)
+	info.Duration, info.Err = time.Since(start), err
+	e.notify(func(l EventListener) { l.OnCompactionEnd(info) })
+	// L0 мог уменьшиться — будим остановленных писателей.
+	e.compactionDone.Broadcast()
+	return err
+}
+
+// compact — тело runCompaction: сливает таблицы и устанавливает результат.
+// Возвращает созданные таблицы.
+func (e *Engine) compact(c *compaction) ([]*table, error) {
+	cf, level, outLevel := c.cf, c.level, c.outLevel()
+	all := c.tables()
+
+	// Источники — от свежих к старым: L0 по убыванию номера, затем нижний уровень.
+	// Таблицы помечены compacting, и tableCache не закроет их до конца слияния.
+	sources := make([]skiplist.Iterator, 0, len(all))
+	for i := len(c.inputs) - 1; i >= 0; i-- {
+		sst, err := e.reader(c.inputs[i])
+		if err != nil {
+			_ = closeIterators(sources)
+			return nil, fmt.Errorf("lsm: compaction L%d->L%d: %w", level, outLevel, err)
+		}
+		sources = append(sources, sst.Scan(nil, nil))
+	}
+	for _, t := range c.overlapped {
+		sst, err := e.reader(t)
+		if err != nil {
+			_ = closeIterators(sources)
+			return nil, fmt.Errorf("lsm: compaction L%d->L%d: %w", level, outLevel, err)
+		}
+		sources = append(sources, sst.Scan(nil, nil))
+	}
+	it := newMergingIterator(cf.cmp, sources)
+	it.collapse = e.compactionCollapse(c, e.now().UnixNano())
+
+	e.mu.Unlock()
+	outputs, err := e.writeTables(it, c)
+	_ = it.Close()
+	e.mu.Lock()
+	if err != nil {
+		return nil, fmt.Errorf("lsm: compaction L%d->L%d: %w", level, outLevel, err)
+	}
+
+	cf.levels[level] = removeTables(cf.levels[level], c.inputs)
+	cf.levels[outLevel] = append(removeTables(cf.levels[outLevel], c.overlapped), outputs...)
+	sortByKey(cf.cmp, cf.levels[outLevel])
+	for _, t := range outputs {
+		e.cacheTable(t)
+	}
+	if err := writeManifest(e.options.FS, e.options.Dir, e.manifest()); err != nil {
+		return outputs, e.setReadOnly(fmt.Errorf("lsm: compaction L%d->L%d: %w", level, outLevel, err))
+	}
+
+	e.options.Logger.Printf("lsm: compaction L%d->L%d: %d+%d таблиц -> %d", level, outLevel, len(c.inputs), len(c.overlapped), len(outputs))
+	e.stats.compactions++
+	for _, t := range all {
+		e.stats.bytesRead += uint64(t.size)
+	}
+	for _, t := range outputs {
+		e.stats.bytesWritten += uint64(t.size)
+	}
+
+	for _, t := range all {
+		e.dropTable(t)
+	}
+	if err := e.removeObsoleteValueLogs(); err != nil {
+		e.options.Logger.Printf("lsm: удаление старых value log: %v", err)
+	}
+	return outputs, nil
+}
+
+// writeTables пишет поток из it в новые таблицы размером около targetFileSize.
+// Tombstone и истёкшие по TTL значения выбрасываются, если ниже выходного уровня ключ больше не встречается.
+// Вызывается без e.mu.
+func (e *Engine) writeTables(it *mergingIterator, c *compaction) ([]*table, error) {
+	now := e.now().UnixNano()
+	var (
+		outputs []*table
+		f       vfs.File
+		w       *sstable.Writer
+		num     uint64
+	)
+	abort := func(err error) ([]*table, error) {
+		if f != nil {
+			_ = f.Close()
+			_ = e.options.FS.Remove(tablePath(e.options.Dir, num))
+		}
+		for _, t := range outputs {
+			_ = t.sst.Close()
+			_ = e.options.FS.Remove(tablePath(e.options.Dir, t.num))
+		}
+		return nil, err
+	}
+	finish := func() error {
+		if err := w.Finish(); err != nil {
+			return err
+		}
+		t, err := e.newTable(c.cf, f, num, w.Size())
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		f, w = nil, nil
+		return nil
+	}
+
+	for {
+		key, raw, ok, err := it.Next()
+		if err != nil {
+			return abort(err)
+		}
+		if !ok {
+			break
+		}
+		en, err := decodeValue(raw)
+		if err != nil {
+			return abort(err)
+		}
+		if en.kind == kindTombstone || en.expired(now) {
+			if c.isBaseLevelForKey(key) {
+				continue
+			}
+			// Истёкшее значение может закрывать более старую версию ниже —
+			// оставляем вместо него tombstone.
+			raw = encodeValue(kindTombstone, nil)
+		}
+		if w == nil {
+			e.mu.Lock()
+			num = e.newFileNum()
+			e.mu.Unlock()
+			f, err = e.options.FS.Create(tablePath(e.options.Dir, num))
+			if err != nil {
+				return abort(err)
+			}
+			w = e.newTableWriter(c.cf, f, c.maxTimestamp(now))
+		}
+		if err := w.Add(key, raw); err != nil {
+			return abort(err)
+		}
+		if w.EstimatedSize() >= targetFileSize {
+			if err := finish(); err != nil {
+				return abort(err)
+			}
+		}
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return abort(err)
+		}
+	}
+	return outputs, nil
+}
+
+func removeTables(tables, remove []*table) []*table {
+	out := tables[:0]
+	for _, t := range tables {
+		drop := false
+		for _, r := range remove {
+			if t == r {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,52 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// engineFileName — файлы, которые создаёт движок: SSTable, сегменты WAL, value log, MANIFEST
+// и его временная копия, оставшаяся после сбоя посреди записи.
+var engineFileName = regexp.MustCompile(`^(data_[0-9]+\.sst|(wal|vlog)_[0-9]+\.log|` + manifestName + `(\.tmp)?)$`)
+
+// Destroy удаляет файлы движка из dir — для очистки после тестов и удаления данных
+// абонента при выводе его из эксплуатации. Чужие файлы и поддиректории не трогаются;
+// сама директория удаляется, только если после этого опустела. Отсутствие dir не ошибка.
+// Движок на dir должен быть закрыт.
+func Destroy(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("lsm: destroy: %w", err)
+	}
+	// MANIFEST удаляется первым: без него оставшиеся после сбоя файлы уже не база,
+	// а мусор, и Open не примет их за частично удалённые данные.
+	if err := os.Remove(filepath.Join(dir, manifestName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("lsm: destroy: %w", err)
+	}
+	others := 0
+	for _, ent := range entries {
+		name := ent.Name()
+		if ent.IsDir() || !engineFileName.MatchString(name) {
+			others++
+			continue
+		}
+		if name == manifestName {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("lsm: destroy: %w", err)
+		}
+	}
+	if others == 0 {
+		if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("lsm: destroy: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// valueKind — тип значения, хранимого в Memtable и SSTable.
+// Первый байт значения кодирует тип, остальное — полезная нагрузка.
+type valueKind byte
+
+const (
+	kindValue     valueKind = 1
+	kindTombstone valueKind = 2
+	// kindValueTTL — значение со сроком жизни: после типа идут 8 байт expiresAt (big-endian).
+	kindValueTTL valueKind = 3
+	// kindMerge — ещё не применённые операнды Merge (от старого к новому),
+	// каждый как uvarint-длина и байты.
+	kindMerge valueKind = 4
+	// kindValueRef — значение в value log: после типа идёт ссылка на него (см. valueRef).
+	kindValueRef valueKind = 5
+)
+
+var errBadValue = errors.New("lsm: повреждённое значение")
+
+// entry — раскодированное значение.
+type entry struct {
+	kind      valueKind
+	expiresAt int64 // наносекунды Unix, 0 — без срока жизни
+	value     []byte
+}
+
+// expired сообщает, истёк ли срок жизни значения к моменту now (наносекунды Unix).
+func (en entry) expired(now int64) bool {
+	return en.expiresAt != 0 && now >= en.expiresAt
+}
+
+func encodeValue(kind valueKind, value []byte) []byte {
+	b := make([]byte, 0, 1+len(value))
+	b = append(b, byte(kind))
+	return append(b, value...)
+}
+
+func encodeValueTTL(value []byte, expiresAt int64) []byte {
+	b := make([]byte, 0, 1+8+len(value))
+	b = append(b, byte(kindValueTTL))
+	b = binary.BigEndian.AppendUint64(b, uint64(expiresAt))
+	return append(b, value...)
+}
+
+func decodeValue(raw []byte) (entry, error) {
+	if len(raw) == 0 {
+		return entry{}, errBadValue
+	}
+	kind := valueKind(raw[0])
+	switch kind {
+	case kindValue, kindTombstone, kindMerge, kindValueRef:
+		return entry{kind: kind, value: raw[1:]}, nil
+	case kindValueTTL:
+		if len(raw) < 1+8 {
+			return entry{}, errBadValue
+		}
+		return entry{
+			kind:      kind,
+			expiresAt: int64(binary.BigEndian.Uint64(raw[1:9])),
+			value:     raw[9:],
+		}, nil
+	default:
+		return entry{}, errBadValue
+	}
+}
+
+// appendOperand дописывает операнд к закодированному значению kindMerge.
+// Если raw == nil, создаётся новое значение из одного операнда.
+func appendOperand(raw, operand []byte) []byte {
+	if raw == nil {
+		raw = []byte{byte(kindMerge)}
+	}
+	raw = binary.AppendUvarint(raw, uint64(len(operand)))
+	return append(raw, operand...)
+}
+
+// decodeOperands разбирает полезную нагрузку kindMerge.
+func decodeOperands(b []byte) ([][]byte, error) {
+	var ops [][]byte
+	for len(b) > 0 {
+		n, sz := binary.Uvarint(b)
+		if sz <= 0 || uint64(len(b)-sz) < n {
+			return nil, errBadValue
+		}
+		b = b[sz:]
+		ops = append(ops, b[:n:n])
+		b = b[n:]
+	}
+	return ops, nil
+}
@@ -0,0 +1,91 @@
+package lsm
+
+import "time"
+
+// EventListener получает уведомления о внутренних событиях движка: Flush, compaction,
+// смене сегмента WAL. Методы вызываются синхронно под внутренней блокировкой движка,
+// поэтому должны быть быстрыми и не могут вызывать методы Engine.
+// Чтобы реализовать только часть методов, встройте NoopEventListener.
+type EventListener interface {
+	OnFlushBegin(FlushInfo)
+	OnFlushEnd(FlushInfo)
+	OnCompactionBegin(CompactionInfo)
+	OnCompactionEnd(CompactionInfo)
+	OnWALRotate(WALRotateInfo)
+}
+
+// TableInfo описывает одну SSTable.
+type TableInfo struct {
+	Num          uint64
+	Path         string
+	ColumnFamily string
+	Level        int
+	Size         int64
+
+	// Smallest и Largest — диапазон ключей таблицы, Entries — число записей в ней
+	// (включая tombstone; 0 для таблиц без блока свойств).
+	Smallest, Largest []byte
+	Entries           uint64
+}
+
+// FlushInfo описывает Flush. Tables, Duration и Err заполняются только в OnFlushEnd.
+type FlushInfo struct {
+	// MemtableBytes — объём сбрасываемых Memtable всех пространств ключей.
+	MemtableBytes int
+
+	Tables   []TableInfo
+	Duration time.Duration
+	Err      error
+}
+
+// CompactionInfo описывает compaction. Outputs, Duration и Err заполняются только в OnCompactionEnd.
+type CompactionInfo struct {
+	ColumnFamily string
+	Level        int
+	OutputLevel  int
+	Inputs       []TableInfo
+
+	Outputs  []TableInfo
+	Duration time.Duration
+	Err      error
+}
+
+// WALRotateInfo описывает переход на новый сегмент WAL.
+// OldLogNum == 0 при открытии движка.
+type WALRotateInfo struct {
+	OldLogNum uint64
+	NewLogNum uint64
+}
+
+// NoopEventListener реализует EventListener пустыми методами.
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFlushBegin(FlushInfo)           {}
+func (NoopEventListener) OnFlushEnd(FlushInfo)             {}
+func (NoopEventListener) OnCompactionBegin(CompactionInfo) {}
+func (NoopEventListener) OnCompactionEnd(CompactionInfo)   {}
+func (NoopEventListener) OnWALRotate(WALRotateInfo)        {}
+
+// notify вызывает fn для каждого зарегистрированного слушателя.
+func (e *Engine) notify(fn func(EventListener)) {
+	for _, l := range e.options.EventListeners {
+		fn(l)
+	}
+}
+
+func (e *Engine) tableInfos(cf *columnFamily, level int, tables []*table) []TableInfo {
+	infos := make([]TableInfo, len(tables))
+	for i, t := range tables {
+		infos[i] = TableInfo{
+			Num:          t.num,
+			Path:         tablePath(e.options.Dir, t.num),
+			ColumnFamily: cf.name,
+			Level:        level,
+			Size:         t.size,
+			Smallest:     t.smallest(),
+			Largest:      t.largest(),
+			Entries:      t.entries,
+		}
+	}
+	return infos
+}
@@ -0,0 +1,99 @@
+package lsm
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// expvarSlots — переменные expvar, опубликованные движками, по имени. expvar не умеет
+// снимать публикацию, поэтому переменная остаётся и после Close и достаётся
+// следующему движку, открытому с тем же именем.
+var expvarSlots = struct {
+	sync.Mutex
+	m map[string]*expvarSlot
+}{m: make(map[string]*expvarSlot)}
+
+type expvarSlot struct {
+	mu sync.Mutex
+	e  *Engine // nil, если движок закрыт
+}
+
+func (s *expvarSlot) value() any {
+	s.mu.Lock()
+	e := s.e
+	s.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+	st := e.Stats()
+	return map[string]any{
+		"puts":               st.Puts,
+		"gets":               st.Gets,
+		"deletes":            st.Deletes,
+		"merges":             st.Merges,
+		"memtable_bytes":     st.MemtableBytes,
+		"wal_bytes":          st.WALBytes,
+		"wal_syncs":          st.WALSyncs,
+		"wal_records":        st.WALRecords,
+		"wal_bytes_written":  st.WALBytesWritten,
+		"wal_writes":         st.WALWrites,
+		"flushes":            st.Flushes,
+		"compactions":        st.Compactions,
+		"bytes_read":         st.BytesRead,
+		"bytes_written":      st.BytesWritten,
+		"write_stall":        st.WriteStall.String(),
+		"stalled_writes":     st.StalledWrites,
+		"stall_time_ns":      st.StallTime.Nanoseconds(),
+		"level_tables":       st.LevelTables,
+		"level_bytes":        st.LevelBytes,
+		"open_tables":        st.OpenTables,
+		"table_cache_hits":   st.TableCacheHits,
+		"table_cache_misses": st.TableCacheMisses,
+	}
+}
+
+// publishExpvar публикует счётчики движка под именем Options.ExpvarName.
+func (e *Engine) publishExpvar() error {
+	name := e.options.ExpvarName
+	if name == "" {
+		return nil
+	}
+	expvarSlots.Lock()
+	defer expvarSlots.Unlock()
+	slot, ok := expvarSlots.m[name]
+	if !ok {
+		if expvar.Get(name) != nil {
+			return fmt.Errorf("%w: переменная expvar %q уже опубликована", ErrInvalidOptions, name)
+		}
+		slot = &expvarSlot{}
+		expvar.Publish(name, expvar.Func(slot.value))
+		expvarSlots.m[name] = slot
+	}
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.e != nil {
+		return fmt.Errorf("%w: переменная expvar %q занята другим движком", ErrInvalidOptions, name)
+	}
+	slot.e = e
+	return nil
+}
+
+// unpublishExpvar отвязывает переменную expvar от закрываемого движка.
+func (e *Engine) unpublishExpvar() {
+	name := e.options.ExpvarName
+	if name == "" {
+		return
+	}
+	expvarSlots.Lock()
+	slot := expvarSlots.m[name]
+	expvarSlots.Unlock()
+	if slot == nil {
+		return
+	}
+	slot.mu.Lock()
+	if slot.e == e {
+		slot.e = nil
+	}
+	slot.mu.Unlock()
+}
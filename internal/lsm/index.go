@@ -0,0 +1,245 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"kvschool/internal/wal"
+)
+
+// indexColumnFamilyPrefix — префикс имён пространств ключей, в которых хранятся вторичные индексы.
+const indexColumnFamilyPrefix = "index:"
+
+// ErrUnknownIndex возвращается IndexScan для незарегистрированного индекса.
+var ErrUnknownIndex = errors.New("lsm: неизвестный индекс")
+
+// Index описывает вторичный индекс по значениям пространства default —
+// например, поиск абонентов по IMEI или по соте.
+// Индекс хранится в отдельном пространстве ключей и обновляется в той же записи WAL,
+// что и основной ключ, поэтому после сбоя они не расходятся.
+type Index struct {
+	Name string
+	// Extract возвращает индексируемую часть значения или nil, если значение не индексируется.
+	// Функция должна быть детерминированной: по ней же проверяется актуальность записей индекса.
+	Extract func(value []byte) []byte
+}
+
+type secondaryIndex struct {
+	Index
+	cf *columnFamily
+}
+
+// indexKey — ключ записи индекса: длина sec (4 байта big-endian), sec, первичный ключ.
+// Длина впереди отделяет sec от первичного ключа и сохраняет порядок по первичным ключам внутри sec.
+func indexKey(sec, primary []byte) []byte {
+	k := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(sec)+len(primary)), uint32(len(sec)))
+	return append(append(k, sec...), primary...)
+}
+
+func indexPrefix(sec []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(sec))), sec...)
+}
+
+// prefixEnd возвращает наименьший ключ, больший всех ключей с префиксом p
+// (nil, если такого нет — p состоит из одних 0xff).
+func prefixEnd(p []byte) []byte {
+	end := append([]byte(nil), p...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// openIndexes создаёт пространства зарегистрированных индексов и заполняет новые
+// по существующим данным. Вызывается из Open без e.mu.
+func (e *Engine) openIndexes() error {
+	e.mu.Lock()
+	registered := make(map[string]bool, len(e.options.Indexes))
+	for _, idx := range e.options.Indexes {
+		registered[indexColumnFamilyPrefix+idx.Name] = true
+	}
+	for _, cf := range e.cfs {
+		if name, ok := strings.CutPrefix(cf.name, indexColumnFamilyPrefix); ok && !registered[cf.name] {
+			e.mu.Unlock()
+			// Без регистрации индекс перестал бы обновляться и молча устарел.
+			return fmt.Errorf("%w: индекс %q есть в базе, но не зарегистрирован", ErrInvalidOptions, name)
+		}
+	}
+	var building []*secondaryIndex
+	for _, idx := range e.options.Indexes {
+		name := indexColumnFamilyPrefix + idx.Name
+		cf := e.findColumnFamily(name)
+		if cf == nil {
+			var err error
+			if cf, err = e.createColumnFamilyLocked(name, true); err != nil {
+				e.mu.Unlock()
+				return err
+			}
+		}
+		si := &secondaryIndex{Index: idx, cf: cf}
+		e.indexes = append(e.indexes, si)
+		if cf.building {
+			building = append(building, si)
+		}
+	}
+	e.mu.Unlock()
+
+	if len(building) == 0 {
+		return nil
+	}
+	return e.buildIndexes(building)
+}
+
+// buildIndexes заполняет индексы по текущим данным. Прерванное заполнение повторяется
+// при следующем Open целиком: записи индекса идемпотентны.
+func (e *Engine) buildIndexes(indexes []*secondaryIndex) error {
+	it := e.Scan(nil, nil)
+	defer it.Close()
+	for {
+		key, value, ok, err := it.Next()
+		if err != nil {
+			return fmt.Errorf("lsm: заполнение индексов: %w", err)
+		}
+		if !ok {
+			break
+		}
+		for _, idx := range indexes {
+			if sec := idx.Extract(value); sec != nil {
+				if err := e.put(context.Background(), idx.cf, indexKey(sec, key), nil); err != nil {
+					return fmt.Errorf("lsm: заполнение индекса %q: %w", idx.Name, err)
+				}
+			}
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, idx := range indexes {
+		idx.cf.building = false
+	}
+	if err := writeManifest(e.options.FS, e.options.Dir, e.manifest()); err != nil {
+		return fmt.Errorf("lsm: заполнение индексов: %w", err)
+	}
+	return nil
+}
+
+// withIndexRecords дополняет записи пространства default записями индексов:
+// удалением устаревших и добавлением новых. Вызывается под e.mu.
+func (e *Engine) withIndexRecords(recs []wal.Record) ([]wal.Record, error) {
+	if len(e.indexes) == 0 {
+		return recs, nil
+	}
+	out := recs
+	for _, rec := range recs {
+		if rec.ColumnFamily != e.defaultCF.id {
+			continue
+		}
+		old, err := e.getLocked(e.defaultCF, rec.Key)
+		hasOld := err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+
+		var value []byte
+		hasValue := true
+		switch rec.Type {
+		case wal.OpPut, wal.OpPutTTL:
+			value = rec.Value
+		case wal.OpMerge:
+			var existing []byte
+			if hasOld {
+				existing = old
+			}
+			if value, err = e.options.MergeOperator(rec.Key, existing, [][]byte{rec.Value}); err != nil {
+				return nil, err
+			}
+		default:
+			hasValue = false
+		}
+
+		for _, idx := range e.indexes {
+			var oldSec, newSec []byte
+			if hasOld {
+				oldSec = idx.Extract(old)
+			}
+			if hasValue {
+				newSec = idx.Extract(value)
+			}
+			if oldSec != nil && (newSec == nil || !bytes.Equal(oldSec, newSec)) {
+				out = append(out, wal.Record{Type: wal.OpDelete, Key: indexKey(oldSec, rec.Key), ColumnFamily: idx.cf.id})
+			}
+			if newSec != nil {
+				ir := wal.Record{Type: wal.OpPut, Key: indexKey(newSec, rec.Key), ColumnFamily: idx.cf.id}
+				if rec.Type == wal.OpPutTTL {
+					ir.Type, ir.ExpiresAt = wal.OpPutTTL, rec.ExpiresAt
+				}
+				out = append(out, ir)
+			}
+		}
+	}
+	return out, nil
+}
+
+// IndexIterator — результат IndexScan: первичные ключи по возрастанию с их значениями.
+type IndexIterator struct {
+	e   *Engine
+	idx *secondaryIndex
+	sec []byte
+	it  *Iterator
+}
+
+// IndexScan возвращает итератор по ключам пространства default, у значений которых
+// индекс name извлекает value. Close обязателен.
+func (e *Engine) IndexScan(name string, value []byte) (*IndexIterator, error) {
+	e.mu.Lock()
+	var idx *secondaryIndex
+	for _, si := range e.indexes {
+		if si.Name == name {
+			idx = si
+		}
+	}
+	e.mu.Unlock()
+	if idx == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownIndex, name)
+	}
+	prefix := indexPrefix(value)
+	return &IndexIterator{
+		e:   e,
+		idx: idx,
+		sec: append([]byte(nil), value...),
+		it:  e.scan(context.Background(), idx.cf, prefix, prefixEnd(prefix)),
+	}, nil
+}
+
+// Next возвращает следующий первичный ключ и его текущее значение. ok == false — конец.
+func (it *IndexIterator) Next() (key, value []byte, ok bool, err error) {
+	prefixLen := 4 + len(it.sec)
+	for {
+		ikey, _, ok, err := it.it.Next()
+		if err != nil || !ok {
+			return nil, nil, false, err
+		}
+		key = ikey[prefixLen:]
+		value, err = it.e.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+		// Значение могло измениться после снимка индекса: отдаём только совпадающие.
+		if !bytes.Equal(it.idx.Extract(value), it.sec) {
+			continue
+		}
+		return key, value, true, nil
+	}
+}
+
+func (it *IndexIterator) Close() error { return it.it.Close() }
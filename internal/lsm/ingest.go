@@ -0,0 +1,218 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+
+	"kvschool/internal/sstable"
+	"kvschool/internal/vfs"
+)
+
+// TableBuilder строит SSTable в формате движка вне Engine — например, при
+// выгрузке исторических CDR. Готовый файл подключается через Engine.Ingest.
+type TableBuilder struct {
+	w *sstable.Writer
+}
+
+// NewTableBuilder создаёт построитель таблицы поверх открытого на запись файла —
+// *os.File или файла любой vfs.FS.
+func NewTableBuilder(f vfs.File) *TableBuilder {
+	return &TableBuilder{w: sstable.NewWriter(f)}
+}
+
+// Put добавляет значение. Ключи должны идти строго по возрастанию.
+func (b *TableBuilder) Put(key, value []byte) error {
+	return b.w.Add(key, encodeValue(kindValue, value))
+}
+
+// Delete добавляет tombstone: после Ingest ключ будет считаться удалённым.
+func (b *TableBuilder) Delete(key []byte) error {
+	return b.w.Add(key, encodeValue(kindTombstone, nil))
+}
+
+// Finish дописывает таблицу на диск. Файл остаётся открытым.
+func (b *TableBuilder) Finish() error {
+	return b.w.Finish()
+}
+
+// ingestFile — проверенная внешняя таблица.
+type ingestFile struct {
+	path              string
+	smallest, largest []byte
+}
+
+// Ingest подключает готовые SSTable (построенные TableBuilder) к движку, минуя Memtable и WAL.
+// Файлы проверяются (порядок ключей, формат значений) и подключаются в директорию движка
+// жёсткой ссылкой, а если она невозможна (другая ФС) — копией. Ссылка делит содержимое
+// с исходным файлом: после Ingest его можно удалить или переименовать, но не изменять
+// на месте. Данные из более поздних путей считаются более свежими,
+// а все вместе — свежее уже записанных данных. Таблицы попадают в пространство ключей default.
+func (e *Engine) Ingest(paths ...string) error {
+	files := make([]ingestFile, 0, len(paths))
+	for _, path := range paths {
+		f, err := validateExternalTable(e.options.FS, path, e.defaultCF.cmp)
+		if err != nil {
+			return fmt.Errorf("lsm: ingest %s: %w", path, err)
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.readOnlyErr != nil {
+		return e.readOnlyErr
+	}
+	// Таблицы подключаются целиком, минуя запись, и индексы бы отстали от данных.
+	if len(e.indexes) > 0 {
+		return fmt.Errorf("lsm: ingest несовместим со вторичными индексами")
+	}
+
+	// Memtable свежее таблиц, поэтому её нужно сбросить до того, как внешние данные станут ещё свежее.
+	if err := e.flushLocked(); err != nil {
+		return err
+	}
+
+	cf := e.defaultCF
+	level := e.ingestLevel(cf, files)
+	added := make([]*table, 0, len(files))
+	for _, f := range files {
+		num := e.newFileNum()
+		if err := linkOrCopy(e.options.FS, f.path, tablePath(e.options.Dir, num)); err != nil {
+			e.dropIngested(added)
+			return fmt.Errorf("lsm: ingest %s: %w", f.path, err)
+		}
+		t, err := e.openTable(cf, num)
+		if err != nil {
+			_ = e.options.FS.Remove(tablePath(e.options.Dir, num))
+			e.dropIngested(added)
+			return err
+		}
+		added = append(added, t)
+	}
+
+	cf.levels[level] = append(cf.levels[level], added...)
+	if level > 0 {
+		sortByKey(cf.cmp, cf.levels[level])
+	}
+	if err := writeManifest(e.options.FS, e.options.Dir, e.manifest()); err != nil {
+		cf.levels[level] = removeTables(cf.levels[level], added)
+		e.dropIngested(added)
+		return fmt.Errorf("lsm: ingest: %w", err)
+	}
+	e.options.Logger.Printf("lsm: ingest: %d таблиц в L%d", len(added), level)
+	e.maybeScheduleCompaction()
+	return nil
+}
+
+// ingestLevel выбирает уровень для внешних таблиц: самый глубокий, над которым
+// (и на котором) нет пересекающихся данных — тогда таблицы не придётся переписывать compaction.
+// Если файлы пересекаются между собой или идёт compaction, таблицы кладутся в L0.
+func (e *Engine) ingestLevel(cf *columnFamily, files []ingestFile) int {
+	if e.runningCompactions > 0 {
+		return 0
+	}
+	for i := range files {
+		for j := i + 1; j < len(files); j++ {
+			if cf.cmp.Compare(files[i].smallest, files[j].largest) <= 0 &&
+				cf.cmp.Compare(files[j].smallest, files[i].largest) <= 0 {
+				return 0
+			}
+		}
+	}
+	level := 0
+	for l := 0; l < numLevels; l++ {
+		for _, f := range files {
+			for _, t := range cf.levels[l] {
+				if overlapsKeys(cf.cmp, t, f.smallest, f.largest) {
+					return level
+				}
+			}
+		}
+		level = l
+	}
+	return level
+}
+
+func (e *Engine) dropIngested(tables []*table) {
+	for _, t := range tables {
+		e.uncacheTable(t)
+		_ = e.options.FS.Remove(tablePath(e.options.Dir, t.num))
+	}
+}
+
+// validateExternalTable проверяет, что файл — непустая SSTable с верными контрольными суммами,
+// упорядоченными ключами и значениями в формате движка. Файл читается через fs.
+func validateExternalTable(fs vfs.FS, path string, cmp Comparator) (ingestFile, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return ingestFile{}, err
+	}
+	sst := sstable.NewSSTable(f, sstable.DefaultBlockSize)
+	defer sst.Close()
+	sst.SetCompare(cmp.Compare)
+	if err := sst.BuildSparseIndex(); err != nil {
+		return ingestFile{}, err
+	}
+	if err := sst.Verify(); err != nil {
+		return ingestFile{}, err
+	}
+
+	it := sst.Scan(nil, nil)
+	defer it.Close()
+	var prev []byte
+	for {
+		key, raw, ok, err := it.Next()
+		if err != nil {
+			return ingestFile{}, err
+		}
+		if !ok {
+			break
+		}
+		if prev != nil && cmp.Compare(key, prev) <= 0 {
+			return ingestFile{}, sstable.ErrOutOfOrder
+		}
+		en, err := decodeValue(raw)
+		if err != nil {
+			return ingestFile{}, err
+		}
+		if en.kind == kindValueRef {
+			// Ссылка ведёт в value log чужого движка.
+			return ingestFile{}, fmt.Errorf("ключ %q: ссылка на value log", key)
+		}
+		prev = key
+	}
+	if prev == nil {
+		return ingestFile{}, fmt.Errorf("пустая таблица")
+	}
+	return ingestFile{path: path, smallest: sst.Smallest(), largest: sst.Largest()}, nil
+}
+
+// linkOrCopy делает жёсткую ссылку на файл, а если это невозможно (другая ФС) — копию.
+func linkOrCopy(fs vfs.FS, src, dst string) error {
+	if err := fs.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = fs.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		_ = fs.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
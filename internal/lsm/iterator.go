@@ -0,0 +1,130 @@
+package lsm
+
+import (
+	"container/heap"
+
+	"kvschool/internal/skiplist"
+)
+
+// mergingIterator склеивает несколько упорядоченных источников в один поток.
+// Источники передаются от самого свежего к самому старому: при совпадении
+// ключей побеждает более свежий, остальные версии пропускаются.
+//
+// Если задан collapse, а самая свежая версия — операнды Merge, итератор собирает все версии
+// ключа (от свежей к старой) и отдаёт вместо них результат collapse.
+type mergingIterator struct {
+	sources  []skiplist.Iterator
+	cmp      Comparator
+	h        mergeHeap
+	started  bool
+	err      error
+	collapse func(key []byte, versions [][]byte) ([]byte, error)
+}
+
+type mergeItem struct {
+	key, value []byte
+	src        int
+}
+
+type mergeHeap struct {
+	items []mergeItem
+	cmp   Comparator
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := h.cmp.Compare(h.items[i].key, h.items[j].key); c != 0 {
+		return c < 0
+	}
+	return h.items[i].src < h.items[j].src
+}
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap) Push(x any)    { h.items = append(h.items, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	old := h.items
+	x := old[len(old)-1]
+	h.items = old[:len(old)-1]
+	return x
+}
+
+func newMergingIterator(cmp Comparator, sources []skiplist.Iterator) *mergingIterator {
+	return &mergingIterator{sources: sources, cmp: cmp, h: mergeHeap{cmp: cmp}}
+}
+
+func (m *mergingIterator) advance(src int) error {
+	k, v, ok, err := m.sources[src].Next()
+	if err != nil {
+		return err
+	}
+	if ok {
+		heap.Push(&m.h, mergeItem{key: k, value: v, src: src})
+	}
+	return nil
+}
+
+// Next возвращает следующий ключ и его самое свежее (закодированное) значение.
+func (m *mergingIterator) Next() (key, value []byte, ok bool, err error) {
+	if m.err != nil {
+		return nil, nil, false, m.err
+	}
+	if !m.started {
+		m.started = true
+		for i := range m.sources {
+			if err := m.advance(i); err != nil {
+				m.err = err
+				return nil, nil, false, err
+			}
+		}
+	}
+	if m.h.Len() == 0 {
+		return nil, nil, false, nil
+	}
+
+	top := heap.Pop(&m.h).(mergeItem)
+	if err := m.advance(top.src); err != nil {
+		m.err = err
+		return nil, nil, false, err
+	}
+	merging := m.collapse != nil && len(top.value) > 0 && valueKind(top.value[0]) == kindMerge
+	var versions [][]byte
+	if merging {
+		versions = append(versions, top.value)
+	}
+	// Более старые версии того же ключа лежат в куче следом — выбрасываем их
+	// (или собираем для collapse).
+	for m.h.Len() > 0 && m.cmp.Compare(m.h.items[0].key, top.key) == 0 {
+		old := heap.Pop(&m.h).(mergeItem)
+		if merging {
+			versions = append(versions, old.value)
+		}
+		if err := m.advance(old.src); err != nil {
+			m.err = err
+			return nil, nil, false, err
+		}
+	}
+	if merging {
+		v, err := m.collapse(top.key, versions)
+		if err != nil {
+			m.err = err
+			return nil, nil, false, err
+		}
+		return top.key, v, true, nil
+	}
+	return top.key, top.value, true, nil
+}
+
+func (m *mergingIterator) Close() error {
+	m.h.items = nil
+	return closeIterators(m.sources)
+}
+
+// closeIterators закрывает все итераторы и возвращает первую ошибку.
+func closeIterators(its []skiplist.Iterator) error {
+	var firstErr error
+	for _, it := range its {
+		if err := it.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -1,110 +1,1151 @@
 package lsm
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"kvschool/internal/skiplist"
 	"kvschool/internal/sstable"
+	"kvschool/internal/vfs"
 	"kvschool/internal/wal"
-	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 )
 
 // ErrNotImplemented используется в заготовке практики второго дня.
 var ErrNotImplemented = errors.New("lsm: функция не реализована")
 
-// Options задаёт параметры LSM движка.
-type Options struct {
-	Dir string // Директория для хранения WAL и SSTables
+// ErrNotFound означает, что ключ отсутствует (или удалён).
+var ErrNotFound = errors.New("lsm: ключ не найден")
 
-	// Максимальный размер Memtable перед сбросом на диск (Flush).
-	// В телекоме это баланс между памятью и частотой I/O.
-	MemtableFlushThreshold int
-}
+// ErrEmptyKey возвращается для пустого ключа: формат SSTable его не допускает.
+var ErrEmptyKey = errors.New("lsm: пустой ключ")
+
+// ErrReadOnly возвращается на запись после сбоя, при котором состояние в памяти
+// могло разойтись с диском: ошибка записи в WAL или в MANIFEST. Чтения продолжают работать,
+// а для восстановления движок нужно переоткрыть.
+var ErrReadOnly = errors.New("lsm: движок переведён в режим только для чтения")
 
 // Engine — основной движок CDR Storage.
 // Координирует работу Memtable, WAL и SSTables.
-// Отвечает за Compaction (сборку мусора).
+// Отвечает за Compaction (сборку мусора), которая выполняется в фоне.
+// Методы Engine можно вызывать из нескольких горутин.
 type Engine struct {
-	options  Options
-	memtable *skiplist.SkipList
-	wal      *wal.Writer
-	walFile  *os.File
-	sstCount int
-	memSize  int
+	// mu защищает все поля ниже; фоновая compaction отпускает его на время слияния.
+	mu sync.Mutex
+
+	options Options
+	wal     *wal.Writer
+	walFile vfs.File
+	// walDirty — в текущий сегмент WAL писали после последнего fsync.
+	walDirty bool
+	// lastSeq — номер последней записи WAL (см. GetUpdatesSince); walSeqMarked — в текущий
+	// сегмент уже записан OpSequence.
+	lastSeq      uint64
+	walSeqMarked bool
+	// walAppended закрывается при следующей записи в WAL и будит подписчиков Watch;
+	// nil — подписчиков, ожидающих записи, нет.
+	walAppended chan struct{}
+	// syncedSeq — последняя запись, которая уже на диске (fsync WAL или Flush);
+	// walSyncing — идёт групповой fsync, его окончания ждут на walSynced (см. SyncWrites).
+	syncedSeq  uint64
+	walSyncing bool
+	walSynced  *sync.Cond
+
+	// cfs — пространства ключей, индекс совпадает с id; cfs[0] — default.
+	// defaultCF не меняется после Open и читается без блокировки.
+	cfs       []*columnFamily
+	defaultCF *columnFamily
+	// memSize — суммарный объём Memtable всех пространств: WAL общий, и Flush тоже общий.
+	memSize int
+
+	// logNum — текущий сегмент WAL; minLogNum — самый старый сегмент, ещё не сброшенный в SSTable.
+	logNum    uint64
+	minLogNum uint64
+	// walPool — отработавшие сегменты WAL, ждущие повторного использования (см. WALRecycleCount);
+	// walCreated — время создания последнего сегмента.
+	walPool    []uint64
+	walCreated time.Time
+
+	// vlog — value log длинных значений (см. ValueLogThreshold).
+	vlog valueLog
+
+	nextFileNum uint64
+
+	stats engineStats
+
+	// now — источник времени для TTL, Options.Clock; подменяется в тестах.
+	now func() time.Time
+
+	// Фоновый планировщик compaction.
+	compactCh          chan struct{}
+	closing            chan struct{}
+	bgWG               sync.WaitGroup
+	compactionDone     *sync.Cond
+	runningCompactions int
+	manualCompaction   bool
+	closed             bool
+
+	// rateLimiter ограничивает запись SSTable (nil — без ограничения).
+	rateLimiter *RateLimiter
+
+	// indexes — вторичные индексы по значениям пространства default.
+	indexes []*secondaryIndex
+
+	// tableCache — открытые файлы SSTable.
+	tableCache *tableCache
+
+	// locks — блокировки ключей пессимистических транзакций.
+	locks     *lockManager
+	nextTxnID uint64
+
+	// walRecovery — итог восстановления WAL при Open.
+	walRecovery WALRecoveryReport
+
+	// readOnlyErr — причина перехода в режим только для чтения (nil в обычном режиме).
+	readOnlyErr error
+}
+
+// table — открытая SSTable вместе с её номером файла.
+type table struct {
+	num  uint64
+	size int64
+	cmp  Comparator
+
+	// sst — открытая таблица или nil, если tableCache закрыл её файл; читать через e.reader.
+	sst  *sstable.SSTable
+	elem *list.Element // позиция в tableCache.lru
+
+	// smallestKey и largestKey — диапазон ключей таблицы.
+	smallestKey, largestKey []byte
+
+	// compacting — таблица участвует в выполняющейся compaction.
+	compacting bool
+
+	// refs — число открытых итераторов Scan, читающих таблицу. Таблицу, выведенную
+	// compaction (obsolete), закрывает и удаляет последний из них.
+	refs     int
+	obsolete bool
+
+	// entries и tombstones — счётчики из блока свойств таблицы.
+	entries    uint64
+	tombstones uint64
+	// maxTimestamp — момент (наносекунды Unix), не позже которого сделаны все записи таблицы;
+	// 0 — неизвестно (таблица записана до появления свойства или внешняя).
+	maxTimestamp int64
+	// valueLogs — файлы value log, на которые ссылаются значения таблицы.
+	valueLogs []uint64
+	// prefixFilter — фильтр префиксов ключей (nil, если таблица записана без него).
+	prefixFilter *prefixFilter
+}
+
+func (t *table) smallest() []byte { return t.smallestKey }
+func (t *table) largest() []byte  { return t.largestKey }
+
+// openTable открывает существующую таблицу и помещает её в кэш таблиц.
+func (e *Engine) openTable(cf *columnFamily, num uint64) (*table, error) {
+	sst, size, err := e.openReader(cf.cmp, num)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{num: num, sst: sst, size: size}
+	t.init(cf)
+	e.cacheTable(t)
+	return t, nil
+}
+
+// init запоминает то, что нужно о таблице без открытого файла: компаратор,
+// диапазон ключей и свойства.
+func (t *table) init(cf *columnFamily) {
+	t.cmp = cf.cmp
+	t.smallestKey, t.largestKey = t.sst.Smallest(), t.sst.Largest()
+	t.loadProperties()
 }
 
-func Open(opts Options) (*Engine, error) {
-	_ = os.MkdirAll(opts.Dir, 0755)
+// Open открывает (или создаёт) движок в opts.Dir.
+// Функциональные опции применяются поверх opts.
+func Open(opts Options, optFns ...Option) (*Engine, error) {
+	opts, err := opts.withDefaults(optFns...)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.FS.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("lsm: создание директории: %w", err)
+	}
+	if opts.WALArchiveDir != "" {
+		if err := opts.FS.MkdirAll(opts.WALArchiveDir, 0755); err != nil {
+			return nil, fmt.Errorf("lsm: создание архива WAL: %w", err)
+		}
+	}
 
 	e := &Engine{
-		options:  opts,
-		memtable: skiplist.New(1),
+		options:    opts,
+		defaultCF:  newColumnFamily(0, DefaultColumnFamilyName, opts.Comparator),
+		now:        opts.Clock,
+		compactCh:  make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		locks:      newLockManager(),
+		tableCache: newTableCache(opts.MaxOpenFiles),
+	}
+	e.cfs = []*columnFamily{e.defaultCF}
+	if opts.RateLimitBytesPerSec > 0 {
+		e.rateLimiter = NewRateLimiter(opts.RateLimitBytesPerSec)
 	}
+	e.compactionDone = sync.NewCond(&e.mu)
+	e.walSynced = sync.NewCond(&e.mu)
 
-	walPath := filepath.Join(opts.Dir, "wal.log")
+	m, err := readManifest(opts.FS, opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if name := m.Comparator; name != "" || len(m.Tables) > 0 {
+		if name == "" {
+			name = BytewiseComparator.Name()
+		}
+		if name != opts.Comparator.Name() {
+			return nil, fmt.Errorf("%w: база упорядочена компаратором %q, а задан %q",
+				ErrInvalidOptions, name, opts.Comparator.Name())
+		}
+	}
+	e.nextFileNum = m.NextFileNum
+	e.lastSeq = m.LastSequence
+	for _, mcf := range m.ColumnFamilies {
+		if mcf.ID != uint32(len(e.cfs)) {
+			return nil, fmt.Errorf("lsm: некорректный id %d у пространства ключей %q", mcf.ID, mcf.Name)
+		}
+		cf := newColumnFamily(mcf.ID, mcf.Name, e.comparatorFor(mcf.Name))
+		cf.building = mcf.Building
+		e.cfs = append(e.cfs, cf)
+	}
+	for _, mt := range m.Tables {
+		if mt.Level < 0 || mt.Level >= numLevels || int(mt.CF) >= len(e.cfs) {
+			e.closeTables()
+			return nil, fmt.Errorf("lsm: некорректное место таблицы %d: пространство %d, уровень %d", mt.Num, mt.CF, mt.Level)
+		}
+		cf := e.cfs[mt.CF]
+		t, err := e.openTable(cf, mt.Num)
+		if err != nil {
+			e.closeTables()
+			return nil, err
+		}
+		cf.levels[mt.Level] = append(cf.levels[mt.Level], t)
+	}
+	for _, cf := range e.cfs {
+		sort.Slice(cf.levels[0], func(i, j int) bool { return cf.levels[0][i].num < cf.levels[0][j].num })
+		for level := 1; level < numLevels; level++ {
+			sortByKey(cf.cmp, cf.levels[level])
+		}
+	}
 
-	if f, err := os.Open(walPath); err == nil {
-		reader := wal.NewReader(f)
-		for {
-			rec, ok, _ := reader.Next()
-			if !ok {
-				break
+	logs, err := listWALs(opts.FS, opts.Dir)
+	if err != nil {
+		e.closeTables()
+		return nil, err
+	}
+	// Номер файла value log совпадает с номером его сегмента WAL, а сегмент мог быть
+	// уже удалён: новые номера не должны совпасть и с ним.
+	vlogs, err := listValueLogs(opts.FS, opts.Dir)
+	if err != nil {
+		e.closeTables()
+		return nil, err
+	}
+	if len(vlogs) > 0 && vlogs[len(vlogs)-1] >= e.nextFileNum {
+		e.nextFileNum = vlogs[len(vlogs)-1] + 1
+	}
+	e.minLogNum = m.LogNum
+	for i, num := range logs {
+		if num >= e.nextFileNum {
+			e.nextFileNum = num + 1
+		}
+		if num < m.LogNum {
+			// Сегмент уже сброшен в SSTable, но не был удалён до сбоя.
+			if err := e.retireWAL(num); err != nil {
+				e.closeTables()
+				return nil, fmt.Errorf("lsm: удаление старого WAL: %w", err)
 			}
-			if rec.Type == wal.OpPut {
-				e.memtable.Put(rec.Key, rec.Value)
-			} else {
-				e.memtable.Delete(rec.Key)
+			continue
+		}
+		if err := e.replayWAL(num, i == len(logs)-1); err != nil {
+			e.closeTables()
+			e.closeValueLogReaders()
+			return nil, err
+		}
+	}
+	// Всё восстановленное уже лежит на диске.
+	e.syncedSeq = e.lastSeq
+	if err := e.rotateWAL(); err != nil {
+		e.closeTables()
+		e.closeValueLogReaders()
+		return nil, fmt.Errorf("lsm: создание WAL: %w", err)
+	}
+	if err := e.removeObsoleteValueLogs(); err != nil {
+		e.options.Logger.Printf("lsm: удаление старых value log: %v", err)
+	}
+
+	e.bgWG.Add(1)
+	go e.compactionLoop()
+	e.maybeScheduleCompaction()
+	if opts.WALSyncInterval > 0 {
+		e.bgWG.Add(1)
+		go e.walSyncLoop()
+	}
+	if opts.Retention > 0 {
+		e.bgWG.Add(1)
+		go e.retentionLoop()
+	}
+
+	if err := e.openIndexes(); err != nil {
+		_ = e.Close()
+		return nil, err
+	}
+	if err := e.publishExpvar(); err != nil {
+		_ = e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// applyRecord применяет к Memtable запись WAL (пакет — целиком).
+func (e *Engine) applyRecord(rec wal.Record) error {
+	if rec.Type == wal.OpBatch {
+		recs, err := wal.DecodeBatch(rec.Value)
+		if err != nil {
+			return err
+		}
+		// Пакет проверяется целиком до применения, чтобы не применить его наполовину.
+		for _, r := range recs {
+			if err := e.checkRecord(r); err != nil {
+				return err
+			}
+		}
+		for _, r := range recs {
+			if err := e.applyRecord(r); err != nil {
+				return err
 			}
 		}
-		f.Close()
+		return nil
+	}
+
+	if err := e.checkRecord(rec); err != nil {
+		return err
+	}
+	cf := e.cfs[rec.ColumnFamily]
+	var raw []byte
+	switch rec.Type {
+	case wal.OpPut:
+		raw = encodeValue(kindValue, rec.Value)
+	case wal.OpPutTTL:
+		raw = encodeValueTTL(rec.Value, rec.ExpiresAt)
+	case wal.OpPutRef:
+		raw = encodeValue(kindValueRef, rec.Value)
+	case wal.OpMerge:
+		var err error
+		if raw, err = e.memtableMerge(cf, rec.Key, rec.Value); err != nil {
+			return err
+		}
+	default:
+		raw = encodeValue(kindTombstone, nil)
+	}
+	return e.apply(cf, rec.Key, raw)
+}
+
+// walCompressionMinSize — с какой длины сжимаются значения при WALCompression:
+// в коротких значениях почти нет повторов, и сжатие их не укорачивает.
+const walCompressionMinSize = 64
+
+// rotateWAL начинает новый сегмент WAL: каждая Memtable пишет в свой сегмент,
+// а старый удаляется только после успешного Flush.
+func (e *Engine) rotateWAL() error {
+	if err := e.closeValueLog(); err != nil {
+		return err
+	}
+	num := e.newFileNum()
+	// Время создания входит в контрольные суммы записей повторно используемого сегмента
+	// и не должно повторяться, даже если часы стоят.
+	created := e.now()
+	if !created.After(e.walCreated) {
+		created = e.walCreated.Add(time.Nanosecond)
+	}
+	var f vfs.File
+	var w *wal.Writer
+	var err error
+	if len(e.walPool) > 0 {
+		f, w, err = e.recycleWAL(num, created)
+	} else {
+		f, w, err = e.createWAL(num, created)
 	}
-	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	e.walCreated = created
+	if e.walFile != nil {
+		if err := e.walFile.Close(); err != nil {
+			e.options.Logger.Printf("lsm: закрытие WAL %d: %v", e.logNum, err)
+		}
+		old := e.wal.Stats()
+		r := &e.stats.retiredWAL
+		r.Records += old.Records
+		r.Bytes += old.Bytes
+		r.Flushes += old.Flushes
+		r.Syncs += old.Syncs
 	}
 	e.walFile = f
-	e.wal = wal.NewWriter(f)
+	e.wal = w
+	e.walDirty = false
+	e.walSeqMarked = false
+	rotated := WALRotateInfo{OldLogNum: e.logNum, NewLogNum: num}
+	e.logNum = num
+	e.notify(func(l EventListener) { l.OnWALRotate(rotated) })
+	return nil
+}
 
-	return e, nil
+// createWAL создаёт сегмент WAL num и пишет его заголовок.
+func (e *Engine) createWAL(num uint64, created time.Time) (vfs.File, *wal.Writer, error) {
+	path := walPath(e.options.Dir, num)
+	f, err := e.options.FS.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if size := e.options.WALPreallocateSize; size > 0 {
+		if err := e.options.FS.Truncate(path, size); err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+	}
+	w := e.newWALWriter(f)
+	if err := w.WriteHeader(created); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, w, nil
+}
+
+// recycleWAL пишет сегмент WAL num поверх отработавшего сегмента из walPool. Заголовок
+// записывается на диск до переименования: после сбоя под новым номером не может
+// оказаться старый сегмент, записи которого уже в SSTable.
+func (e *Engine) recycleWAL(num uint64, created time.Time) (vfs.File, *wal.Writer, error) {
+	old := e.walPool[len(e.walPool)-1]
+	oldPath := walPath(e.options.Dir, old)
+	f, err := e.options.FS.OpenWrite(oldPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := e.newWALWriter(f)
+	if err := w.WriteRecycledHeader(created); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	if err := w.Sync(); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	if err := e.options.FS.Rename(oldPath, walPath(e.options.Dir, num)); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	e.walPool = e.walPool[:len(e.walPool)-1]
+	return f, w, nil
+}
+
+func (e *Engine) newWALWriter(f vfs.File) *wal.Writer {
+	w := wal.NewWriter(f)
+	if e.options.WALCompression {
+		w.SetCompression(walCompressionMinSize)
+	}
+	return w
+}
+
+// removeObsoleteWALs удаляет (или архивирует) сегменты WAL, данные которых уже лежат в SSTable.
+func (e *Engine) removeObsoleteWALs() error {
+	logs, err := listWALs(e.options.FS, e.options.Dir)
+	if err != nil {
+		return err
+	}
+	for _, num := range logs {
+		if num >= e.minLogNum {
+			break
+		}
+		if slices.Contains(e.walPool, num) {
+			continue
+		}
+		if err := e.retireWAL(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retireWAL удаляет сегмент WAL, данные которого уже в SSTable, отдаёт его в архив
+// (см. WALArchiveDir, WALArchiveFunc) или оставляет для повторного использования (WALRecycleCount).
+func (e *Engine) retireWAL(num uint64) error {
+	path := walPath(e.options.Dir, num)
+	switch {
+	case len(e.walPool) < e.options.WALRecycleCount:
+		e.walPool = append(e.walPool, num)
+		return nil
+	case e.options.WALArchiveFunc != nil:
+		return e.options.WALArchiveFunc(path)
+	case e.options.WALArchiveDir != "":
+		return e.options.FS.Rename(path, filepath.Join(e.options.WALArchiveDir, filepath.Base(path)))
+	}
+	return e.options.FS.Remove(path)
+}
+
+// resetMemtables очищает Memtable всех пространств.
+func (e *Engine) resetMemtables() {
+	for _, cf := range e.cfs {
+		cf.resetMemtable()
+		cf.memSize = 0
+	}
+	e.memSize = 0
+}
+
+// apply кладёт закодированное значение в Memtable пространства и учитывает его размер.
+func (e *Engine) apply(cf *columnFamily, key, raw []byte) error {
+	n := len(key) + len(raw)
+	cf.memSize += n
+	e.memSize += n
+	return cf.memtable.Put(key, raw)
+}
+
+// setReadOnly переводит движок в режим только для чтения и возвращает ошибку для вызывающего.
+// Вызывается под e.mu.
+func (e *Engine) setReadOnly(cause error) error {
+	if e.readOnlyErr == nil {
+		e.readOnlyErr = fmt.Errorf("%w: %w", ErrReadOnly, cause)
+		e.options.Logger.Printf("%v", e.readOnlyErr)
+	}
+	return e.readOnlyErr
+}
+
+// writeLocked — общий путь записи: WAL, затем Memtable, затем Flush при переполнении.
+// Вызывается под e.mu.
+// ctx ограничивает только ожидание при переполнении L0: начатая запись в WAL не прерывается.
+func (e *Engine) writeLocked(ctx context.Context, cf *columnFamily, rec wal.Record, raw []byte) error {
+	if e.closed {
+		return ErrClosed
+	}
+	if e.readOnlyErr != nil {
+		return e.readOnlyErr
+	}
+	if err := e.stallLocked(ctx); err != nil {
+		return err
+	}
+	rec.ColumnFamily = cf.id
+	if cf == e.defaultCF && len(e.indexes) > 0 {
+		recs, err := e.withIndexRecords([]wal.Record{rec})
+		if err != nil {
+			return err
+		}
+		return e.commitBatchLocked(recs)
+	}
+	if n := e.options.ValueLogThreshold; n > 0 && rec.Type == wal.OpPut && len(rec.Value) >= n {
+		ref, err := e.writeValueLog(rec.Value)
+		if err != nil {
+			return err
+		}
+		rec.Type, rec.Value = wal.OpPutRef, ref
+		raw = encodeValue(kindValueRef, ref)
+	}
+	if err := e.appendWAL(rec); err != nil {
+		return err
+	}
+	seq := e.lastSeq
+	if err := e.apply(cf, rec.Key, raw); err != nil {
+		return err
+	}
+	if err := e.maybeFlushLocked(); err != nil {
+		return err
+	}
+	return e.waitWALSyncLocked(seq)
+}
+
+// writeBatchLocked атомарно записывает несколько операций одной записью WAL:
+// после сбоя восстанавливаются либо все, либо ни одной. Вызывается под e.mu.
+func (e *Engine) writeBatchLocked(ctx context.Context, recs []wal.Record) error {
+	if e.closed {
+		return ErrClosed
+	}
+	if e.readOnlyErr != nil {
+		return e.readOnlyErr
+	}
+	if err := e.stallLocked(ctx); err != nil {
+		return err
+	}
+	recs, err := e.withIndexRecords(recs)
+	if err != nil {
+		return err
+	}
+	return e.commitBatchLocked(recs)
+}
+
+// commitBatchLocked пишет пакет в WAL и применяет его к Memtable. Вызывается под e.mu.
+func (e *Engine) commitBatchLocked(recs []wal.Record) error {
+	batch, err := wal.EncodeBatch(recs)
+	if err != nil {
+		return err
+	}
+	if err := e.appendWAL(wal.Record{Type: wal.OpBatch, Value: batch}); err != nil {
+		return err
+	}
+	seq := e.lastSeq
+	for _, rec := range recs {
+		if err := e.applyRecord(rec); err != nil {
+			// Пакет уже в WAL, а в Memtable применён частично.
+			return e.setReadOnly(fmt.Errorf("lsm: применение пакета: %w", err))
+		}
+	}
+	if err := e.maybeFlushLocked(); err != nil {
+		return err
+	}
+	return e.waitWALSyncLocked(seq)
+}
+
+// appendWAL пишет запись в WAL и присваивает ей следующий номер. Первой записи сегмента
+// предшествует OpSequence, чтобы номера восстанавливались по самому сегменту.
+// Вызывается под e.mu.
+func (e *Engine) appendWAL(rec wal.Record) error {
+	recs := []wal.Record{rec}
+	if !e.walSeqMarked {
+		recs = []wal.Record{wal.SequenceRecord(e.lastSeq + 1), rec}
+	}
+	if _, err := e.wal.AppendBatch(recs, false); err != nil {
+		// Хвост WAL мог остаться недописанным: продолжать писать после него нельзя.
+		return e.setReadOnly(fmt.Errorf("lsm: запись в WAL: %w", err))
+	}
+	e.walSeqMarked = true
+	e.walDirty = true
+	e.lastSeq++
+	if e.walAppended != nil {
+		close(e.walAppended)
+		e.walAppended = nil
+	}
+	return nil
+}
+
+// waitWALSyncLocked при SyncWrites ждёт, пока запись seq окажется на диске (групповая
+// фиксация). Первый ожидающий становится ведущим и делает fsync без e.mu; записи,
+// дописанные за это время, ждут его окончания и следующий fsync делают одним на всех.
+// Вызывается под e.mu после применения записи к Memtable.
+func (e *Engine) waitWALSyncLocked(seq uint64) error {
+	if !e.options.SyncWrites {
+		return nil
+	}
+	for e.syncedSeq < seq {
+		if e.readOnlyErr != nil {
+			return e.readOnlyErr
+		}
+		if e.walSyncing {
+			e.walSynced.Wait()
+			continue
+		}
+		e.walSyncing = true
+		f, vf, target := e.walFile, e.vlog.f, e.lastSeq
+		e.mu.Unlock()
+		err := syncWALFiles(vf, f)
+		e.mu.Lock()
+		e.walSyncing = false
+		e.walSynced.Broadcast()
+		if f != e.walFile {
+			// Пока шёл fsync, Flush сменил сегмент: его записи уже в SSTable
+			// (syncedSeq продвинут) или движок перешёл в режим только для чтения.
+			continue
+		}
+		if err != nil {
+			return e.setReadOnly(fmt.Errorf("lsm: fsync WAL: %w", err))
+		}
+		e.stats.walSyncs++
+		e.syncedSeq = max(e.syncedSeq, target)
+		if e.syncedSeq == e.lastSeq {
+			e.walDirty = false
+		}
+	}
+	return nil
+}
+
+// maybeFlushLocked сбрасывает Memtable, если она переполнена. Вызывается под e.mu после записи.
+func (e *Engine) maybeFlushLocked() error {
+	if e.memSize >= e.options.MemtableFlushThreshold {
+		if err := e.flushLocked(); err != nil {
+			return fmt.Errorf("lsm: flush после записи (сама запись сохранена в WAL): %w", err)
+		}
+	}
+	return nil
 }
 
 func (e *Engine) Put(key, value []byte) error {
-	_ = e.wal.Append(wal.Record{Type: wal.OpPut, Key: key, Value: value})
-	e.memSize += len(key) + len(value)
-	err := e.memtable.Put(key, value)
+	return e.put(context.Background(), e.defaultCF, key, value)
+}
 
-	if e.options.MemtableFlushThreshold > 0 && e.memSize >= e.options.MemtableFlushThreshold {
-		_ = e.Flush()
-		e.memSize = 0
+// PutContext — Put, ожидание которого при остановке записи (см. L0StopWritesTrigger)
+// прерывается отменой ctx.
+func (e *Engine) PutContext(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	return e.put(ctx, e.defaultCF, key, value)
+}
 
-	return err
+func (e *Engine) put(ctx context.Context, cf *columnFamily, key, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.puts++
+	return e.writeLocked(ctx, cf, wal.Record{Type: wal.OpPut, Key: key, Value: value}, encodeValue(kindValue, value))
+}
+
+// PutWithTTL записывает значение, которое перестаёт быть видимым через ttl.
+// Истёкшие ключи читаются как отсутствующие, а compaction удаляет их с диска —
+// так CDR стареют автоматически в соответствии со сроками хранения.
+func (e *Engine) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return e.putWithTTL(e.defaultCF, key, value, ttl)
+}
+
+func (e *Engine) putWithTTL(cf *columnFamily, key, value []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("lsm: некорректный ttl %v", ttl)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.puts++
+	expiresAt := e.now().Add(ttl).UnixNano()
+	rec := wal.Record{Type: wal.OpPutTTL, Key: key, Value: value, ExpiresAt: expiresAt}
+	return e.writeLocked(context.Background(), cf, rec, encodeValueTTL(value, expiresAt))
+}
+
+// Get ищет ключ: сначала в Memtable, затем в L0 от свежих таблиц к старым, затем по уровням.
+func (e *Engine) Get(key []byte) ([]byte, error) { return e.get(e.defaultCF, key) }
+
+// GetContext — Get, который не начинается, если ctx уже отменён.
+func (e *Engine) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return e.get(e.defaultCF, key)
+}
+
+func (e *Engine) get(cf *columnFamily, key []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.gets++
+	return e.getLocked(cf, key)
 }
 
-func (e *Engine) Get(key []byte) ([]byte, error) {
-	return e.memtable.Get(key)
+// getLocked — Get без учёта в статистике. Вызывается под e.mu.
+func (e *Engine) getLocked(cf *columnFamily, key []byte) ([]byte, error) {
+	var l lookup
+	if err := e.forEachVersion(cf, key, l.add); err != nil {
+		return nil, err
+	}
+	return e.resolve(key, &l, e.now().UnixNano())
 }
 
-func (e *Engine) Flush() error {
-	e.sstCount++
-	path := filepath.Join(e.options.Dir, fmt.Sprintf("data_%d.sst", e.sstCount))
+// lookup собирает версии одного ключа от свежих к старым. Операнды Merge
+// не закрывают старые версии: они копятся, пока не встретится значение или tombstone.
+type lookup struct {
+	merges []entry
+	base   *entry
+}
+
+// add добавляет очередную версию; возвращает false, когда более старые версии уже не нужны.
+func (l *lookup) add(raw []byte) (bool, error) {
+	en, err := decodeValue(raw)
+	if err != nil {
+		return false, err
+	}
+	if en.kind == kindMerge {
+		l.merges = append(l.merges, en)
+		return true, nil
+	}
+	l.base = &en
+	return false, nil
+}
 
-	f, _ := os.Create(path)
-	writer := sstable.NewWriter(f)
-	if err := writer.WriteFromSkipList(e.memtable); err != nil {
+// resolve вычисляет значение ключа по собранным версиям.
+func (e *Engine) resolve(key []byte, l *lookup, now int64) ([]byte, error) {
+	if l.base != nil {
+		base, err := e.loadValue(*l.base)
+		if err != nil {
+			return nil, err
+		}
+		l.base = &base
+	}
+	if len(l.merges) > 0 {
+		var existing []byte
+		if l.base != nil {
+			existing, _ = mergeBase(*l.base, now)
+		}
+		return e.fullMerge(key, existing, l.merges)
+	}
+	if l.base == nil || l.base.kind == kindTombstone || l.base.expired(now) {
+		return nil, ErrNotFound
+	}
+	return l.base.value, nil
+}
+
+// forEachVersion передаёт fn версии key от самой свежей к самой старой:
+// Memtable, L0 от новых таблиц к старым, затем уровни по очереди.
+// Обход прекращается, когда fn возвращает false.
+func (e *Engine) forEachVersion(cf *columnFamily, key []byte, fn func(raw []byte) (bool, error)) error {
+	raw, err := cf.memtable.Get(key)
+	if err == nil {
+		if more, err := fn(raw); err != nil || !more {
+			return err
+		}
+	} else if err != skiplist.ErrNotFound {
 		return err
 	}
-	e.memtable = skiplist.New(1)
-	return e.walFile.Truncate(0)
+
+	for i := len(cf.levels[0]) - 1; i >= 0; i-- {
+		sst, err := e.reader(cf.levels[0][i])
+		if err != nil {
+			return err
+		}
+		raw, ok, err := sst.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if more, err := fn(raw); err != nil || !more {
+				return err
+			}
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		t := findTable(cf.cmp, cf.levels[level], key)
+		if t == nil {
+			continue
+		}
+		sst, err := e.reader(t)
+		if err != nil {
+			return err
+		}
+		raw, ok, err := sst.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if more, err := fn(raw); err != nil || !more {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findTable возвращает таблицу уровня (>= 1), чей диапазон ключей содержит key.
+func findTable(cmp Comparator, tables []*table, key []byte) *table {
+	i := sort.Search(len(tables), func(i int) bool {
+		return cmp.Compare(tables[i].largest(), key) >= 0
+	})
+	if i == len(tables) || cmp.Compare(tables[i].smallest(), key) > 0 {
+		return nil
+	}
+	return tables[i]
+}
+
+func sortByKey(cmp Comparator, tables []*table) {
+	sort.Slice(tables, func(i, j int) bool {
+		return cmp.Compare(tables[i].smallest(), tables[j].smallest()) < 0
+	})
+}
+
+// newTable открывает на чтение только что записанную таблицу.
+// В режиме ParanoidChecks таблица перед установкой целиком перечитывается и проверяется.
+func (e *Engine) newTable(cf *columnFamily, f vfs.File, num uint64, size int64) (*table, error) {
+	t := &table{num: num, sst: sstable.NewSSTable(f, e.options.BlockSize), size: size}
+	t.sst.SetCompare(cf.cmp.Compare)
+	if err := t.sst.BuildSparseIndex(); err != nil {
+		return nil, fmt.Errorf("чтение таблицы %d: %w", num, err)
+	}
+	if e.options.ParanoidChecks {
+		t.sst.SetParanoidChecks(true)
+		if err := t.sst.Verify(); err != nil {
+			return nil, fmt.Errorf("проверка таблицы %d: %w", num, err)
+		}
+	}
+	t.init(cf)
+	return t, nil
+}
+
+// newTableWriter создаёт Writer для новой таблицы движка с общим ограничителем скорости
+// и подсчётом tombstone, фильтром префиксов и временем записи maxTimestamp
+// (наносекунды Unix) в блоке свойств.
+func (e *Engine) newTableWriter(cf *columnFamily, f vfs.File, maxTimestamp int64) *sstable.Writer {
+	w := sstable.NewWriterSize(f, e.options.BlockSize)
+	w.SetCompare(cf.cmp.Compare)
+	if e.rateLimiter != nil {
+		w.SetLimiter(e.rateLimiter)
+	}
+	w.AddPropertyCollector(&tombstoneCollector{})
+	w.AddPropertyCollector(timestampCollector(maxTimestamp))
+	w.AddPropertyCollector(&valueLogCollector{})
+	if e.options.PrefixLength > 0 {
+		w.AddPropertyCollector(&prefixFilterCollector{prefixLen: e.options.PrefixLength})
+	}
+	return w
+}
+
+func (e *Engine) newFileNum() uint64 {
+	n := e.nextFileNum
+	e.nextFileNum++
+	return n
+}
+
+// Flush сбрасывает Memtable всех пространств ключей в новые таблицы L0 и удаляет сегмент WAL.
+// Пустая Memtable не порождает пустых файлов. Возвращает описание созданных таблиц
+// (пусто, если сбрасывать было нечего).
+func (e *Engine) Flush() ([]TableInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var info FlushInfo
+	err := e.flush(&info)
+	return info.Tables, err
+}
+
+// FlushResult — итог Flush, запущенного FlushAsync.
+type FlushResult struct {
+	Tables []TableInfo
+	Err    error
+}
+
+// FlushAsync запускает Flush в фоне. Из канала читается ровно один результат,
+// после чего канал закрывается.
+func (e *Engine) FlushAsync() <-chan FlushResult {
+	ch := make(chan FlushResult, 1)
+	go func() {
+		tables, err := e.Flush()
+		ch <- FlushResult{Tables: tables, Err: err}
+		close(ch)
+	}()
+	return ch
+}
+
+// flushLocked выполняет Flush; вызывается под e.mu.
+// Ошибки до записи MANIFEST не теряют данных: Memtable остаётся в памяти, её сегменты WAL
+// не удаляются, и Flush можно повторить. Ошибка записи MANIFEST переводит движок
+// в режим только для чтения.
+func (e *Engine) flushLocked() error {
+	var info FlushInfo
+	return e.flush(&info)
+}
+
+// flush — flushLocked, заполняющий info. Вызывается под e.mu.
+func (e *Engine) flush(info *FlushInfo) error {
+	if e.memSize == 0 {
+		return nil
+	}
+	if e.readOnlyErr != nil {
+		return e.readOnlyErr
+	}
+	*info = FlushInfo{MemtableBytes: e.memSize}
+	e.notify(func(l EventListener) { l.OnFlushBegin(*info) })
+	start := time.Now()
+	err := e.flushMemtables(info)
+	info.Duration, info.Err = time.Since(start), err
+	e.notify(func(l EventListener) { l.OnFlushEnd(*info) })
+	return err
+}
+
+// flushMemtables — тело Flush; созданные таблицы добавляются в info.
+func (e *Engine) flushMemtables(info *FlushInfo) error {
+	// Новые записи идут уже в следующий сегмент; текущий удалится после успешного Flush.
+	if err := e.rotateWAL(); err != nil {
+		return e.setReadOnly(fmt.Errorf("lsm: flush: создание WAL: %w", err))
+	}
+
+	// Сегмент WAL общий, поэтому удалить его можно, только когда сброшены все пространства.
+	flushed := make([]*table, len(e.cfs))
+	for i, cf := range e.cfs {
+		if cf.memSize == 0 {
+			continue
+		}
+		t, err := e.writeMemtable(cf)
+		if err != nil {
+			for _, t := range flushed {
+				if t != nil {
+					_ = t.sst.Close()
+					_ = e.options.FS.Remove(tablePath(e.options.Dir, t.num))
+				}
+			}
+			return err
+		}
+		flushed[i] = t
+	}
+	for i, t := range flushed {
+		if t == nil {
+			continue
+		}
+		cf := e.cfs[i]
+		cf.levels[0] = append(cf.levels[0], t)
+		e.cacheTable(t)
+		info.Tables = append(info.Tables, e.tableInfos(cf, 0, []*table{t})...)
+		e.stats.bytesWritten += uint64(t.size)
+	}
+	e.stats.flushes++
+	e.minLogNum = e.logNum
+	if err := writeManifest(e.options.FS, e.options.Dir, e.manifest()); err != nil {
+		// Таблицы уже видны в памяти, а на диске их нет в MANIFEST.
+		return e.setReadOnly(fmt.Errorf("lsm: flush: %w", err))
+	}
+	// Записи старого сегмента теперь в SSTable: ждать их fsync больше не нужно.
+	e.syncedSeq = e.lastSeq
+	e.resetMemtables()
+	// Отметка для replay: всё, что до неё, уже в SSTable, даже если старые сегменты
+	// не удалятся или MANIFEST окажется старее WAL.
+	if _, err := e.wal.AppendSync(wal.CheckpointRecord(e.lastSeq), e.options.SyncWrites); err != nil {
+		return e.setReadOnly(fmt.Errorf("lsm: flush: запись в WAL: %w", err))
+	}
+	e.walDirty = !e.options.SyncWrites
+	if err := e.removeObsoleteWALs(); err != nil {
+		// Лишние сегменты безопасны: при Open они будут пропущены и удалены.
+		e.options.Logger.Printf("lsm: удаление старых WAL: %v", err)
+	}
+	if err := e.removeObsoleteValueLogs(); err != nil {
+		e.options.Logger.Printf("lsm: удаление старых value log: %v", err)
+	}
+	e.maybeScheduleCompaction()
+	return nil
+}
+
+// writeMemtable записывает Memtable пространства в новую таблицу.
+func (e *Engine) writeMemtable(cf *columnFamily) (*table, error) {
+	num := e.newFileNum()
+	path := tablePath(e.options.Dir, num)
+
+	f, err := e.options.FS.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("lsm: flush: %w", err)
+	}
+	// Всё в Memtable записано не позже, чем сейчас.
+	writer := e.newTableWriter(cf, f, e.now().UnixNano())
+	if err := writer.WriteFromSkipList(cf.memtable); err != nil {
+		_ = f.Close()
+		_ = e.options.FS.Remove(path)
+		return nil, fmt.Errorf("lsm: flush: запись %s: %w", path, err)
+	}
+	t, err := e.newTable(cf, f, num, writer.Size())
+	if err != nil {
+		_ = f.Close()
+		_ = e.options.FS.Remove(path)
+		return nil, fmt.Errorf("lsm: flush: %w", err)
+	}
+	e.options.Logger.Printf("lsm: flush %s -> таблица %d (%d записей, %d байт)", cf.name, num, writer.Count(), t.size)
+	return t, nil
+}
+
+// manifest собирает описание текущего набора таблиц.
+func (e *Engine) manifest() manifest {
+	m := manifest{
+		NextFileNum:  e.nextFileNum,
+		LogNum:       e.minLogNum,
+		LastSequence: e.lastSeq,
+		Comparator:   e.options.Comparator.Name(),
+	}
+	for _, cf := range e.cfs {
+		if cf != e.defaultCF {
+			m.ColumnFamilies = append(m.ColumnFamilies, manifestColumnFamily{ID: cf.id, Name: cf.name, Building: cf.building})
+		}
+		for level, tables := range cf.levels {
+			for _, t := range tables {
+				m.Tables = append(m.Tables, manifestTable{Num: t.num, Level: level, CF: cf.id})
+			}
+		}
+	}
+	return m
 }
 
+func (e *Engine) closeTables() {
+	for _, cf := range e.cfs {
+		for level := range cf.levels {
+			for _, t := range cf.levels[level] {
+				e.uncacheTable(t)
+			}
+			cf.levels[level] = nil
+		}
+	}
+}
+
+// dropTable закрывает и удаляет таблицу, выведенную compaction.
+// Если таблицу ещё читают итераторы Scan, это сделает последний из них. Вызывается под e.mu.
+func (e *Engine) dropTable(t *table) {
+	if t.refs > 0 {
+		t.obsolete = true
+		return
+	}
+	e.uncacheTable(t)
+	_ = e.options.FS.Remove(tablePath(e.options.Dir, t.num))
+}
+
+// unrefTable отпускает таблицу, захваченную итератором Scan. Вызывается под e.mu.
+func (e *Engine) unrefTable(t *table) {
+	t.refs--
+	if t.refs == 0 && t.obsolete {
+		e.dropTable(t)
+	}
+}
+
+// Close останавливает фоновую compaction, сбрасывает Memtable и закрывает файлы.
 func (e *Engine) Close() error {
-	_ = e.Flush()
-	return e.walFile.Close()
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	// Будим писателей, ожидающих compaction.
+	e.compactionDone.Broadcast()
+	e.mu.Unlock()
+	e.unpublishExpvar()
+
+	close(e.closing)
+	e.bgWG.Wait()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var flushErr error
+	if e.readOnlyErr == nil {
+		if err := e.flushLocked(); err != nil {
+			flushErr = fmt.Errorf("lsm: close: %w", err)
+		}
+	}
+	e.closeTables()
+	// Порядок остановки: value log, затем WAL, который на него ссылается, — оба с fsync;
+	// файл сегмента закрывается последним.
+	vlogErr := e.closeValueLog()
+	e.closeValueLogReaders()
+	var walErr error
+	if e.readOnlyErr == nil {
+		// В режиме только для чтения хвост WAL мог остаться недописанным: дописывать
+		// и синхронизировать его нельзя.
+		if err := e.wal.Close(); err != nil {
+			walErr = fmt.Errorf("lsm: close: WAL: %w", err)
+		}
+	}
+	return errors.Join(flushErr, vlogErr, walErr, e.walFile.Close())
 }
 
-func (e *Engine) Delete(key []byte) error {
-	_ = e.wal.Append(wal.Record{Type: wal.OpDelete, Key: key})
-	return e.memtable.Delete(key)
+func (e *Engine) Delete(key []byte) error { return e.delete(e.defaultCF, key) }
+
+func (e *Engine) delete(cf *columnFamily, key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.deletes++
+	return e.writeLocked(context.Background(), cf, wal.Record{Type: wal.OpDelete, Key: key}, encodeValue(kindTombstone, nil))
 }
@@ -0,0 +1,3286 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kvschool/internal/sstable"
+	"kvschool/internal/vfs"
+	"kvschool/internal/wal"
+)
+
+func openTestEngine(t *testing.T, dir string) *Engine {
+	t.Helper()
+	e, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return e
+}
+
+// crash останавливает движок без Flush, имитируя падение процесса.
+func crash(e *Engine) {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	close(e.closing)
+	e.bgWG.Wait()
+	_ = e.walFile.Close()
+	if e.vlog.f != nil {
+		_ = e.vlog.f.Close()
+	}
+	e.closeValueLogReaders()
+	e.closeTables()
+}
+
+func TestEngine_GetAfterFlushAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Delete([]byte("a")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	e = openTestEngine(t, dir)
+	defer e.Close()
+
+	if _, err := e.Get([]byte("a")); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for deleted key, got %v", err)
+	}
+	got, err := e.Get([]byte("b"))
+	if err != nil {
+		t.Fatalf("Get b: %v", err)
+	}
+	if string(got) != "2" {
+		t.Fatalf("value mismatch: got=%q want=%q", string(got), "2")
+	}
+}
+
+func TestEngine_CompactRangeDropsTombstones(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := e.Delete([]byte(fmt.Sprintf("k%03d", i))); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+
+	if err := e.CompactRange(nil, []byte("k050")); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+
+	entries := 0
+	for level := range e.defaultCF.levels {
+		for _, tbl := range e.defaultCF.levels[level] {
+			it := tbl.sst.Scan(nil, nil)
+			for {
+				_, _, ok, err := it.Next()
+				if err != nil {
+					t.Fatalf("Next: %v", err)
+				}
+				if !ok {
+					break
+				}
+				entries++
+			}
+		}
+	}
+	if entries != 50 {
+		t.Fatalf("expected 50 live entries on disk, got %d", entries)
+	}
+
+	if _, err := e.Get([]byte("k010")); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for deleted key, got %v", err)
+	}
+	if _, err := e.Get([]byte("k060")); err != nil {
+		t.Fatalf("Get k060: %v", err)
+	}
+}
+
+func TestEngine_Stats(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	_ = e.Put([]byte("a"), []byte("1"))
+	_ = e.Put([]byte("b"), []byte("2"))
+	_ = e.Delete([]byte("a"))
+	_, _ = e.Get([]byte("b"))
+
+	s := e.Stats()
+	if s.Puts != 2 || s.Deletes != 1 || s.Gets != 1 {
+		t.Fatalf("unexpected op counters: %+v", s)
+	}
+	if s.MemtableBytes == 0 || s.WALBytes <= wal.HeaderSize {
+		t.Fatalf("expected non-empty memtable and WAL: %+v", s)
+	}
+
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	s = e.Stats()
+	if s.Flushes != 1 || s.LevelTables[0] != 1 || s.BytesWritten == 0 {
+		t.Fatalf("unexpected stats after flush: %+v", s)
+	}
+	// В новом сегменте только заголовок и отметка OpCheckpoint.
+	var checkpoint bytes.Buffer
+	if _, err := wal.NewWriter(&checkpoint).Append(wal.CheckpointRecord(0)); err != nil {
+		t.Fatal(err)
+	}
+	if s.MemtableBytes != 0 || s.WALBytes != wal.HeaderSize+int64(checkpoint.Len()) {
+		t.Fatalf("expected empty memtable and WAL after flush: %+v", s)
+	}
+}
+
+func TestEngine_PutWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	defer e.Close()
+
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+
+	if err := e.Put([]byte("cdr1"), []byte("old")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.PutWithTTL([]byte("cdr1"), []byte("new"), time.Minute); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+	if err := e.PutWithTTL([]byte("cdr2"), []byte("x"), time.Hour); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+
+	got, err := e.Get([]byte("cdr1"))
+	if err != nil || string(got) != "new" {
+		t.Fatalf("Get before expiry: got=%q err=%v", string(got), err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := e.Get([]byte("cdr1")); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound after expiry, got %v", err)
+	}
+
+	// Истёкшее значение не должно «воскресить» старую версию после compaction.
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	if _, err := e.Get([]byte("cdr1")); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound after compaction, got %v", err)
+	}
+	if got, err := e.Get([]byte("cdr2")); err != nil || string(got) != "x" {
+		t.Fatalf("Get cdr2: got=%q err=%v", string(got), err)
+	}
+}
+
+func TestOpen_ValidatesOptions(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name  string
+		opts  Options
+		extra []Option
+	}{
+		{"no dir", Options{}, nil},
+		{"negative threshold", Options{Dir: dir, MemtableFlushThreshold: -1}, nil},
+		{"tiny block", Options{Dir: dir}, []Option{WithBlockSize(8)}},
+		{"huge block", Options{Dir: dir}, []Option{WithBlockSize(MaxBlockSize + 1)}},
+		{"stop below slowdown", Options{Dir: dir}, []Option{WithL0WriteTriggers(8, 6)}},
+		{"stop below compaction", Options{Dir: dir}, []Option{WithL0WriteTriggers(2, 3)}},
+		{"negative max open files", Options{Dir: dir}, []Option{WithMaxOpenFiles(-1)}},
+		{"negative WAL sync interval", Options{Dir: dir}, []Option{WithWALSyncInterval(-time.Second)}},
+		{"negative retention", Options{Dir: dir}, []Option{WithRetention(-time.Hour)}},
+		{"negative WAL preallocation", Options{Dir: dir}, []Option{WithWALPreallocate(-1)}},
+		{"WAL archive dir and func", Options{Dir: dir}, []Option{WithWALArchive(dir), WithWALArchiveFunc(os.Remove)}},
+		{"negative WAL recycle", Options{Dir: dir}, []Option{WithWALRecycle(-1)}},
+		{"WAL recycle and archive", Options{Dir: dir}, []Option{WithWALRecycle(1), WithWALArchive(dir)}},
+		{"negative value log threshold", Options{Dir: dir}, []Option{WithValueLog(-1)}},
+	}
+	for _, tc := range cases {
+		if _, err := Open(tc.opts, tc.extra...); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("%s: expected ErrInvalidOptions, got %v", tc.name, err)
+		}
+	}
+
+	e, err := Open(Options{Dir: dir}, WithBlockSize(128))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if e.options.BlockSize != 128 || e.options.MemtableFlushThreshold != DefaultMemtableFlushThreshold {
+		t.Fatalf("unexpected effective options: %+v", e.options)
+	}
+}
+
+func TestEngine_WALSegmentPerMemtable(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+
+	_ = e.Put([]byte("a"), []byte("1"))
+	before, err := listWALs(vfs.Default, dir)
+	if err != nil || len(before) != 1 {
+		t.Fatalf("expected one WAL segment, got %v (err=%v)", before, err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	after, _ := listWALs(vfs.Default, dir)
+	if len(after) != 1 || after[0] == before[0] {
+		t.Fatalf("expected flushed segment %d to be replaced, got %v", before[0], after)
+	}
+
+	_ = e.Put([]byte("b"), []byte("2"))
+	crash(e)
+
+	e = openTestEngine(t, dir)
+	defer e.Close()
+	for _, k := range []string{"a", "b"} {
+		if _, err := e.Get([]byte(k)); err != nil {
+			t.Fatalf("Get %s after restart: %v", k, err)
+		}
+	}
+}
+
+func TestEngine_BackgroundCompaction(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	for i := 0; i < l0CompactionTrigger; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().Compactions == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("background compaction did not run: %+v", e.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s := e.Stats()
+	if s.LevelTables[0] != 0 || s.LevelTables[1] != 1 {
+		t.Fatalf("expected L0 merged into a single L1 table: %+v", s)
+	}
+	for i := 0; i < l0CompactionTrigger; i++ {
+		if _, err := e.Get([]byte(fmt.Sprintf("k%d", i))); err != nil {
+			t.Fatalf("Get k%d: %v", i, err)
+		}
+	}
+}
+
+func buildExternalTable(t *testing.T, path string, keys ...string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	b := NewTableBuilder(f)
+	for _, k := range keys {
+		if err := b.Put([]byte(k), []byte("ext-"+k)); err != nil {
+			t.Fatalf("builder Put: %v", err)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatalf("builder Finish: %v", err)
+	}
+}
+
+func TestEngine_Ingest(t *testing.T) {
+	dir := t.TempDir()
+	extDir := t.TempDir()
+	e := openTestEngine(t, dir)
+
+	_ = e.Put([]byte("m"), []byte("old"))
+
+	// Не пересекается ни с чем — должна лечь сразу на последний уровень.
+	far := filepath.Join(extDir, "far.sst")
+	buildExternalTable(t, far, "x1", "x2")
+	// Пересекается с "m" — должна оказаться свежее.
+	near := filepath.Join(extDir, "near.sst")
+	buildExternalTable(t, near, "a", "m")
+
+	if err := e.Ingest(far); err != nil {
+		t.Fatalf("Ingest far: %v", err)
+	}
+	if got := e.Stats().LevelTables[numLevels-1]; got != 1 {
+		t.Fatalf("expected non-overlapping table in the last level, got %d", got)
+	}
+	if err := e.Ingest(near); err != nil {
+		t.Fatalf("Ingest near: %v", err)
+	}
+
+	bad := filepath.Join(extDir, "bad.sst")
+	if err := os.WriteFile(bad, []byte("garbage"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := e.Ingest(bad); err == nil {
+		t.Fatalf("expected error for corrupt table")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	e = openTestEngine(t, dir)
+	defer e.Close()
+	for k, want := range map[string]string{"m": "ext-m", "a": "ext-a", "x2": "ext-x2"} {
+		got, err := e.Get([]byte(k))
+		if err != nil || string(got) != want {
+			t.Fatalf("Get %s: got=%q err=%v want=%q", k, string(got), err, want)
+		}
+	}
+}
+
+func TestEngine_IngestLinkFS(t *testing.T) {
+	dir := t.TempDir()
+	fs := vfs.NewFaultFS(vfs.Default)
+	e, err := Open(Options{Dir: dir}, WithFS(fs))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	// Таблица на той же ФС подключается жёсткой ссылкой, а если ссылка не удалась — копией.
+	// Обе операции идут через Options.FS.
+	linked := filepath.Join(t.TempDir(), "linked.sst")
+	buildExternalTable(t, linked, "a", "b")
+	copied := filepath.Join(t.TempDir(), "copied.sst")
+	buildExternalTable(t, copied, "c", "d")
+	if err := e.Ingest(linked); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	fs.SetInjector(vfs.FailAlways(vfs.OpLink, ".sst"))
+	if err := e.Ingest(copied); err != nil {
+		t.Fatalf("Ingest без жёстких ссылок: %v", err)
+	}
+	fs.SetInjector(nil)
+
+	sameFile := func(src string) bool {
+		t.Helper()
+		st, err := os.Stat(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range names {
+			if info, err := n.Info(); err == nil && os.SameFile(st, info) {
+				return true
+			}
+		}
+		return false
+	}
+	if !sameFile(linked) || sameFile(copied) {
+		t.Fatalf("ссылка на linked: %v, на copied: %v", sameFile(linked), sameFile(copied))
+	}
+	for _, k := range []string{"a", "d"} {
+		if _, err := e.Get([]byte(k)); err != nil {
+			t.Fatalf("Get(%s): %v", k, err)
+		}
+	}
+
+	// Проверка таблицы перед подключением тоже читает её через Options.FS,
+	// а TableBuilder пишет в файл любой vfs.FS.
+	checked := filepath.Join(t.TempDir(), "checked.sst")
+	f, err := fs.Create(checked)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	b := NewTableBuilder(f)
+	if err := b.Put([]byte("e"), []byte("ext-e")); err != nil {
+		t.Fatalf("builder Put: %v", err)
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatalf("builder Finish: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetInjector(vfs.FailAlways(vfs.OpRead, "checked.sst"))
+	if err := e.Ingest(checked); !errors.Is(err, vfs.ErrInjected) {
+		t.Fatalf("Ingest при сбое чтения: %v, ожидалась ErrInjected", err)
+	}
+	fs.SetInjector(nil)
+	if err := e.Ingest(checked); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	if v, err := e.Get([]byte("e")); err != nil || string(v) != "ext-e" {
+		t.Fatalf("Get(e) = %q, %v", v, err)
+	}
+}
+
+func TestEngine_ApproximateSize(t *testing.T) {
+	e, err := Open(Options{Dir: t.TempDir()}, WithBlockSize(MinBlockSize))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	value := make([]byte, 100)
+	for i := 0; i < 200; i++ {
+		_ = e.Put([]byte(fmt.Sprintf("k%03d", i)), value)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for i := 200; i < 300; i++ {
+		_ = e.Put([]byte(fmt.Sprintf("k%03d", i)), value)
+	}
+
+	all := e.ApproximateSize(nil, nil)
+	half := e.ApproximateSize(nil, []byte("k100"))
+	mem := e.ApproximateSize([]byte("k200"), nil)
+	if all < 300*100 {
+		t.Fatalf("total size too small: %d", all)
+	}
+	if half <= 0 || half >= all/2 {
+		t.Fatalf("unexpected size for first third: half=%d all=%d", half, all)
+	}
+	if mem < 100*100 || mem >= all {
+		t.Fatalf("unexpected memtable range size: mem=%d all=%d", mem, all)
+	}
+	if got := e.ApproximateSize([]byte("z"), nil); got != 0 {
+		t.Fatalf("expected empty range to be 0, got %d", got)
+	}
+}
+
+func TestEngine_ReadOnlyAfterWALFailure(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// Имитируем сбой диска: файл WAL закрыт под движком.
+	e.mu.Lock()
+	_ = e.walFile.Close()
+	e.mu.Unlock()
+
+	if err := e.Put([]byte("b"), []byte("2")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Put после сбоя WAL: %v, ожидалась ErrReadOnly", err)
+	}
+	if err := e.Delete([]byte("a")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Delete в режиме только для чтения: %v", err)
+	}
+	if _, err := e.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Flush в режиме только для чтения: %v", err)
+	}
+	got, err := e.Get([]byte("a"))
+	if err != nil || string(got) != "1" {
+		t.Fatalf("Get(a) = %q, %v; чтения должны работать", got, err)
+	}
+	_ = e.Close()
+}
+
+func TestOpen_CorruptWAL(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	for _, k := range []string{"a", "b"} {
+		if err := e.Put([]byte(k), []byte("1")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	crash(e)
+
+	// Обрезаем последнюю запись посередине значения.
+	path := walPath(dir, num)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, st.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(Options{Dir: dir}, WithWALRecoveryMode(WALRecoveryStrict)); err == nil {
+		t.Fatal("Open в строгом режиме с повреждённым WAL должен вернуть ошибку")
+	}
+
+	// По умолчанию оборванный хвост отбрасывается, а файл обрезается.
+	e, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	report := e.WALRecovery()
+	if report.Records != 1 || report.TruncatedBytes == 0 || len(report.Errors) != 1 {
+		t.Fatalf("WALRecovery = %+v", report)
+	}
+	if v, err := e.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get(a) = %q, %v", v, err)
+	}
+	if _, err := e.Get([]byte("b")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(b) оборванной записи: %v", err)
+	}
+	crash(e)
+
+	e, err = Open(Options{Dir: dir}, WithWALRecoveryMode(WALRecoveryStrict))
+	if err != nil {
+		t.Fatalf("Open после обрезания WAL: %v", err)
+	}
+	defer e.Close()
+	if report := e.WALRecovery(); report.TruncatedBytes != 0 || report.Records != 1 {
+		t.Fatalf("WALRecovery после обрезания = %+v", report)
+	}
+}
+
+func TestOpen_WALRecoverySkipCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	crash(e)
+
+	// Запись в несуществующее пространство ключей, за ней — нормальная запись.
+	f, err := os.OpenFile(walPath(dir, num), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wal.NewWriter(f)
+	for _, rec := range []wal.Record{
+		{Type: wal.OpPut, Key: []byte("x"), Value: []byte("?"), ColumnFamily: 7},
+		{Type: wal.OpPut, Key: []byte("b"), Value: []byte("2")},
+	} {
+		if _, err := w.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(Options{Dir: dir}); !errors.Is(err, ErrUnknownColumnFamily) {
+		t.Fatalf("Open с неприменимой записью WAL: %v", err)
+	}
+	e, err = Open(Options{Dir: dir}, WithWALRecoveryMode(WALRecoverySkipCorrupt))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	report := e.WALRecovery()
+	if report.Records != 2 || report.Skipped != 1 || len(report.Errors) != 1 {
+		t.Fatalf("WALRecovery = %+v", report)
+	}
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}} {
+		if v, err := e.Get([]byte(kv[0])); err != nil || string(v) != kv[1] {
+			t.Fatalf("Get(%s) = %q, %v", kv[0], v, err)
+		}
+	}
+}
+
+func TestEngine_Merge(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Engine {
+		e, err := Open(Options{Dir: dir}, WithMergeOperator(Uint64AddOperator))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return e
+	}
+	counter := func(n uint64) []byte { return binary.BigEndian.AppendUint64(nil, n) }
+	check := func(e *Engine, key string, want uint64) {
+		t.Helper()
+		got, err := e.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		if n := binary.BigEndian.Uint64(got); n != want {
+			t.Fatalf("Get(%s) = %d, want %d", key, n, want)
+		}
+	}
+
+	e := open()
+	if err := e.Put([]byte("msisdn:1"), counter(100)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := e.Merge([]byte("msisdn:1"), counter(10)); err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+		if err := e.Merge([]byte("msisdn:2"), counter(1)); err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+	}
+	check(e, "msisdn:1", 130)
+	check(e, "msisdn:2", 3)
+
+	// Операнды переживают падение (WAL), Flush и compaction.
+	crash(e)
+	e = open()
+	check(e, "msisdn:1", 130)
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Merge([]byte("msisdn:2"), counter(5)); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	check(e, "msisdn:1", 130)
+	check(e, "msisdn:2", 8)
+
+	if err := e.Delete([]byte("msisdn:1")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := e.Merge([]byte("msisdn:1"), counter(7)); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	check(e, "msisdn:1", 7)
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	e = openTestEngine(t, dir)
+	defer e.Close()
+	if err := e.Merge([]byte("k"), counter(1)); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("Merge без MergeOperator: %v", err)
+	}
+}
+
+// scanIterator — общее у Iterator и ShardedIterator.
+type scanIterator interface {
+	Next() (key, value []byte, ok bool, err error)
+	Close() error
+}
+
+func scanAll(t *testing.T, it scanIterator) []string {
+	t.Helper()
+	defer it.Close()
+	var got []string
+	for {
+		key, value, ok, err := it.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			return got
+		}
+		got = append(got, string(key)+"="+string(value))
+	}
+}
+
+func TestEngine_Scan(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	for i := 0; i < 6; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte("old")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Put([]byte("k1"), []byte("new")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Delete([]byte("k2")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	it := e.Scan([]byte("k1"), []byte("k5"))
+	// Compaction во время чтения не должна ломать открытый итератор.
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	got := scanAll(t, it)
+	want := []string{"k1=new", "k3=old", "k4=old"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Scan = %v, want %v", got, want)
+	}
+	if n := len(scanAll(t, e.Scan(nil, nil))); n != 5 {
+		t.Fatalf("Scan(nil, nil): %d ключей, want 5", n)
+	}
+}
+
+func TestEngine_ColumnFamilies(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+
+	subs, err := e.CreateColumnFamily("subscribers")
+	if err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	cdr, err := e.CreateColumnFamily("cdr")
+	if err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	if err := subs.Put([]byte("k"), []byte("subscriber")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := cdr.Put([]byte("k"), []byte("call")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := cdr.Put([]byte("k2"), []byte("call2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Get([]byte("k")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("default Get(k): %v, want ErrNotFound", err)
+	}
+
+	// Memtable восстанавливается из общего WAL, таблицы — по MANIFEST.
+	crash(e)
+	e = openTestEngine(t, dir)
+	defer e.Close()
+
+	if got := e.ColumnFamilies(); fmt.Sprint(got) != "[default subscribers cdr]" {
+		t.Fatalf("ColumnFamilies = %v", got)
+	}
+	subs, err = e.ColumnFamily("subscribers")
+	if err != nil {
+		t.Fatalf("ColumnFamily: %v", err)
+	}
+	if got, err := subs.Get([]byte("k")); err != nil || string(got) != "subscriber" {
+		t.Fatalf("subscribers Get(k) = %q, %v", got, err)
+	}
+	cdr, _ = e.ColumnFamily("cdr")
+	if got := scanAll(t, cdr.Scan(nil, nil)); fmt.Sprint(got) != "[k=call k2=call2]" {
+		t.Fatalf("cdr Scan = %v", got)
+	}
+	if _, err := e.ColumnFamily("sessions"); !errors.Is(err, ErrUnknownColumnFamily) {
+		t.Fatalf("ColumnFamily(sessions): %v", err)
+	}
+}
+
+func TestEngine_Checkpoint(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	if err := e.Put([]byte("flushed"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Put([]byte("in-wal"), []byte("2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if err := e.Checkpoint(dir); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if err := e.Put([]byte("after"), []byte("3")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Checkpoint(dir); err == nil {
+		t.Fatal("Checkpoint в существующую директорию должен вернуть ошибку")
+	}
+
+	cp := openTestEngine(t, dir)
+	defer cp.Close()
+	if got := scanAll(t, cp.Scan(nil, nil)); fmt.Sprint(got) != "[flushed=1 in-wal=2]" {
+		t.Fatalf("checkpoint Scan = %v", got)
+	}
+}
+
+func TestEngine_CheckpointFS(t *testing.T) {
+	// Копии WAL для Checkpoint пишутся через Options.FS; при сбое директория удаляется.
+	fs := vfs.NewFaultFS(vfs.Default)
+	e, err := Open(Options{Dir: t.TempDir()}, WithFS(fs))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	fs.SetInjector(vfs.FailAlways(vfs.OpCreate, filepath.Join(dir, "wal_")))
+	if err := e.Checkpoint(dir); !errors.Is(err, vfs.ErrInjected) {
+		t.Fatalf("Checkpoint при сбое копирования WAL: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("директория после сбоя Checkpoint: %v", err)
+	}
+	fs.SetInjector(nil)
+	if err := e.Checkpoint(dir); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+}
+
+func TestEngine_BackupRestore(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := e.Backup(&buf); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := Restore(bytes.NewReader(buf.Bytes()), dir); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if err := Restore(bytes.NewReader(buf.Bytes()), dir); err == nil {
+		t.Fatal("Restore в непустую директорию должен вернуть ошибку")
+	}
+	restored := openTestEngine(t, dir)
+	defer restored.Close()
+	if got := scanAll(t, restored.Scan(nil, nil)); fmt.Sprint(got) != "[a=1 b=2]" {
+		t.Fatalf("restored Scan = %v", got)
+	}
+}
+
+func TestEngine_BackupFS(t *testing.T) {
+	// Сегменты WAL для резервной копии читаются через Options.FS.
+	fs := vfs.NewFaultFS(vfs.Default)
+	e, err := Open(Options{Dir: t.TempDir()}, WithFS(fs))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	fs.SetInjector(vfs.FailAlways(vfs.OpOpen, "wal_"))
+	if err := e.Backup(io.Discard); !errors.Is(err, vfs.ErrInjected) {
+		t.Fatalf("Backup при сбое чтения WAL: %v", err)
+	}
+	fs.SetInjector(nil)
+	if err := e.Backup(io.Discard); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+}
+
+// recordingListener запоминает имена событий по порядку.
+type recordingListener struct {
+	NoopEventListener
+	events []string
+}
+
+func (r *recordingListener) OnFlushBegin(FlushInfo) { r.events = append(r.events, "flush-begin") }
+func (r *recordingListener) OnFlushEnd(info FlushInfo) {
+	r.events = append(r.events, fmt.Sprintf("flush-end:%d", len(info.Tables)))
+}
+func (r *recordingListener) OnCompactionEnd(info CompactionInfo) {
+	r.events = append(r.events, fmt.Sprintf("compaction-end:L%d->L%d", info.Level, info.OutputLevel))
+}
+
+func TestEngine_EventListener(t *testing.T) {
+	l := &recordingListener{}
+	e, err := Open(Options{Dir: t.TempDir()}, WithEventListener(l))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+
+	e.mu.Lock()
+	got := fmt.Sprint(l.events)
+	e.mu.Unlock()
+	if want := "[flush-begin flush-end:1 compaction-end:L0->L1 compaction-end:L1->L2 compaction-end:L2->L3]"; got != want {
+		t.Fatalf("events = %s, want %s", got, want)
+	}
+}
+
+func TestEngine_WriteStall(t *testing.T) {
+	e, err := Open(Options{Dir: t.TempDir()}, WithL0WriteTriggers(4, 6))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	// Не даём фоновой compaction разгрузить L0.
+	e.mu.Lock()
+	e.manualCompaction = true
+	e.mu.Unlock()
+	flushKey := func(i int) {
+		t.Helper()
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		flushKey(i)
+	}
+	if s := e.Stats(); s.WriteStall != WriteStallSlowdown || s.StalledWrites != 0 {
+		t.Fatalf("WriteStall = %v, StalledWrites = %d", s.WriteStall, s.StalledWrites)
+	}
+	flushKey(4)
+	flushKey(5)
+	if s := e.Stats(); s.WriteStall != WriteStallStopped || s.StalledWrites != 2 {
+		t.Fatalf("WriteStall = %v, StalledWrites = %d", s.WriteStall, s.StalledWrites)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- e.Put([]byte("blocked"), []byte("v")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Put при остановке записи завершился: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	e.mu.Lock()
+	e.manualCompaction = false
+	e.maybeScheduleCompaction()
+	e.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put не дождался compaction")
+	}
+	if s := e.Stats(); s.WriteStall != WriteStallNone {
+		t.Fatalf("после compaction WriteStall = %v", s.WriteStall)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1 << 20)
+	start := time.Now()
+	// Запас — 0.1 с, остальные 0.1 с придётся подождать.
+	for i := 0; i < 20; i++ {
+		l.Wait(1 << 20 / 100)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("0.2 МБ при 1 МБ/с записаны за %v", elapsed)
+	}
+
+	e, err := Open(Options{Dir: t.TempDir()}, WithRateLimit(64<<20))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+func TestEngine_ParanoidChecks(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.Put([]byte("a"), []byte("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	m, err := readManifest(vfs.Default, dir)
+	if err != nil || len(m.Tables) != 1 {
+		t.Fatalf("readManifest: %+v, %v", m, err)
+	}
+	// Портим байт значения: [keyLen]["a"][valLen][kind]["hello"].
+	path := tablePath(dir, m.Tables[0].Num)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[4+1+4+1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = Open(Options{Dir: dir}, WithParanoidChecks())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if _, err := e.Get([]byte("a")); !errors.Is(err, sstable.ErrCorrupt) {
+		t.Fatalf("Get повреждённого блока: %v, ожидалась sstable.ErrCorrupt", err)
+	}
+	if err := e.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush с проверкой новой таблицы: %v", err)
+	}
+}
+
+func TestEngine_ContextCancellation(t *testing.T) {
+	e, err := Open(Options{Dir: t.TempDir()}, WithL0WriteTriggers(4, 4))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 3; i++ {
+		if err := e.PutContext(ctx, []byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("PutContext: %v", err)
+		}
+	}
+	it := e.ScanContext(ctx, nil, nil)
+	defer it.Close()
+	if _, _, ok, err := it.Next(); !ok || err != nil {
+		t.Fatalf("Next: ok=%v err=%v", ok, err)
+	}
+	cancel()
+	if _, _, _, err := it.Next(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Next после отмены: %v", err)
+	}
+	if _, err := e.GetContext(ctx, []byte("k0")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetContext после отмены: %v", err)
+	}
+
+	// Запись, остановленная переполнением L0, прерывается по дедлайну.
+	e.mu.Lock()
+	e.manualCompaction = true
+	e.mu.Unlock()
+	for i := 0; i < 4; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("f%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := e.PutContext(ctx, []byte("stalled"), []byte("v")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("PutContext при остановке записи: %v", err)
+	}
+}
+
+func TestEngine_Txn(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithTxnLockTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := e.Put([]byte("balance"), []byte("10")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	tx := e.BeginTxn()
+	if v, err := tx.GetForUpdate([]byte("balance")); err != nil || string(v) != "10" {
+		t.Fatalf("GetForUpdate = %q, %v", v, err)
+	}
+	if err := tx.Put([]byte("balance"), []byte("7")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := tx.Delete([]byte("old")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if v, _ := tx.Get([]byte("balance")); string(v) != "7" {
+		t.Fatalf("Get в транзакции = %q, хотим собственную запись", v)
+	}
+	if v, _ := e.Get([]byte("balance")); string(v) != "10" {
+		t.Fatalf("Get до Commit = %q", v)
+	}
+
+	// Ключ заблокирован: вторая транзакция ждёт и получает таймаут.
+	other := e.BeginTxn()
+	if err := other.Put([]byte("balance"), []byte("0")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Put чужого ключа: %v", err)
+	}
+	if err := other.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("повторный Commit: %v", err)
+	}
+
+	// Пакет транзакции восстанавливается из WAL целиком.
+	crash(e)
+	e = openTestEngine(t, dir)
+	defer e.Close()
+	if v, err := e.Get([]byte("balance")); err != nil || string(v) != "7" {
+		t.Fatalf("Get после восстановления = %q, %v", v, err)
+	}
+
+	// После Commit блокировка отпущена.
+	tx = e.BeginTxn()
+	if err := tx.Put([]byte("balance"), []byte("8")); err != nil {
+		t.Fatalf("Put после Commit: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if v, _ := e.Get([]byte("balance")); string(v) != "7" {
+		t.Fatalf("Get после Rollback = %q", v)
+	}
+}
+
+func TestEngine_TxnDeadlock(t *testing.T) {
+	e, err := Open(Options{Dir: t.TempDir()}, WithTxnLockTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	a, b := e.BeginTxn(), e.BeginTxn()
+	if err := a.Put([]byte("x"), []byte("a")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := b.Put([]byte("y"), []byte("b")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- a.Put([]byte("y"), []byte("a")) }()
+	// Ждём, пока a встанет в очередь за блокировкой y.
+	for {
+		e.locks.mu.Lock()
+		_, waiting := e.locks.waitsFor[a.id]
+		e.locks.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := b.Put([]byte("x"), []byte("b")); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("Put с циклом ожидания: %v", err)
+	}
+	if err := b.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Put после отката b: %v", err)
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if v, _ := e.Get([]byte("y")); string(v) != "a" {
+		t.Fatalf("Get(y) = %q", v)
+	}
+}
+
+func TestEngine_WriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithTxnLockTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := e.CreateColumnFamily("subscribers"); err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	if err := e.Put([]byte("old"), []byte("x")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Пакет не берёт блокировок: ключ, заблокированный транзакцией, он не ждёт.
+	tx := e.BeginTxn()
+	if err := tx.Put([]byte("a"), []byte("txn")); err != nil {
+		t.Fatalf("Put в транзакции: %v", err)
+	}
+	ctx := context.Background()
+	err = e.WriteBatch(ctx, []Mutation{
+		{Kind: MutationPut, Key: []byte("a"), Value: []byte("0")},
+		{Kind: MutationPut, Key: []byte("a"), Value: []byte("1")},
+		{Kind: MutationPut, ColumnFamily: "subscribers", Key: []byte("s"), Value: []byte("2")},
+		{Kind: MutationDelete, Key: []byte("old")},
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	// Пакет с некорректным изменением не применяется целиком.
+	for _, bad := range []Mutation{
+		{Kind: MutationPut, Key: nil, Value: []byte("x")},
+		{Kind: MutationPut, ColumnFamily: "nope", Key: []byte("x")},
+		{Kind: MutationMerge, Key: []byte("x")},
+	} {
+		if err := e.WriteBatch(ctx, []Mutation{{Kind: MutationPut, Key: []byte("b"), Value: []byte("1")}, bad}); err == nil {
+			t.Fatalf("WriteBatch с %+v без ошибки", bad)
+		}
+	}
+	if err := e.WriteBatch(ctx, []Mutation{{Key: nil}}); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("WriteBatch с пустым ключом: %v", err)
+	}
+
+	// Пакет восстанавливается из WAL целиком.
+	crash(e)
+	e = openTestEngine(t, dir)
+	defer e.Close()
+	if v, err := e.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get(a) = %q, %v", v, err)
+	}
+	for _, key := range []string{"old", "b"} {
+		if _, err := e.Get([]byte(key)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(%s) = %v, ожидалась ErrNotFound", key, err)
+		}
+	}
+	cf, err := e.ColumnFamily("subscribers")
+	if err != nil {
+		t.Fatalf("ColumnFamily: %v", err)
+	}
+	if v, err := cf.Get([]byte("s")); err != nil || string(v) != "2" {
+		t.Fatalf("subscribers: Get(s) = %q, %v", v, err)
+	}
+}
+
+func TestEngine_MultiGet(t *testing.T) {
+	e, err := Open(Options{Dir: t.TempDir()}, WithMergeOperator(Uint64AddOperator))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	// Версии распределены по уровням, Memtable и L0.
+	for i := 0; i < 50; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	if err := e.Put([]byte("k10"), []byte("new")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Delete([]byte("k20")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	one := make([]byte, 8)
+	binary.BigEndian.PutUint64(one, 1)
+	for i := 0; i < 2; i++ {
+		if err := e.Merge([]byte("counter"), one); err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if err := e.Put([]byte("k30"), []byte("mem")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	keys := [][]byte{[]byte("k30"), []byte("missing"), []byte("k10"), []byte("counter"), []byte("k20"), []byte("k05"), []byte("k10")}
+	values, errs := e.MultiGet(keys)
+	for i, key := range keys {
+		want, wantErr := e.Get(key)
+		if !errors.Is(errs[i], wantErr) || !bytes.Equal(values[i], want) {
+			t.Errorf("MultiGet(%s) = %q, %v; Get = %q, %v", key, values[i], errs[i], want, wantErr)
+		}
+	}
+	if string(values[0]) != "mem" || !errors.Is(errs[1], ErrNotFound) || binary.BigEndian.Uint64(values[3]) != 2 {
+		t.Fatalf("MultiGet = %q, %v", values, errs)
+	}
+}
+
+func TestEngine_TombstoneCompactionPriority(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	for i := 0; i < 90; i++ {
+		if err := e.Delete([]byte(fmt.Sprintf("k%03d", i))); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+
+	// Переносим tombstone в L1 без автоматических compaction: уровень далёк от своего
+	// предела, и выбрать его может только доля tombstone.
+	e.mu.Lock()
+	e.manualCompaction = true
+	if err := e.flushLocked(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	cf := e.defaultCF
+	if err := e.runCompaction(cf.newCompaction(0, cf.levels[0])); err != nil {
+		t.Fatalf("compaction L0: %v", err)
+	}
+	if len(cf.levels[1]) != 1 || cf.levels[1][0].tombstones != 90 || cf.levels[1][0].entries != 90 {
+		t.Fatalf("L1 = %d таблиц, ожидаем одну с 90 tombstone", len(cf.levels[1]))
+	}
+	c := e.pickCompaction()
+	if c == nil || c.level != 1 {
+		t.Fatalf("pickCompaction = %+v, ожидаем compaction L1", c)
+	}
+	e.manualCompaction = false
+	e.mu.Unlock()
+
+	// Фоновые compaction доводят tombstone до последнего уровня и выбрасывают их.
+	e.maybeScheduleCompaction()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e.mu.Lock()
+		l3 := cf.levels[numLevels-1]
+		done := len(cf.levels[1]) == 0 && len(cf.levels[2]) == 0 && len(l3) == 1 && l3[0].entries == 10
+		e.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tombstone не вытеснены compaction")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := e.Get([]byte("k000")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get удалённого ключа: %v", err)
+	}
+}
+
+func TestEngine_GetProperty(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Put([]byte("m"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Delete([]byte("k0")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		PropertyNumSSTables:                    "1",
+		PropertyNumSSTablesAtLevelPrefix + "0": "1",
+		PropertyNumSSTablesAtLevelPrefix + "1": "0",
+		PropertyEstimateLiveKeys:               "10",
+		PropertyNumColumnFamilies:              "1",
+		PropertyWriteStall:                     "none",
+		PropertyReadOnly:                       "0",
+	} {
+		if got, ok := e.GetProperty(name); !ok || got != want {
+			t.Errorf("GetProperty(%q) = %q, %v; хотим %q", name, got, ok, want)
+		}
+	}
+	if got, _ := e.GetProperty(PropertyMemtableBytes); got == "0" {
+		t.Errorf("%s = 0 при непустой Memtable", PropertyMemtableBytes)
+	}
+	for _, name := range []string{"kv.unknown", PropertyNumSSTablesAtLevelPrefix + "9", PropertyNumSSTablesAtLevelPrefix + "x"} {
+		if _, ok := e.GetProperty(name); ok {
+			t.Errorf("GetProperty(%q) должно быть неизвестным", name)
+		}
+	}
+}
+
+// cellOf извлекает из значения вида "cell/imei" номер соты.
+func cellOf(value []byte) []byte {
+	cell, _, ok := bytes.Cut(value, []byte("/"))
+	if !ok {
+		return nil
+	}
+	return cell
+}
+
+func indexKeys(t *testing.T, e *Engine, name, value string) []string {
+	t.Helper()
+	it, err := e.IndexScan(name, []byte(value))
+	if err != nil {
+		t.Fatalf("IndexScan: %v", err)
+	}
+	defer it.Close()
+	var keys []string
+	for {
+		k, _, ok, err := it.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			return keys
+		}
+		keys = append(keys, string(k))
+	}
+}
+
+func TestEngine_SecondaryIndex(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.Put([]byte("imsi1"), []byte("c1/imei1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Новый индекс заполняется по уже записанным данным.
+	e, err := Open(Options{Dir: dir}, WithIndex("cell", cellOf))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := indexKeys(t, e, "cell", "c1"); fmt.Sprint(got) != "[imsi1]" {
+		t.Fatalf("cell=c1 после заполнения: %v", got)
+	}
+
+	for _, kv := range [][2]string{{"imsi2", "c1/imei2"}, {"imsi3", "c2/imei3"}, {"imsi4", "no-cell"}} {
+		if err := e.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	// Абонент переходит в другую соту, другой удаляется.
+	if err := e.Put([]byte("imsi1"), []byte("c2/imei1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Delete([]byte("imsi3")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	tx := e.BeginTxn()
+	if err := tx.Put([]byte("imsi5"), []byte("c2/imei5")); err != nil {
+		t.Fatalf("Txn.Put: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	check := func() {
+		t.Helper()
+		if got := indexKeys(t, e, "cell", "c1"); fmt.Sprint(got) != "[imsi2]" {
+			t.Errorf("cell=c1: %v", got)
+		}
+		if got := indexKeys(t, e, "cell", "c2"); fmt.Sprint(got) != "[imsi1 imsi5]" {
+			t.Errorf("cell=c2: %v", got)
+		}
+	}
+	check()
+	if _, err := e.IndexScan("imei", nil); !errors.Is(err, ErrUnknownIndex) {
+		t.Fatalf("IndexScan неизвестного индекса: %v", err)
+	}
+
+	// Индекс и данные восстанавливаются из WAL вместе.
+	crash(e)
+	if _, err := Open(Options{Dir: dir}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("Open без зарегистрированного индекса: %v", err)
+	}
+	e, err = Open(Options{Dir: dir}, WithIndex("cell", cellOf))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	check()
+	if _, err := e.CreateColumnFamily(indexColumnFamilyPrefix + "x"); err == nil {
+		t.Fatal("CreateColumnFamily с зарезервированным префиксом должен завершиться ошибкой")
+	}
+}
+
+func TestEngine_PrefixFilter(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithPrefixLength(6))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	for _, prefix := range []string{"250011", "250022", "250033"} {
+		for i := 0; i < 3; i++ {
+			if err := e.Put([]byte(fmt.Sprintf("%s%09d", prefix, i)), []byte("v")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	it := e.ScanPrefix([]byte("250022"))
+	if len(it.tables) != 1 {
+		t.Errorf("ScanPrefix читает %d таблиц, ожидали 1", len(it.tables))
+	}
+	if got := scanAll(t, it); len(got) != 3 || got[0] != "250022000000000=v" {
+		t.Fatalf("ScanPrefix = %v", got)
+	}
+
+	// Диапазон шире одного префикса фильтры не использует.
+	it = e.Scan([]byte("250011"), nil)
+	if len(it.tables) != 3 {
+		t.Errorf("Scan читает %d таблиц, ожидали 3", len(it.tables))
+	}
+	if got := scanAll(t, it); len(got) != 9 {
+		t.Fatalf("Scan = %v", got)
+	}
+
+	it = e.ScanPrefix([]byte("250099"))
+	if len(it.tables) != 0 {
+		t.Errorf("ScanPrefix отсутствующего префикса читает %d таблиц", len(it.tables))
+	}
+	if got := scanAll(t, it); len(got) != 0 {
+		t.Fatalf("ScanPrefix = %v", got)
+	}
+}
+
+// reverseComparator упорядочивает ключи по убыванию.
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string            { return "test.Reverse" }
+
+func TestEngine_Comparator(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithComparator(reverseComparator{}))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for round := 0; round < 5; round++ {
+		for i := round; i < 20; i += 5 {
+			if err := e.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("v")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	if err := e.Delete([]byte("k07")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// В обратном порядке диапазон [k10, k05) — это ключи от k10 до k06.
+	got := scanAll(t, e.Scan([]byte("k10"), []byte("k05")))
+	if want := "[k10=v k09=v k08=v k06=v]"; fmt.Sprint(got) != want {
+		t.Fatalf("Scan = %v, хотим %s", got, want)
+	}
+	if got := scanAll(t, e.ScanPrefix([]byte("k1"))); len(got) != 10 || got[0] != "k19=v" {
+		t.Fatalf("ScanPrefix = %v", got)
+	}
+	values, errs := e.MultiGet([][]byte{[]byte("k03"), []byte("k07"), []byte("k18")})
+	if string(values[0]) != "v" || !errors.Is(errs[1], ErrNotFound) || string(values[2]) != "v" {
+		t.Fatalf("MultiGet = %q, %v", values, errs)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Данные нельзя открыть с другим порядком ключей.
+	if _, err := Open(Options{Dir: dir}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("Open с другим компаратором: %v", err)
+	}
+	e, err = Open(Options{Dir: dir}, WithComparator(reverseComparator{}))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if v, err := e.Get([]byte("k11")); err != nil || string(v) != "v" {
+		t.Fatalf("Get после переоткрытия = %q, %v", v, err)
+	}
+}
+
+func TestEngine_FaultInjection(t *testing.T) {
+	dir := t.TempDir()
+	fs := vfs.NewFaultFS(vfs.Default)
+	open := func() *Engine {
+		t.Helper()
+		e, err := Open(Options{Dir: dir}, WithFS(fs))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return e
+	}
+	e := open()
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Сбой fsync таблицы: Flush можно повторить, данные остаются в Memtable и WAL.
+	fs.SetInjector(vfs.FailNth(vfs.OpSync, ".sst", 1))
+	if _, err := e.Flush(); !errors.Is(err, vfs.ErrInjected) {
+		t.Fatalf("Flush при сбое fsync: %v", err)
+	}
+	if v, err := e.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get после сбоя Flush = %q, %v", v, err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("повторный Flush: %v", err)
+	}
+
+	// Сбой rename MANIFEST переводит движок в режим только для чтения;
+	// после перезапуска запись восстанавливается из WAL.
+	if err := e.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	fs.SetInjector(vfs.FailAlways(vfs.OpRename, manifestName))
+	if _, err := e.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Flush при сбое MANIFEST: %v", err)
+	}
+	if err := e.Put([]byte("c"), []byte("3")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Put в режиме только для чтения: %v", err)
+	}
+	crash(e)
+
+	fs.SetInjector(nil)
+	e = open()
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}} {
+		if v, err := e.Get([]byte(kv[0])); err != nil || string(v) != kv[1] {
+			t.Fatalf("Get(%s) после перезапуска = %q, %v", kv[0], v, err)
+		}
+	}
+
+	// Оборванная запись в WAL тоже переводит движок в режим только для чтения.
+	fs.SetInjector(vfs.FailAlways(vfs.OpWrite, "wal_"))
+	if err := e.Put([]byte("d"), []byte("4")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Put при сбое записи WAL: %v", err)
+	}
+	crash(e)
+
+	// После перезапуска оборванная запись отбрасывается.
+	fs.SetInjector(nil)
+	e = open()
+	defer e.Close()
+	if report := e.WALRecovery(); report.TruncatedBytes == 0 {
+		t.Fatalf("WALRecovery = %+v", report)
+	}
+	if _, err := e.Get([]byte("d")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(d) оборванной записи: %v", err)
+	}
+}
+
+func TestEngine_TableCache(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithMaxOpenFiles(2))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	// Compaction L0 запустилась бы на четвёртой таблице, поэтому таблиц три.
+	for i := 0; i < l0CompactionTrigger-1; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if s := e.Stats(); s.OpenTables != 2 {
+		t.Fatalf("OpenTables = %d, want 2", s.OpenTables)
+	}
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < l0CompactionTrigger-1; i++ {
+			v, err := e.Get([]byte(fmt.Sprintf("k%d", i)))
+			if err != nil || string(v) != fmt.Sprint(i) {
+				t.Fatalf("Get(k%d) = %q, %v", i, v, err)
+			}
+		}
+	}
+	s := e.Stats()
+	if s.OpenTables > 2 || s.TableCacheMisses == 0 || s.TableCacheHits == 0 {
+		t.Fatalf("после Get: %+v", s)
+	}
+
+	// Итератор держит все свои таблицы открытыми, пока не будет закрыт.
+	it := e.Scan(nil, nil)
+	if got := e.Stats().OpenTables; got != l0CompactionTrigger-1 {
+		t.Fatalf("OpenTables при открытом Scan = %d", got)
+	}
+	n := 0
+	for {
+		_, _, ok, err := it.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		n++
+	}
+	it.Close()
+	if n != l0CompactionTrigger-1 {
+		t.Fatalf("Scan вернул %d ключей", n)
+	}
+	if _, err := e.Get([]byte("k0")); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := e.Stats().OpenTables; got > 2 {
+		t.Fatalf("OpenTables после Scan = %d", got)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	e := openTestEngine(t, dir)
+	for i := 0; i < 3; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if err := e.Put([]byte("wal"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Чужой файл остаётся, и директория вместе с ним.
+	foreign := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(foreign, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Destroy(dir); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "notes.txt" {
+		t.Fatalf("после Destroy осталось %v", entries)
+	}
+
+	// Пустая директория удаляется; повторный Destroy — no-op.
+	if err := os.Remove(foreign); err != nil {
+		t.Fatal(err)
+	}
+	if err := Destroy(dir); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("директория не удалена: %v", err)
+	}
+	if err := Destroy(dir); err != nil {
+		t.Fatalf("повторный Destroy: %v", err)
+	}
+}
+
+func TestEngine_Expvar(t *testing.T) {
+	dir := t.TempDir()
+	const name = "lsm_test_engine"
+	e, err := Open(Options{Dir: dir}, WithExpvar(name))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := Open(Options{Dir: t.TempDir()}, WithExpvar(name)); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("второй движок с тем же именем: %v", err)
+	}
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	var vars struct {
+		Puts    uint64 `json:"puts"`
+		Flushes uint64 `json:"flushes"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &vars); err != nil {
+		t.Fatalf("expvar: %v", err)
+	}
+	if vars.Puts != 1 || vars.Flushes != 1 {
+		t.Fatalf("expvar = %+v", vars)
+	}
+
+	// После Close имя освобождается для следующего движка.
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := expvar.Get(name).String(); got != "null" {
+		t.Fatalf("expvar после Close = %s", got)
+	}
+	e, err = Open(Options{Dir: dir}, WithExpvar(name))
+	if err != nil {
+		t.Fatalf("повторный Open: %v", err)
+	}
+	e.Close()
+}
+
+func TestEngine_FlushMetadata(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	for _, k := range []string{"b", "a", "c"} {
+		if err := e.Put([]byte(k), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := e.Delete([]byte("d")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	tables, err := e.Flush()
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("Flush вернул %d таблиц", len(tables))
+	}
+	ti := tables[0]
+	if string(ti.Smallest) != "a" || string(ti.Largest) != "d" || ti.Entries != 4 || ti.Level != 0 {
+		t.Fatalf("TableInfo = %+v", ti)
+	}
+	if st, err := os.Stat(ti.Path); err != nil || st.Size() != ti.Size {
+		t.Fatalf("файл таблицы %s: %v", ti.Path, err)
+	}
+
+	if tables, err := e.Flush(); err != nil || len(tables) != 0 {
+		t.Fatalf("Flush пустой Memtable = %v, %v", tables, err)
+	}
+
+	if err := e.Put([]byte("e"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	res := <-e.FlushAsync()
+	if res.Err != nil || len(res.Tables) != 1 || string(res.Tables[0].Smallest) != "e" {
+		t.Fatalf("FlushAsync = %+v", res)
+	}
+	if s := e.Stats(); s.LevelTables[0] != 2 || s.MemtableBytes != 0 {
+		t.Fatalf("после FlushAsync: %+v", s)
+	}
+}
+
+func TestEngine_WALSyncInterval(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.Default)
+	e, err := Open(Options{Dir: t.TempDir()}, WithFS(fs), WithWALSyncInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	// Без записей fsync не нужен.
+	time.Sleep(20 * time.Millisecond)
+	if n := e.Stats().WALSyncs; n != 0 {
+		t.Fatalf("WALSyncs без записей = %d", n)
+	}
+
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().WALSyncs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("фоновый fsync WAL не выполнился")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Неудачный fsync переводит движок в режим только для чтения.
+	fs.SetInjector(vfs.FailAlways(vfs.OpSync, "wal_"))
+	if err := e.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	for {
+		if err := e.Put([]byte("c"), []byte("3")); errors.Is(err, ErrReadOnly) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("сбой fsync WAL не перевёл движок в режим только для чтения")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fs.SetInjector(nil)
+}
+
+func TestEngine_ScanWithOptions(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+
+	for _, k := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		if err := e.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Delete([]byte("a2")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := e.Put([]byte("b3"), []byte("vb3")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		opts ScanOptions
+		want string
+	}{
+		{"all", ScanOptions{}, "a1=va1 a3=va3 b1=vb1 b2=vb2 b3=vb3 c1=vc1"},
+		{"reverse", ScanOptions{Reverse: true}, "c1=vc1 b3=vb3 b2=vb2 b1=vb1 a3=va3 a1=va1"},
+		{"limit", ScanOptions{Limit: 2}, "a1=va1 a3=va3"},
+		{"reverse limit", ScanOptions{Reverse: true, Limit: 2}, "c1=vc1 b3=vb3"},
+		{"prefix", ScanOptions{Prefix: []byte("b")}, "b1=vb1 b2=vb2 b3=vb3"},
+		{"prefix and range", ScanOptions{Prefix: []byte("b"), Start: []byte("b2"), End: []byte("c")}, "b2=vb2 b3=vb3"},
+		{"prefix reverse keys only", ScanOptions{Prefix: []byte("a"), Reverse: true, KeysOnly: true}, "a3= a1="},
+		{"range reverse limit", ScanOptions{Start: []byte("a3"), End: []byte("c1"), Reverse: true, Limit: 3}, "b3=vb3 b2=vb2 b1=vb1"},
+	}
+	for _, tc := range cases {
+		if got := strings.Join(scanAll(t, e.ScanWithOptions(tc.opts)), " "); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEngine_Retention(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithRetention(time.Hour))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	e.mu.Lock()
+	e.now = func() time.Time { return now }
+	e.mu.Unlock()
+
+	put := func(key string) {
+		t.Helper()
+		if err := e.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	put("a")
+	now = now.Add(30 * time.Minute)
+	put("b")
+	now = now.Add(45 * time.Minute)
+
+	dropped, err := e.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention: %v", err)
+	}
+	if len(dropped) != 1 || string(dropped[0].Smallest) != "a" {
+		t.Fatalf("удалены %+v", dropped)
+	}
+	if _, err := os.Stat(dropped[0].Path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("файл удалённой таблицы: %v", err)
+	}
+	if _, err := e.Get([]byte("a")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(a) = %v", err)
+	}
+
+	// Compaction наследует время записи самой свежей из входных таблиц.
+	put("c")
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	now = now.Add(30 * time.Minute)
+	if dropped, err := e.EnforceRetention(); err != nil || len(dropped) != 0 {
+		t.Fatalf("EnforceRetention до истечения окна = %+v, %v", dropped, err)
+	}
+	now = now.Add(31 * time.Minute)
+	if dropped, err := e.EnforceRetention(); err != nil || len(dropped) != 1 {
+		t.Fatalf("EnforceRetention = %+v, %v", dropped, err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Удаление записано в MANIFEST.
+	e = openTestEngine(t, dir)
+	defer e.Close()
+	if n, _ := e.GetProperty(PropertyNumSSTables); n != "0" {
+		t.Fatalf("таблиц после перезапуска: %s", n)
+	}
+}
+
+func TestEngine_GetUpdatesSince(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithIndex("len", func(v []byte) []byte { return []byte{byte(len(v))} }))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	updates := func(e *Engine, since uint64) []string {
+		t.Helper()
+		it, err := e.GetUpdatesSince(since)
+		if err != nil {
+			t.Fatalf("GetUpdatesSince: %v", err)
+		}
+		defer it.Close()
+		var got []string
+		for {
+			u, ok, err := it.Next()
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			if !ok {
+				return got
+			}
+			for _, m := range u.Mutations {
+				got = append(got, fmt.Sprintf("%d:%s:%s=%s", u.Seq, m.Kind, m.Key, m.Value))
+			}
+		}
+	}
+
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	tx := e.BeginTxn()
+	if err := tx.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Txn.Put: %v", err)
+	}
+	if err := tx.Delete([]byte("a")); err != nil {
+		t.Fatalf("Txn.Delete: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := e.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if seq := e.LatestSequence(); seq != 3 {
+		t.Fatalf("LatestSequence = %d", seq)
+	}
+	want := "1:put:a=1 2:put:b=2 2:delete:a= 3:put:c=3"
+	if got := strings.Join(updates(e, 0), " "); got != want {
+		t.Fatalf("GetUpdatesSince(0) = %q, want %q", got, want)
+	}
+	if got := strings.Join(updates(e, 2), " "); got != "3:put:c=3" {
+		t.Fatalf("GetUpdatesSince(2) = %q", got)
+	}
+
+	// Номера переживают перезапуск, а сброшенные в SSTable записи больше недоступны.
+	crash(e)
+	e, err = Open(Options{Dir: dir}, WithIndex("len", func(v []byte) []byte { return []byte{byte(len(v))} }))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := strings.Join(updates(e, 1), " "); got != "2:put:b=2 2:delete:a= 3:put:c=3" {
+		t.Fatalf("после перезапуска: %q", got)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	// Сброшенных записей нет и без новых записей после них.
+	it, err := e.GetUpdatesSince(2)
+	if err != nil {
+		t.Fatalf("GetUpdatesSince: %v", err)
+	}
+	if _, _, err := it.Next(); !errors.Is(err, ErrUpdatesUnavailable) {
+		t.Fatalf("Next сразу после Flush: %v", err)
+	}
+	it.Close()
+	if err := e.Put([]byte("d"), []byte("4")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := strings.Join(updates(e, 3), " "); got != "4:put:d=4" {
+		t.Fatalf("после Flush: %q", got)
+	}
+	it, err = e.GetUpdatesSince(1)
+	if err != nil {
+		t.Fatalf("GetUpdatesSince: %v", err)
+	}
+	if _, _, err := it.Next(); !errors.Is(err, ErrUpdatesUnavailable) {
+		t.Fatalf("Next после Flush: %v", err)
+	}
+	it.Close()
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// После Close все сегменты пусты, и номер берётся из MANIFEST.
+	e, err = Open(Options{Dir: dir}, WithIndex("len", func(v []byte) []byte { return []byte{byte(len(v))} }))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if seq := e.LatestSequence(); seq != 4 {
+		t.Fatalf("LatestSequence после Close = %d", seq)
+	}
+}
+
+func TestEngine_ApplyUpdate(t *testing.T) {
+	leader := openTestEngine(t, t.TempDir())
+	defer leader.Close()
+	if err := leader.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	replicaDir := filepath.Join(t.TempDir(), "replica")
+	if err := leader.Checkpoint(replicaDir); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+
+	cdr, err := leader.CreateColumnFamily("cdr")
+	if err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	if err := cdr.Put([]byte("x"), []byte("call")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	tx := leader.BeginTxn()
+	if err := tx.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Txn.Put: %v", err)
+	}
+	if err := tx.Delete([]byte("a")); err != nil {
+		t.Fatalf("Txn.Delete: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := leader.PutWithTTL([]byte("t"), []byte("ttl"), time.Hour); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+
+	replica := openTestEngine(t, replicaDir)
+	if seq := replica.LatestSequence(); seq != 1 {
+		t.Fatalf("LatestSequence копии = %d", seq)
+	}
+	it, err := leader.GetUpdatesSince(replica.LatestSequence())
+	if err != nil {
+		t.Fatalf("GetUpdatesSince: %v", err)
+	}
+	for {
+		u, ok, err := it.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if err := replica.ApplyUpdate(u); err != nil {
+			t.Fatalf("ApplyUpdate(%d): %v", u.Seq, err)
+		}
+		// Повторное применение пропускается.
+		if err := replica.ApplyUpdate(u); err != nil {
+			t.Fatalf("повторный ApplyUpdate(%d): %v", u.Seq, err)
+		}
+	}
+	it.Close()
+	if got, want := replica.LatestSequence(), leader.LatestSequence(); got != want {
+		t.Fatalf("LatestSequence реплики = %d, ведущего %d", got, want)
+	}
+
+	check := func(e *Engine) {
+		t.Helper()
+		if _, err := e.Get([]byte("a")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(a): %v", err)
+		}
+		for k, want := range map[string]string{"b": "2", "t": "ttl"} {
+			if v, err := e.Get([]byte(k)); err != nil || string(v) != want {
+				t.Fatalf("Get(%s) = %q, %v", k, v, err)
+			}
+		}
+		cf, err := e.ColumnFamily("cdr")
+		if err != nil {
+			t.Fatalf("ColumnFamily: %v", err)
+		}
+		if v, err := cf.Get([]byte("x")); err != nil || string(v) != "call" {
+			t.Fatalf("cdr.Get(x) = %q, %v", v, err)
+		}
+	}
+	check(replica)
+
+	// Пропуск номеров сохраняется и после восстановления.
+	gap := leader.LatestSequence() + 5
+	if err := replica.ApplyUpdate(Update{Seq: gap, Mutations: []Mutation{{Kind: MutationPut, ColumnFamily: DefaultColumnFamilyName, Key: []byte("g"), Value: []byte("5")}}}); err != nil {
+		t.Fatalf("ApplyUpdate с пропуском: %v", err)
+	}
+	gap++
+	if err := replica.ApplyUpdate(Update{Seq: gap}); err != nil {
+		t.Fatalf("ApplyUpdate без изменений: %v", err)
+	}
+	crash(replica)
+	replica = openTestEngine(t, replicaDir)
+	defer replica.Close()
+	if seq := replica.LatestSequence(); seq != gap {
+		t.Fatalf("LatestSequence после восстановления = %d, ожидался %d", seq, gap)
+	}
+	check(replica)
+	if v, err := replica.Get([]byte("g")); err != nil || string(v) != "5" {
+		t.Fatalf("Get(g) = %q, %v", v, err)
+	}
+}
+
+func TestOpen_WALChecksum(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	for _, kv := range [][2]string{{"a", "first"}, {"b", "second"}, {"c", "third"}} {
+		if err := e.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	crash(e)
+
+	// Портим значение средней записи, не меняя длин.
+	path := walPath(dir, num)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte("second"))
+	if i < 0 {
+		t.Fatal("значение не найдено в WAL")
+	}
+	data[i] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(Options{Dir: dir}); !errors.Is(err, wal.ErrChecksum) {
+		t.Fatalf("Open с повреждённой записью в середине WAL: %v", err)
+	}
+	e, err = Open(Options{Dir: dir}, WithWALRecoveryMode(WALRecoverySkipCorrupt))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if r := e.WALRecovery(); r.Records != 2 || r.Skipped != 1 {
+		t.Fatalf("WALRecovery = %+v", r)
+	}
+	if _, err := e.Get([]byte("b")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(b) повреждённой записи: %v", err)
+	}
+	if v, err := e.Get([]byte("c")); err != nil || string(v) != "third" {
+		t.Fatalf("Get(c) = %q, %v", v, err)
+	}
+}
+
+func TestOpen_WALTornTailChecksum(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	for _, kv := range [][2]string{{"a", "first"}, {"b", "second"}} {
+		if err := e.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	crash(e)
+
+	// Последняя запись дописана мусором той же длины — контрольная сумма не сойдётся.
+	path := walPath(dir, num)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte("second"))
+	copy(data[i:], "garbag")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(Options{Dir: dir}, WithWALRecoveryMode(WALRecoveryStrict)); !errors.Is(err, wal.ErrChecksum) {
+		t.Fatalf("Open в строгом режиме: %v", err)
+	}
+	e, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	r := e.WALRecovery()
+	if r.Records != 1 || r.TruncatedBytes == 0 || len(r.Errors) != 1 || !errors.Is(r.Errors[0], wal.ErrChecksum) {
+		t.Fatalf("WALRecovery = %+v", r)
+	}
+	if _, err := e.Get([]byte("b")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(b): %v", err)
+	}
+	if v, err := e.Get([]byte("a")); err != nil || string(v) != "first" {
+		t.Fatalf("Get(a) = %q, %v", v, err)
+	}
+}
+
+func TestEngine_SyncWrites(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.Default)
+	var syncs atomic.Int64
+	fs.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpSync && strings.Contains(name, "wal_") {
+			syncs.Add(1)
+		}
+		return nil
+	})
+	e, err := Open(Options{Dir: t.TempDir()}, WithFS(fs), WithSyncWrites())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if n := syncs.Load(); n != 3 {
+		t.Fatalf("fsync WAL = %d, ожидалось 3", n)
+	}
+
+	// Неудачный fsync не подтверждает запись и переводит движок в режим только для чтения.
+	fs.SetInjector(vfs.FailAlways(vfs.OpSync, "wal_"))
+	if err := e.Put([]byte("x"), []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Put при сбое fsync: %v", err)
+	}
+	fs.SetInjector(nil)
+}
+
+func TestEngine_StatsWALBytes(t *testing.T) {
+	// Engine.Stats().WALBytes берётся из Writer и совпадает с размером сегмента.
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	defer e.Close()
+	if err := e.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	st, err := os.Stat(walPath(dir, num))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Stats().WALBytes; got != st.Size() {
+		t.Fatalf("WALBytes = %d, размер файла %d", got, st.Size())
+	}
+}
+
+func TestEngine_CloseSyncsWAL(t *testing.T) {
+	// Движок при остановке делает fsync WAL, даже если записи его не требовали.
+	fs := vfs.NewFaultFS(vfs.Default)
+	var syncs atomic.Int64
+	fs.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpSync && strings.Contains(name, "wal_") {
+			syncs.Add(1)
+		}
+		return nil
+	})
+	e, err := Open(Options{Dir: t.TempDir()}, WithFS(fs))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := syncs.Load(); n != 0 {
+		t.Fatalf("fsync WAL до Close = %d", n)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := syncs.Load(); n != 1 {
+		t.Fatalf("fsync WAL при Close = %d, ожидался 1", n)
+	}
+}
+
+func TestOpen_WALHeader(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now()
+	e := openTestEngine(t, dir)
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	crash(e)
+
+	path := walPath(dir, num)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := wal.NewReader(bytes.NewReader(data))
+	h, err := r.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if h.Version != wal.FormatVersion || h.Created.Before(before) || h.Created.After(time.Now()) {
+		t.Fatalf("Header = %+v", h)
+	}
+	if r.Offset() != wal.HeaderSize {
+		t.Fatalf("Offset после заголовка = %d", r.Offset())
+	}
+
+	// Чужой файл или другой формат не читается ни в одном режиме.
+	bad := bytes.Clone(data)
+	bad[0] ^= 0xff
+	if err := os.WriteFile(path, bad, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{Dir: dir}, WithWALRecoveryMode(WALRecoverySkipCorrupt)); !errors.Is(err, wal.ErrBadHeader) {
+		t.Fatalf("Open с испорченным заголовком WAL: %v", err)
+	}
+
+	// Оборванный заголовок последнего сегмента — сбой сразу после его создания.
+	if err := os.WriteFile(path, data[:wal.HeaderSize/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{Dir: dir}, WithWALRecoveryMode(WALRecoveryStrict)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Open в строгом режиме с оборванным заголовком: %v", err)
+	}
+	e, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if r := e.WALRecovery(); r.TruncatedBytes != wal.HeaderSize/2 || r.Records != 0 {
+		t.Fatalf("WALRecovery = %+v", r)
+	}
+}
+
+func TestOpen_WALCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestEngine(t, dir)
+	if err := e.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	e.mu.Lock()
+	oldNum := e.logNum
+	e.mu.Unlock()
+	old, err := os.ReadFile(walPath(dir, oldNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1", "2"} {
+		if err := e.Put([]byte("a"), []byte(v)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	crash(e)
+
+	// Старый сегмент уцелел, а MANIFEST не говорит, что он уже сброшен:
+	// без отметки OpCheckpoint a=1 из него перекрыл бы a=2 в SSTable.
+	if err := os.WriteFile(walPath(dir, oldNum), old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(vfs.Default, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LogNum = oldNum
+	if err := writeManifest(vfs.Default, dir, m); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if v, err := e.Get([]byte("a")); err != nil || string(v) != "2" {
+		t.Fatalf("Get(a) = %q, %v", v, err)
+	}
+	if r := e.WALRecovery(); r.Persisted != 1 || r.Records != 0 {
+		t.Fatalf("WALRecovery = %+v", r)
+	}
+	if seq := e.LatestSequence(); seq != 3 {
+		t.Fatalf("LatestSequence = %d", seq)
+	}
+}
+
+func TestEngine_GroupCommit(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.Default)
+	var syncs atomic.Int64
+	fs.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpSync && strings.Contains(name, "wal_") {
+			syncs.Add(1)
+			// Медленный диск: пока идёт fsync, успевают прийти другие записи.
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	})
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithFS(fs), WithSyncWrites())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const writers, perWriter = 16, 20
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := 0; i < perWriter; i++ {
+				if err := e.Put([]byte(fmt.Sprintf("w%02d-%02d", w, i)), []byte("v")); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	n := syncs.Load()
+	if n == 0 || n >= writers*perWriter {
+		t.Fatalf("fsync WAL = %d на %d записей: записи не объединяются", n, writers*perWriter)
+	}
+	if got := e.Stats().WALSyncs; got != uint64(n) {
+		t.Fatalf("WALSyncs = %d, fsync WAL = %d", got, n)
+	}
+	crash(e)
+
+	// Каждая подтверждённая запись на диске.
+	e, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if r := e.WALRecovery(); r.Records != writers*perWriter {
+		t.Fatalf("WALRecovery = %+v", r)
+	}
+}
+
+func TestEngine_WALPreallocate(t *testing.T) {
+	const size = 64 << 10
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithWALPreallocate(size))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := e.Put([]byte(k), []byte("1")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	written := e.Stats().WALBytes
+	it, err := e.GetUpdatesSince(0)
+	if err != nil {
+		t.Fatalf("GetUpdatesSince: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok, err := it.Next(); !ok || err != nil {
+			t.Fatalf("UpdateIterator.Next: %v, %v", ok, err)
+		}
+	}
+	if _, ok, err := it.Next(); ok || err != nil {
+		t.Fatalf("UpdateIterator.Next после конца: %v, %v", ok, err)
+	}
+	_ = it.Close()
+	crash(e)
+
+	path := walPath(dir, num)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != size || written >= size {
+		t.Fatalf("размер сегмента %d, записано %d", st.Size(), written)
+	}
+
+	// Сбой посреди записи: за оборванной записью — нули предвыделения.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{byte(wal.OpPut), 1, 0, 0, 0, 'c'}, written); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	e, err = Open(Options{Dir: dir}, WithWALPreallocate(size))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if r := e.WALRecovery(); r.Records != 2 || r.TruncatedBytes != size-written {
+		t.Fatalf("WALRecovery = %+v", r)
+	}
+	e.mu.Lock()
+	num = e.logNum
+	e.mu.Unlock()
+	written = e.Stats().WALBytes
+	crash(e)
+
+	// Ненулевые байты за концом лога — не обрыв, а повреждение.
+	path = walPath(dir, num)
+	f, err = os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, written+100); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{Dir: dir}); !errors.Is(err, wal.ErrCorrupt) {
+		t.Fatalf("Open с данными за концом лога: %v", err)
+	}
+}
+
+func TestEngine_WALCompression(t *testing.T) {
+	cdr := bytes.Repeat([]byte("MSISDN=79001234567;IMSI=250011234567890;DUR=60;"), 40)
+
+	var buf bytes.Buffer
+	w := wal.NewWriter(&buf)
+	w.SetCompression(64)
+	recs := []wal.Record{
+		{Type: wal.OpPut, Key: []byte("big"), Value: cdr},
+		{Type: wal.OpPut, Key: []byte("small"), Value: []byte("v")},
+	}
+	for _, rec := range recs {
+		if _, err := w.Append(rec); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if buf.Len() >= len(cdr) {
+		t.Fatalf("размер лога %d не меньше значения %d", buf.Len(), len(cdr))
+	}
+	r := wal.NewReader(bytes.NewReader(buf.Bytes()))
+	for _, want := range recs {
+		rec, ok, err := r.Next()
+		if err != nil || !ok || !bytes.Equal(rec.Value, want.Value) || rec.Type != want.Type {
+			t.Fatalf("Next = %+v, %v, %v", rec, ok, err)
+		}
+	}
+
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithWALCompression())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := e.Put([]byte("cdr"), cdr); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := e.Stats().WALBytes; n >= int64(len(cdr)) {
+		t.Fatalf("WALBytes = %d, значение %d байт", n, len(cdr))
+	}
+	crash(e)
+
+	// Сжатый WAL читается и без WALCompression.
+	e, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if v, err := e.Get([]byte("cdr")); err != nil || !bytes.Equal(v, cdr) {
+		t.Fatalf("Get(cdr) = %d байт, %v", len(v), err)
+	}
+}
+
+func TestEngine_WALArchive(t *testing.T) {
+	dir, archive := t.TempDir(), filepath.Join(t.TempDir(), "archive")
+	e, err := Open(Options{Dir: dir}, WithWALArchive(archive))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := e.Put([]byte(k), []byte("1")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// В архиве — отработавшие сегменты со всеми записями, в Dir — только текущий.
+	segs, err := listWALs(vfs.Default, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, num := range segs {
+		f, err := os.Open(walPath(archive, num))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := wal.NewReader(f)
+		if _, err := r.ReadHeader(); err != nil {
+			t.Fatalf("ReadHeader: %v", err)
+		}
+		for {
+			rec, ok, err := r.Next()
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			if !ok {
+				break
+			}
+			if rec.Type == wal.OpPut {
+				keys = append(keys, string(rec.Key))
+			}
+		}
+		_ = f.Close()
+	}
+	if strings.Join(keys, ",") != "a,b" {
+		t.Fatalf("ключи в архиве WAL: %v (сегменты %v)", keys, segs)
+	}
+	if logs, err := listWALs(vfs.Default, dir); err != nil || len(logs) != 1 {
+		t.Fatalf("сегменты в Dir: %v, %v", logs, err)
+	}
+
+	// WALArchiveFunc получает сегменты вместо удаления.
+	var archived []string
+	e, err = Open(Options{Dir: dir}, WithWALArchiveFunc(func(path string) error {
+		archived = append(archived, filepath.Base(path))
+		return os.Remove(path)
+	}))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if err := e.Put([]byte("c"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(archived) != 2 {
+		t.Fatalf("WALArchiveFunc получила %v", archived)
+	}
+}
+
+func TestEngine_WALRecycle(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(Options{Dir: dir}, WithWALRecycle(1))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	logNum := func() uint64 {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.logNum
+	}
+	// Первый сегмент длинный: новый лог, записанный поверх, окажется короче старого.
+	for i := 0; i < 20; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("big%02d", i)), bytes.Repeat([]byte{'v'}, 1024)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	first, err := os.Stat(walPath(dir, logNum()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"x", "y"} {
+		if err := e.Put([]byte(k), []byte("1")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	// Второй Flush записал новый сегмент в файл первого.
+	cur, err := os.Stat(walPath(dir, logNum()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(first, cur) {
+		t.Fatalf("сегмент %d создан заново, а не поверх старого", logNum())
+	}
+	if logs, err := listWALs(vfs.Default, dir); err != nil || len(logs) != 2 {
+		t.Fatalf("сегменты WAL: %v, %v", logs, err)
+	}
+	for _, k := range []string{"k1", "k2"} {
+		if err := e.Put([]byte(k), []byte("2")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	num := logNum()
+	crash(e)
+
+	f, err := os.Open(walPath(dir, num))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := wal.NewReader(f).ReadHeader()
+	_ = f.Close()
+	if err != nil || !hdr.Recycled {
+		t.Fatalf("ReadHeader = %+v, %v", hdr, err)
+	}
+
+	// За концом лога — записи прежнего сегмента: это не повреждение.
+	e, err = Open(Options{Dir: dir}, WithWALRecycle(1), WithWALRecoveryMode(WALRecoveryStrict))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	if r := e.WALRecovery(); r.Records != 2 || r.TruncatedBytes != 0 || len(r.Errors) != 0 {
+		t.Fatalf("WALRecovery = %+v", r)
+	}
+	for _, k := range []string{"big00", "x", "y", "k1", "k2"} {
+		if _, err := e.Get([]byte(k)); err != nil {
+			t.Fatalf("Get(%s): %v", k, err)
+		}
+	}
+}
+
+func TestEngine_ValueLog(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("cdr;"), 1024)
+	e, err := Open(Options{Dir: dir}, WithValueLog(256))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := e.Put([]byte(k), big); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := e.Put([]byte("c"), []byte("short")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	// Длинные значения записаны один раз — в value log, в WAL только ссылки.
+	if st, err := os.Stat(valueLogPath(dir, num)); err != nil || st.Size() != int64(2*len(big)) {
+		t.Fatalf("value log: %v, %v", st, err)
+	}
+	if st, err := os.Stat(walPath(dir, num)); err != nil || st.Size() >= int64(len(big)) {
+		t.Fatalf("WAL: %v, %v", st, err)
+	}
+	check := func(keys ...string) {
+		t.Helper()
+		for _, k := range keys {
+			if v, err := e.Get([]byte(k)); err != nil || !bytes.Equal(v, big) {
+				t.Fatalf("Get(%s) = %d байт, %v", k, len(v), err)
+			}
+		}
+	}
+	check("a", "b")
+	it, err := e.GetUpdatesSince(0)
+	if err != nil {
+		t.Fatalf("GetUpdatesSince: %v", err)
+	}
+	u, ok, err := it.Next()
+	if err != nil || !ok || !bytes.Equal(u.Mutations[0].Value, big) {
+		t.Fatalf("changefeed: %+v, %v, %v", u, ok, err)
+	}
+	_ = it.Close()
+
+	// После Flush таблица хранит ссылки, а после сбоя они восстанавливаются из WAL.
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	check("a", "b")
+	if err := e.Put([]byte("d"), big); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	crash(e)
+	e, err = Open(Options{Dir: dir}, WithValueLog(256))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	check("a", "b", "d")
+	sit := e.Scan(nil, nil)
+	n := 0
+	for {
+		_, v, ok, err := sit.Next()
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if len(v) == len(big) {
+			n++
+		}
+	}
+	_ = sit.Close()
+	if n != 3 {
+		t.Fatalf("Scan: %d длинных значений", n)
+	}
+
+	// Когда на value log не ссылается ни одна таблица, он удаляется.
+	for _, k := range []string{"a", "b", "d"} {
+		if err := e.Delete([]byte(k)); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	if nums, err := listValueLogs(vfs.Default, dir); err != nil || len(nums) != 0 {
+		t.Fatalf("value log после compaction: %v, %v", nums, err)
+	}
+}
+
+func TestEngine_ReplayWAL(t *testing.T) {
+	src := t.TempDir()
+	e := openTestEngine(t, src)
+	for _, k := range []string{"25001-1", "25002-1"} {
+		if err := e.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	txn := e.BeginTxn()
+	for _, k := range []string{"25001-2", "25002-2"} {
+		if err := txn.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("Txn.Put: %v", err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := e.Delete([]byte("25001-1")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	e.mu.Lock()
+	num := e.logNum
+	e.mu.Unlock()
+	crash(e)
+
+	// Новый шард забирает из WAL узла только свой префикс.
+	shard := openTestEngine(t, t.TempDir())
+	defer shard.Close()
+	n, err := shard.ReplayWAL(walPath(src, num), []byte("25001"))
+	if err != nil {
+		t.Fatalf("ReplayWAL: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("ReplayWAL применил %d записей", n)
+	}
+	if v, err := shard.Get([]byte("25001-2")); err != nil || string(v) != "v25001-2" {
+		t.Fatalf("Get(25001-2) = %q, %v", v, err)
+	}
+	for _, k := range []string{"25001-1", "25002-1", "25002-2"} {
+		if _, err := shard.Get([]byte(k)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(%s): %v", k, err)
+		}
+	}
+}
+
+func TestEngine_WALMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	w := wal.NewWriter(&buf)
+	recs := make([]wal.Record, 10)
+	for i := range recs {
+		recs[i] = wal.Record{Type: wal.OpDelete, Key: []byte{byte('a' + i)}}
+	}
+	if _, err := w.AppendBatch(recs, false); err != nil {
+		t.Fatal(err)
+	}
+	if s := w.Stats(); s.Records != 10 || s.Flushes != 1 || s.Syncs != 0 || s.Bytes != int64(buf.Len()) || s.Size != w.Offset() {
+		t.Fatalf("WriterStats = %+v", s)
+	}
+
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := e.Put([]byte(k), []byte("1")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	// Заголовок, затем OpSequence вместе с первой записью и ещё две записи.
+	s := e.Stats()
+	if s.WALRecords != 4 || s.WALWrites != 4 || s.WALBytesWritten != uint64(s.WALBytes) {
+		t.Fatalf("Stats = %+v", s)
+	}
+	before := s.WALBytes
+
+	// Счётчики закрытого сегмента не теряются; в новом — заголовок и OpCheckpoint.
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	s = e.Stats()
+	if s.WALRecords != 5 || s.WALWrites != 6 || s.WALBytesWritten != uint64(before+s.WALBytes) {
+		t.Fatalf("Stats после Flush = %+v", s)
+	}
+}
+
+func TestShardedEngine(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSharded(Options{Dir: dir}, 4)
+	if err != nil {
+		t.Fatalf("OpenSharded: %v", err)
+	}
+	var want []string
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("25001%010d", i)
+		if err := s.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if i%10 == 3 {
+			if err := s.Delete([]byte(k)); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			continue
+		}
+		want = append(want, k+"=v"+k)
+	}
+	// Ключи с общим префиксом расходятся по всем шардам.
+	for i := range s.NumShards() {
+		if n := len(scanAll(t, s.Shard(i).Scan(nil, nil))); n < 20 {
+			t.Fatalf("в шарде %d всего %d ключей", i, n)
+		}
+	}
+	if _, err := s.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := s.Put([]byte("25001"+"9999999999"), []byte("last")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	want = append(want, "250019999999999=last")
+
+	if got := scanAll(t, s.Scan(nil, nil)); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("Scan = %v", got)
+	}
+	got := scanAll(t, s.ScanWithOptions(ScanOptions{Reverse: true, Limit: 3}))
+	if strings.Join(got, " ") != strings.Join([]string{want[len(want)-1], want[len(want)-2], want[len(want)-3]}, " ") {
+		t.Fatalf("Scan в обратном порядке = %v", got)
+	}
+	if got := scanAll(t, s.ScanPrefix([]byte("25001000000001"))); len(got) != 9 {
+		t.Fatalf("ScanPrefix = %v", got)
+	}
+
+	values, errs := s.MultiGet([][]byte{[]byte("250010000000001"), []byte("250010000000003"), []byte("250019999999999")})
+	if string(values[0]) != "v250010000000001" || !errors.Is(errs[1], ErrNotFound) || string(values[2]) != "last" {
+		t.Fatalf("MultiGet = %q, %v", values, errs)
+	}
+	if err := s.CompactRange(nil, nil); err != nil {
+		t.Fatalf("CompactRange: %v", err)
+	}
+	if st := s.Stats(); st.Puts != 201 || st.Deletes != 20 || st.Flushes < 4 {
+		t.Fatalf("Stats = %+v", st)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Число шардов запоминается: другое число — ошибка, 0 — как при создании.
+	if _, err := OpenSharded(Options{Dir: dir}, 8); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("OpenSharded с другим числом шардов: %v", err)
+	}
+	if _, err := OpenSharded(Options{Dir: t.TempDir()}, 0); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("OpenSharded без числа шардов: %v", err)
+	}
+	s, err = OpenSharded(Options{Dir: dir}, 0)
+	if err != nil {
+		t.Fatalf("OpenSharded: %v", err)
+	}
+	defer s.Close()
+	if s.NumShards() != 4 {
+		t.Fatalf("NumShards = %d", s.NumShards())
+	}
+	if v, err := s.Get([]byte("250010000000042")); err != nil || string(v) != "v250010000000042" {
+		t.Fatalf("Get после переоткрытия = %q, %v", v, err)
+	}
+}
+
+func TestEngine_Watch(t *testing.T) {
+	e := openTestEngine(t, t.TempDir())
+	defer e.Close()
+	if err := e.Put([]byte("250010000000001"), []byte("before")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := e.Watch(ctx, []byte("25001"))
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	next := func(ch <-chan WatchEvent) WatchEvent {
+		t.Helper()
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				t.Fatal("канал Watch закрыт")
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("нет события Watch")
+		}
+		return WatchEvent{}
+	}
+	// Запись до Watch, чужой префикс и другие пространства ключей не видны.
+	if err := e.Put([]byte("250020000000001"), []byte("x")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	cf, err := e.CreateColumnFamily("profiles")
+	if err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	if err := cf.Put([]byte("250010000000001"), []byte("x")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := e.Put([]byte("250010000000001"), []byte("v1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	ev := next(ch)
+	if ev.Err != nil || ev.Kind != MutationPut || string(ev.Key) != "250010000000001" || string(ev.Value) != "v1" {
+		t.Fatalf("событие = %+v", ev)
+	}
+	first := ev.Seq
+
+	// Подписка переживает Flush и смену сегмента WAL.
+	if _, err := e.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := e.Delete([]byte("250010000000001")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ev := next(ch); ev.Kind != MutationDelete || ev.Seq <= first {
+		t.Fatalf("событие = %+v", ev)
+	}
+
+	// WatchSince продолжает с заданного номера, если записи ещё в WAL.
+	ch2, err := e.WatchSince(ctx, nil, first)
+	if err != nil {
+		t.Fatalf("WatchSince: %v", err)
+	}
+	if ev := next(ch2); ev.Kind != MutationDelete {
+		t.Fatalf("событие WatchSince = %+v", ev)
+	}
+	ch3, err := e.WatchSince(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("WatchSince: %v", err)
+	}
+	if ev := next(ch3); !errors.Is(ev.Err, ErrUpdatesUnavailable) {
+		t.Fatalf("WatchSince(0) после Flush = %+v", ev)
+	}
+
+	// Отмена ctx закрывает канал, закрытие движка — с ошибкой ErrClosed.
+	ctx4, cancel4 := context.WithCancel(context.Background())
+	ch4, err := e.Watch(ctx4, nil)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	cancel4()
+	if _, ok := <-ch4; ok {
+		t.Fatal("канал открыт после отмены ctx")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if ev := next(ch); !errors.Is(ev.Err, ErrClosed) {
+		t.Fatalf("событие после Close = %+v", ev)
+	}
+	if _, err := e.Watch(ctx, nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Watch после Close: %v", err)
+	}
+}
+
+func TestEngine_WatchTail(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.Default)
+	var opens atomic.Int64
+	fs.SetInjector(func(op vfs.Op, name string) error {
+		if op == vfs.OpOpen && strings.Contains(name, "wal_") {
+			opens.Add(1)
+		}
+		return nil
+	})
+	e, err := Open(Options{Dir: t.TempDir(), WALRecycleCount: 1}, WithFS(fs))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := e.Watch(ctx, nil)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	next := func() WatchEvent {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			if ev.Err != nil {
+				t.Fatalf("событие Watch: %v", ev.Err)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("нет события Watch")
+		}
+		return WatchEvent{}
+	}
+
+	// Подписчик дочитывает хвост открытого сегмента, а не перебирает сегменты
+	// при каждой записи. Переживает смену сегментов, в том числе переиспользованных.
+	var last uint64
+	for round := 0; round < 3; round++ {
+		before := opens.Load()
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("k%d-%02d", round, i)
+			if err := e.Put([]byte(key), []byte("v")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			ev := next()
+			if string(ev.Key) != key || ev.Seq <= last {
+				t.Fatalf("событие = %+v, ждали %s после %d", ev, key, last)
+			}
+			last = ev.Seq
+		}
+		if n := opens.Load() - before; n > 2 {
+			t.Fatalf("раунд %d: сегменты WAL открыты %d раз на 50 записей", round, n)
+		}
+		if _, err := e.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kvschool/internal/vfs"
+)
+
+const manifestName = "MANIFEST"
+
+// manifest — список живых SSTable по уровням и граница живых сегментов WAL.
+// Переписывается целиком через временный файл и rename, поэтому
+// после сбоя на диске всегда лежит либо старая, либо новая версия.
+type manifest struct {
+	NextFileNum uint64 `json:"next_file_num"`
+	// LogNum — номер самого старого сегмента WAL, данные которого ещё не сброшены в SSTable.
+	// Сегменты с меньшими номерами можно удалять.
+	LogNum uint64          `json:"log_num"`
+	Tables []manifestTable `json:"tables"`
+	// LastSequence — номер последней записи WAL на момент записи MANIFEST. Нужен, когда
+	// все сегменты WAL пусты; иначе номера восстанавливаются по записям OpSequence.
+	LastSequence uint64 `json:"last_sequence,omitempty"`
+	// Comparator — имя компаратора, которым упорядочены ключи. Пустое в MANIFEST,
+	// записанных до появления поля, означает BytewiseComparator.
+	Comparator string `json:"comparator,omitempty"`
+	// ColumnFamilies — пространства ключей, кроме default (у него всегда ID 0).
+	ColumnFamilies []manifestColumnFamily `json:"column_families,omitempty"`
+}
+
+type manifestTable struct {
+	Num   uint64 `json:"num"`
+	Level int    `json:"level"`
+	CF    uint32 `json:"cf,omitempty"`
+}
+
+type manifestColumnFamily struct {
+	ID   uint32 `json:"id"`
+	Name string `json:"name"`
+	// Building — пространство вторичного индекса ещё заполняется по существующим данным.
+	Building bool `json:"building,omitempty"`
+}
+
+func readManifest(fs vfs.FS, dir string) (manifest, error) {
+	f, err := fs.Open(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest{NextFileNum: 1}, nil
+	}
+	if err != nil {
+		return manifest{}, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return manifest{}, err
+	}
+	return unmarshalManifest(b)
+}
+
+func unmarshalManifest(b []byte) (manifest, error) {
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("lsm: повреждён %s: %w", manifestName, err)
+	}
+	return m, nil
+}
+
+func marshalManifest(m manifest) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func writeManifest(fs vfs.FS, dir string, m manifest) error {
+	b, err := marshalManifest(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, filepath.Join(dir, manifestName))
+}
+
+func tablePath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("data_%d.sst", num))
+}
+
+func walPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wal_%d.log", num))
+}
+
+// listWALs возвращает номера сегментов WAL в директории по возрастанию.
+func listWALs(fs vfs.FS, dir string) ([]uint64, error) {
+	return listNumbered(fs, dir, "wal_", ".log")
+}
+
+// listNumbered возвращает по возрастанию номера файлов директории с именами prefix+номер+suffix.
+func listNumbered(fs vfs.FS, dir, prefix, suffix string) ([]uint64, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	nums := make([]uint64, 0, len(names))
+	for _, name := range names {
+		base, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		base, ok = strings.CutSuffix(base, suffix)
+		if !ok {
+			continue
+		}
+		num, err := strconv.ParseUint(base, 10, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
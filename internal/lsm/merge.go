@@ -0,0 +1,164 @@
+package lsm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"kvschool/internal/skiplist"
+	"kvschool/internal/wal"
+)
+
+// ErrNoMergeOperator возвращается Merge (и чтением ключа с операндами), если в Options
+// не задан MergeOperator.
+var ErrNoMergeOperator = errors.New("lsm: не задан MergeOperator")
+
+// MergeOperator объединяет существующее значение ключа с операндами Merge.
+// existing == nil, если значения нет (ключ не записан, удалён или истёк по TTL);
+// operands идут от старого к новому. Функция должна быть детерминированной:
+// она вызывается при чтении и при compaction, возможно многократно для одних и тех же данных.
+type MergeOperator func(key, existing []byte, operands [][]byte) ([]byte, error)
+
+// Uint64AddOperator складывает 8-байтовые счётчики big-endian — например, объём трафика абонента.
+// Каждый операнд и существующее значение должны быть ровно 8 байт.
+func Uint64AddOperator(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum uint64
+	if existing != nil {
+		if len(existing) != 8 {
+			return nil, fmt.Errorf("lsm: счётчик %q: длина значения %d, ожидалось 8", key, len(existing))
+		}
+		sum = binary.BigEndian.Uint64(existing)
+	}
+	for _, op := range operands {
+		if len(op) != 8 {
+			return nil, fmt.Errorf("lsm: счётчик %q: длина операнда %d, ожидалось 8", key, len(op))
+		}
+		sum += binary.BigEndian.Uint64(op)
+	}
+	return binary.BigEndian.AppendUint64(nil, sum), nil
+}
+
+// Merge записывает операнд для key. Операнды применяются MergeOperator лениво — при чтении
+// и compaction, поэтому счётчики обновляются без чтения текущего значения.
+func (e *Engine) Merge(key, operand []byte) error { return e.merge(e.defaultCF, key, operand) }
+
+func (e *Engine) merge(cf *columnFamily, key, operand []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if e.options.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats.merges++
+	raw, err := e.memtableMerge(cf, key, operand)
+	if err != nil {
+		return err
+	}
+	return e.writeLocked(context.Background(), cf, wal.Record{Type: wal.OpMerge, Key: key, Value: operand}, raw)
+}
+
+// memtableMerge вычисляет новое значение key в Memtable после Merge(key, operand).
+// Если в Memtable уже операнды, новый дописывается к ним. Если там значение или tombstone,
+// старые версии ниже больше не нужны, и операнд применяется сразу.
+// Вызывается под e.mu.
+func (e *Engine) memtableMerge(cf *columnFamily, key, operand []byte) ([]byte, error) {
+	raw, err := cf.memtable.Get(key)
+	if err == skiplist.ErrNotFound {
+		return appendOperand(nil, operand), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	en, err := decodeValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	if en.kind == kindMerge {
+		return appendOperand(raw, operand), nil
+	}
+	if en, err = e.loadValue(en); err != nil {
+		return nil, err
+	}
+	base, expiresAt := mergeBase(en, e.now().UnixNano())
+	v, err := e.options.MergeOperator(key, base, [][]byte{operand})
+	if err != nil {
+		return nil, err
+	}
+	return encodeMerged(v, expiresAt), nil
+}
+
+// mergeBase возвращает значение, к которому применяются операнды:
+// nil для tombstone и истёкшего TTL. Срок жизни базового значения сохраняется.
+func mergeBase(en entry, now int64) (value []byte, expiresAt int64) {
+	if en.kind == kindTombstone || en.expired(now) {
+		return nil, 0
+	}
+	return en.value, en.expiresAt
+}
+
+func encodeMerged(value []byte, expiresAt int64) []byte {
+	if expiresAt != 0 {
+		return encodeValueTTL(value, expiresAt)
+	}
+	return encodeValue(kindValue, value)
+}
+
+// fullMerge применяет к base операнды из merges (значения kindMerge от свежих к старым).
+func (e *Engine) fullMerge(key, base []byte, merges []entry) ([]byte, error) {
+	if e.options.MergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	var operands [][]byte
+	for i := len(merges) - 1; i >= 0; i-- {
+		ops, err := decodeOperands(merges[i].value)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, ops...)
+	}
+	return e.options.MergeOperator(key, base, operands)
+}
+
+// compactionCollapse возвращает функцию для mergingIterator.collapse при compaction c.
+// Если среди версий есть базовое значение (или ниже ключ больше не встречается),
+// операнды применяются, иначе они склеиваются в одно значение kindMerge.
+func (e *Engine) compactionCollapse(c *compaction, now int64) func(key []byte, versions [][]byte) ([]byte, error) {
+	return func(key []byte, versions [][]byte) ([]byte, error) {
+		var merges []entry
+		for _, raw := range versions {
+			en, err := decodeValue(raw)
+			if err != nil {
+				return nil, err
+			}
+			if en.kind == kindMerge {
+				merges = append(merges, en)
+				continue
+			}
+			if en, err = e.loadValue(en); err != nil {
+				return nil, err
+			}
+			base, expiresAt := mergeBase(en, now)
+			v, err := e.fullMerge(key, base, merges)
+			if err != nil {
+				return nil, err
+			}
+			return encodeMerged(v, expiresAt), nil
+		}
+		if c.isBaseLevelForKey(key) {
+			v, err := e.fullMerge(key, nil, merges)
+			if err != nil {
+				return nil, err
+			}
+			return encodeValue(kindValue, v), nil
+		}
+		raw := []byte{byte(kindMerge)}
+		for i := len(merges) - 1; i >= 0; i-- {
+			raw = append(raw, merges[i].value...)
+		}
+		return raw, nil
+	}
+}
@@ -0,0 +1,125 @@
+package lsm
+
+import (
+	"sort"
+
+	"kvschool/internal/skiplist"
+)
+
+// MultiGet ищет несколько ключей за один проход. Ключи сортируются, и каждая
+// SSTable просматривается один раз для всех попадающих в её диапазон ключей,
+// а каждый её блок читается не более одного раза.
+// values[i] и errs[i] соответствуют keys[i]; отсутствующий ключ даёт ErrNotFound.
+func (e *Engine) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	return e.multiGet(e.defaultCF, keys)
+}
+
+func (e *Engine) multiGet(cf *columnFamily, keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	lookups := make([]lookup, len(keys))
+
+	// order — индексы keys по возрастанию ключа; pending — ещё не найденные из них.
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return cf.cmp.Compare(keys[order[a]], keys[order[b]]) < 0 })
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stats.gets += uint64(len(keys))
+
+	var pending []int
+	for _, i := range order {
+		raw, err := cf.memtable.Get(keys[i])
+		switch {
+		case err == skiplist.ErrNotFound:
+			pending = append(pending, i)
+		case err != nil:
+			errs[i] = err
+		default:
+			if more, err := lookups[i].add(raw); err != nil {
+				errs[i] = err
+			} else if more {
+				pending = append(pending, i)
+			}
+		}
+	}
+
+	for t := len(cf.levels[0]) - 1; t >= 0 && len(pending) > 0; t-- {
+		pending = e.multiGetTable(cf.cmp, cf.levels[0][t], keys, pending, lookups, errs)
+	}
+	for level := 1; level < numLevels && len(pending) > 0; level++ {
+		// Таблицы уровня не пересекаются: ключи каждой таблицы идут подряд в pending.
+		var next []int
+		for start := 0; start < len(pending); {
+			t := findTable(cf.cmp, cf.levels[level], keys[pending[start]])
+			if t == nil {
+				next = append(next, pending[start])
+				start++
+				continue
+			}
+			end := start + 1
+			for end < len(pending) && cf.cmp.Compare(keys[pending[end]], t.largest()) <= 0 {
+				end++
+			}
+			next = append(next, e.multiGetTable(cf.cmp, t, keys, pending[start:end], lookups, errs)...)
+			start = end
+		}
+		pending = next
+	}
+
+	now := e.now().UnixNano()
+	for i := range keys {
+		if errs[i] == nil {
+			values[i], errs[i] = e.resolve(keys[i], &lookups[i], now)
+		}
+	}
+	return values, errs
+}
+
+// multiGetTable ищет в таблице ключи pending (по возрастанию), попадающие в её диапазон,
+// и возвращает те, для которых нужны более старые версии. Вызывается под e.mu.
+func (e *Engine) multiGetTable(cmp Comparator, t *table, keys [][]byte, pending []int, lookups []lookup, errs []error) []int {
+	var in []int
+	var rest []int
+	for _, i := range pending {
+		if cmp.Compare(keys[i], t.smallest()) < 0 || cmp.Compare(keys[i], t.largest()) > 0 {
+			rest = append(rest, i)
+		} else {
+			in = append(in, i)
+		}
+	}
+	if len(in) == 0 {
+		return pending
+	}
+
+	batch := make([][]byte, len(in))
+	for j, i := range in {
+		batch[j] = keys[i]
+	}
+	var raws [][]byte
+	var found []bool
+	sst, err := e.reader(t)
+	if err == nil {
+		raws, found, err = sst.MultiGet(batch)
+	}
+	for j, i := range in {
+		switch {
+		case err != nil:
+			errs[i] = err
+		case !found[j]:
+			rest = append(rest, i)
+		default:
+			if more, err := lookups[i].add(raws[j]); err != nil {
+				errs[i] = err
+			} else if more {
+				rest = append(rest, i)
+			}
+		}
+	}
+	// Порядок pending нужен для группировки по таблицам уровня.
+	sort.Slice(rest, func(a, b int) bool { return cmp.Compare(keys[rest[a]], keys[rest[b]]) < 0 })
+	return rest
+}
@@ -0,0 +1,427 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"kvschool/internal/sstable"
+	"kvschool/internal/vfs"
+)
+
+const (
+	// DefaultMemtableFlushThreshold — порог Flush, если он не задан явно.
+	DefaultMemtableFlushThreshold = 4 << 20
+
+	// MinBlockSize и MaxBlockSize ограничивают размер блока SSTable:
+	// слишком маленький блок раздувает sparse index, слишком большой — чтение на один Get.
+	MinBlockSize = 64
+	MaxBlockSize = 4 << 20
+
+	// DefaultL0SlowdownWritesTrigger и DefaultL0StopWritesTrigger — пороги замедления
+	// и остановки записи по числу таблиц L0, если они не заданы явно.
+	DefaultL0SlowdownWritesTrigger = 8
+	DefaultL0StopWritesTrigger     = 12
+)
+
+// ErrInvalidOptions возвращается Open при некорректных параметрах.
+var ErrInvalidOptions = errors.New("lsm: некорректные параметры")
+
+// Options задаёт параметры LSM движка.
+// Нулевые значения полей заменяются значениями по умолчанию.
+type Options struct {
+	Dir string // Директория для хранения WAL и SSTables
+
+	// Максимальный размер Memtable перед сбросом на диск (Flush).
+	// В телекоме это баланс между памятью и частотой I/O.
+	MemtableFlushThreshold int
+
+	// BlockSize — размер блока данных SSTable (по умолчанию sstable.DefaultBlockSize).
+	BlockSize int
+
+	// Comparator задаёт порядок ключей в Memtable, SSTable и при слиянии (по умолчанию
+	// BytewiseComparator). Имя компаратора записывается в MANIFEST, и Open с другим
+	// компаратором завершается ошибкой. Вторичные индексы всегда упорядочены побайтово.
+	Comparator Comparator
+
+	// MaxBackgroundCompactions — сколько compaction может выполняться одновременно (по умолчанию 1).
+	MaxBackgroundCompactions int
+
+	// L0SlowdownWritesTrigger — с какого числа таблиц L0 каждая запись задерживается,
+	// давая compaction догнать поток. L0StopWritesTrigger — с какого числа запись
+	// блокируется до завершения compaction. Каждая таблица L0 — лишнее чтение на Get.
+	L0SlowdownWritesTrigger int
+	L0StopWritesTrigger     int
+
+	// RateLimitBytesPerSec ограничивает скорость записи SSTable при Flush и compaction
+	// (0 — без ограничения).
+	RateLimitBytesPerSec int64
+
+	// ParanoidChecks включает проверку контрольных сумм блоков и порядка ключей при каждом
+	// чтении SSTable, а также полную проверку каждой таблицы после Flush и compaction
+	// до записи в MANIFEST. Стоит дополнительного CPU и чтения с диска.
+	ParanoidChecks bool
+
+	// WALSyncInterval — как часто фоновая горутина делает fsync WAL, если в него писали
+	// (0 — никогда: запись переживает падение процесса, но не отключение питания).
+	// При сбое питания теряются записи не более чем за последний интервал.
+	WALSyncInterval time.Duration
+
+	// SyncWrites — делать fsync WAL до подтверждения каждой записи: подтверждённая запись
+	// переживает отключение питания. Записи из одновременных горутин подтверждаются одним
+	// общим fsync (групповая фиксация). Читатели видят запись сразу, ещё до fsync.
+	SyncWrites bool
+
+	// WALPreallocateSize — до скольких байт новый сегмент WAL сразу дополняется нулями,
+	// чтобы дозапись не расширяла файл и fsync не сбрасывал каждый раз его метаданные
+	// (0 — без предвыделения). Разумно взять чуть больше MemtableFlushThreshold.
+	WALPreallocateSize int64
+
+	// WALCompression включает сжатие значений в WAL (Snappy, не короче 64 байт):
+	// длинные CDR — основной объём записи в WAL. Стоит CPU на каждую запись.
+	WALCompression bool
+
+	// WALArchiveDir — куда переносить сегменты WAL, данные которых уже в SSTable, вместо
+	// удаления (по умолчанию удаляются). Архив вместе с резервной копией позволяет потом
+	// восстановить состояние на любой момент. Директория должна быть на той же файловой
+	// системе, что и Dir; очищать её — забота пользователя.
+	WALArchiveDir string
+
+	// WALArchiveFunc, если задана, вызывается вместо удаления такого сегмента с его путём
+	// и сама распоряжается файлом (например, выгружает его и удаляет). Вызывается под
+	// блокировкой движка, поэтому не должна обращаться к Engine. Ошибка оставляет сегмент
+	// на месте: после следующего Flush он будет передан снова.
+	WALArchiveFunc func(path string) error
+
+	// WALRecycleCount — сколько отработавших сегментов WAL держать для повторного
+	// использования (0 — удалять сразу). Новый сегмент тогда пишется поверх старого файла,
+	// без создания файла и fsync метаданных при каждой смене сегмента. Несовместимо
+	// с архивом WAL. Повреждение посреди такого сегмента неотличимо от конца лога:
+	// записи за ним теряются даже при WALRecoveryStrict.
+	WALRecycleCount int
+
+	// ValueLogThreshold — с какой длины значение Put пишется один раз в value log рядом
+	// с WAL, а в WAL и SSTable хранится лишь ссылка на него (0 — значения хранятся как есть).
+	// Избавляет от повторной записи многокилобайтных CDR при Flush и compaction, но каждое
+	// чтение такого значения — лишнее обращение к диску. Место value log освобождается
+	// целым файлом, когда на него не ссылается ни одна таблица. Значения пакетов, транзакций,
+	// Put с TTL и Put при вторичных индексах пишутся, как раньше.
+	ValueLogThreshold int
+
+	// WALRecoveryMode — что делать при восстановлении с повреждённым WAL
+	// (по умолчанию WALRecoveryTolerateTornTail). Итог — в Engine.WALRecovery.
+	WALRecoveryMode WALRecoveryMode
+
+	// PrefixLength — длина префикса ключа (например, 6 цифр IMSI), по которому для каждой
+	// таблицы строится фильтр Блума. Scan в пределах одного префикса пропускает таблицы,
+	// где такого префикса нет. 0 — фильтры не строятся.
+	PrefixLength int
+
+	// MaxOpenFiles — сколько SSTable держать открытыми одновременно (по умолчанию
+	// DefaultMaxOpenFiles). Остальные открываются по требованию, вытесняя давно не читанные.
+	// Файлы WAL и MANIFEST в этот предел не входят.
+	MaxOpenFiles int
+
+	// Retention — окно хранения: таблицы, все записи которых старше окна, удаляются целиком,
+	// без переписывания данных compaction (0 — данные хранятся бессрочно). Подходит для
+	// журналов вроде CDR, где ключи не перезаписываются: удалённая таблица могла закрывать
+	// более старые версии своих ключей, и те снова станут видны, если их таблица ещё жива.
+	Retention time.Duration
+
+	// TxnLockTimeout — сколько транзакция ждёт блокировку ключа (по умолчанию DefaultTxnLockTimeout).
+	TxnLockTimeout time.Duration
+
+	// MergeOperator применяет операнды Engine.Merge (по умолчанию не задан, и Merge недоступен).
+	MergeOperator MergeOperator
+
+	// Indexes — вторичные индексы по значениям пространства default. Индекс, однажды
+	// созданный в базе, нужно регистрировать при каждом Open.
+	Indexes []Index
+
+	// ExpvarName — имя, под которым счётчики Stats публикуются через expvar (по умолчанию
+	// не публикуются). Их подхватывает любой стандартный мониторинг процесса, например /debug/vars.
+	// Одно имя может занимать только один открытый движок.
+	ExpvarName string
+
+	// EventListeners получают уведомления о Flush, compaction и смене сегмента WAL.
+	EventListeners []EventListener
+
+	// FS — файловая система движка (по умолчанию vfs.Default). В тестах сюда подставляется
+	// vfs.FaultFS. Напрямую через ОС работают только Restore, проверка внешних таблиц
+	// в Ingest и создание директории Checkpoint.
+	FS vfs.FS
+
+	// Logger получает сообщения о Flush и compaction (по умолчанию сообщения отбрасываются).
+	Logger *log.Logger
+
+	// Clock — источник текущего времени для TTL (по умолчанию time.Now). Тесты фронтендов
+	// подставляют сюда управляемые часы, чтобы проверять истечение без ожидания.
+	Clock func() time.Time
+}
+
+// Option — функциональная опция для Open.
+type Option func(*Options)
+
+// WithBlockSize задаёт размер блока SSTable.
+func WithBlockSize(n int) Option {
+	return func(o *Options) { o.BlockSize = n }
+}
+
+// WithComparator задаёт порядок ключей.
+func WithComparator(c Comparator) Option {
+	return func(o *Options) { o.Comparator = c }
+}
+
+// WithEventListener добавляет слушателя событий движка.
+func WithEventListener(l EventListener) Option {
+	return func(o *Options) { o.EventListeners = append(o.EventListeners, l) }
+}
+
+// WithIndex регистрирует вторичный индекс.
+func WithIndex(name string, extract func(value []byte) []byte) Option {
+	return func(o *Options) { o.Indexes = append(o.Indexes, Index{Name: name, Extract: extract}) }
+}
+
+// WithExpvar публикует счётчики движка через expvar под именем name.
+func WithExpvar(name string) Option {
+	return func(o *Options) { o.ExpvarName = name }
+}
+
+// WithFS задаёт файловую систему движка.
+func WithFS(fs vfs.FS) Option {
+	return func(o *Options) { o.FS = fs }
+}
+
+// WithClock задаёт источник текущего времени движка.
+func WithClock(now func() time.Time) Option {
+	return func(o *Options) { o.Clock = now }
+}
+
+// WithLogger задаёт логгер движка.
+func WithLogger(l *log.Logger) Option {
+	return func(o *Options) { o.Logger = l }
+}
+
+// WithMergeOperator задаёт функцию слияния для Engine.Merge.
+func WithMergeOperator(m MergeOperator) Option {
+	return func(o *Options) { o.MergeOperator = m }
+}
+
+// WithL0WriteTriggers задаёт пороги замедления и остановки записи по числу таблиц L0.
+func WithL0WriteTriggers(slowdown, stop int) Option {
+	return func(o *Options) {
+		o.L0SlowdownWritesTrigger = slowdown
+		o.L0StopWritesTrigger = stop
+	}
+}
+
+// WithParanoidChecks включает режим ParanoidChecks.
+func WithParanoidChecks() Option {
+	return func(o *Options) { o.ParanoidChecks = true }
+}
+
+// WithRateLimit ограничивает скорость записи Flush и compaction в байтах в секунду.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(o *Options) { o.RateLimitBytesPerSec = bytesPerSec }
+}
+
+// WithWALSyncInterval включает периодический fsync WAL.
+func WithWALSyncInterval(d time.Duration) Option {
+	return func(o *Options) { o.WALSyncInterval = d }
+}
+
+// WithSyncWrites включает fsync WAL при каждой записи.
+func WithSyncWrites() Option {
+	return func(o *Options) { o.SyncWrites = true }
+}
+
+// WithWALPreallocate включает предвыделение сегментов WAL размером size байт.
+func WithWALPreallocate(size int64) Option {
+	return func(o *Options) { o.WALPreallocateSize = size }
+}
+
+// WithWALCompression включает сжатие значений в WAL.
+func WithWALCompression() Option {
+	return func(o *Options) { o.WALCompression = true }
+}
+
+// WithWALArchive переносит отработавшие сегменты WAL в dir вместо удаления.
+func WithWALArchive(dir string) Option {
+	return func(o *Options) { o.WALArchiveDir = dir }
+}
+
+// WithWALArchiveFunc передаёт отработавшие сегменты WAL в fn вместо удаления.
+func WithWALArchiveFunc(fn func(path string) error) Option {
+	return func(o *Options) { o.WALArchiveFunc = fn }
+}
+
+// WithWALRecycle включает повторное использование до n отработавших сегментов WAL.
+func WithWALRecycle(n int) Option {
+	return func(o *Options) { o.WALRecycleCount = n }
+}
+
+// WithValueLog выносит значения Put не короче threshold байт в value log.
+func WithValueLog(threshold int) Option {
+	return func(o *Options) { o.ValueLogThreshold = threshold }
+}
+
+// WithWALRecoveryMode задаёт режим восстановления WAL.
+func WithWALRecoveryMode(m WALRecoveryMode) Option {
+	return func(o *Options) { o.WALRecoveryMode = m }
+}
+
+// WithPrefixLength задаёт длину префикса для фильтров Scan.
+func WithPrefixLength(n int) Option {
+	return func(o *Options) { o.PrefixLength = n }
+}
+
+// WithMaxOpenFiles задаёт предел открытых SSTable.
+func WithMaxOpenFiles(n int) Option {
+	return func(o *Options) { o.MaxOpenFiles = n }
+}
+
+// WithRetention задаёт окно хранения данных.
+func WithRetention(d time.Duration) Option {
+	return func(o *Options) { o.Retention = d }
+}
+
+// WithTxnLockTimeout задаёт время ожидания блокировки ключа в транзакциях.
+func WithTxnLockTimeout(d time.Duration) Option {
+	return func(o *Options) { o.TxnLockTimeout = d }
+}
+
+// WithMaxBackgroundCompactions задаёт предел одновременных фоновых compaction.
+func WithMaxBackgroundCompactions(n int) Option {
+	return func(o *Options) { o.MaxBackgroundCompactions = n }
+}
+
+// WithMemtableFlushThreshold задаёт порог Flush.
+func WithMemtableFlushThreshold(n int) Option {
+	return func(o *Options) { o.MemtableFlushThreshold = n }
+}
+
+// Comparator задаёт порядок ключей.
+// Name идентифицирует порядок: данные, записанные с одним порядком, нельзя читать с другим.
+type Comparator interface {
+	Compare(a, b []byte) int
+	Name() string
+}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int { return bytes.Compare(a, b) }
+func (bytewiseComparator) Name() string            { return "kvschool.BytewiseComparator" }
+
+// BytewiseComparator — лексикографический порядок bytes.Compare.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+// withDefaults применяет опции, заполняет значения по умолчанию и проверяет результат.
+func (o Options) withDefaults(optFns ...Option) (Options, error) {
+	for _, fn := range optFns {
+		fn(&o)
+	}
+	if o.Dir == "" {
+		return o, fmt.Errorf("%w: не задан Dir", ErrInvalidOptions)
+	}
+	if o.MemtableFlushThreshold == 0 {
+		o.MemtableFlushThreshold = DefaultMemtableFlushThreshold
+	}
+	if o.MemtableFlushThreshold < 0 {
+		return o, fmt.Errorf("%w: MemtableFlushThreshold=%d должен быть > 0", ErrInvalidOptions, o.MemtableFlushThreshold)
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = sstable.DefaultBlockSize
+	}
+	if o.BlockSize < MinBlockSize || o.BlockSize > MaxBlockSize {
+		return o, fmt.Errorf("%w: BlockSize=%d вне диапазона [%d, %d]", ErrInvalidOptions, o.BlockSize, MinBlockSize, MaxBlockSize)
+	}
+	if o.MaxBackgroundCompactions == 0 {
+		o.MaxBackgroundCompactions = 1
+	}
+	if o.MaxBackgroundCompactions < 0 {
+		return o, fmt.Errorf("%w: MaxBackgroundCompactions=%d должен быть > 0", ErrInvalidOptions, o.MaxBackgroundCompactions)
+	}
+	if o.L0SlowdownWritesTrigger == 0 {
+		o.L0SlowdownWritesTrigger = DefaultL0SlowdownWritesTrigger
+	}
+	if o.L0StopWritesTrigger == 0 {
+		o.L0StopWritesTrigger = DefaultL0StopWritesTrigger
+	}
+	if o.L0SlowdownWritesTrigger < 0 || o.L0StopWritesTrigger < o.L0SlowdownWritesTrigger {
+		return o, fmt.Errorf("%w: нужно 0 < L0SlowdownWritesTrigger=%d <= L0StopWritesTrigger=%d",
+			ErrInvalidOptions, o.L0SlowdownWritesTrigger, o.L0StopWritesTrigger)
+	}
+	// Иначе запись остановится раньше, чем L0 наберёт таблиц на compaction, и не возобновится.
+	if o.L0StopWritesTrigger < l0CompactionTrigger {
+		return o, fmt.Errorf("%w: L0StopWritesTrigger=%d меньше порога compaction L0 (%d)",
+			ErrInvalidOptions, o.L0StopWritesTrigger, l0CompactionTrigger)
+	}
+	if o.RateLimitBytesPerSec < 0 {
+		return o, fmt.Errorf("%w: RateLimitBytesPerSec=%d не может быть отрицательным", ErrInvalidOptions, o.RateLimitBytesPerSec)
+	}
+	if o.PrefixLength < 0 {
+		return o, fmt.Errorf("%w: PrefixLength=%d не может быть отрицательным", ErrInvalidOptions, o.PrefixLength)
+	}
+	if o.WALSyncInterval < 0 {
+		return o, fmt.Errorf("%w: WALSyncInterval=%v не может быть отрицательным", ErrInvalidOptions, o.WALSyncInterval)
+	}
+	if o.WALPreallocateSize < 0 {
+		return o, fmt.Errorf("%w: WALPreallocateSize=%d не может быть отрицательным", ErrInvalidOptions, o.WALPreallocateSize)
+	}
+	if o.WALArchiveDir != "" && o.WALArchiveFunc != nil {
+		return o, fmt.Errorf("%w: WALArchiveDir и WALArchiveFunc взаимоисключающие", ErrInvalidOptions)
+	}
+	if o.WALRecycleCount < 0 {
+		return o, fmt.Errorf("%w: WALRecycleCount=%d не может быть отрицательным", ErrInvalidOptions, o.WALRecycleCount)
+	}
+	if o.ValueLogThreshold < 0 {
+		return o, fmt.Errorf("%w: ValueLogThreshold=%d не может быть отрицательным", ErrInvalidOptions, o.ValueLogThreshold)
+	}
+	if o.WALRecycleCount > 0 && (o.WALArchiveDir != "" || o.WALArchiveFunc != nil) {
+		return o, fmt.Errorf("%w: WALRecycleCount несовместим с архивом WAL", ErrInvalidOptions)
+	}
+	if o.WALRecoveryMode < WALRecoveryTolerateTornTail || o.WALRecoveryMode > WALRecoverySkipCorrupt {
+		return o, fmt.Errorf("%w: неизвестный WALRecoveryMode=%d", ErrInvalidOptions, o.WALRecoveryMode)
+	}
+	if o.MaxOpenFiles == 0 {
+		o.MaxOpenFiles = DefaultMaxOpenFiles
+	}
+	if o.MaxOpenFiles < 0 {
+		return o, fmt.Errorf("%w: MaxOpenFiles=%d должен быть > 0", ErrInvalidOptions, o.MaxOpenFiles)
+	}
+	if o.Retention < 0 {
+		return o, fmt.Errorf("%w: Retention=%v не может быть отрицательным", ErrInvalidOptions, o.Retention)
+	}
+	if o.TxnLockTimeout == 0 {
+		o.TxnLockTimeout = DefaultTxnLockTimeout
+	}
+	if o.TxnLockTimeout < 0 {
+		return o, fmt.Errorf("%w: TxnLockTimeout=%v не может быть отрицательным", ErrInvalidOptions, o.TxnLockTimeout)
+	}
+	if o.Comparator == nil {
+		o.Comparator = BytewiseComparator
+	}
+	if o.Comparator.Name() == "" {
+		return o, fmt.Errorf("%w: у компаратора пустое имя", ErrInvalidOptions)
+	}
+	seen := make(map[string]bool, len(o.Indexes))
+	for _, idx := range o.Indexes {
+		if idx.Name == "" || idx.Extract == nil || seen[idx.Name] {
+			return o, fmt.Errorf("%w: индекс %q: нужны уникальное имя и Extract", ErrInvalidOptions, idx.Name)
+		}
+		seen[idx.Name] = true
+	}
+	if o.FS == nil {
+		o.FS = vfs.Default
+	}
+	if o.Logger == nil {
+		o.Logger = log.New(io.Discard, "", 0)
+	}
+	if o.Clock == nil {
+		o.Clock = time.Now
+	}
+	return o, nil
+}
@@ -0,0 +1,121 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+)
+
+const (
+	// propPrefixFilter — свойство таблицы: фильтр Блума по префиксам ключей
+	// (длина префикса 4 байта big-endian, число хешей 1 байт, затем биты).
+	propPrefixFilter = "lsm.prefix-filter"
+
+	// prefixFilterBitsPerKey и prefixFilterHashes дают около 1% ложных срабатываний.
+	prefixFilterBitsPerKey = 10
+	prefixFilterHashes     = 6
+)
+
+// prefixFilter — фильтр Блума по префиксам фиксированной длины: Scan по префиксу
+// пропускает таблицы, в которых ключей с этим префиксом точно нет.
+type prefixFilter struct {
+	prefixLen int
+	hashes    int
+	bits      []byte
+}
+
+// prefixHash возвращает две половины 64-битного FNV-1a для двойного хеширования.
+func prefixHash(p []byte) (h1, h2 uint32) {
+	h := fnv.New64a()
+	h.Write(p)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (f *prefixFilter) mayContain(prefix []byte) bool {
+	if len(prefix) != f.prefixLen {
+		return true
+	}
+	h1, h2 := prefixHash(prefix)
+	n := uint32(len(f.bits) * 8)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % n
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func decodePrefixFilter(b []byte) *prefixFilter {
+	if len(b) < 6 {
+		return nil
+	}
+	f := &prefixFilter{prefixLen: int(binary.BigEndian.Uint32(b)), hashes: int(b[4]), bits: b[5:]}
+	if len(f.bits) == 0 || f.hashes == 0 {
+		return nil
+	}
+	return f
+}
+
+// prefixFilterCollector собирает префиксы ключей записываемой таблицы.
+// Ключи приходят по возрастанию, поэтому одинаковые префиксы идут подряд.
+type prefixFilterCollector struct {
+	prefixLen int
+	last      []byte
+	hashes    [][2]uint32
+}
+
+func (c *prefixFilterCollector) Add(key, _ []byte) {
+	if len(key) < c.prefixLen {
+		return
+	}
+	p := key[:c.prefixLen]
+	if c.last != nil && bytes.Equal(p, c.last) {
+		return
+	}
+	c.last = append(c.last[:0], p...)
+	h1, h2 := prefixHash(p)
+	c.hashes = append(c.hashes, [2]uint32{h1, h2})
+}
+
+func (c *prefixFilterCollector) Properties() map[string][]byte {
+	nbits := max(64, len(c.hashes)*prefixFilterBitsPerKey)
+	b := binary.BigEndian.AppendUint32(nil, uint32(c.prefixLen))
+	b = append(b, prefixFilterHashes)
+	b = append(b, make([]byte, (nbits+7)/8)...)
+	bits := b[5:]
+	n := uint32(len(bits) * 8)
+	for _, h := range c.hashes {
+		for i := 0; i < prefixFilterHashes; i++ {
+			bit := (h[0] + uint32(i)*h[1]) % n
+			bits[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return map[string][]byte{propPrefixFilter: b}
+}
+
+// scanPrefix возвращает префикс, по которому можно проверить фильтры таблиц при Scan
+// [start, end), или nil, если диапазон выходит за пределы одного префикса.
+// Ключи с общим префиксом идут подряд только при побайтовом порядке.
+func (e *Engine) scanPrefix(cf *columnFamily, start, end []byte) []byte {
+	n := e.options.PrefixLength
+	if n == 0 || len(start) < n || end == nil || !isBytewise(cf.cmp) {
+		return nil
+	}
+	p := start[:n]
+	if limit := prefixEnd(p); limit != nil && bytes.Compare(end, limit) > 0 {
+		return nil
+	}
+	return p
+}
+
+// ScanPrefix возвращает итератор по ключам пространства default, начинающимся с prefix.
+// Если prefix не короче Options.PrefixLength, таблицы без ключей с таким префиксом
+// пропускаются по фильтру, не читая диск. При небайтовом компараторе ключи с префиксом
+// могут идти вперемешку с остальными, и ScanPrefix просматривает всё пространство.
+func (e *Engine) ScanPrefix(prefix []byte) *Iterator {
+	return e.ScanWithOptions(ScanOptions{Prefix: prefix})
+}
+
+func isBytewise(c Comparator) bool { return c.Name() == BytewiseComparator.Name() }
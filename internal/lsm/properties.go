@@ -0,0 +1,82 @@
+package lsm
+
+import (
+	"encoding/binary"
+
+	"kvschool/internal/sstable"
+)
+
+const (
+	// propNumTombstones — свойство таблицы: число tombstone, 8 байт big-endian.
+	propNumTombstones = "lsm.num-tombstones"
+
+	// tombstoneCompactionRatio — доля tombstone, начиная с которой таблица уровня
+	// сливается вне очереди: после массового Delete место освобождается сразу,
+	// а не когда уровень дорастёт до своего предела.
+	tombstoneCompactionRatio = 0.5
+)
+
+// tombstoneCollector считает tombstone в записываемой таблице.
+type tombstoneCollector struct {
+	tombstones uint64
+}
+
+func (c *tombstoneCollector) Add(_, value []byte) {
+	if len(value) > 0 && valueKind(value[0]) == kindTombstone {
+		c.tombstones++
+	}
+}
+
+func (c *tombstoneCollector) Properties() map[string][]byte {
+	return map[string][]byte{propNumTombstones: binary.BigEndian.AppendUint64(nil, c.tombstones)}
+}
+
+// loadProperties читает счётчики из блока свойств. У таблиц без блока свойств
+// (записанных до его появления или внешних) счётчики остаются нулевыми.
+func (t *table) loadProperties() {
+	props := t.sst.Properties()
+	t.entries = propUint64(props, sstable.PropNumEntries)
+	t.tombstones = propUint64(props, propNumTombstones)
+	t.prefixFilter = decodePrefixFilter(props[propPrefixFilter])
+	t.maxTimestamp = int64(propUint64(props, propMaxTimestamp))
+	t.valueLogs = decodeValueLogs(props[propValueLogs])
+}
+
+func propUint64(props map[string][]byte, name string) uint64 {
+	v := props[name]
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// garbageRatio — доля tombstone среди записей таблицы.
+func (t *table) garbageRatio() float64 {
+	if t.entries == 0 {
+		return 0
+	}
+	return float64(t.tombstones) / float64(t.entries)
+}
+
+// pickTombstoneCompaction выбирает таблицу уровня 1..numLevels-2 с наибольшей долей
+// tombstone не ниже tombstoneCompactionRatio. Последний уровень не рассматривается:
+// на нём tombstone выбрасываются при первой же compaction, пришедшей сверху.
+// Вызывается под e.mu.
+func (cf *columnFamily) pickTombstoneCompaction() *compaction {
+	var best *table
+	bestLevel := 0
+	for level := 1; level < numLevels-1; level++ {
+		for _, t := range cf.levels[level] {
+			if t.compacting || t.garbageRatio() < tombstoneCompactionRatio {
+				continue
+			}
+			if best == nil || t.garbageRatio() > best.garbageRatio() {
+				best, bestLevel = t, level
+			}
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return cf.newCompaction(bestLevel, []*table{best})
+}
@@ -0,0 +1,114 @@
+package lsm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Имена свойств для GetProperty. Значения суммируются по всем пространствам ключей.
+const (
+	// PropertyNumSSTables — число SSTable на всех уровнях.
+	PropertyNumSSTables = "kv.num-sstables"
+	// PropertyNumSSTablesAtLevelPrefix — префикс свойства с числом SSTable уровня,
+	// например "kv.num-sstables-at-level0".
+	PropertyNumSSTablesAtLevelPrefix = "kv.num-sstables-at-level"
+	// PropertyTotalSSTBytes — суммарный размер SSTable в байтах.
+	PropertyTotalSSTBytes = "kv.total-sst-bytes"
+	// PropertyMemtableBytes — текущий объём Memtable в байтах.
+	PropertyMemtableBytes = "kv.memtable-bytes"
+	// PropertyEstimateLiveKeys — оценка числа живых ключей: записи SSTable минус tombstone
+	// плюс значения в Memtable. Перезаписанные версии одного ключа считаются несколько раз.
+	PropertyEstimateLiveKeys = "kv.estimate-live-keys"
+	// PropertyNumColumnFamilies — число пространств ключей.
+	PropertyNumColumnFamilies = "kv.num-column-families"
+	// PropertyWriteStall — текущее ограничение записи: "none", "slowdown" или "stopped".
+	PropertyWriteStall = "kv.write-stall"
+	// PropertyReadOnly — "1", если движок переведён в режим только для чтения, иначе "0".
+	PropertyReadOnly = "kv.read-only"
+)
+
+// GetProperty возвращает значение свойства движка в виде строки — для скриптов
+// и дашбордов. ok == false для неизвестного имени.
+func (e *Engine) GetProperty(name string) (value string, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch name {
+	case PropertyNumSSTables:
+		n := 0
+		for _, cf := range e.cfs {
+			for _, tables := range cf.levels {
+				n += len(tables)
+			}
+		}
+		return strconv.Itoa(n), true
+	case PropertyTotalSSTBytes:
+		var n int64
+		for _, cf := range e.cfs {
+			for level := range cf.levels {
+				n += cf.levelSize(level)
+			}
+		}
+		return strconv.FormatInt(n, 10), true
+	case PropertyMemtableBytes:
+		return strconv.Itoa(e.memSize), true
+	case PropertyEstimateLiveKeys:
+		return strconv.FormatUint(e.estimateLiveKeys(), 10), true
+	case PropertyNumColumnFamilies:
+		return strconv.Itoa(len(e.cfs)), true
+	case PropertyWriteStall:
+		return e.writeStall().String(), true
+	case PropertyReadOnly:
+		if e.readOnlyErr != nil {
+			return "1", true
+		}
+		return "0", true
+	}
+
+	if s, found := strings.CutPrefix(name, PropertyNumSSTablesAtLevelPrefix); found {
+		level, err := strconv.Atoi(s)
+		if err != nil || level < 0 || level >= numLevels {
+			return "", false
+		}
+		n := 0
+		for _, cf := range e.cfs {
+			n += len(cf.levels[level])
+		}
+		return strconv.Itoa(n), true
+	}
+	return "", false
+}
+
+// estimateLiveKeys оценивает число живых ключей по счётчикам блоков свойств
+// и содержимому Memtable. Вызывается под e.mu.
+func (e *Engine) estimateLiveKeys() uint64 {
+	var live, dead uint64
+	for _, cf := range e.cfs {
+		for _, tables := range cf.levels {
+			for _, t := range tables {
+				live += t.entries - t.tombstones
+			}
+		}
+		it, err := cf.memtable.Scan(nil, nil)
+		if err != nil {
+			continue
+		}
+		for {
+			_, raw, ok, err := it.Next()
+			if err != nil || !ok {
+				break
+			}
+			// Tombstone в Memtable, скорее всего, закрывает ключ из SSTable.
+			if len(raw) > 0 && valueKind(raw[0]) == kindTombstone {
+				dead++
+			} else {
+				live++
+			}
+		}
+		_ = it.Close()
+	}
+	if dead > live {
+		return 0
+	}
+	return live - dead
+}
@@ -0,0 +1,42 @@
+package lsm
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter — token bucket в байтах в секунду. Общий для Flush и compaction,
+// чтобы фоновый I/O не отнимал диск у Get на узлах HLR.
+// Методы можно вызывать из нескольких горутин.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // байт в секунду
+	burst  float64 // максимум накопленных токенов
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter создаёт ограничитель на bytesPerSec байт в секунду.
+// Запас токенов — десятая доля секунды, так что всплески не длиннее 100 мс.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	rate := float64(bytesPerSec)
+	return &RateLimiter{rate: rate, burst: rate / 10, tokens: rate / 10, last: time.Now()}
+}
+
+// Wait резервирует n байт и, если токенов не хватает, спит, пока они не накопятся.
+// Запрос больше запаса не отклоняется: долг отрабатывается сном.
+func (l *RateLimiter) Wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,232 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"kvschool/internal/wal"
+)
+
+// WALRecoveryMode — политика восстановления Memtable из повреждённого WAL.
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryTolerateTornTail отбрасывает оборванную последнюю запись последнего
+	// сегмента (сбой посреди записи: запись короче заявленной или с неверной контрольной
+	// суммой) и обрезает по ней файл. Повреждение в середине журнала — ошибка Open.
+	WALRecoveryTolerateTornTail WALRecoveryMode = iota
+	// WALRecoveryStrict завершает Open ошибкой при любом повреждении WAL.
+	WALRecoveryStrict
+	// WALRecoverySkipCorrupt пропускает записи с неверной контрольной суммой и записи, которые
+	// нельзя применить (неизвестный тип, несуществующее пространство ключей), и обрезает
+	// оборванный хвост любого сегмента.
+	// Пропущенные записи теряются — режим для спасения данных, а не для штатной работы.
+	WALRecoverySkipCorrupt
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case WALRecoveryTolerateTornTail:
+		return "tolerate-torn-tail"
+	case WALRecoveryStrict:
+		return "strict"
+	case WALRecoverySkipCorrupt:
+		return "skip-corrupt"
+	}
+	return fmt.Sprintf("WALRecoveryMode(%d)", int(m))
+}
+
+// WALRecoveryReport — итог восстановления WAL при Open.
+type WALRecoveryReport struct {
+	Segments       int     // прочитано сегментов
+	Records        int     // применено записей
+	Persisted      int     // отброшено применённых записей, уже сохранённых в SSTable (wal.OpCheckpoint)
+	Skipped        int     // пропущено записей (только WALRecoverySkipCorrupt)
+	TruncatedBytes int64   // отброшено байт оборванных хвостов
+	Errors         []error // причины пропусков и обрезаний
+}
+
+// WALRecovery возвращает итог восстановления WAL при Open.
+func (e *Engine) WALRecovery() WALRecoveryReport {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r := e.walRecovery
+	r.Errors = append([]error(nil), r.Errors...)
+	return r
+}
+
+// replayWAL восстанавливает в Memtable записи сегмента WAL; last — последний сегмент.
+// Повреждения обрабатываются согласно Options.WALRecoveryMode.
+func (e *Engine) replayWAL(num uint64, last bool) error {
+	path := walPath(e.options.Dir, num)
+	f, err := e.options.FS.Open(path)
+	if err != nil {
+		return fmt.Errorf("lsm: открытие %s: %w", path, err)
+	}
+	defer f.Close()
+
+	mode := e.options.WALRecoveryMode
+	report := &e.walRecovery
+	report.Segments++
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("lsm: восстановление %s: %w", path, err)
+	}
+	tolerateTail := mode == WALRecoverySkipCorrupt || mode == WALRecoveryTolerateTornTail && last
+	reader := wal.NewReader(f)
+	hdr, err := reader.ReadHeader()
+	if err != nil {
+		switch {
+		case err == io.EOF:
+			// Сбой сразу после создания сегмента: записей в нём нет.
+			return nil
+		case errors.Is(err, io.ErrUnexpectedEOF) && tolerateTail:
+			return e.truncateWAL(path, st.Size(), 0, err)
+		}
+		return fmt.Errorf("lsm: восстановление %s: %w", path, err)
+	}
+	for {
+		start := reader.Offset()
+		rec, ok, err := reader.Next()
+		// Оборванная запись или неверная контрольная сумма у последней записи файла
+		// (за ней конец файла или нули предвыделения) — признак сбоя посреди записи:
+		// хвост отбрасывается.
+		torn := errors.Is(err, io.ErrUnexpectedEOF)
+		if errors.Is(err, wal.ErrChecksum) {
+			var zerr error
+			if torn, zerr = zeroFrom(f, reader.Offset(), st.Size()); zerr != nil {
+				return fmt.Errorf("lsm: восстановление %s: %w", path, zerr)
+			}
+		}
+		if torn && tolerateTail {
+			return e.truncateWAL(path, st.Size(), start, err)
+		}
+		if errors.Is(err, wal.ErrChecksum) && mode == WALRecoverySkipCorrupt {
+			// Reader уже за повреждённой записью: пропускаем её и читаем дальше.
+			e.lastSeq++
+			report.Skipped++
+			report.Errors = append(report.Errors, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		if err != nil {
+			// Смещение повреждения указывает сама *wal.CorruptError.
+			return fmt.Errorf("lsm: восстановление %s: %w", path, err)
+		}
+		if !ok {
+			if hdr.Recycled {
+				// За концом лога — записи прежнего сегмента, в том числе оборванные.
+				return nil
+			}
+			// Лог кончается нулевым байтом или концом файла; данные за концом означают,
+			// что обнулён заголовок записи посреди сегмента.
+			clean, err := zeroFrom(f, reader.Offset(), st.Size())
+			if err != nil {
+				return fmt.Errorf("lsm: восстановление %s: %w", path, err)
+			}
+			if !clean {
+				err := &wal.CorruptError{Offset: reader.Offset(), Reason: "данные после конца лога"}
+				if mode != WALRecoverySkipCorrupt {
+					return fmt.Errorf("lsm: восстановление %s: %w", path, err)
+				}
+				report.Errors = append(report.Errors, fmt.Errorf("%s: %w", path, err))
+			}
+			return nil
+		}
+		if rec.Type == wal.OpSequence {
+			seq, err := rec.Sequence()
+			if err != nil {
+				return fmt.Errorf("lsm: восстановление %s (смещение %d): %w", path, reader.Offset(), err)
+			}
+			e.lastSeq = seq - 1
+			continue
+		}
+		if rec.Type == wal.OpCheckpoint {
+			seq, err := rec.Checkpoint()
+			if err != nil {
+				return fmt.Errorf("lsm: восстановление %s (смещение %d): %w", path, reader.Offset(), err)
+			}
+			if seq >= e.lastSeq {
+				// Всё восстановленное до отметки уже в SSTable: повторно применять
+				// старые записи поверх более новых таблиц нельзя.
+				e.resetMemtables()
+				report.Persisted += report.Records
+				report.Records = 0
+				e.lastSeq = seq
+			}
+			continue
+		}
+		if err := e.checkValueRef(rec); err != nil {
+			// Значение не дошло до диска раньше ссылки на него: запись оборвана,
+			// как если бы до диска не дошла она сама.
+			if tolerateTail {
+				return e.truncateWAL(path, st.Size(), start, err)
+			}
+			return fmt.Errorf("lsm: восстановление %s (смещение %d): %w", path, start, err)
+		}
+		// Номер занимает и запись, которую не удалось применить: по нему её найдёт GetUpdatesSince.
+		e.lastSeq++
+		if err := e.applyRecord(rec); err != nil {
+			if mode != WALRecoverySkipCorrupt {
+				return fmt.Errorf("lsm: восстановление %s (смещение %d): %w", path, reader.Offset(), err)
+			}
+			report.Skipped++
+			report.Errors = append(report.Errors, fmt.Errorf("%s (смещение %d): %w", path, reader.Offset(), err))
+			continue
+		}
+		report.Records++
+	}
+}
+
+// zeroFrom сообщает, что байты f с off до size — нули (или их нет).
+func zeroFrom(f io.ReaderAt, off, size int64) (bool, error) {
+	buf := make([]byte, 32<<10)
+	for off < size {
+		n := int(min(int64(len(buf)), size-off))
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += int64(n)
+	}
+	return true, nil
+}
+
+// truncateWAL обрезает сегмент размера size по концу последней целой записи off;
+// cause — чем оказался плох хвост.
+func (e *Engine) truncateWAL(path string, size, off int64, cause error) error {
+	if err := e.options.FS.Truncate(path, off); err != nil {
+		return fmt.Errorf("lsm: обрезание %s: %w", path, err)
+	}
+	torn := size - off
+	e.walRecovery.TruncatedBytes += torn
+	e.walRecovery.Errors = append(e.walRecovery.Errors,
+		fmt.Errorf("%s: отброшен хвост %d байт: %w", path, torn, cause))
+	e.options.Logger.Printf("lsm: %s: отброшен оборванный хвост WAL, %d байт", path, torn)
+	return nil
+}
+
+// checkRecord проверяет, что запись WAL можно применить, не изменяя Memtable.
+func (e *Engine) checkRecord(rec wal.Record) error {
+	switch rec.Type {
+	case wal.OpPut, wal.OpDelete, wal.OpPutTTL:
+	case wal.OpPutRef:
+		if _, err := decodeValueRef(rec.Value); err != nil {
+			return err
+		}
+	case wal.OpMerge:
+		if e.options.MergeOperator == nil {
+			return ErrNoMergeOperator
+		}
+	default:
+		return fmt.Errorf("lsm: неизвестный тип записи WAL %d", rec.Type)
+	}
+	if int(rec.ColumnFamily) >= len(e.cfs) {
+		return fmt.Errorf("%w: id %d", ErrUnknownColumnFamily, rec.ColumnFamily)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"kvschool/internal/wal"
+)
+
+// ApplyUpdate атомарно применяет запись ведущего, полученную через его GetUpdatesSince,
+// под тем же номером u.Seq: после применения LatestSequence реплики равен номеру
+// последней записи ведущего, которую она получила, и по нему реплика продолжает после
+// перезапуска. Пропуски номеров (записи ведущего без выдаваемых изменений) сохраняются.
+// Записи с номером не больше LatestSequence уже применены и пропускаются.
+// Пространства ключей, которых у реплики нет, создаются.
+//
+// Реплика должна начинаться с копии ведущего (Checkpoint) и не принимать собственных
+// записей: иначе её номера разойдутся с номерами ведущего.
+func (e *Engine) ApplyUpdate(u Update) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	if u.Seq <= e.lastSeq {
+		return nil
+	}
+
+	recs := make([]wal.Record, 0, len(u.Mutations))
+	for _, m := range u.Mutations {
+		if strings.HasPrefix(m.ColumnFamily, indexColumnFamilyPrefix) {
+			// GetUpdatesSince их не выдаёт: индексы реплика строит сама по своим Options.Indexes.
+			return fmt.Errorf("lsm: запись %d: изменение служебного пространства %q", u.Seq, m.ColumnFamily)
+		}
+		cf := e.findColumnFamily(m.ColumnFamily)
+		if cf == nil {
+			var err error
+			if cf, err = e.createColumnFamilyLocked(m.ColumnFamily, false); err != nil {
+				return err
+			}
+		}
+		rec := wal.Record{ColumnFamily: cf.id, Key: m.Key, Value: m.Value}
+		switch m.Kind {
+		case MutationPut:
+			rec.Type = wal.OpPut
+			if !m.ExpiresAt.IsZero() {
+				rec.Type, rec.ExpiresAt = wal.OpPutTTL, m.ExpiresAt.UnixNano()
+			}
+		case MutationDelete:
+			rec.Type = wal.OpDelete
+		case MutationMerge:
+			rec.Type = wal.OpMerge
+		default:
+			return fmt.Errorf("lsm: запись %d: неизвестный вид изменения %v", u.Seq, m.Kind)
+		}
+		if err := e.checkRecord(rec); err != nil {
+			return fmt.Errorf("lsm: запись %d: %w", u.Seq, err)
+		}
+		recs = append(recs, rec)
+	}
+	for _, rec := range recs {
+		switch rec.Type {
+		case wal.OpDelete:
+			e.stats.deletes++
+		case wal.OpMerge:
+			e.stats.merges++
+		default:
+			e.stats.puts++
+		}
+	}
+
+	if u.Seq > e.lastSeq+1 {
+		// Перед записью в WAL ляжет OpSequence с её номером: пропуск переживёт восстановление.
+		e.lastSeq = u.Seq - 1
+		e.walSeqMarked = false
+	}
+	if len(recs) == 0 {
+		// Номер занимает пустой пакет.
+		return e.commitBatchLocked(nil)
+	}
+	return e.writeBatchLocked(context.Background(), recs)
+}
@@ -0,0 +1,103 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// propMaxTimestamp — свойство таблицы: момент, не позже которого сделаны все её записи,
+// наносекунды Unix, 8 байт big-endian.
+const propMaxTimestamp = "lsm.max-timestamp"
+
+// maxRetentionCheckInterval — как часто проверяется Retention, если окно больше.
+const maxRetentionCheckInterval = time.Minute
+
+// timestampCollector записывает в блок свойств заранее известное время записи таблицы.
+type timestampCollector int64
+
+func (c timestampCollector) Add(key, value []byte) {}
+
+func (c timestampCollector) Properties() map[string][]byte {
+	return map[string][]byte{propMaxTimestamp: binary.BigEndian.AppendUint64(nil, uint64(c))}
+}
+
+// maxTimestamp — время записи результата compaction: самое позднее из входных таблиц.
+// Если у какой-то таблицы оно неизвестно, берётся now, чтобы Retention не удалил данные раньше срока.
+func (c *compaction) maxTimestamp(now int64) int64 {
+	var ts int64
+	for _, t := range c.tables() {
+		if t.maxTimestamp == 0 {
+			return now
+		}
+		ts = max(ts, t.maxTimestamp)
+	}
+	return ts
+}
+
+// EnforceRetention удаляет таблицы, все записи которых старше Options.Retention, и возвращает
+// их описание. Данные не переписываются: таблица удаляется целиком или остаётся.
+// Движок вызывает его сам в фоне; явный вызов нужен, чтобы освободить место сразу.
+func (e *Engine) EnforceRetention() ([]TableInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	if e.readOnlyErr != nil {
+		return nil, e.readOnlyErr
+	}
+	if e.options.Retention <= 0 {
+		return nil, nil
+	}
+
+	cutoff := e.now().Add(-e.options.Retention).UnixNano()
+	var expired []*table
+	var infos []TableInfo
+	for _, cf := range e.cfs {
+		for level, tables := range cf.levels {
+			var old []*table
+			for _, t := range tables {
+				if t.maxTimestamp != 0 && t.maxTimestamp < cutoff && !t.compacting {
+					old = append(old, t)
+				}
+			}
+			if len(old) == 0 {
+				continue
+			}
+			infos = append(infos, e.tableInfos(cf, level, old)...)
+			cf.levels[level] = removeTables(tables, old)
+			expired = append(expired, old...)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	if err := writeManifest(e.options.FS, e.options.Dir, e.manifest()); err != nil {
+		return nil, e.setReadOnly(fmt.Errorf("lsm: retention: %w", err))
+	}
+	for _, t := range expired {
+		e.dropTable(t)
+	}
+	e.options.Logger.Printf("lsm: retention: удалено %d таблиц старше %v", len(expired), e.options.Retention)
+	// L0 мог уменьшиться — будим остановленных писателей.
+	e.compactionDone.Broadcast()
+	return infos, nil
+}
+
+// retentionLoop периодически применяет Retention.
+func (e *Engine) retentionLoop() {
+	defer e.bgWG.Done()
+	ticker := time.NewTicker(min(e.options.Retention, maxRetentionCheckInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closing:
+			return
+		case <-ticker.C:
+		}
+		if _, err := e.EnforceRetention(); err != nil {
+			e.options.Logger.Printf("%v", err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+
+	"kvschool/internal/skiplist"
+	"kvschool/internal/sstable"
+)
+
+// Iterator — результат Scan: ключи по возрастанию с актуальными значениями.
+// Удалённые и истёкшие по TTL ключи пропускаются, операнды Merge уже применены.
+// Итератор читает снимок данных на момент Scan: более поздние записи в него не попадают.
+// Close обязателен: до него таблицы, заменённые compaction, не удаляются с диска.
+type Iterator struct {
+	ctx    context.Context
+	e      *Engine
+	it     *mergingIterator
+	tables []*table
+	now    int64
+	closed bool
+	// prefix — если задан, пропускаются ключи без этого префикса (ScanPrefix).
+	prefix []byte
+
+	// Параметры ScanWithOptions: reverse — выдача в обратном порядке из буфера buf,
+	// который заполняется при первом Next; limit — предел числа ключей (0 — без предела),
+	// returned — сколько уже выдано; keysOnly — значения не возвращаются.
+	reverse  bool
+	buf      []sstable.KeyValue
+	buffered bool
+	limit    int
+	returned int
+	keysOnly bool
+}
+
+// ScanOptions — параметры ScanWithOptions.
+type ScanOptions struct {
+	// Start и End задают диапазон [Start, End); nil — -∞ и +∞ соответственно.
+	Start, End []byte
+	// Prefix оставляет только ключи с этим префиксом (как ScanPrefix) внутри [Start, End).
+	Prefix []byte
+	// Reverse выдаёт ключи по убыванию. Итератор при этом читает диапазон целиком
+	// при первом Next и держит в памяти его хвост — не больше Limit записей,
+	// а без Limit — весь диапазон.
+	Reverse bool
+	// Limit — сколько ключей выдать самое большее (0 — без ограничения).
+	Limit int
+	// KeysOnly — Next возвращает только ключи, value всегда nil.
+	KeysOnly bool
+}
+
+// Scan возвращает итератор по ключам пространства default в диапазоне [start, end).
+// Если start == nil, считается -∞. Если end == nil, считается +∞.
+func (e *Engine) Scan(start, end []byte) *Iterator {
+	return e.scan(context.Background(), e.defaultCF, start, end)
+}
+
+// ScanContext — Scan, итерация которого прерывается отменой ctx:
+// после неё Next возвращает ctx.Err(). Close по-прежнему обязателен.
+func (e *Engine) ScanContext(ctx context.Context, start, end []byte) *Iterator {
+	return e.scan(ctx, e.defaultCF, start, end)
+}
+
+func (e *Engine) scan(ctx context.Context, cf *columnFamily, start, end []byte) *Iterator {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	it := &Iterator{ctx: ctx, e: e, now: e.now().UnixNano()}
+	e.vlog.pins++
+
+	// Источники — от свежих к старым: Memtable, L0 от новых таблиц к старым, затем уровни.
+	// Memtable продолжает меняться, поэтому диапазон из неё копируется сразу.
+	mem, err := snapshotMemtable(cf.memtable, start, end)
+	sources := []skiplist.Iterator{mem}
+	for i := len(cf.levels[0]) - 1; i >= 0; i-- {
+		it.tables = append(it.tables, cf.levels[0][i])
+	}
+	for level := 1; level < numLevels; level++ {
+		it.tables = append(it.tables, cf.levels[level]...)
+	}
+	if prefix := e.scanPrefix(cf, start, end); prefix != nil {
+		tables := it.tables[:0]
+		for _, t := range it.tables {
+			if t.prefixFilter == nil || t.prefixFilter.mayContain(prefix) {
+				tables = append(tables, t)
+			}
+		}
+		it.tables = tables
+	}
+	for _, t := range it.tables {
+		t.refs++
+		sst, rerr := e.reader(t)
+		if rerr != nil {
+			if err == nil {
+				err = rerr
+			}
+			continue
+		}
+		sources = append(sources, sst.Scan(start, end))
+	}
+
+	it.it = newMergingIterator(cf.cmp, sources)
+	it.it.collapse = e.readCollapse(it.now)
+	// Ошибку снимка Memtable вернёт первый Next.
+	it.it.err = err
+	return it
+}
+
+// ScanWithOptions возвращает итератор по ключам пространства default с параметрами opts —
+// чтобы API-серверу не приходилось фильтровать и разворачивать полную выгрузку.
+func (e *Engine) ScanWithOptions(opts ScanOptions) *Iterator {
+	return e.scanWithOptions(e.defaultCF, opts)
+}
+
+func (e *Engine) scanWithOptions(cf *columnFamily, opts ScanOptions) *Iterator {
+	start, end := opts.Start, opts.End
+	var prefix []byte
+	if opts.Prefix != nil {
+		if isBytewise(cf.cmp) {
+			// Префикс — это диапазон [prefix, prefixEnd(prefix)): пересекаем его с [Start, End).
+			if start == nil || bytes.Compare(opts.Prefix, start) > 0 {
+				start = opts.Prefix
+			}
+			if pe := prefixEnd(opts.Prefix); pe != nil && (end == nil || bytes.Compare(pe, end) < 0) {
+				end = pe
+			}
+		} else {
+			prefix = append([]byte(nil), opts.Prefix...)
+		}
+	}
+	it := e.scan(context.Background(), cf, start, end)
+	it.prefix = prefix
+	it.reverse = opts.Reverse
+	it.limit = opts.Limit
+	it.keysOnly = opts.KeysOnly
+	return it
+}
+
+// Next возвращает следующий живой ключ. ok == false означает конец диапазона.
+func (it *Iterator) Next() (key, value []byte, ok bool, err error) {
+	if it.closed || it.limit > 0 && it.returned >= it.limit {
+		return nil, nil, false, nil
+	}
+	if it.reverse {
+		key, value, ok, err = it.prev()
+	} else {
+		key, value, ok, err = it.next()
+	}
+	if err != nil || !ok {
+		return nil, nil, false, err
+	}
+	it.returned++
+	if it.keysOnly {
+		value = nil
+	}
+	return key, value, true, nil
+}
+
+// prev выдаёт ключи по убыванию: при первом вызове читает диапазон целиком,
+// сохраняя только последние limit записей.
+func (it *Iterator) prev() (key, value []byte, ok bool, err error) {
+	if !it.buffered {
+		for {
+			key, value, ok, err := it.next()
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if !ok {
+				break
+			}
+			if it.keysOnly {
+				value = nil
+			}
+			it.buf = append(it.buf, sstable.KeyValue{Key: key, Value: value})
+			if it.limit > 0 && len(it.buf) >= 2*it.limit {
+				it.buf = append(it.buf[:0], it.buf[len(it.buf)-it.limit:]...)
+			}
+		}
+		if it.limit > 0 && len(it.buf) > it.limit {
+			it.buf = it.buf[len(it.buf)-it.limit:]
+		}
+		it.buffered = true
+	}
+	if len(it.buf) == 0 {
+		return nil, nil, false, nil
+	}
+	kv := it.buf[len(it.buf)-1]
+	it.buf = it.buf[:len(it.buf)-1]
+	return kv.Key, kv.Value, true, nil
+}
+
+// next возвращает следующий по возрастанию живой ключ.
+func (it *Iterator) next() (key, value []byte, ok bool, err error) {
+	for {
+		if err := it.ctx.Err(); err != nil {
+			return nil, nil, false, err
+		}
+		key, raw, ok, err := it.it.Next()
+		if err != nil || !ok {
+			return nil, nil, false, err
+		}
+		en, err := decodeValue(raw)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if en.kind == kindTombstone || en.expired(it.now) || !bytes.HasPrefix(key, it.prefix) {
+			continue
+		}
+		if !it.keysOnly {
+			if en, err = it.e.loadValue(en); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		return key, en.value, true, nil
+	}
+}
+
+// Close освобождает таблицы снимка. Повторный вызов ничего не делает.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	err := it.it.Close()
+
+	it.e.mu.Lock()
+	defer it.e.mu.Unlock()
+	for _, t := range it.tables {
+		it.e.unrefTable(t)
+	}
+	it.tables = nil
+	it.e.vlog.pins--
+	return err
+}
+
+// readCollapse возвращает функцию для mergingIterator.collapse при чтении:
+// операнды Merge применяются к ближайшему базовому значению (или к nil, если его нет).
+func (e *Engine) readCollapse(now int64) func(key []byte, versions [][]byte) ([]byte, error) {
+	return func(key []byte, versions [][]byte) ([]byte, error) {
+		var merges []entry
+		var base []byte
+		var expiresAt int64
+		for _, raw := range versions {
+			en, err := decodeValue(raw)
+			if err != nil {
+				return nil, err
+			}
+			if en.kind != kindMerge {
+				if en, err = e.loadValue(en); err != nil {
+					return nil, err
+				}
+				base, expiresAt = mergeBase(en, now)
+				break
+			}
+			merges = append(merges, en)
+		}
+		v, err := e.fullMerge(key, base, merges)
+		if err != nil {
+			return nil, err
+		}
+		return encodeMerged(v, expiresAt), nil
+	}
+}
+
+// sliceIterator — skiplist.Iterator поверх готового среза записей.
+type sliceIterator struct {
+	kvs []sstable.KeyValue
+	pos int
+}
+
+func (s *sliceIterator) Next() (key, value []byte, ok bool, err error) {
+	if s.pos >= len(s.kvs) {
+		return nil, nil, false, nil
+	}
+	kv := s.kvs[s.pos]
+	s.pos++
+	return kv.Key, kv.Value, true, nil
+}
+
+func (s *sliceIterator) Close() error { return nil }
+
+// snapshotMemtable копирует записи Memtable из диапазона [start, end).
+// При ошибке возвращается пустой итератор, чтобы его можно было закрыть как обычно.
+func snapshotMemtable(sl *skiplist.SkipList, start, end []byte) (*sliceIterator, error) {
+	src, err := sl.Scan(start, end)
+	if err != nil {
+		return &sliceIterator{}, err
+	}
+	defer src.Close()
+
+	snap := &sliceIterator{}
+	for {
+		key, value, ok, err := src.Next()
+		if err != nil {
+			return &sliceIterator{}, err
+		}
+		if !ok {
+			return snap, nil
+		}
+		snap.kvs = append(snap.kvs, sstable.KeyValue{Key: key, Value: value})
+	}
+}
@@ -0,0 +1,451 @@
+package lsm
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shardsName — файл ShardedEngine с числом шардов.
+const shardsName = "SHARDS"
+
+// ShardedEngine делит ключи по хешу между несколькими Engine, каждый в своей
+// поддиректории (shard-000, shard-001, ...). У каждого шарда свои мьютекс, Memtable,
+// WAL и фоновая compaction, поэтому на многоядерной машине запись не упирается
+// в одну блокировку, а compaction шардов идёт параллельно.
+//
+// Атомарна запись только одного ключа: пакетов и транзакций, охватывающих несколько
+// шардов, нет. Scan сливает итераторы всех шардов; снимки шардов берутся по очереди,
+// поэтому запись, сделанная во время Scan, может попасть в один шард и не попасть в другой.
+type ShardedEngine struct {
+	shards []*Engine
+	cmp    Comparator
+}
+
+// OpenSharded открывает (или создаёт) в opts.Dir движок из n шардов. Число шардов
+// записывается в файл SHARDS и потом меняться не может: ключи распределены по хешу.
+// n == 0 — открыть существующий движок с тем числом шардов, с которым он создан.
+//
+// Каждый шард открывается с opts, кроме Dir и WALArchiveDir (поддиректория шарда)
+// и ExpvarName (имя с суффиксом ".shard-NNN"). Лимиты RateLimitBytesPerSec
+// и MaxOpenFiles делятся между шардами поровну, а MemtableFlushThreshold действует
+// на каждый шард отдельно: памяти под Memtable нужно в n раз больше.
+func OpenSharded(opts Options, n int, optFns ...Option) (*ShardedEngine, error) {
+	opts, err := opts.withDefaults(optFns...)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("%w: число шардов %d", ErrInvalidOptions, n)
+	}
+	if err := opts.FS.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("lsm: создание директории: %w", err)
+	}
+	stored, err := readShardCount(opts)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case stored == 0 && n == 0:
+		return nil, fmt.Errorf("%w: в %s нет движка, а число шардов не задано", ErrInvalidOptions, opts.Dir)
+	case stored == 0:
+		if err := writeShardCount(opts, n); err != nil {
+			return nil, err
+		}
+	case n != 0 && n != stored:
+		return nil, fmt.Errorf("%w: движок создан с %d шардами, а задано %d", ErrInvalidOptions, stored, n)
+	default:
+		n = stored
+	}
+
+	s := &ShardedEngine{shards: make([]*Engine, 0, n), cmp: opts.Comparator}
+	for i := range n {
+		e, err := Open(shardOptions(opts, i, n))
+		if err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("lsm: шард %d: %w", i, err)
+		}
+		s.shards = append(s.shards, e)
+	}
+	return s, nil
+}
+
+// shardOptions возвращает параметры шарда i из n.
+func shardOptions(opts Options, i, n int) Options {
+	name := fmt.Sprintf("shard-%03d", i)
+	opts.Dir = filepath.Join(opts.Dir, name)
+	if opts.WALArchiveDir != "" {
+		opts.WALArchiveDir = filepath.Join(opts.WALArchiveDir, name)
+	}
+	if opts.ExpvarName != "" {
+		opts.ExpvarName += "." + name
+	}
+	if opts.RateLimitBytesPerSec > 0 {
+		opts.RateLimitBytesPerSec = max(opts.RateLimitBytesPerSec/int64(n), 1)
+	}
+	opts.MaxOpenFiles = max(opts.MaxOpenFiles/n, 1)
+	return opts
+}
+
+// readShardCount читает число шардов из SHARDS; 0 — файла нет.
+func readShardCount(opts Options) (int, error) {
+	f, err := opts.FS.Open(filepath.Join(opts.Dir, shardsName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("lsm: повреждён %s: %q", shardsName, b)
+	}
+	return n, nil
+}
+
+// writeShardCount записывает SHARDS через временный файл, как MANIFEST.
+func writeShardCount(opts Options, n int) error {
+	tmp := filepath.Join(opts.Dir, shardsName+".tmp")
+	f, err := opts.FS.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(strconv.Itoa(n) + "\n")); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return opts.FS.Rename(tmp, filepath.Join(opts.Dir, shardsName))
+}
+
+// NumShards возвращает число шардов.
+func (s *ShardedEngine) NumShards() int { return len(s.shards) }
+
+// Shard возвращает движок шарда i — например, для Checkpoint или GetProperty шарда.
+// Ключи в него нужно писать только через ShardFor, иначе их не найдёт Get.
+func (s *ShardedEngine) Shard(i int) *Engine { return s.shards[i] }
+
+// ShardFor возвращает номер шарда ключа. Он зависит только от ключа и числа шардов.
+func (s *ShardedEngine) ShardFor(key []byte) int {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	// Перемешивание из splitmix64: у FNV младшие биты плохо зависят от последних байт,
+	// а ключи CDR одного абонента различаются как раз в конце.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return int(x % uint64(len(s.shards)))
+}
+
+func (s *ShardedEngine) shard(key []byte) *Engine { return s.shards[s.ShardFor(key)] }
+
+// Get ищет ключ в его шарде.
+func (s *ShardedEngine) Get(key []byte) ([]byte, error) { return s.shard(key).Get(key) }
+
+// GetContext — Get, который не начинается, если ctx уже отменён.
+func (s *ShardedEngine) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return s.shard(key).GetContext(ctx, key)
+}
+
+// MultiGet ищет несколько ключей: ключи группируются по шардам, и шарды
+// опрашиваются параллельно. Результаты — в порядке keys, как у Engine.MultiGet.
+func (s *ShardedEngine) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	values, errs = make([][]byte, len(keys)), make([]error, len(keys))
+	groups := make([][]int, len(s.shards))
+	for i, key := range keys {
+		n := s.ShardFor(key)
+		groups[n] = append(groups[n], i)
+	}
+	s.parallel(func(n int, e *Engine) error {
+		if len(groups[n]) == 0 {
+			return nil
+		}
+		sub := make([][]byte, len(groups[n]))
+		for j, i := range groups[n] {
+			sub[j] = keys[i]
+		}
+		vs, es := e.MultiGet(sub)
+		for j, i := range groups[n] {
+			values[i], errs[i] = vs[j], es[j]
+		}
+		return nil
+	})
+	return values, errs
+}
+
+// Put записывает значение в шард ключа.
+func (s *ShardedEngine) Put(key, value []byte) error { return s.shard(key).Put(key, value) }
+
+// PutContext — Put, ожидание которого при остановке записи прерывается отменой ctx.
+func (s *ShardedEngine) PutContext(ctx context.Context, key, value []byte) error {
+	return s.shard(key).PutContext(ctx, key, value)
+}
+
+// PutWithTTL записывает значение, которое перестаёт быть видимым через ttl.
+func (s *ShardedEngine) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return s.shard(key).PutWithTTL(key, value, ttl)
+}
+
+// Delete удаляет ключ из его шарда.
+func (s *ShardedEngine) Delete(key []byte) error { return s.shard(key).Delete(key) }
+
+// Merge записывает операнд для key (нужен Options.MergeOperator).
+func (s *ShardedEngine) Merge(key, operand []byte) error { return s.shard(key).Merge(key, operand) }
+
+// Scan возвращает итератор по ключам всех шардов в диапазоне [start, end).
+// Если start == nil, считается -∞. Если end == nil, считается +∞.
+func (s *ShardedEngine) Scan(start, end []byte) *ShardedIterator {
+	return s.ScanWithOptions(ScanOptions{Start: start, End: end})
+}
+
+// ScanContext — Scan, итерация которого прерывается отменой ctx.
+func (s *ShardedEngine) ScanContext(ctx context.Context, start, end []byte) *ShardedIterator {
+	return s.merge(ScanOptions{}, func(e *Engine) *Iterator { return e.ScanContext(ctx, start, end) })
+}
+
+// ScanPrefix возвращает итератор по ключам с префиксом prefix.
+func (s *ShardedEngine) ScanPrefix(prefix []byte) *ShardedIterator {
+	return s.ScanWithOptions(ScanOptions{Prefix: prefix})
+}
+
+// ScanWithOptions — Scan с параметрами opts. Limit соблюдается для всего результата.
+func (s *ShardedEngine) ScanWithOptions(opts ScanOptions) *ShardedIterator {
+	return s.merge(opts, func(e *Engine) *Iterator { return e.ScanWithOptions(opts) })
+}
+
+func (s *ShardedEngine) merge(opts ScanOptions, scan func(e *Engine) *Iterator) *ShardedIterator {
+	it := &ShardedIterator{
+		its:     make([]*Iterator, len(s.shards)),
+		cmp:     s.cmp,
+		reverse: opts.Reverse,
+		limit:   opts.Limit,
+		last:    -1,
+	}
+	for i, e := range s.shards {
+		it.its[i] = scan(e)
+	}
+	return it
+}
+
+// Flush сбрасывает Memtable всех шардов параллельно.
+func (s *ShardedEngine) Flush() ([]TableInfo, error) {
+	var (
+		mu     sync.Mutex
+		tables []TableInfo
+	)
+	err := s.parallel(func(_ int, e *Engine) error {
+		ts, err := e.Flush()
+		mu.Lock()
+		tables = append(tables, ts...)
+		mu.Unlock()
+		return err
+	})
+	return tables, err
+}
+
+// CompactRange выполняет Engine.CompactRange во всех шардах параллельно.
+func (s *ShardedEngine) CompactRange(start, end []byte) error {
+	return s.parallel(func(_ int, e *Engine) error { return e.CompactRange(start, end) })
+}
+
+// ApproximateSize — сумма оценок Engine.ApproximateSize по шардам.
+func (s *ShardedEngine) ApproximateSize(start, end []byte) int64 {
+	var total int64
+	for _, e := range s.shards {
+		total += e.ApproximateSize(start, end)
+	}
+	return total
+}
+
+// Stats возвращает сумму счётчиков шардов. WriteStall — самое сильное ограничение
+// записи среди шардов.
+func (s *ShardedEngine) Stats() Stats {
+	total := Stats{LevelTables: make([]int, numLevels), LevelBytes: make([]int64, numLevels)}
+	for _, e := range s.shards {
+		st := e.Stats()
+		total.Puts += st.Puts
+		total.Gets += st.Gets
+		total.Deletes += st.Deletes
+		total.Merges += st.Merges
+		total.MemtableBytes += st.MemtableBytes
+		total.WALBytes += st.WALBytes
+		total.Flushes += st.Flushes
+		total.Compactions += st.Compactions
+		total.BytesRead += st.BytesRead
+		total.BytesWritten += st.BytesWritten
+		total.WALSyncs += st.WALSyncs
+		total.WALRecords += st.WALRecords
+		total.WALBytesWritten += st.WALBytesWritten
+		total.WALWrites += st.WALWrites
+		total.WriteStall = max(total.WriteStall, st.WriteStall)
+		total.StalledWrites += st.StalledWrites
+		total.StallTime += st.StallTime
+		for level := range st.LevelTables {
+			total.LevelTables[level] += st.LevelTables[level]
+			total.LevelBytes[level] += st.LevelBytes[level]
+		}
+		total.OpenTables += st.OpenTables
+		total.TableCacheHits += st.TableCacheHits
+		total.TableCacheMisses += st.TableCacheMisses
+	}
+	return total
+}
+
+// Close закрывает все шарды.
+func (s *ShardedEngine) Close() error {
+	var errs []error
+	for i, e := range s.shards {
+		if err := e.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("lsm: шард %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parallel вызывает fn для каждого шарда в своей горутине и возвращает ошибки шардов.
+func (s *ShardedEngine) parallel(fn func(i int, e *Engine) error) error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, e := range s.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(i, e); err != nil {
+				errs[i] = fmt.Errorf("lsm: шард %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// ShardedIterator — результат Scan ShardedEngine: ключи всех шардов по порядку.
+// Как и у Iterator, Close обязателен.
+type ShardedIterator struct {
+	its     []*Iterator
+	cmp     Comparator
+	reverse bool
+	limit   int
+
+	h        shardHeap
+	started  bool
+	last     int // шард ключа, выданного последним; -1 — его нет
+	returned int
+	err      error
+}
+
+// shardHead — очередной ключ шарда.
+type shardHead struct {
+	src        int
+	key, value []byte
+}
+
+type shardHeap struct {
+	items   []shardHead
+	cmp     Comparator
+	reverse bool
+}
+
+func (h *shardHeap) Len() int { return len(h.items) }
+func (h *shardHeap) Less(i, j int) bool {
+	c := h.cmp.Compare(h.items[i].key, h.items[j].key)
+	if h.reverse {
+		return c > 0
+	}
+	return c < 0
+}
+func (h *shardHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *shardHeap) Push(x any)    { h.items = append(h.items, x.(shardHead)) }
+func (h *shardHeap) Pop() any {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
+
+// Next возвращает следующий ключ. ok == false означает конец диапазона.
+// Ключ и значение действительны до следующего вызова Next.
+func (it *ShardedIterator) Next() (key, value []byte, ok bool, err error) {
+	if it.err != nil {
+		return nil, nil, false, it.err
+	}
+	if it.limit > 0 && it.returned >= it.limit {
+		return nil, nil, false, nil
+	}
+	// Шард, ключ которого выдан последним, продвигается только сейчас: до этого
+	// вызова его ключ и значение должны оставаться действительными.
+	if !it.started {
+		it.started = true
+		it.h = shardHeap{cmp: it.cmp, reverse: it.reverse}
+		for i := range it.its {
+			head, ok, err := it.read(i)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if ok {
+				it.h.items = append(it.h.items, head)
+			}
+		}
+		heap.Init(&it.h)
+	} else if it.last >= 0 {
+		head, ok, err := it.read(it.last)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if ok {
+			it.h.items[0] = head
+			heap.Fix(&it.h, 0)
+		} else {
+			heap.Pop(&it.h)
+		}
+	}
+	if len(it.h.items) == 0 {
+		it.last = -1
+		return nil, nil, false, nil
+	}
+	head := it.h.items[0]
+	it.last = head.src
+	it.returned++
+	return head.key, head.value, true, nil
+}
+
+// read читает следующий ключ шарда i.
+func (it *ShardedIterator) read(i int) (shardHead, bool, error) {
+	key, value, ok, err := it.its[i].Next()
+	if err != nil {
+		it.err = fmt.Errorf("lsm: шард %d: %w", i, err)
+		return shardHead{}, false, it.err
+	}
+	return shardHead{src: i, key: key, value: value}, ok, nil
+}
+
+// Close закрывает итераторы шардов. Повторный вызов ничего не делает.
+func (it *ShardedIterator) Close() error {
+	var errs []error
+	for _, sub := range it.its {
+		errs = append(errs, sub.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,52 @@
+package lsm
+
+// ApproximateSize оценивает, сколько байт занимают ключи диапазона [start, end):
+// по SSTable — разница смещений блоков из sparse index (без чтения диска),
+// по Memtable — сумма размеров ключей и значений.
+// Оценки достаточно, чтобы слой шардирования выбрал точку разбиения горячего диапазона IMSI.
+// Если start == nil, считается -∞. Если end == nil, считается +∞.
+// Учитывается только пространство ключей default.
+func (e *Engine) ApproximateSize(start, end []byte) int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cf := e.defaultCF
+	var total int64
+	for level := range cf.levels {
+		for _, t := range cf.levels[level] {
+			if !overlapsRange(cf.cmp, t, start, end) {
+				continue
+			}
+			sst, err := e.reader(t)
+			if err != nil {
+				continue
+			}
+			var from, to int64
+			if start != nil {
+				from = sst.ApproximateOffsetOf(start)
+			}
+			if end != nil {
+				to = sst.ApproximateOffsetOf(end)
+			} else {
+				to = t.size
+			}
+			if to > from {
+				total += to - from
+			}
+		}
+	}
+
+	it, err := cf.memtable.Scan(start, end)
+	if err != nil {
+		return total
+	}
+	defer it.Close()
+	for {
+		key, value, ok, err := it.Next()
+		if err != nil || !ok {
+			break
+		}
+		total += int64(len(key) + len(value))
+	}
+	return total
+}
@@ -0,0 +1,94 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrClosed возвращается на запись в закрытый движок.
+var ErrClosed = errors.New("lsm: движок закрыт")
+
+// writeSlowdownDelay — задержка каждой записи, пока L0 выше L0SlowdownWritesTrigger.
+const writeSlowdownDelay = time.Millisecond
+
+// WriteStall — состояние ограничения записи.
+type WriteStall int
+
+const (
+	// WriteStallNone — запись идёт без задержек.
+	WriteStallNone WriteStall = iota
+	// WriteStallSlowdown — каждая запись задерживается на writeSlowdownDelay.
+	WriteStallSlowdown
+	// WriteStallStopped — запись ждёт, пока compaction уменьшит L0.
+	WriteStallStopped
+)
+
+func (s WriteStall) String() string {
+	switch s {
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallStopped:
+		return "stopped"
+	default:
+		return "none"
+	}
+}
+
+// writeStall вычисляет текущее состояние по самому нагруженному пространству ключей.
+// Вызывается под e.mu.
+func (e *Engine) writeStall() WriteStall {
+	l0 := 0
+	for _, cf := range e.cfs {
+		l0 = max(l0, len(cf.levels[0]))
+	}
+	switch {
+	case l0 >= e.options.L0StopWritesTrigger:
+		return WriteStallStopped
+	case l0 >= e.options.L0SlowdownWritesTrigger:
+		return WriteStallSlowdown
+	default:
+		return WriteStallNone
+	}
+}
+
+// stallLocked задерживает запись, пока L0 переполнен: при замедлении — на writeSlowdownDelay,
+// при остановке — до завершения compaction или отмены ctx.
+// Вызывается под e.mu; на время ожидания блокировка отпускается.
+func (e *Engine) stallLocked(ctx context.Context) error {
+	stall := e.writeStall()
+	if stall == WriteStallNone {
+		return nil
+	}
+	start := time.Now()
+	e.stats.stalledWrites++
+	e.maybeScheduleCompaction()
+	if stall == WriteStallSlowdown {
+		e.mu.Unlock()
+		timer := time.NewTimer(writeSlowdownDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		e.mu.Lock()
+	}
+	// sync.Cond не умеет ждать ctx, поэтому отмена будит ожидающих через Broadcast.
+	stop := context.AfterFunc(ctx, func() {
+		e.mu.Lock()
+		e.compactionDone.Broadcast()
+		e.mu.Unlock()
+	})
+	defer stop()
+	for e.writeStall() == WriteStallStopped && !e.closed && e.readOnlyErr == nil && ctx.Err() == nil {
+		e.compactionDone.Wait()
+	}
+	e.stats.stallTime += time.Since(start)
+	if e.closed {
+		return ErrClosed
+	}
+	if e.readOnlyErr != nil {
+		return e.readOnlyErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,110 @@
+package lsm
+
+import (
+	"time"
+
+	"kvschool/internal/wal"
+)
+
+// Stats — снимок счётчиков движка для мониторинга приёма данных.
+type Stats struct {
+	Puts    uint64
+	Gets    uint64
+	Deletes uint64
+	Merges  uint64
+
+	// MemtableBytes — текущий учтённый объём Memtable (ключи + закодированные значения).
+	MemtableBytes int
+	// WALBytes — сколько байт записано в текущий сегмент WAL (без предвыделенного хвоста).
+	WALBytes int64
+
+	Flushes     uint64
+	Compactions uint64
+
+	// BytesRead — байты SSTable, прочитанные compaction.
+	// BytesWritten — байты SSTable, записанные Flush и compaction.
+	// Отношение BytesWritten к объёму пользовательских данных — это write amplification.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// WALSyncs — сколько раз сделан fsync WAL: фоновой горутиной (см. WALSyncInterval),
+	// групповой фиксацией (см. SyncWrites) или при записи отметки после Flush.
+	WALSyncs uint64
+	// WALRecords, WALBytesWritten и WALWrites — сколько записей и байт дописано в WAL
+	// за всё время работы и сколькими системными вызовами записи.
+	WALRecords      uint64
+	WALBytesWritten uint64
+	WALWrites       uint64
+
+	// WriteStall — текущее ограничение записи по числу таблиц L0.
+	// StalledWrites — сколько записей было задержано, StallTime — сколько они суммарно ждали.
+	WriteStall    WriteStall
+	StalledWrites uint64
+	StallTime     time.Duration
+
+	// LevelTables и LevelBytes — количество и суммарный размер таблиц на каждом уровне
+	// (суммарно по всем пространствам ключей).
+	LevelTables []int
+	LevelBytes  []int64
+
+	// OpenTables — сколько SSTable сейчас открыто. TableCacheHits и TableCacheMisses —
+	// сколько раз чтению досталась уже открытая таблица и сколько раз файл пришлось открыть заново.
+	OpenTables       int
+	TableCacheHits   uint64
+	TableCacheMisses uint64
+}
+
+// engineStats — накопительные счётчики внутри Engine.
+type engineStats struct {
+	puts, gets, deletes     uint64
+	merges                  uint64
+	flushes, compactions    uint64
+	bytesRead, bytesWritten uint64
+	stalledWrites           uint64
+	walSyncs                uint64
+	stallTime               time.Duration
+
+	// retiredWAL — счётчики Writer уже закрытых сегментов WAL.
+	retiredWAL wal.WriterStats
+}
+
+// Stats возвращает текущие счётчики движка.
+func (e *Engine) Stats() Stats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := Stats{
+		Puts:          e.stats.puts,
+		Gets:          e.stats.gets,
+		Deletes:       e.stats.deletes,
+		Merges:        e.stats.merges,
+		MemtableBytes: e.memSize,
+		Flushes:       e.stats.flushes,
+		Compactions:   e.stats.compactions,
+		BytesRead:     e.stats.bytesRead,
+		BytesWritten:  e.stats.bytesWritten,
+		WALSyncs:      e.stats.walSyncs,
+		WriteStall:    e.writeStall(),
+		StalledWrites: e.stats.stalledWrites,
+		StallTime:     e.stats.stallTime,
+		LevelTables:   make([]int, numLevels),
+		LevelBytes:    make([]int64, numLevels),
+
+		OpenTables:       e.tableCache.lru.Len(),
+		TableCacheHits:   e.tableCache.hits,
+		TableCacheMisses: e.tableCache.misses,
+	}
+	w := e.wal.Stats()
+	s.WALBytes = w.Size
+	s.WALSyncs += uint64(e.stats.retiredWAL.Syncs + w.Syncs)
+	s.WALRecords = uint64(e.stats.retiredWAL.Records + w.Records)
+	s.WALBytesWritten = uint64(e.stats.retiredWAL.Bytes + w.Bytes)
+	s.WALWrites = uint64(e.stats.retiredWAL.Flushes + w.Flushes)
+	for _, cf := range e.cfs {
+		for level := range cf.levels {
+			s.LevelTables[level] += len(cf.levels[level])
+			s.LevelBytes[level] += cf.levelSize(level)
+		}
+	}
+	return s
+}
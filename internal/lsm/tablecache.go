@@ -0,0 +1,97 @@
+package lsm
+
+import (
+	"container/list"
+	"fmt"
+
+	"kvschool/internal/sstable"
+)
+
+// DefaultMaxOpenFiles — предел открытых SSTable, если MaxOpenFiles не задан.
+const DefaultMaxOpenFiles = 1000
+
+// tableCache — LRU открытых SSTable: каждая держит дескриптор файла и sparse index.
+// Диапазон ключей и свойства таблицы остаются в памяти и после закрытия файла,
+// поэтому выбор таблиц для чтения не требует открывать её заново.
+// Все методы вызываются под e.mu.
+type tableCache struct {
+	capacity int
+	lru      *list.List // *table; в начале — недавно использованные
+	hits     uint64
+	misses   uint64
+}
+
+func newTableCache(capacity int) *tableCache {
+	return &tableCache{capacity: capacity, lru: list.New()}
+}
+
+// reader возвращает открытую SSTable таблицы t, при необходимости открывая файл заново.
+// Вызывается под e.mu.
+func (e *Engine) reader(t *table) (*sstable.SSTable, error) {
+	if t.sst != nil {
+		e.tableCache.hits++
+	} else {
+		e.tableCache.misses++
+		sst, _, err := e.openReader(t.cmp, t.num)
+		if err != nil {
+			return nil, err
+		}
+		t.sst = sst
+	}
+	e.cacheTable(t)
+	return t.sst, nil
+}
+
+// cacheTable помечает открытую таблицу недавно использованной и закрывает самые старые
+// сверх предела. Вызывается под e.mu.
+func (e *Engine) cacheTable(t *table) {
+	c := e.tableCache
+	if t.elem == nil {
+		t.elem = c.lru.PushFront(t)
+	} else {
+		c.lru.MoveToFront(t.elem)
+	}
+	// Таблицы, которые читают итераторы, compaction или Backup, закрывать нельзя:
+	// тогда кэш временно превышает предел.
+	for el := c.lru.Back(); el != nil && c.lru.Len() > c.capacity; {
+		prev := el.Prev()
+		if victim := el.Value.(*table); victim != t && victim.refs == 0 && !victim.compacting {
+			e.uncacheTable(victim)
+		}
+		el = prev
+	}
+}
+
+// uncacheTable закрывает файл таблицы и убирает её из кэша. Вызывается под e.mu.
+func (e *Engine) uncacheTable(t *table) {
+	if t.elem != nil {
+		e.tableCache.lru.Remove(t.elem)
+		t.elem = nil
+	}
+	if t.sst != nil {
+		_ = t.sst.Close()
+		t.sst = nil
+	}
+}
+
+// openReader открывает файл таблицы и строит её sparse index.
+func (e *Engine) openReader(cmp Comparator, num uint64) (*sstable.SSTable, int64, error) {
+	path := tablePath(e.options.Dir, num)
+	f, err := e.options.FS.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("lsm: открытие %s: %w", path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, fmt.Errorf("lsm: открытие %s: %w", path, err)
+	}
+	sst := sstable.NewSSTable(f, e.options.BlockSize)
+	sst.SetCompare(cmp.Compare)
+	if err := sst.BuildSparseIndex(); err != nil {
+		_ = f.Close()
+		return nil, 0, fmt.Errorf("lsm: открытие %s: %w", path, err)
+	}
+	sst.SetParanoidChecks(e.options.ParanoidChecks)
+	return sst, st.Size(), nil
+}
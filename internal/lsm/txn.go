@@ -0,0 +1,238 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"kvschool/internal/wal"
+)
+
+// DefaultTxnLockTimeout — сколько транзакция ждёт блокировку ключа, если TxnLockTimeout не задан.
+const DefaultTxnLockTimeout = time.Second
+
+var (
+	// ErrDeadlock возвращается, если ожидание блокировки замкнуло бы цикл между транзакциями.
+	ErrDeadlock = errors.New("lsm: взаимная блокировка транзакций")
+	// ErrLockTimeout возвращается, если блокировку ключа не удалось получить за TxnLockTimeout.
+	ErrLockTimeout = errors.New("lsm: истекло ожидание блокировки ключа")
+	// ErrTxnDone возвращается при обращении к завершённой транзакции.
+	ErrTxnDone = errors.New("lsm: транзакция уже завершена")
+)
+
+// lockManager выдаёт транзакциям эксклюзивные блокировки ключей.
+// waitsFor — граф ожидания: какая транзакция ждёт какую; по нему ищутся циклы.
+type lockManager struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	owners   map[string]uint64
+	waitsFor map[uint64]uint64
+}
+
+func newLockManager() *lockManager {
+	m := &lockManager{owners: make(map[string]uint64), waitsFor: make(map[uint64]uint64)}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// lock захватывает key для транзакции id. Повторный захват своей блокировки — no-op.
+// Возвращает true, если блокировка получена впервые.
+func (m *lockManager) lock(id uint64, key string, timeout time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	var timer *time.Timer
+	defer func() {
+		delete(m.waitsFor, id)
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		owner, ok := m.owners[key]
+		if !ok {
+			m.owners[key] = id
+			return true, nil
+		}
+		if owner == id {
+			return false, nil
+		}
+		if m.waitsOn(owner, id) {
+			return false, ErrDeadlock
+		}
+		if !time.Now().Before(deadline) {
+			return false, ErrLockTimeout
+		}
+		if timer == nil {
+			// sync.Cond не умеет ждать с таймаутом, поэтому по истечении будим всех.
+			timer = time.AfterFunc(timeout, func() {
+				m.mu.Lock()
+				m.cond.Broadcast()
+				m.mu.Unlock()
+			})
+		}
+		m.waitsFor[id] = owner
+		m.cond.Wait()
+	}
+}
+
+// waitsOn сообщает, ждёт ли from (напрямую или по цепочке) транзакцию to. Вызывается под m.mu.
+func (m *lockManager) waitsOn(from, to uint64) bool {
+	// Каждая транзакция ждёт не больше одной другой, так что цепочка длиннее len(waitsFor) — цикл без to.
+	for i := 0; i <= len(m.waitsFor); i++ {
+		if from == to {
+			return true
+		}
+		next, ok := m.waitsFor[from]
+		if !ok {
+			return false
+		}
+		from = next
+	}
+	return false
+}
+
+// unlock отпускает блокировки keys, принадлежащие транзакции id.
+func (m *lockManager) unlock(id uint64, keys []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		if m.owners[k] == id {
+			delete(m.owners, k)
+		}
+	}
+	m.cond.Broadcast()
+}
+
+// Txn — пессимистическая транзакция: Put, Delete и GetForUpdate блокируют ключ
+// до Commit или Rollback, а записи копятся в транзакции и применяются Commit атомарно
+// (одной записью WAL). Транзакция не потокобезопасна: ею пользуется одна горутина.
+type Txn struct {
+	e      *Engine
+	id     uint64
+	locked []string
+	writes []wal.Record
+	index  map[string]int // ключ -> позиция в writes
+	done   bool
+}
+
+// BeginTxn начинает транзакцию над пространством ключей по умолчанию.
+func (e *Engine) BeginTxn() *Txn {
+	e.mu.Lock()
+	e.nextTxnID++
+	id := e.nextTxnID
+	e.mu.Unlock()
+	return &Txn{e: e, id: id, index: make(map[string]int)}
+}
+
+func (t *Txn) lock(key []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	k := string(key)
+	acquired, err := t.e.locks.lock(t.id, k, t.e.options.TxnLockTimeout)
+	if err != nil {
+		return err
+	}
+	if acquired {
+		t.locked = append(t.locked, k)
+	}
+	return nil
+}
+
+// Get читает ключ с учётом собственных незафиксированных записей, не блокируя его.
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if i, ok := t.index[string(key)]; ok {
+		if rec := t.writes[i]; rec.Type == wal.OpPut {
+			return rec.Value, nil
+		}
+		return nil, ErrNotFound
+	}
+	return t.e.Get(key)
+}
+
+// GetForUpdate блокирует ключ и читает его: до конца транзакции значение
+// не изменит никто другой.
+func (t *Txn) GetForUpdate(key []byte) ([]byte, error) {
+	if err := t.lock(key); err != nil {
+		return nil, err
+	}
+	return t.Get(key)
+}
+
+// Put блокирует ключ и запоминает запись до Commit.
+func (t *Txn) Put(key, value []byte) error {
+	if err := t.lock(key); err != nil {
+		return err
+	}
+	t.buffer(wal.Record{Type: wal.OpPut, Key: key, Value: value})
+	return nil
+}
+
+// Delete блокирует ключ и запоминает удаление до Commit.
+func (t *Txn) Delete(key []byte) error {
+	if err := t.lock(key); err != nil {
+		return err
+	}
+	t.buffer(wal.Record{Type: wal.OpDelete, Key: key})
+	return nil
+}
+
+// buffer запоминает запись; повторная запись того же ключа заменяет предыдущую.
+func (t *Txn) buffer(rec wal.Record) {
+	rec.Key = append([]byte(nil), rec.Key...)
+	rec.Value = append([]byte(nil), rec.Value...)
+	if i, ok := t.index[string(rec.Key)]; ok {
+		t.writes[i] = rec
+		return
+	}
+	t.index[string(rec.Key)] = len(t.writes)
+	t.writes = append(t.writes, rec)
+}
+
+// Commit атомарно применяет записи транзакции и отпускает блокировки.
+// Блокировки отпускаются и при ошибке: транзакция в любом случае завершена.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	defer t.finish()
+	if len(t.writes) == 0 {
+		return nil
+	}
+
+	e := t.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rec := range t.writes {
+		if rec.Type == wal.OpPut {
+			e.stats.puts++
+		} else {
+			e.stats.deletes++
+		}
+	}
+	return e.writeBatchLocked(context.Background(), t.writes)
+}
+
+// Rollback отбрасывает записи транзакции и отпускает блокировки.
+func (t *Txn) Rollback() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.finish()
+	return nil
+}
+
+func (t *Txn) finish() {
+	t.done = true
+	t.e.locks.unlock(t.id, t.locked)
+	t.locked, t.writes, t.index = nil, nil, nil
+}
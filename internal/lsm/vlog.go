@@ -0,0 +1,279 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"kvschool/internal/vfs"
+	"kvschool/internal/wal"
+)
+
+// Value log — файлы vlog_N.log с длинными значениями (см. ValueLogThreshold). Значение
+// пишется туда один раз, а в WAL, Memtable и SSTable хранится только ссылка на него
+// (wal.OpPutRef, kindValueRef). Файл value log дописывается, пока пишется сегмент WAL
+// с тем же номером, и удаляется целиком, когда на него не ссылается ни одна таблица.
+
+// propValueLogs — свойство таблицы: номера файлов value log, на которые она ссылается,
+// каждый как uvarint.
+const propValueLogs = "lsm.value-logs"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// valueRef — ссылка на значение: файл, смещение, длина и CRC32C значения.
+type valueRef struct {
+	num  uint64
+	off  uint64
+	size uint64
+	crc  uint32
+}
+
+func encodeValueRef(ref valueRef) []byte {
+	b := binary.AppendUvarint(nil, ref.num)
+	b = binary.AppendUvarint(b, ref.off)
+	b = binary.AppendUvarint(b, ref.size)
+	return binary.BigEndian.AppendUint32(b, ref.crc)
+}
+
+func decodeValueRef(b []byte) (valueRef, error) {
+	var ref valueRef
+	for _, v := range []*uint64{&ref.num, &ref.off, &ref.size} {
+		n, sz := binary.Uvarint(b)
+		if sz <= 0 {
+			return valueRef{}, errBadValue
+		}
+		*v, b = n, b[sz:]
+	}
+	if len(b) != 4 {
+		return valueRef{}, errBadValue
+	}
+	ref.crc = binary.BigEndian.Uint32(b)
+	return ref, nil
+}
+
+// readValueRef читает значение по ссылке из файла value log f и проверяет его CRC.
+func readValueRef(f io.ReaderAt, ref valueRef) ([]byte, error) {
+	v := make([]byte, ref.size)
+	if _, err := f.ReadAt(v, int64(ref.off)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("lsm: value log %d, смещение %d: %w", ref.num, ref.off, err)
+	}
+	if crc32.Checksum(v, crcTable) != ref.crc {
+		return nil, fmt.Errorf("lsm: value log %d, смещение %d: неверная контрольная сумма: %w", ref.num, ref.off, errBadValue)
+	}
+	return v, nil
+}
+
+// valueLog — состояние value log движка.
+type valueLog struct {
+	// f — файл, в который дописываются значения, num — его номер (номер текущего сегмента
+	// WAL), off — его длина. pins — открытые итераторы и резервные копии: пока они есть,
+	// файлы не удаляются, ведь читаемые ими ссылки могли уже пропасть из таблиц. Под e.mu.
+	f    vfs.File
+	num  uint64
+	off  int64
+	pins int
+
+	// mu защищает readers — файлы, открытые для чтения: значения читаются и без e.mu.
+	mu      sync.Mutex
+	readers map[uint64]vfs.File
+}
+
+func valueLogPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("vlog_%d.log", num))
+}
+
+// listValueLogs возвращает номера файлов value log в директории по возрастанию.
+func listValueLogs(fs vfs.FS, dir string) ([]uint64, error) {
+	return listNumbered(fs, dir, "vlog_", ".log")
+}
+
+// writeValueLog дописывает value в value log текущего сегмента WAL и возвращает ссылку
+// на него. Вызывается под e.mu до записи ссылки в WAL.
+func (e *Engine) writeValueLog(value []byte) ([]byte, error) {
+	v := &e.vlog
+	if v.f == nil {
+		f, err := e.options.FS.Create(valueLogPath(e.options.Dir, e.logNum))
+		if err != nil {
+			return nil, fmt.Errorf("lsm: value log: %w", err)
+		}
+		v.f, v.num, v.off = f, e.logNum, 0
+	}
+	ref := valueRef{num: v.num, off: uint64(v.off), size: uint64(len(value)), crc: crc32.Checksum(value, crcTable)}
+	n, err := v.f.Write(value)
+	v.off += int64(n)
+	if err != nil {
+		// Хвост файла мог остаться недописанным: продолжать писать после него нельзя.
+		return nil, e.setReadOnly(fmt.Errorf("lsm: value log: %w", err))
+	}
+	return encodeValueRef(ref), nil
+}
+
+// closeValueLog делает fsync и закрывает файл value log текущего сегмента WAL — при смене
+// сегмента: таблицы, которые Flush запишет следом, ссылаются на его значения. Вызывается под e.mu.
+func (e *Engine) closeValueLog() error {
+	f := e.vlog.f
+	if f == nil {
+		return nil
+	}
+	e.vlog.f = nil
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("lsm: fsync value log %d: %w", e.vlog.num, err)
+	}
+	return f.Close()
+}
+
+// readValueLog возвращает значение по ссылке (полезной нагрузке kindValueRef или wal.OpPutRef).
+// Вызывается с e.mu и без.
+func (e *Engine) readValueLog(b []byte) ([]byte, error) {
+	ref, err := decodeValueRef(b)
+	if err != nil {
+		return nil, err
+	}
+	v := &e.vlog
+	v.mu.Lock()
+	f, ok := v.readers[ref.num]
+	if !ok {
+		f, err = e.options.FS.Open(valueLogPath(e.options.Dir, ref.num))
+		if err != nil {
+			v.mu.Unlock()
+			return nil, fmt.Errorf("lsm: value log: %w", err)
+		}
+		if v.readers == nil {
+			v.readers = make(map[uint64]vfs.File)
+		}
+		v.readers[ref.num] = f
+	}
+	v.mu.Unlock()
+	return readValueRef(f, ref)
+}
+
+// loadValue заменяет ссылку на значение в value log самим значением.
+func (e *Engine) loadValue(en entry) (entry, error) {
+	if en.kind != kindValueRef {
+		return en, nil
+	}
+	v, err := e.readValueLog(en.value)
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{kind: kindValue, value: v}, nil
+}
+
+// closeValueLogReaders закрывает файлы value log, открытые для чтения.
+func (e *Engine) closeValueLogReaders() {
+	v := &e.vlog
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for num, f := range v.readers {
+		_ = f.Close()
+		delete(v.readers, num)
+	}
+}
+
+// removeObsoleteValueLogs удаляет файлы value log, на которые не ссылаются ни таблицы,
+// ни живые сегменты WAL. Пока value log читают итераторы или резервные копии,
+// ничего не удаляется. Вызывается под e.mu.
+func (e *Engine) removeObsoleteValueLogs() error {
+	if e.vlog.pins > 0 {
+		return nil
+	}
+	nums, err := listValueLogs(e.options.FS, e.options.Dir)
+	if err != nil {
+		return err
+	}
+	live := make(map[uint64]bool)
+	for _, cf := range e.cfs {
+		for _, level := range cf.levels {
+			for _, t := range level {
+				for _, num := range t.valueLogs {
+					live[num] = true
+				}
+			}
+		}
+	}
+	for _, num := range nums {
+		if num >= e.minLogNum || live[num] {
+			continue
+		}
+		e.vlog.mu.Lock()
+		if f, ok := e.vlog.readers[num]; ok {
+			_ = f.Close()
+			delete(e.vlog.readers, num)
+		}
+		e.vlog.mu.Unlock()
+		if err := e.options.FS.Remove(valueLogPath(e.options.Dir, num)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncWALFiles делает fsync value log (если он есть), затем сегмента WAL: записи WAL
+// ссылаются на значения value log, и те должны попасть на диск не позже.
+func syncWALFiles(vlog, f vfs.File) error {
+	if vlog != nil {
+		if err := vlog.Sync(); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// valueLogCollector собирает номера файлов value log, на которые ссылается записываемая таблица.
+type valueLogCollector struct {
+	nums map[uint64]bool
+}
+
+func (c *valueLogCollector) Add(_, value []byte) {
+	if len(value) == 0 || valueKind(value[0]) != kindValueRef {
+		return
+	}
+	ref, err := decodeValueRef(value[1:])
+	if err != nil {
+		return
+	}
+	if c.nums == nil {
+		c.nums = make(map[uint64]bool)
+	}
+	c.nums[ref.num] = true
+}
+
+func (c *valueLogCollector) Properties() map[string][]byte {
+	if len(c.nums) == 0 {
+		return nil
+	}
+	var b []byte
+	for num := range c.nums {
+		b = binary.AppendUvarint(b, num)
+	}
+	return map[string][]byte{propValueLogs: b}
+}
+
+func decodeValueLogs(b []byte) []uint64 {
+	var nums []uint64
+	for len(b) > 0 {
+		n, sz := binary.Uvarint(b)
+		if sz <= 0 {
+			return nums
+		}
+		nums = append(nums, n)
+		b = b[sz:]
+	}
+	return nums
+}
+
+// checkValueRef проверяет, что значение, на которое ссылается запись WAL, дошло до диска.
+func (e *Engine) checkValueRef(rec wal.Record) error {
+	if rec.Type != wal.OpPutRef {
+		return nil
+	}
+	_, err := e.readValueLog(rec.Value)
+	return err
+}
@@ -0,0 +1,48 @@
+package lsm
+
+import (
+	"fmt"
+	"time"
+)
+
+// walSyncLoop раз в WALSyncInterval делает fsync текущего сегмента WAL, если в него писали.
+func (e *Engine) walSyncLoop() {
+	defer e.bgWG.Done()
+	ticker := time.NewTicker(e.options.WALSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closing:
+			return
+		case <-ticker.C:
+		}
+		e.syncWAL()
+	}
+}
+
+// syncWAL делает fsync WAL без e.mu, чтобы не задерживать запись на время fsync.
+func (e *Engine) syncWAL() {
+	e.mu.Lock()
+	if !e.walDirty || e.closed || e.readOnlyErr != nil {
+		e.mu.Unlock()
+		return
+	}
+	f, vf := e.walFile, e.vlog.f
+	e.walDirty = false
+	e.mu.Unlock()
+
+	err := syncWALFiles(vf, f)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if f != e.walFile {
+		// Пока шёл fsync, Flush сменил и закрыл сегмент; его записи сохранит SSTable.
+		return
+	}
+	if err != nil {
+		// После неудачного fsync неизвестно, что из WAL дошло до диска.
+		_ = e.setReadOnly(fmt.Errorf("lsm: fsync WAL: %w", err))
+		return
+	}
+	e.stats.walSyncs++
+}
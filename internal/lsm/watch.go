@@ -0,0 +1,234 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"kvschool/internal/vfs"
+	"kvschool/internal/wal"
+)
+
+// watchBufferSize — сколько событий Watch накапливает, пока подписчик их не читает.
+const watchBufferSize = 256
+
+// WatchEvent — изменение ключа, полученное через Watch. Seq — номер записи, в которой
+// оно сделано (у изменений одного пакета номер общий). Для Merge Value — операнд,
+// а не итоговое значение.
+//
+// Err != nil только у последнего события перед закрытием канала: подписка
+// прервана ошибкой. ErrUpdatesUnavailable — подписчик отстал настолько, что нужные
+// записи уже удалены из WAL; продолжить можно со снимка (Scan) и WatchSince.
+type WatchEvent struct {
+	Seq uint64
+	Mutation
+	Err error
+}
+
+// Watch подписывается на изменения ключей пространства default с префиксом prefix
+// (nil — всех ключей), зафиксированные после вызова. События приходят в порядке
+// записей; канал закрывается, когда отменён ctx или закрыт движок.
+//
+// События читаются из хвоста WAL, поэтому запись не ждёт подписчиков. Подписчик,
+// который не успевает читать, отстаёт, а если его записи успеют уйти из WAL
+// после Flush, получит ErrUpdatesUnavailable.
+// После того как события перестают быть нужны, ctx нужно отменить.
+func (e *Engine) Watch(ctx context.Context, prefix []byte) (<-chan WatchEvent, error) {
+	return e.WatchSince(ctx, prefix, e.LatestSequence())
+}
+
+// WatchSince — Watch, начинающийся с записей после seq, например после Seq последнего
+// обработанного события: так подписчик продолжает после перезапуска без пропусков.
+func (e *Engine) WatchSince(ctx context.Context, prefix []byte, seq uint64) (<-chan WatchEvent, error) {
+	e.mu.Lock()
+	closed := e.closed
+	e.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	ch := make(chan WatchEvent, watchBufferSize)
+	go e.watch(ctx, bytes.Clone(prefix), seq, ch)
+	return ch, nil
+}
+
+func (e *Engine) watch(ctx context.Context, prefix []byte, seq uint64, ch chan<- WatchEvent) {
+	defer close(ch)
+	send := func(ev WatchEvent) bool {
+		select {
+		case ch <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	var tail watchTail
+	defer tail.close()
+	for {
+		// Канал берётся до чтения WAL: запись, сделанная после чтения, его закроет.
+		appended, err := e.waitAppend()
+		if err == nil {
+			seq, err = e.watchUpdates(&tail, prefix, seq, send)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				send(WatchEvent{Err: err})
+			}
+			return
+		}
+		select {
+		case <-appended:
+		case <-e.closing:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitAppend возвращает канал, который закроется при следующей записи в WAL.
+func (e *Engine) waitAppend() (<-chan struct{}, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	if e.walAppended == nil {
+		e.walAppended = make(chan struct{})
+	}
+	return e.walAppended, nil
+}
+
+// watchTail — открытый подписчиком текущий сегмент WAL: новые записи читаются
+// с места, где остановилось прошлое чтение, а не перебором всех сегментов.
+type watchTail struct {
+	num  uint64
+	f    vfs.File
+	tail *wal.TailReader
+}
+
+func (t *watchTail) close() {
+	if t.f != nil {
+		_ = t.f.Close()
+	}
+	*t = watchTail{}
+}
+
+// watchUpdates передаёт send подходящие изменения записей после seq и возвращает
+// номер последней просмотренной записи. send false — подписка отменена.
+//
+// Пока сегмент WAL не сменился, записи читаются из хвоста tail. После смены сегмента
+// (или если хвост прочитать не удалось) подписчик догоняет через GetUpdatesSince
+// и открывает хвост нового сегмента.
+func (e *Engine) watchUpdates(tail *watchTail, prefix []byte, seq uint64, send func(WatchEvent) bool) (uint64, error) {
+	if tail.tail != nil {
+		next, ok, err := e.tailUpdates(tail, prefix, seq, send)
+		if err != nil || ok {
+			return next, err
+		}
+		tail.close()
+		seq = next
+	}
+
+	it, err := e.GetUpdatesSince(seq)
+	if err != nil {
+		return seq, err
+	}
+	defer it.Close()
+	for {
+		u, ok, err := it.Next()
+		if err != nil {
+			return seq, err
+		}
+		if !ok {
+			break
+		}
+		if !watchSend(u, prefix, send) {
+			return seq, context.Canceled
+		}
+		seq = u.Seq
+	}
+	// Просмотрены все записи по it.last, в том числе без выдаваемых изменений:
+	// иначе после удаления их сегментов GetUpdatesSince счёл бы их потерянными.
+	seq = max(seq, it.last)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return seq, ErrClosed
+	}
+	if e.logNum != it.logNum {
+		// Сегмент уже сменился: хвост откроется при следующем чтении через GetUpdatesSince.
+		return seq, nil
+	}
+	f, err := e.options.FS.Open(walPath(e.options.Dir, it.logNum))
+	if err != nil {
+		return seq, fmt.Errorf("lsm: watch: %w", err)
+	}
+	*tail = watchTail{num: it.logNum, f: f, tail: wal.NewTailReader(f, it.logOff, 0)}
+	return seq, nil
+}
+
+// tailUpdates читает из хвоста записи, дописанные в текущий сегмент после seq.
+// ok == false — сегмент сменился или его не удалось дочитать, и записи после
+// возвращённого номера нужно брать через GetUpdatesSince.
+func (e *Engine) tailUpdates(tail *watchTail, prefix []byte, seq uint64, send func(WatchEvent) bool) (next uint64, ok bool, err error) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return seq, false, ErrClosed
+	}
+	if e.logNum != tail.num {
+		e.mu.Unlock()
+		return seq, false, nil
+	}
+	// Читается только записанное к этому моменту: Writer мог не дописать следующую запись.
+	end := e.wal.Offset()
+	cfs := e.updateColumnFamilies()
+	e.vlog.pins++
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.vlog.pins--
+		e.mu.Unlock()
+	}()
+
+	for tail.tail.Offset() < end {
+		rec, ok, err := tail.tail.TryNext()
+		if err != nil || !ok {
+			// Сегмент успели сменить и переиспользовать: остаток — через GetUpdatesSince.
+			return seq, false, nil
+		}
+		switch rec.Type {
+		case wal.OpSequence:
+			s, err := rec.Sequence()
+			if err != nil {
+				return seq, false, fmt.Errorf("lsm: watch: %w", err)
+			}
+			seq = s - 1
+			continue
+		case wal.OpCheckpoint:
+			continue
+		}
+		u, err := e.recordUpdate(cfs, seq+1, rec)
+		if err != nil {
+			return seq, false, fmt.Errorf("lsm: watch: запись %d: %w", seq+1, err)
+		}
+		if !watchSend(u, prefix, send) {
+			return seq, false, context.Canceled
+		}
+		seq++
+	}
+	return seq, true, nil
+}
+
+// watchSend передаёт send изменения u ключей пространства default с префиксом prefix.
+func watchSend(u Update, prefix []byte, send func(WatchEvent) bool) bool {
+	for _, m := range u.Mutations {
+		if m.ColumnFamily != DefaultColumnFamilyName || !bytes.HasPrefix(m.Key, prefix) {
+			continue
+		}
+		if !send(WatchEvent{Seq: u.Seq, Mutation: m}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+type client struct {
+	t     *testing.T
+	c     net.Conn
+	br    *bufio.Reader
+	clock *testClock
+}
+
+// testClock — часы движка и сервера, которые тест переводит вручную.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestClient(t *testing.T) (*client, *Server, *lsm.Engine) {
+	t.Helper()
+	clock := &testClock{now: time.Unix(1_700_000_000, 0)}
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()}, lsm.WithClock(clock.Now))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(e)
+	srv.now = clock.Now
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve: %v", err)
+		}
+		_ = e.Close()
+	})
+	return &client{t: t, c: c, br: bufio.NewReader(c), clock: clock}, srv, e
+}
+
+// do отправляет req и читает n строк ответа.
+func (c *client) do(req string, n int) string {
+	c.t.Helper()
+	if _, err := c.c.Write([]byte(req)); err != nil {
+		c.t.Fatal(err)
+	}
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%q: чтение ответа: %v", req, err)
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+func TestCommands(t *testing.T) {
+	c, _, _ := newTestClient(t)
+
+	for _, tc := range []struct {
+		req   string
+		lines int
+		want  string
+	}{
+		{"get a\r\n", 1, "END\r\n"},
+		{"set a 0 0 5\r\nhello\r\n", 1, "STORED\r\n"},
+		{"set b 7 0 0\r\n\r\n", 1, "STORED\r\n"},
+		{"get a b c\r\n", 5, "VALUE a 0 5\r\nhello\r\nVALUE b 0 0\r\n\r\nEND\r\n"},
+		{"delete a\r\n", 1, "DELETED\r\n"},
+		{"delete a\r\n", 1, "NOT_FOUND\r\n"},
+		{"set a 0 0 1 noreply\r\nx\r\nget a\r\n", 3, "VALUE a 0 1\r\nx\r\nEND\r\n"},
+		{"set a 0 0\r\n", 1, "ERROR\r\n"},
+		{"incr a 1\r\n", 1, "ERROR\r\n"},
+		{"get " + strings.Repeat("k", 251) + "\r\n", 1, "CLIENT_ERROR слишком длинный ключ\r\n"},
+		// Остаток данных за заявленной длиной читается как следующая команда.
+		{"set a 0 0 2\r\nxyz\r\n", 1, "CLIENT_ERROR некорректный блок данных\r\n"},
+	} {
+		if got := c.do(tc.req, tc.lines); got != tc.want {
+			t.Fatalf("%q: ответ %q, ожидался %q", tc.req, got, tc.want)
+		}
+	}
+}
+
+func TestExptime(t *testing.T) {
+	c, srv, e := newTestClient(t)
+
+	if got := c.do("set short 0 1 1\r\nv\r\n", 1); got != "STORED\r\n" {
+		t.Fatalf("set с exptime 1: %q", got)
+	}
+	// Абсолютное время истечения в прошлом удаляет ключ.
+	if err := e.Put([]byte("old"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	past := srv.now().Add(-time.Hour).Unix()
+	if got := c.do("set old 0 "+strconv.FormatInt(past, 10)+" 1\r\nv\r\n", 1); got != "STORED\r\n" {
+		t.Fatalf("set с прошедшим exptime: %q", got)
+	}
+	if _, err := e.Get([]byte("old")); !errors.Is(err, lsm.ErrNotFound) {
+		t.Fatalf("Get после set с прошедшим exptime: %v", err)
+	}
+	future := srv.now().Add(time.Hour).Unix()
+	if got := c.do("set long 0 "+strconv.FormatInt(future, 10)+" 1\r\nv\r\n", 1); got != "STORED\r\n" {
+		t.Fatalf("set с абсолютным exptime: %q", got)
+	}
+
+	c.clock.Advance(1100 * time.Millisecond)
+	if got := c.do("get short long\r\n", 3); got != "VALUE long 0 1\r\nv\r\nEND\r\n" {
+		t.Fatalf("get после истечения: %q", got)
+	}
+}
@@ -0,0 +1,260 @@
+// Package memcache — фронтенд движка по текстовому протоколу memcached: команды
+// get, set и delete для систем, которые умеют говорить только с memcached.
+//
+// Флаги элемента не хранятся: значение лежит в движке как есть, чтобы его видели
+// остальные фронтенды, а get всегда возвращает флаги 0.
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"kvschool/internal/lsm"
+	"kvschool/internal/tcpserver"
+)
+
+// ErrServerClosed возвращает Serve после Close.
+var ErrServerClosed = errors.New("memcache: сервер закрыт")
+
+const (
+	maxKeyLen   = 250      // наибольший ключ, как в memcached
+	maxValueLen = 64 << 20 // наибольшее значение
+	maxLine     = 64 << 10 // наибольшая строка команды
+
+	// relativeExpiry — наибольшее время жизни, которое exptime задаёт в секундах;
+	// большее значение — момент истечения в секундах Unix.
+	relativeExpiry = 30 * 24 * 60 * 60
+)
+
+// Server обслуживает соединения клиентов memcached над движком.
+type Server struct {
+	e *lsm.Engine
+	// now — источник времени для абсолютного exptime; подменяется в тестах.
+	now func() time.Time
+
+	// writeMu упорядочивает изменяющие команды: delete читает ключ перед удалением.
+	writeMu sync.Mutex
+
+	srv *tcpserver.Server
+}
+
+// NewServer создает сервер над e.
+func NewServer(e *lsm.Engine) *Server {
+	s := &Server{e: e, now: time.Now}
+	s.srv = tcpserver.New(s.serveConn, ErrServerClosed)
+	return s
+}
+
+// Serve принимает соединения на l и обслуживает каждое в своей горутине, пока
+// не будет вызван Close (тогда возвращает ErrServerClosed) или Accept не вернёт ошибку.
+func (s *Server) Serve(l net.Listener) error { return s.srv.Serve(l) }
+
+// Close закрывает слушателей и соединения и дожидается завершения их обработчиков:
+// после Close движок можно закрывать.
+func (s *Server) Close() error { return s.srv.Close() }
+
+// clientError — ошибка в команде клиента: ответ CLIENT_ERROR, соединение остаётся открытым.
+type clientError string
+
+func (e clientError) Error() string { return string(e) }
+
+func (s *Server) serveConn(nc net.Conn) {
+	br := bufio.NewReaderSize(nc, maxLine)
+	bw := bufio.NewWriter(nc)
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			fmt.Fprintf(bw, "CLIENT_ERROR строка длиннее %d байт\r\n", maxLine)
+			_ = bw.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		// Строка лежит в буфере br, а set читает следом данные: аргументы копируются.
+		args := bytes.Fields(bytes.Clone(line))
+		if len(args) == 0 {
+			bw.WriteString("ERROR\r\n")
+		} else if string(args[0]) == "quit" {
+			_ = bw.Flush()
+			return
+		} else if err := s.exec(br, bw, args); err != nil {
+			var ce clientError
+			switch {
+			case errors.As(err, &ce):
+				fmt.Fprintf(bw, "CLIENT_ERROR %s\r\n", ce)
+			case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+				return
+			default:
+				fmt.Fprintf(bw, "SERVER_ERROR %v\r\n", err)
+			}
+		}
+		// Ответы на конвейер команд уходят одной записью.
+		if br.Buffered() == 0 {
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// exec выполняет команду args и пишет ответ в bw; данные set читаются из br.
+func (s *Server) exec(br *bufio.Reader, bw *bufio.Writer, args [][]byte) error {
+	switch string(args[0]) {
+	case "get":
+		return s.get(bw, args[1:])
+	case "set":
+		return s.set(br, bw, args[1:])
+	case "delete":
+		return s.delete(bw, args[1:])
+	case "version":
+		bw.WriteString("VERSION kvschool\r\n")
+		return nil
+	}
+	bw.WriteString("ERROR\r\n")
+	return nil
+}
+
+// get — get <key>*: VALUE для каждого найденного ключа, затем END.
+func (s *Server) get(bw *bufio.Writer, keys [][]byte) error {
+	if len(keys) == 0 {
+		bw.WriteString("ERROR\r\n")
+		return nil
+	}
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		v, err := s.e.Get(key)
+		if errors.Is(err, lsm.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "VALUE %s 0 %d\r\n", key, len(v))
+		bw.Write(v)
+		bw.WriteString("\r\n")
+	}
+	bw.WriteString("END\r\n")
+	return nil
+}
+
+// set — set <key> <flags> <exptime> <bytes> [noreply], за строкой — данные и "\r\n".
+func (s *Server) set(br *bufio.Reader, bw *bufio.Writer, args [][]byte) error {
+	if len(args) != 4 && len(args) != 5 {
+		bw.WriteString("ERROR\r\n")
+		return nil
+	}
+	noreply := len(args) == 5 && string(args[4]) == "noreply"
+	size, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil || size < 0 {
+		return clientError("некорректный формат строки команды")
+	}
+	if size > maxValueLen {
+		// Данные пропускаются, чтобы следующая команда читалась с начала строки.
+		if _, err := io.CopyN(io.Discard, br, size+2); err != nil {
+			return err
+		}
+		return errors.New("значение слишком велико")
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return clientError("некорректный блок данных")
+	}
+	if err := checkKey(args[0]); err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(string(args[1]), 10, 32); err != nil {
+		return clientError("некорректный формат строки команды")
+	}
+	exptime, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return clientError("некорректный формат строки команды")
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	value := data[:size:size]
+	switch ttl := s.ttl(exptime); {
+	case exptime == 0:
+		err = s.e.Put(args[0], value)
+	case ttl <= 0:
+		// Уже истёкший элемент: как в memcached, set лишь удаляет прежнее значение.
+		err = s.e.Delete(args[0])
+	default:
+		err = s.e.PutWithTTL(args[0], value, ttl)
+	}
+	if err != nil {
+		return err
+	}
+	if !noreply {
+		bw.WriteString("STORED\r\n")
+	}
+	return nil
+}
+
+// ttl переводит exptime memcached в время жизни: до 30 суток — секунды от текущего
+// момента, больше — момент истечения в секундах Unix.
+func (s *Server) ttl(exptime int64) time.Duration {
+	if exptime > relativeExpiry {
+		return time.Unix(exptime, 0).Sub(s.now())
+	}
+	return time.Duration(exptime) * time.Second
+}
+
+// delete — delete <key> [noreply]: DELETED или NOT_FOUND.
+func (s *Server) delete(bw *bufio.Writer, args [][]byte) error {
+	if len(args) != 1 && len(args) != 2 {
+		bw.WriteString("ERROR\r\n")
+		return nil
+	}
+	if err := checkKey(args[0]); err != nil {
+		return err
+	}
+	noreply := len(args) == 2 && string(args[1]) == "noreply"
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	reply := "DELETED\r\n"
+	_, err := s.e.Get(args[0])
+	switch {
+	case errors.Is(err, lsm.ErrNotFound):
+		reply = "NOT_FOUND\r\n"
+	case err != nil:
+		return err
+	default:
+		if err := s.e.Delete(args[0]); err != nil {
+			return err
+		}
+	}
+	if !noreply {
+		bw.WriteString(reply)
+	}
+	return nil
+}
+
+// checkKey проверяет ключ: не длиннее maxKeyLen байт, без управляющих символов.
+func checkKey(key []byte) error {
+	if len(key) > maxKeyLen {
+		return clientError("слишком длинный ключ")
+	}
+	for _, b := range key {
+		if b < ' ' || b == 0x7f {
+			return clientError("недопустимый символ в ключе")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"strconv"
+
+	"kvschool/internal/lsm"
+)
+
+type engineCollector struct {
+	e *lsm.Engine
+}
+
+// Engine возвращает Collector счетчиков движка e (см. lsm.Stats) с префиксом kvschool_lsm_.
+func Engine(e *lsm.Engine) Collector {
+	return engineCollector{e: e}
+}
+
+func (c engineCollector) Collect(w *Writer) {
+	st := c.e.Stats()
+
+	w.Counter("kvschool_lsm_puts_total", "Число записей Put.", float64(st.Puts))
+	w.Counter("kvschool_lsm_gets_total", "Число чтений Get.", float64(st.Gets))
+	w.Counter("kvschool_lsm_deletes_total", "Число удалений Delete.", float64(st.Deletes))
+	w.Counter("kvschool_lsm_merges_total", "Число операндов Merge.", float64(st.Merges))
+	w.Gauge("kvschool_lsm_memtable_bytes", "Объем Memtable.", float64(st.MemtableBytes))
+
+	w.Gauge("kvschool_lsm_wal_segment_bytes", "Байт записано в текущий сегмент WAL.", float64(st.WALBytes))
+	w.Counter("kvschool_lsm_wal_records_total", "Записей дописано в WAL.", float64(st.WALRecords))
+	w.Counter("kvschool_lsm_wal_written_bytes_total", "Байт дописано в WAL.", float64(st.WALBytesWritten))
+	w.Counter("kvschool_lsm_wal_writes_total", "Системных вызовов записи WAL.", float64(st.WALWrites))
+	w.Counter("kvschool_lsm_wal_syncs_total", "Вызовов fsync WAL.", float64(st.WALSyncs))
+
+	w.Counter("kvschool_lsm_flushes_total", "Сбросов Memtable в SSTable.", float64(st.Flushes))
+	w.Counter("kvschool_lsm_compactions_total", "Выполненных compaction.", float64(st.Compactions))
+	w.Counter("kvschool_lsm_compaction_read_bytes_total", "Байт SSTable прочитано compaction.", float64(st.BytesRead))
+	w.Counter("kvschool_lsm_table_written_bytes_total", "Байт SSTable записано Flush и compaction.", float64(st.BytesWritten))
+	for level, n := range st.LevelTables {
+		w.Gauge("kvschool_lsm_level_tables", "Число таблиц уровня.", float64(n), Label{"level", strconv.Itoa(level)})
+	}
+	for level, n := range st.LevelBytes {
+		w.Gauge("kvschool_lsm_level_bytes", "Суммарный размер таблиц уровня.", float64(n), Label{"level", strconv.Itoa(level)})
+	}
+
+	w.Gauge("kvschool_lsm_write_stall", "Ограничение записи: 0 — нет, 1 — замедление, 2 — остановка.", float64(st.WriteStall))
+	w.Counter("kvschool_lsm_stalled_writes_total", "Задержанных записей.", float64(st.StalledWrites))
+	w.Counter("kvschool_lsm_stall_seconds_total", "Суммарное время задержки записей.", st.StallTime.Seconds())
+
+	w.Gauge("kvschool_lsm_open_tables", "Открытых SSTable в кэше таблиц.", float64(st.OpenTables))
+	w.Counter("kvschool_lsm_table_cache_hits_total", "Попаданий в кэш таблиц.", float64(st.TableCacheHits))
+	w.Counter("kvschool_lsm_table_cache_misses_total", "Промахов кэша таблиц.", float64(st.TableCacheMisses))
+}
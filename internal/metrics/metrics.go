@@ -0,0 +1,171 @@
+// Package metrics отдает метрики в текстовом формате Prometheus (версия 0.0.4):
+// счетчики движка, WAL, compaction и кэша таблиц, а также скетчи пакета stream —
+// без клиентской библиотеки Prometheus.
+//
+//	reg := metrics.NewRegistry()
+//	reg.Register(metrics.Engine(e))
+//	mux.Handle("/metrics", reg)
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kvschool/internal/stream"
+)
+
+// Collector пишет метрики при каждом опросе.
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// Func — Collector из функции, например для скетчей приложения.
+type Func func(w *Writer)
+
+// Collect вызывает f.
+func (f Func) Collect(w *Writer) { f(w) }
+
+// Registry — набор Collector; как http.Handler отдает их метрики.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry создает пустой набор.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register добавляет Collector в набор.
+func (r *Registry) Register(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, cs...)
+}
+
+// ServeHTTP отдает метрики всех Collector в порядке регистрации.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	cs := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	mw := &Writer{families: make(map[string]bool)}
+	for _, c := range cs {
+		c.Collect(mw)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(mw.buf.Bytes())
+}
+
+// Label — метка серии.
+type Label struct {
+	Name, Value string
+}
+
+// Writer накапливает метрики одного опроса. Серии одного семейства (одного имени)
+// пишутся подряд: HELP и TYPE выводятся перед первой из них.
+type Writer struct {
+	buf      bytes.Buffer
+	families map[string]bool
+}
+
+// Counter пишет значение счетчика. По соглашению Prometheus имя оканчивается на _total.
+func (w *Writer) Counter(name, help string, v float64, labels ...Label) {
+	w.family(name, help, "counter")
+	w.sample(name, labels, v)
+}
+
+// Gauge пишет текущее значение.
+func (w *Writer) Gauge(name, help string, v float64, labels ...Label) {
+	w.family(name, help, "gauge")
+	w.sample(name, labels, v)
+}
+
+// Histogram пишет гистограмму: корзины с границами le = 0, 1, 3, 7, ..., 2^63 - 1
+// и +Inf, сумму и число значений. h читается без блокировок: это снимок или
+// гистограмма, которую сейчас никто не изменяет.
+func (w *Writer) Histogram(name, help string, h *stream.ExpHistogram, labels ...Label) {
+	w.family(name, help, "histogram")
+	counts := make([]uint64, 65)
+	h.Buckets(func(_, hi, n uint64) {
+		counts[bits.Len64(hi)] += n
+	})
+	var cum uint64
+	for i := 0; i < 64; i++ {
+		cum += counts[i]
+		le := strconv.FormatUint(1<<i-1, 10)
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], Label{"le", le}), float64(cum))
+	}
+	w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], Label{"le", "+Inf"}), float64(h.Count()))
+	w.sample(name+"_sum", labels, h.Sum())
+	w.sample(name+"_count", labels, float64(h.Count()))
+}
+
+// Summary пишет квантили quantiles (например, 0.5, 0.9, 0.99) скетча s, сумму и
+// число значений. s читается без блокировок, как в Histogram.
+func (w *Writer) Summary(name, help string, s *stream.QuantileSketch, quantiles []float64, labels ...Label) {
+	w.family(name, help, "summary")
+	for _, q := range quantiles {
+		w.sample(name, append(labels[:len(labels):len(labels)], Label{"quantile", formatFloat(q)}), s.Quantile(q))
+	}
+	w.sample(name+"_sum", labels, s.Sum())
+	w.sample(name+"_count", labels, float64(s.Count()))
+}
+
+func (w *Writer) family(name, help, typ string) {
+	if w.families[name] {
+		return
+	}
+	w.families[name] = true
+	w.buf.WriteString("# HELP ")
+	w.buf.WriteString(name)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(helpEscaper.Replace(help))
+	w.buf.WriteString("\n# TYPE ")
+	w.buf.WriteString(name)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(typ)
+	w.buf.WriteByte('\n')
+}
+
+func (w *Writer) sample(name string, labels []Label, v float64) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.buf.WriteString(l.Name)
+			w.buf.WriteString(`="`)
+			w.buf.WriteString(labelEscaper.Replace(l.Value))
+			w.buf.WriteByte('"')
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatFloat(v))
+	w.buf.WriteByte('\n')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kvschool/internal/lsm"
+	"kvschool/internal/stream"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type: %q", ct)
+	}
+	b, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWriter(t *testing.T) {
+	reg := NewRegistry()
+	var h stream.ExpHistogram
+	h.AddN(0, 2)
+	h.Add(5)
+	h.Add(6)
+	q := stream.NewQuantileSketch(0.01)
+	for i := 1; i <= 100; i++ {
+		_ = q.Add(float64(i))
+	}
+	reg.Register(Func(func(w *Writer) {
+		w.Counter("requests_total", "Запросы.", 3, Label{"method", "get"})
+		w.Counter("requests_total", "Запросы.", 1, Label{"method", `p"u\t`})
+		w.Gauge("temperature", "Строка 1\nстрока 2.", -1.5)
+		w.Histogram("size_bytes", "Размер.", &h)
+		w.Summary("latency_seconds", "Задержка.", q, []float64{0.5})
+	}))
+	out := scrape(t, reg)
+
+	for _, want := range []string{
+		"# HELP requests_total Запросы.\n# TYPE requests_total counter\nrequests_total{method=\"get\"} 3\nrequests_total{method=\"p\\\"u\\\\t\"} 1\n",
+		"# HELP temperature Строка 1\\nстрока 2.\n# TYPE temperature gauge\ntemperature -1.5\n",
+		"# TYPE size_bytes histogram\n",
+		"size_bytes_bucket{le=\"0\"} 2\nsize_bytes_bucket{le=\"1\"} 2\nsize_bytes_bucket{le=\"3\"} 2\nsize_bytes_bucket{le=\"7\"} 4\n",
+		"size_bytes_bucket{le=\"+Inf\"} 4\nsize_bytes_sum 11\nsize_bytes_count 4\n",
+		"# TYPE latency_seconds summary\n",
+		"latency_seconds_sum 5050\nlatency_seconds_count 100\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("нет %q в\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "# TYPE requests_total"); n != 1 {
+		t.Errorf("TYPE requests_total выведен %d раз", n)
+	}
+	if !strings.Contains(out, `latency_seconds{quantile="0.5"} `+formatFloat(q.Quantile(0.5))+"\n") {
+		t.Errorf("нет квантиля 0.5 в\n%s", out)
+	}
+}
+
+func TestEngine(t *testing.T) {
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := e.Put([]byte(k), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := NewRegistry()
+	reg.Register(Engine(e))
+	out := scrape(t, reg)
+	for _, want := range []string{
+		"kvschool_lsm_puts_total 3\n",
+		"kvschool_lsm_flushes_total 1\n",
+		"kvschool_lsm_level_tables{level=\"0\"} 1\n",
+		"# TYPE kvschool_lsm_write_stall gauge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("нет %q в\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Package murmur3 — хеш-функция MurmurHash3 x64 128
+// (https://github.com/aappleby/smhasher/blob/master/src/MurmurHash3.cpp).
+// Хорошо перемешивает и короткие похожие ключи (IMSI, счетчики), поэтому ею
+// пользуются фильтры Блума и скетчи частот.
+package murmur3
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Sum128 возвращает две половины MurmurHash3 x64 128 ключа с seed.
+func Sum128(key []byte, seed uint64) (h1, h2 uint64) {
+	const (
+		c1 = 0x87c37b91114253d5
+		c2 = 0x4cf5ad432745937f
+	)
+	n := len(key)
+	h1, h2 = seed, seed
+	for ; len(key) >= 16; key = key[16:] {
+		k1 := binary.LittleEndian.Uint64(key)
+		k2 := binary.LittleEndian.Uint64(key[8:])
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+	var k1, k2 uint64
+	for i := len(key) - 1; i >= 8; i-- {
+		k2 ^= uint64(key[i]) << ((i - 8) * 8)
+	}
+	if len(key) > 8 {
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+	}
+	for i := min(len(key), 8) - 1; i >= 0; i-- {
+		k1 ^= uint64(key[i]) << (i * 8)
+	}
+	if len(key) > 0 {
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+	}
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return h1, h2
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
@@ -0,0 +1,19 @@
+package murmur3
+
+import "testing"
+
+func TestSum128(t *testing.T) {
+	// Эталонные значения MurmurHash3 x64 128.
+	for _, tc := range []struct {
+		key    string
+		seed   uint64
+		h1, h2 uint64
+	}{
+		{"", 0, 0, 0},
+		{"The quick brown fox jumps over the lazy dog", 0, 0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347},
+	} {
+		if h1, h2 := Sum128([]byte(tc.key), tc.seed); h1 != tc.h1 || h2 != tc.h2 {
+			t.Errorf("Sum128(%q, %d): %x %x, ожидалось %x %x", tc.key, tc.seed, h1, h2, tc.h1, tc.h2)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+var errBadMessage = errors.New("raft: некорректное сообщение")
+
+// Сообщения и записи лога кодируются последовательностью полей: числа — uvarint
+// (момент истечения — varint), строки и байты — длина uvarint и содержимое,
+// флаги — байт 0 или 1.
+
+// appendEntry кодирует запись лога: номер, срок и число изменений, затем каждое
+// изменение — вид (байт), пространство ключей, ключ, значение и момент истечения
+// в наносекундах Unix (0 — без срока).
+func appendEntry(b []byte, e Entry) []byte {
+	b = binary.AppendUvarint(b, e.Index)
+	b = binary.AppendUvarint(b, e.Term)
+	b = binary.AppendUvarint(b, uint64(len(e.Mutations)))
+	for _, m := range e.Mutations {
+		b = append(b, byte(m.Kind))
+		b = appendBytes(b, []byte(m.ColumnFamily))
+		b = appendBytes(b, m.Key)
+		b = appendBytes(b, m.Value)
+		var expires int64
+		if !m.ExpiresAt.IsZero() {
+			expires = m.ExpiresAt.UnixNano()
+		}
+		b = binary.AppendVarint(b, expires)
+	}
+	return b
+}
+
+func (d *decoder) entry() Entry {
+	e := Entry{Index: d.uvarint(), Term: d.uvarint()}
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err, d.b = true, nil
+		return Entry{}
+	}
+	if n > 0 {
+		e.Mutations = make([]lsm.Mutation, 0, n)
+	}
+	for range n {
+		m := lsm.Mutation{Kind: lsm.MutationKind(d.byte())}
+		m.ColumnFamily = string(d.bytes())
+		m.Key = d.bytes()
+		m.Value = d.bytes()
+		if expires := d.varint(); expires != 0 {
+			m.ExpiresAt = time.Unix(0, expires)
+		}
+		e.Mutations = append(e.Mutations, m)
+	}
+	return e
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// MarshalBinary кодирует сообщение для Transport.
+func (m *RequestVoteArgs) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = appendBytes(b, []byte(m.CandidateID))
+	b = binary.AppendUvarint(b, m.LastLogIndex)
+	b = binary.AppendUvarint(b, m.LastLogTerm)
+	return appendBool(b, m.PreVote), nil
+}
+
+// UnmarshalBinary разбирает сообщение, закодированное MarshalBinary.
+func (m *RequestVoteArgs) UnmarshalBinary(b []byte) error {
+	d := decoder{b: b}
+	*m = RequestVoteArgs{
+		Term:         d.uvarint(),
+		CandidateID:  string(d.bytes()),
+		LastLogIndex: d.uvarint(),
+		LastLogTerm:  d.uvarint(),
+		PreVote:      d.bool(),
+	}
+	return d.finish("RequestVote")
+}
+
+// MarshalBinary кодирует сообщение для Transport.
+func (m *RequestVoteReply) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, m.Term)
+	return appendBool(b, m.VoteGranted), nil
+}
+
+// UnmarshalBinary разбирает сообщение, закодированное MarshalBinary.
+func (m *RequestVoteReply) UnmarshalBinary(b []byte) error {
+	d := decoder{b: b}
+	*m = RequestVoteReply{Term: d.uvarint(), VoteGranted: d.bool()}
+	return d.finish("ответ RequestVote")
+}
+
+// MarshalBinary кодирует сообщение для Transport.
+func (m *AppendEntriesArgs) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = appendBytes(b, []byte(m.LeaderID))
+	b = binary.AppendUvarint(b, m.PrevLogIndex)
+	b = binary.AppendUvarint(b, m.PrevLogTerm)
+	b = binary.AppendUvarint(b, m.LeaderCommit)
+	b = binary.AppendUvarint(b, uint64(len(m.Entries)))
+	for _, e := range m.Entries {
+		b = appendEntry(b, e)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary разбирает сообщение, закодированное MarshalBinary.
+func (m *AppendEntriesArgs) UnmarshalBinary(b []byte) error {
+	d := decoder{b: b}
+	*m = AppendEntriesArgs{
+		Term:         d.uvarint(),
+		LeaderID:     string(d.bytes()),
+		PrevLogIndex: d.uvarint(),
+		PrevLogTerm:  d.uvarint(),
+		LeaderCommit: d.uvarint(),
+	}
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = true
+	} else if n > 0 {
+		m.Entries = make([]Entry, 0, n)
+		for range n {
+			m.Entries = append(m.Entries, d.entry())
+		}
+	}
+	return d.finish("AppendEntries")
+}
+
+// MarshalBinary кодирует сообщение для Transport.
+func (m *AppendEntriesReply) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = appendBool(b, m.Success)
+	b = binary.AppendUvarint(b, m.ConflictIndex)
+	return binary.AppendUvarint(b, m.ConflictTerm), nil
+}
+
+// UnmarshalBinary разбирает сообщение, закодированное MarshalBinary.
+func (m *AppendEntriesReply) UnmarshalBinary(b []byte) error {
+	d := decoder{b: b}
+	*m = AppendEntriesReply{Term: d.uvarint(), Success: d.bool(), ConflictIndex: d.uvarint(), ConflictTerm: d.uvarint()}
+	return d.finish("ответ AppendEntries")
+}
+
+// MarshalBinary кодирует сообщение для Transport (без самой копии базы).
+func (m *InstallSnapshotArgs) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, m.Term)
+	b = appendBytes(b, []byte(m.LeaderID))
+	b = binary.AppendUvarint(b, m.LastIndex)
+	return binary.AppendUvarint(b, m.LastTerm), nil
+}
+
+// UnmarshalBinary разбирает сообщение, закодированное MarshalBinary.
+func (m *InstallSnapshotArgs) UnmarshalBinary(b []byte) error {
+	d := decoder{b: b}
+	*m = InstallSnapshotArgs{Term: d.uvarint(), LeaderID: string(d.bytes()), LastIndex: d.uvarint(), LastTerm: d.uvarint()}
+	return d.finish("InstallSnapshot")
+}
+
+// MarshalBinary кодирует сообщение для Transport.
+func (m *InstallSnapshotReply) MarshalBinary() ([]byte, error) {
+	return binary.AppendUvarint(nil, m.Term), nil
+}
+
+// UnmarshalBinary разбирает сообщение, закодированное MarshalBinary.
+func (m *InstallSnapshotReply) UnmarshalBinary(b []byte) error {
+	d := decoder{b: b}
+	*m = InstallSnapshotReply{Term: d.uvarint()}
+	return d.finish("ответ InstallSnapshot")
+}
+
+// decoder читает поля из b; при нехватке байт выставляет err и дальше возвращает нули.
+type decoder struct {
+	b   []byte
+	err bool
+}
+
+// finish сообщает об ошибке разбора what: нехватке байт или лишних байтах в конце.
+func (d *decoder) finish(what string) error {
+	if d.err || len(d.b) != 0 {
+		return fmt.Errorf("%w: %s", errBadMessage, what)
+	}
+	return nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err, d.b = true, nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err, d.b = true, nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) == 0 {
+		d.err = true
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) bool() bool {
+	switch d.byte() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	d.err, d.b = true, nil
+	return false
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err, d.b = true, nil
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
@@ -0,0 +1,1058 @@
+// Package raft — синхронная репликация движка на группу из 3 или 5 узлов консенсусом
+// Raft: запись подтверждается, когда ее сохранило большинство узлов, и переживает
+// отказ меньшинства, включая ведущего.
+//
+// Запись лога Raft — пакет изменений (lsm.Mutation), какой движок пишет в WAL одной
+// записью. Зафиксированные записи применяются к движку каждого узла через
+// Engine.ApplyUpdate под номером записи лога, поэтому LatestSequence движка — номер
+// последней примененной записи, и после перезапуска узел продолжает с него. Лог
+// периодически усекается по примененным записям (движок перед этим делает Flush);
+// узлу, которому нужны уже отброшенные записи, ведущий отправляет копию базы
+// (Engine.Checkpoint).
+//
+// Записи принимает только ведущий (Propose); Get и ReadBarrier дают линеаризуемое
+// чтение через ведущего. Состав группы фиксирован при создании.
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+var (
+	// ErrNotLeader — узел не ведущий; адрес ведущего, если он известен, возвращает Leader.
+	ErrNotLeader = errors.New("raft: узел не ведущий")
+	// ErrLeadershipLost — ведущий сменился, пока запись ждала фиксации: она могла быть
+	// как применена, так и отброшена.
+	ErrLeadershipLost = errors.New("raft: ведущий сменился, результат записи неизвестен")
+	// ErrClosed — узел остановлен.
+	ErrClosed = errors.New("raft: узел остановлен")
+)
+
+const (
+	// snapshotTimeout ограничивает передачу копии базы отстающему узлу.
+	snapshotTimeout = 10 * time.Minute
+	// maxApplyBatch — сколько записей применяется за раз.
+	maxApplyBatch = 1024
+)
+
+// Entry — запись лога Raft. Запись без изменений добавляет новый ведущий.
+type Entry struct {
+	Index     uint64
+	Term      uint64
+	Mutations []lsm.Mutation
+}
+
+// Config — параметры узла.
+type Config struct {
+	// ID — идентификатор узла, по нему его находят остальные через Transport.
+	ID string
+	// Peers — идентификаторы всех узлов группы, включая ID. Одинаков на всех узлах.
+	Peers []string
+	// Dir — директория узла: лог Raft и база движка (поддиректория db).
+	Dir string
+	// Engine — параметры движка; Dir задает узел.
+	Engine lsm.Options
+	// Transport доставляет сообщения остальным узлам.
+	Transport Transport
+
+	// ElectionTimeout — сколько узел ждет ведущего, прежде чем начать выборы
+	// (случайно от ElectionTimeout до 2*ElectionTimeout). По умолчанию 1 с.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval — как часто ведущий напоминает о себе. По умолчанию 100 мс.
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold — сколько примененных записей копится в логе, прежде чем
+	// он усекается. По умолчанию 8192.
+	SnapshotThreshold uint64
+	// MaxAppendEntries — сколько записей ведущий отправляет одним AppendEntries.
+	// По умолчанию 256.
+	MaxAppendEntries int
+	// Logger получает сообщения о выборах и копиях базы (по умолчанию отбрасываются).
+	Logger *log.Logger
+}
+
+func (c Config) withDefaults() (Config, error) {
+	if c.ID == "" || c.Dir == "" || c.Transport == nil {
+		return c, errors.New("raft: не заданы ID, Dir или Transport")
+	}
+	if !slices.Contains(c.Peers, c.ID) {
+		return c, fmt.Errorf("raft: узла %q нет среди Peers", c.ID)
+	}
+	if c.ElectionTimeout <= 0 {
+		c.ElectionTimeout = time.Second
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = 8192
+	}
+	if c.MaxAppendEntries <= 0 {
+		c.MaxAppendEntries = 256
+	}
+	if c.Logger == nil {
+		c.Logger = log.New(io.Discard, "", 0)
+	}
+	c.Engine.Dir = filepath.Join(c.Dir, dbDirName)
+	return c, nil
+}
+
+// State — роль узла.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Status — состояние узла.
+type Status struct {
+	ID        string
+	State     State
+	Term      uint64
+	Leader    string // "" — ведущий неизвестен
+	LastIndex uint64 // номер последней записи лога
+	Commit    uint64 // номер последней зафиксированной записи
+	Applied   uint64 // номер последней записи, примененной к движку
+}
+
+// waiter ждет применения записи, предложенной ведущим в сроке term.
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node — узел группы Raft и его движок.
+type Node struct {
+	cfg    Config
+	peers  []string // остальные узлы
+	quorum int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// applyMu упорядочивает применение записей, чтение копии базы и ее установку.
+	// Берется раньше mu.
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+	log      *logStore
+	commit   uint64
+	applied  uint64
+	engine   *lsm.Engine
+	deadline time.Time // начало выборов, если до него ведущий не объявится
+	// lastContact — когда узел последний раз получал сообщение ведущего.
+	lastContact time.Time
+	// round — номер попытки выборов: ответы на прежние попытки не учитываются.
+	round uint64
+	// installing — узел устанавливает копию базы и не начинает выборов.
+	installing bool
+	next       map[string]uint64 // ведущий: следующая запись для узла
+	match      map[string]uint64 // ведущий: последняя запись, которая точно есть у узла
+	waiters    map[uint64]waiter
+	triggers   map[string]chan struct{}
+	// changed закрывается и заменяется при каждом изменении commit, applied и state.
+	changed chan struct{}
+	err     error // узел остановлен: ErrClosed или причина сбоя
+}
+
+// Open открывает узел в cfg.Dir (создает, если его нет) и запускает его.
+// Пустой узел присоединяется к группе, и ведущий присылает ему копию базы
+// или записи с начала лога.
+func Open(cfg Config) (*Node, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("raft: %w", err)
+	}
+	st, err := loadState(filepath.Join(cfg.Dir, stateFileName))
+	if err != nil {
+		return nil, err
+	}
+	l, err := openLog(filepath.Join(cfg.Dir, logFileName))
+	if err != nil {
+		return nil, err
+	}
+	if err := finishSnapshot(cfg.Dir, l.base); err != nil {
+		_ = l.close()
+		return nil, err
+	}
+	e, err := lsm.Open(cfg.Engine)
+	if err != nil {
+		_ = l.close()
+		return nil, fmt.Errorf("raft: %w", err)
+	}
+	applied := e.LatestSequence()
+	if applied < l.base || applied > l.lastIndex() {
+		_ = e.Close()
+		_ = l.close()
+		return nil, fmt.Errorf("%w: движок на записи %d, в логе записи %d–%d", ErrCorrupt, applied, l.base, l.lastIndex())
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		term:     st.term,
+		votedFor: st.votedFor,
+		log:      l,
+		commit:   applied,
+		applied:  applied,
+		engine:   e,
+		waiters:  make(map[uint64]waiter),
+		triggers: make(map[string]chan struct{}),
+		changed:  make(chan struct{}),
+	}
+	for _, p := range cfg.Peers {
+		if p != cfg.ID && !slices.Contains(n.peers, p) {
+			n.peers = append(n.peers, p)
+			n.triggers[p] = make(chan struct{}, 1)
+		}
+	}
+	n.quorum = (len(n.peers)+1)/2 + 1
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.resetDeadline()
+
+	n.wg.Add(2 + len(n.peers))
+	go n.runTicker()
+	go n.runApplier()
+	for _, p := range n.peers {
+		go n.runReplicator(p)
+	}
+	return n, nil
+}
+
+// finishSnapshot доводит до конца установку копии базы, прерванную сбоем: копия
+// snapshot-N заменяет db, если лог уже усечен по N, иначе удаляется.
+// Удаляются и оставшиеся временные копии для отправки.
+func finishSnapshot(dir string, base uint64) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("raft: %w", err)
+	}
+	for _, ent := range ents {
+		name := ent.Name()
+		path := filepath.Join(dir, name)
+		if strings.HasPrefix(name, sendDirPrefix) {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("raft: %w", err)
+			}
+			continue
+		}
+		idx, ok := strings.CutPrefix(name, snapshotDirPrefix)
+		if !ok {
+			continue
+		}
+		if i, err := strconv.ParseUint(idx, 10, 64); err == nil && i == base {
+			if err := swapDB(dir, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("raft: %w", err)
+		}
+	}
+	return nil
+}
+
+// swapDB заменяет базу узла директорией snapshot.
+func swapDB(dir, snapshot string) error {
+	db := filepath.Join(dir, dbDirName)
+	if err := os.RemoveAll(db); err != nil {
+		return fmt.Errorf("raft: установка копии базы: %w", err)
+	}
+	if err := os.Rename(snapshot, db); err != nil {
+		return fmt.Errorf("raft: установка копии базы: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("raft: установка копии базы: %w", err)
+	}
+	return nil
+}
+
+// Close останавливает узел и закрывает его движок.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if errors.Is(n.err, ErrClosed) {
+		n.mu.Unlock()
+		return nil
+	}
+	n.stopLocked(ErrClosed)
+	n.mu.Unlock()
+	n.wg.Wait()
+
+	// Установка копии базы, начатая до Close, закончится под applyMu.
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var err error
+	if n.engine != nil {
+		err = n.engine.Close()
+		n.engine = nil
+	}
+	if cerr := n.log.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// stopLocked останавливает узел с причиной err; Close после сбоя все равно нужен.
+func (n *Node) stopLocked(err error) {
+	if n.err == nil {
+		n.cfg.Logger.Printf("raft: %s: остановка: %v", n.cfg.ID, err)
+	}
+	if n.err == nil || errors.Is(err, ErrClosed) {
+		n.err = err
+	}
+	n.cancel()
+	n.failWaitersLocked(err)
+	n.notifyLocked()
+}
+
+func (n *Node) failLocked(err error) {
+	n.stopLocked(fmt.Errorf("raft: узел остановлен после сбоя: %w", err))
+}
+
+func (n *Node) notifyLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *Node) failWaitersLocked(err error) {
+	for i, w := range n.waiters {
+		w.done <- err
+		delete(n.waiters, i)
+	}
+}
+
+// Engine возвращает движок узла для чтения; писать в него можно только через
+// Propose. Чтение без ReadBarrier может не видеть последних записей группы.
+// Установка копии базы от ведущего заменяет движок: старый закрывается.
+func (n *Node) Engine() *lsm.Engine {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.engine
+}
+
+// Leader возвращает идентификатор ведущего; "" — ведущий неизвестен.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Status возвращает состояние узла.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:        n.cfg.ID,
+		State:     n.state,
+		Term:      n.term,
+		Leader:    n.leader,
+		LastIndex: n.log.lastIndex(),
+		Commit:    n.commit,
+		Applied:   n.applied,
+	}
+}
+
+// Propose записывает изменения атомарно и ждет, пока их зафиксирует группа
+// и применит движок ведущего. Вызывается на ведущем, иначе ErrNotLeader.
+// Ошибка применения (например, lsm.ErrNoMergeOperator) возвращается как есть:
+// такая запись не изменяет движков ни одного узла.
+// Если ctx отменен раньше, запись все равно может быть применена.
+func (n *Node) Propose(ctx context.Context, muts ...lsm.Mutation) error {
+	muts, err := n.prepare(muts)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	if n.err != nil {
+		n.mu.Unlock()
+		return n.err
+	}
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	e := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Mutations: muts}
+	if err := n.log.append([]Entry{e}); err != nil {
+		n.failLocked(err)
+		n.mu.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, done: done}
+	n.advanceCommitLocked()
+	n.triggerLocked()
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prepare проверяет изменения и копирует их: запись лога живет дольше вызова Propose.
+func (n *Node) prepare(muts []lsm.Mutation) ([]lsm.Mutation, error) {
+	out := make([]lsm.Mutation, len(muts))
+	for i, m := range muts {
+		switch m.Kind {
+		case lsm.MutationPut, lsm.MutationDelete:
+		case lsm.MutationMerge:
+			if n.cfg.Engine.MergeOperator == nil {
+				return nil, lsm.ErrNoMergeOperator
+			}
+		default:
+			return nil, fmt.Errorf("raft: неизвестный вид изменения %v", m.Kind)
+		}
+		if len(m.Key) == 0 {
+			return nil, lsm.ErrEmptyKey
+		}
+		if m.ColumnFamily == "" {
+			m.ColumnFamily = lsm.DefaultColumnFamilyName
+		}
+		m.Key, m.Value = bytes.Clone(m.Key), bytes.Clone(m.Value)
+		out[i] = m
+	}
+	return out, nil
+}
+
+// Put записывает key в пространство ключей по умолчанию.
+func (n *Node) Put(ctx context.Context, key, value []byte) error {
+	return n.Propose(ctx, lsm.Mutation{Kind: lsm.MutationPut, Key: key, Value: value})
+}
+
+// PutWithTTL записывает key со сроком жизни ttl, отсчитанным от момента вызова.
+func (n *Node) PutWithTTL(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	return n.Propose(ctx, lsm.Mutation{Kind: lsm.MutationPut, Key: key, Value: value, ExpiresAt: time.Now().Add(ttl)})
+}
+
+// Delete удаляет key из пространства ключей по умолчанию.
+func (n *Node) Delete(ctx context.Context, key []byte) error {
+	return n.Propose(ctx, lsm.Mutation{Kind: lsm.MutationDelete, Key: key})
+}
+
+// Get возвращает значение key линеаризуемо: с учетом всех записей, зафиксированных
+// до вызова. Вызывается на ведущем, иначе ErrNotLeader.
+func (n *Node) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := n.ReadBarrier(ctx); err != nil {
+		return nil, err
+	}
+	return n.Engine().GetContext(ctx, key)
+}
+
+// ReadBarrier ждет, пока движок ведущего применит все записи, зафиксированные до
+// вызова, и подтверждает у большинства, что узел все еще ведущий. Чтение из Engine
+// после ReadBarrier линеаризуемо. Вызывается на ведущем, иначе ErrNotLeader.
+func (n *Node) ReadBarrier(ctx context.Context) error {
+	n.mu.Lock()
+	// Пока не зафиксирована запись текущего срока, commit ведущего может отставать.
+	for n.err == nil && n.state == Leader {
+		if t, _ := n.log.term(n.commit); t == n.term {
+			break
+		}
+		if err := n.waitLocked(ctx); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+	if n.err != nil {
+		defer n.mu.Unlock()
+		return n.err
+	}
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	readIndex, term := n.commit, n.term
+	n.mu.Unlock()
+
+	if err := n.confirmLeadership(ctx, term); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.err == nil && n.applied < readIndex {
+		if err := n.waitLocked(ctx); err != nil {
+			return err
+		}
+	}
+	return n.err
+}
+
+// waitLocked ждет изменения состояния узла (notifyLocked) или отмены ctx; mu
+// на время ожидания отпускается.
+func (n *Node) waitLocked(ctx context.Context) error {
+	ch := n.changed
+	n.mu.Unlock()
+	defer n.mu.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// confirmLeadership рассылает heartbeat и ждет, пока большинство признает узел
+// ведущим в сроке term.
+func (n *Node) confirmLeadership(ctx context.Context, term uint64) error {
+	if len(n.peers) == 0 {
+		return nil
+	}
+	// Пустой AppendEntries с PrevLogIndex 0 не меняет лога и commit узла.
+	args := &AppendEntriesArgs{Term: term, LeaderID: n.cfg.ID}
+	acks := make(chan bool, len(n.peers))
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ElectionTimeout)
+	defer cancel()
+	for _, p := range n.peers {
+		go func() {
+			reply, err := n.cfg.Transport.AppendEntries(ctx, p, args)
+			if err != nil {
+				acks <- false
+				return
+			}
+			if reply.Term > term {
+				n.mu.Lock()
+				if n.err == nil {
+					n.stepDownLocked(reply.Term)
+				}
+				n.mu.Unlock()
+			}
+			acks <- reply.Term == term
+		}()
+	}
+	got, rest := 1, len(n.peers)
+	for got < n.quorum {
+		if got+rest < n.quorum {
+			return ErrNotLeader
+		}
+		if <-acks {
+			got++
+		}
+		rest--
+	}
+	return nil
+}
+
+func (n *Node) resetDeadline() {
+	t := n.cfg.ElectionTimeout
+	n.deadline = time.Now().Add(t + rand.N(t))
+}
+
+func (n *Node) triggerLocked() {
+	for _, ch := range n.triggers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *Node) saveStateLocked() error {
+	err := saveState(filepath.Join(n.cfg.Dir, stateFileName), hardState{term: n.term, votedFor: n.votedFor})
+	if err != nil {
+		n.failLocked(err)
+	}
+	return err
+}
+
+// stepDownLocked делает узел ведомым; term больше текущего срока начинает новый срок.
+func (n *Node) stepDownLocked(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor, n.leader = term, "", ""
+		if n.saveStateLocked() != nil {
+			return
+		}
+	}
+	if n.state == Leader {
+		n.failWaitersLocked(ErrLeadershipLost)
+		n.resetDeadline()
+	}
+	if n.state != Follower {
+		n.state = Follower
+		n.notifyLocked()
+	}
+}
+
+// runTicker начинает выборы, если ведущий долго молчит.
+func (n *Node) runTicker() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.cfg.ElectionTimeout / 10)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-t.C:
+		}
+		n.mu.Lock()
+		if n.err == nil && n.state != Leader && !n.installing && time.Now().After(n.deadline) {
+			n.preCampaignLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// preCampaignLocked начинает предварительное голосование: срок увеличивается и
+// выборы начинаются, только если за узел готово проголосовать большинство. Иначе
+// узел, отрезанный от группы и вернувшийся в нее, сбрасывал бы работающего ведущего
+// своим выросшим сроком.
+func (n *Node) preCampaignLocked() {
+	n.resetDeadline()
+	n.round++
+	if n.quorum == 1 {
+		n.campaignLocked()
+		return
+	}
+	term, round := n.term, n.round
+	args := &RequestVoteArgs{
+		Term:         term + 1,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+		PreVote:      true,
+	}
+	votes := 1
+	for _, p := range n.peers {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(n.ctx, n.cfg.ElectionTimeout)
+			reply, err := n.cfg.Transport.RequestVote(ctx, p, args)
+			cancel()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.err != nil {
+				return
+			}
+			if reply.Term > n.term {
+				n.stepDownLocked(reply.Term)
+				return
+			}
+			if n.state == Leader || n.term != term || n.round != round || !reply.VoteGranted {
+				return
+			}
+			if votes++; votes == n.quorum {
+				n.campaignLocked()
+			}
+		}()
+	}
+}
+
+// campaignLocked начинает выборы в новом сроке.
+func (n *Node) campaignLocked() {
+	n.state, n.term, n.votedFor, n.leader = Candidate, n.term+1, n.cfg.ID, ""
+	n.round++
+	if n.saveStateLocked() != nil {
+		return
+	}
+	n.resetDeadline()
+	n.notifyLocked()
+	term := n.term
+	args := &RequestVoteArgs{Term: term, CandidateID: n.cfg.ID, LastLogIndex: n.log.lastIndex(), LastLogTerm: n.log.lastTerm()}
+	votes := 1
+	if votes >= n.quorum {
+		n.becomeLeaderLocked()
+		return
+	}
+	for _, p := range n.peers {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(n.ctx, n.cfg.ElectionTimeout)
+			reply, err := n.cfg.Transport.RequestVote(ctx, p, args)
+			cancel()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.err != nil {
+				return
+			}
+			if reply.Term > n.term {
+				n.stepDownLocked(reply.Term)
+				return
+			}
+			if n.state != Candidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			if votes++; votes == n.quorum {
+				n.becomeLeaderLocked()
+			}
+		}()
+	}
+}
+
+// becomeLeaderLocked делает узел ведущим. Пустая запись нового срока фиксирует
+// записи прежних ведущих, оставшиеся в логе.
+func (n *Node) becomeLeaderLocked() {
+	n.state, n.leader = Leader, n.cfg.ID
+	n.cfg.Logger.Printf("raft: %s: ведущий в сроке %d", n.cfg.ID, n.term)
+	last := n.log.lastIndex()
+	n.next = make(map[string]uint64, len(n.peers))
+	n.match = make(map[string]uint64, len(n.peers))
+	for _, p := range n.peers {
+		n.next[p] = last + 1
+	}
+	if err := n.log.append([]Entry{{Index: last + 1, Term: n.term}}); err != nil {
+		n.failLocked(err)
+		return
+	}
+	n.notifyLocked()
+	n.advanceCommitLocked()
+	n.triggerLocked()
+}
+
+// advanceCommitLocked фиксирует записи текущего срока, которые есть у большинства.
+func (n *Node) advanceCommitLocked() {
+	for i := n.log.lastIndex(); i > n.commit; i-- {
+		if t, _ := n.log.term(i); t != n.term {
+			// Записи прежних сроков фиксируются только вместе с записью текущего.
+			return
+		}
+		count := 1
+		for _, p := range n.peers {
+			if n.match[p] >= i {
+				count++
+			}
+		}
+		if count >= n.quorum {
+			n.commit = i
+			n.notifyLocked()
+			return
+		}
+	}
+}
+
+// HandleRequestVote обрабатывает запрос голоса кандидата.
+func (n *Node) HandleRequestVote(args *RequestVoteArgs) (*RequestVoteReply, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return nil, n.err
+	}
+	// Голос получает кандидат, чей лог не отстает от лога узла.
+	lastTerm := n.log.lastTerm()
+	upToDate := args.LastLogTerm > lastTerm || args.LastLogTerm == lastTerm && args.LastLogIndex >= n.log.lastIndex()
+	if args.PreVote {
+		// Предварительный голос ни к чему не обязывает и срока не меняет; узел, который
+		// недавно слышал ведущего, его не дает.
+		heard := n.state == Leader || n.leader != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout
+		return &RequestVoteReply{Term: n.term, VoteGranted: args.Term > n.term && upToDate && !heard}, nil
+	}
+	if args.Term > n.term {
+		n.stepDownLocked(args.Term)
+		if n.err != nil {
+			return nil, n.err
+		}
+	}
+	reply := &RequestVoteReply{Term: n.term}
+	if args.Term < n.term || n.votedFor != "" && n.votedFor != args.CandidateID || !upToDate {
+		return reply, nil
+	}
+	if n.votedFor != args.CandidateID {
+		n.votedFor = args.CandidateID
+		if err := n.saveStateLocked(); err != nil {
+			return nil, err
+		}
+	}
+	n.resetDeadline()
+	reply.VoteGranted = true
+	return reply, nil
+}
+
+// observeLeaderLocked признает ведущим узел id в сроке term (не меньше текущего).
+func (n *Node) observeLeaderLocked(term uint64, id string) error {
+	if term > n.term || n.state != Follower {
+		n.stepDownLocked(term)
+		if n.err != nil {
+			return n.err
+		}
+	}
+	n.leader, n.lastContact = id, time.Now()
+	n.resetDeadline()
+	return nil
+}
+
+// HandleAppendEntries обрабатывает записи ведущего.
+func (n *Node) HandleAppendEntries(args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return nil, n.err
+	}
+	if args.Term < n.term {
+		return &AppendEntriesReply{Term: n.term}, nil
+	}
+	if err := n.observeLeaderLocked(args.Term, args.LeaderID); err != nil {
+		return nil, err
+	}
+	reply := &AppendEntriesReply{Term: n.term}
+
+	prev, ents := args.PrevLogIndex, args.Entries
+	if prev < n.log.base {
+		// Записи по base уже зафиксированы и применены: они совпадают с записями ведущего.
+		skip := n.log.base - prev
+		if skip > uint64(len(ents)) {
+			reply.Success = true
+			return reply, nil
+		}
+		prev, ents = n.log.base, ents[skip:]
+	} else if prev > n.log.lastIndex() {
+		reply.ConflictIndex = n.log.lastIndex() + 1
+		return reply, nil
+	} else if t, _ := n.log.term(prev); t != args.PrevLogTerm {
+		reply.ConflictTerm = t
+		reply.ConflictIndex = n.log.firstIndexOf(t, prev)
+		return reply, nil
+	}
+
+	for i, e := range ents {
+		if e.Index <= n.log.lastIndex() {
+			if t, _ := n.log.term(e.Index); t == e.Term {
+				continue
+			}
+			if e.Index <= n.commit {
+				// Зафиксированные записи не расходятся у разных ведущих: сообщение испорчено.
+				return nil, fmt.Errorf("raft: ведущий %s заменяет зафиксированную запись %d", args.LeaderID, e.Index)
+			}
+			if err := n.log.truncate(e.Index); err != nil {
+				n.failLocked(err)
+				return nil, err
+			}
+		}
+		if err := n.log.append(ents[i:]); err != nil {
+			n.failLocked(err)
+			return nil, err
+		}
+		break
+	}
+
+	if last := prev + uint64(len(ents)); args.LeaderCommit > n.commit && last > n.commit {
+		n.commit = min(args.LeaderCommit, last)
+		n.notifyLocked()
+	}
+	reply.Success = true
+	return reply, nil
+}
+
+// runReplicator отправляет записи ведущего узлу peer: по новым записям и раз
+// в HeartbeatInterval.
+func (n *Node) runReplicator(peer string) {
+	defer n.wg.Done()
+	t := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.triggers[peer]:
+		case <-t.C:
+		}
+		for n.replicate(peer) {
+		}
+	}
+}
+
+// replicate отправляет узлу peer одно сообщение; true — есть что отправить еще.
+func (n *Node) replicate(peer string) bool {
+	n.mu.Lock()
+	if n.err != nil || n.state != Leader {
+		n.mu.Unlock()
+		return false
+	}
+	term, next := n.term, n.next[peer]
+	if next <= n.log.base {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+	last := min(n.log.lastIndex(), next+uint64(n.cfg.MaxAppendEntries)-1)
+	prevTerm, _ := n.log.term(next - 1)
+	args := &AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevTerm,
+		Entries:      slices.Clone(n.log.slice(next, last+1)),
+		LeaderCommit: n.commit,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.cfg.ElectionTimeout)
+	reply, err := n.cfg.Transport.AppendEntries(ctx, peer, args)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return false
+	}
+	if reply.Term > n.term {
+		n.stepDownLocked(reply.Term)
+		return false
+	}
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	if reply.Success {
+		if m := args.PrevLogIndex + uint64(len(args.Entries)); m > n.match[peer] {
+			n.match[peer] = m
+			n.advanceCommitLocked()
+		}
+		n.next[peer] = max(n.next[peer], n.match[peer]+1)
+		return n.next[peer] <= n.log.lastIndex()
+	}
+	next = reply.ConflictIndex
+	if reply.ConflictTerm != 0 {
+		if i := n.log.lastIndexOf(reply.ConflictTerm); i != 0 {
+			next = i + 1
+		}
+	}
+	n.next[peer] = max(min(next, args.PrevLogIndex), n.match[peer]+1, 1)
+	return true
+}
+
+// runApplier применяет зафиксированные записи к движку.
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for n.err == nil && n.applied >= n.commit {
+			ch := n.changed
+			n.mu.Unlock()
+			select {
+			case <-ch:
+			case <-n.ctx.Done():
+			}
+			n.mu.Lock()
+		}
+		n.mu.Unlock()
+
+		n.applyMu.Lock()
+		err := n.applyCommitted()
+		n.applyMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// applyCommitted применяет очередные зафиксированные записи и при необходимости
+// усекает лог; ошибка — узел остановлен. Вызывается под applyMu.
+func (n *Node) applyCommitted() error {
+	n.mu.Lock()
+	if n.err != nil {
+		defer n.mu.Unlock()
+		return n.err
+	}
+	ents := n.log.slice(n.applied+1, min(n.commit, n.applied+maxApplyBatch)+1)
+	e := n.engine
+	n.mu.Unlock()
+
+	for _, ent := range ents {
+		applyErr, err := apply(e, ent)
+		n.mu.Lock()
+		if err != nil {
+			n.failLocked(fmt.Errorf("применение записи %d: %w", ent.Index, err))
+			n.mu.Unlock()
+			return err
+		}
+		n.applied = ent.Index
+		if w, ok := n.waiters[ent.Index]; ok {
+			delete(n.waiters, ent.Index)
+			if w.term != ent.Term {
+				applyErr = ErrLeadershipLost
+			}
+			w.done <- applyErr
+		}
+		n.notifyLocked()
+		n.mu.Unlock()
+	}
+	return n.maybeCompact(e)
+}
+
+// apply применяет запись лога к движку. Запись, которую движок отверг до записи
+// в WAL, отвергнута так же на всех узлах: ее номер занимает пустой пакет, а причина
+// возвращается как applyErr. err — движок не может продолжать.
+func apply(e *lsm.Engine, ent Entry) (applyErr, err error) {
+	err = e.ApplyUpdate(lsm.Update{Seq: ent.Index, Mutations: ent.Mutations})
+	if err == nil || errors.Is(err, lsm.ErrClosed) || errors.Is(err, lsm.ErrReadOnly) {
+		return nil, err
+	}
+	if err := e.ApplyUpdate(lsm.Update{Seq: ent.Index}); err != nil {
+		return nil, err
+	}
+	return err, nil
+}
+
+// maybeCompact усекает лог по примененным записям, когда их накопилось
+// SnapshotThreshold. Движок сперва сбрасывает их в SSTable: после усечения
+// восстановить их из лога уже нельзя. Вызывается под applyMu.
+func (n *Node) maybeCompact(e *lsm.Engine) error {
+	n.mu.Lock()
+	applied := n.applied
+	due := applied-n.log.base >= n.cfg.SnapshotThreshold
+	n.mu.Unlock()
+	if !due {
+		return nil
+	}
+	if _, err := e.Flush(); err != nil {
+		// Сбой Flush не теряет данных: лог усечется в следующий раз.
+		n.cfg.Logger.Printf("raft: %s: усечение лога: %v", n.cfg.ID, err)
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	term, _ := n.log.term(applied)
+	if err := n.log.compact(applied, term); err != nil {
+		n.failLocked(err)
+		return err
+	}
+	return nil
+}
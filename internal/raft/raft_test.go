@@ -0,0 +1,635 @@
+package raft
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+var errUnreachable = errors.New("узел недоступен")
+
+// memNetwork связывает узлы теста в памяти; отключенные узлы не получают и не
+// отправляют сообщений.
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+type memTransport struct {
+	net  *memNetwork
+	from string
+}
+
+func (t memTransport) peer(to string) (*Node, error) {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	n := t.net.nodes[to]
+	if n == nil || t.net.down[t.from] || t.net.down[to] {
+		return nil, errUnreachable
+	}
+	return n, nil
+}
+
+// roundTrip пропускает сообщение через MarshalBinary и UnmarshalBinary.
+func roundTrip[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}](m PT) (PT, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	out := PT(new(T))
+	return out, out.UnmarshalBinary(b)
+}
+
+func (t memTransport) RequestVote(_ context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	n, err := t.peer(peer)
+	if err != nil {
+		return nil, err
+	}
+	if args, err = roundTrip(args); err != nil {
+		return nil, err
+	}
+	reply, err := n.HandleRequestVote(args)
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(reply)
+}
+
+func (t memTransport) AppendEntries(_ context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	n, err := t.peer(peer)
+	if err != nil {
+		return nil, err
+	}
+	if args, err = roundTrip(args); err != nil {
+		return nil, err
+	}
+	reply, err := n.HandleAppendEntries(args)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.peer(peer); err != nil {
+		// Ответ потерян: узел отключился, пока обрабатывал сообщение.
+		return nil, err
+	}
+	return roundTrip(reply)
+}
+
+func (t memTransport) InstallSnapshot(_ context.Context, peer string, args *InstallSnapshotArgs, snapshot io.Reader) (*InstallSnapshotReply, error) {
+	n, err := t.peer(peer)
+	if err != nil {
+		return nil, err
+	}
+	if args, err = roundTrip(args); err != nil {
+		return nil, err
+	}
+	reply, err := n.HandleInstallSnapshot(args, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(reply)
+}
+
+type testCluster struct {
+	t     *testing.T
+	net   *memNetwork
+	ids   []string
+	dirs  []string
+	nodes []*Node
+	tweak func(*Config)
+}
+
+func newTestCluster(t *testing.T, size int, tweak func(*Config)) *testCluster {
+	t.Helper()
+	c := &testCluster{
+		t:     t,
+		net:   &memNetwork{nodes: make(map[string]*Node), down: make(map[string]bool)},
+		nodes: make([]*Node, size),
+		tweak: tweak,
+	}
+	for i := range size {
+		c.ids = append(c.ids, fmt.Sprintf("n%d", i))
+		c.dirs = append(c.dirs, t.TempDir())
+	}
+	for i := range size {
+		c.start(i)
+	}
+	t.Cleanup(func() {
+		for i := range c.nodes {
+			c.stop(i)
+		}
+	})
+	return c
+}
+
+func (c *testCluster) config(i int) Config {
+	cfg := Config{
+		ID:                c.ids[i],
+		Peers:             c.ids,
+		Dir:               c.dirs[i],
+		Transport:         memTransport{net: c.net, from: c.ids[i]},
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+	if c.tweak != nil {
+		c.tweak(&cfg)
+	}
+	return cfg
+}
+
+func (c *testCluster) start(i int) {
+	c.t.Helper()
+	n, err := Open(c.config(i))
+	if err != nil {
+		c.t.Fatalf("Open %s: %v", c.ids[i], err)
+	}
+	c.nodes[i] = n
+	c.net.mu.Lock()
+	c.net.nodes[c.ids[i]] = n
+	c.net.mu.Unlock()
+}
+
+func (c *testCluster) stop(i int) {
+	c.t.Helper()
+	n := c.nodes[i]
+	if n == nil {
+		return
+	}
+	c.net.mu.Lock()
+	delete(c.net.nodes, c.ids[i])
+	c.net.mu.Unlock()
+	if err := n.Close(); err != nil {
+		c.t.Errorf("Close %s: %v", c.ids[i], err)
+	}
+	c.nodes[i] = nil
+}
+
+func (c *testCluster) setDown(i int, down bool) {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	c.net.down[c.ids[i]] = down
+}
+
+// leader ждет ведущего среди работающих и подключенных узлов.
+func (c *testCluster) leader() (int, *Node) {
+	c.t.Helper()
+	var (
+		idx  int
+		lead *Node
+	)
+	waitFor(c.t, "выборы ведущего", func() bool {
+		c.net.mu.Lock()
+		defer c.net.mu.Unlock()
+		for i, n := range c.nodes {
+			if n != nil && !c.net.down[c.ids[i]] && n.Status().State == Leader {
+				idx, lead = i, n
+				return true
+			}
+		}
+		return false
+	})
+	return idx, lead
+}
+
+// waitApplied ждет, пока узел i применит все записи, зафиксированные ведущим lead.
+func (c *testCluster) waitApplied(i int, lead *Node) {
+	c.t.Helper()
+	commit := lead.Status().Commit
+	waitFor(c.t, fmt.Sprintf("применение записей на %s", c.ids[i]), func() bool {
+		return c.nodes[i].Status().Applied >= commit
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("не дождались: %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func checkValue(t *testing.T, e *lsm.Engine, key, want string) {
+	t.Helper()
+	got, err := e.Get([]byte(key))
+	if want == "" {
+		if !errors.Is(err, lsm.ErrNotFound) {
+			t.Fatalf("Get(%q) = %q, %v; want ErrNotFound", key, got, err)
+		}
+		return
+	}
+	if err != nil || string(got) != want {
+		t.Fatalf("Get(%q) = %q, %v; want %q", key, got, err, want)
+	}
+}
+
+func TestCluster_Replication(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	ctx := testContext(t)
+	li, lead := c.leader()
+
+	for i := range 20 {
+		if err := lead.Put(ctx, []byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := lead.Delete(ctx, []byte("k05")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	err := lead.Propose(ctx,
+		lsm.Mutation{Kind: lsm.MutationPut, ColumnFamily: "sessions", Key: []byte("s1"), Value: []byte("x")},
+		lsm.Mutation{Kind: lsm.MutationDelete, Key: []byte("k06")},
+	)
+	if err != nil {
+		t.Fatalf("Propose: %v", err)
+	}
+	if got, err := lead.Get(ctx, []byte("k07")); err != nil || string(got) != "v7" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+
+	for i, n := range c.nodes {
+		c.waitApplied(i, lead)
+		e := n.Engine()
+		checkValue(t, e, "k00", "v0")
+		checkValue(t, e, "k19", "v19")
+		checkValue(t, e, "k05", "")
+		checkValue(t, e, "k06", "")
+		cf, err := e.ColumnFamily("sessions")
+		if err != nil {
+			t.Fatalf("%s: ColumnFamily: %v", c.ids[i], err)
+		}
+		if got, err := cf.Get([]byte("s1")); err != nil || string(got) != "x" {
+			t.Fatalf("%s: sessions/s1 = %q, %v", c.ids[i], got, err)
+		}
+		if got, want := e.LatestSequence(), n.Status().Applied; got != want {
+			t.Fatalf("%s: LatestSequence = %d, Applied = %d", c.ids[i], got, want)
+		}
+		if i == li {
+			continue
+		}
+		if err := n.Put(ctx, []byte("x"), []byte("y")); !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("%s: Put на ведомом: %v, want ErrNotLeader", c.ids[i], err)
+		}
+		if _, err := n.Get(ctx, []byte("k00")); !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("%s: Get на ведомом: %v, want ErrNotLeader", c.ids[i], err)
+		}
+		if got := n.Leader(); got != c.ids[li] {
+			t.Fatalf("%s: Leader = %q, want %q", c.ids[i], got, c.ids[li])
+		}
+	}
+
+	if err := lead.Propose(ctx, lsm.Mutation{Kind: lsm.MutationMerge, Key: []byte("m"), Value: []byte("1")}); !errors.Is(err, lsm.ErrNoMergeOperator) {
+		t.Fatalf("Merge без MergeOperator: %v", err)
+	}
+	if err := lead.Put(ctx, nil, []byte("v")); !errors.Is(err, lsm.ErrEmptyKey) {
+		t.Fatalf("Put с пустым ключом: %v", err)
+	}
+}
+
+func TestCluster_Failover(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	ctx := testContext(t)
+	oldIdx, old := c.leader()
+	if err := old.Put(ctx, []byte("before"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	c.setDown(oldIdx, true)
+	// Запись отрезанного ведущего не зафиксирует большинство.
+	shortCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	err := old.Put(shortCtx, []byte("lost"), []byte("x"))
+	cancel()
+	if err == nil {
+		t.Fatal("Put отрезанного ведущего прошел")
+	}
+
+	newIdx, lead := c.leader()
+	if newIdx == oldIdx {
+		t.Fatalf("ведущим остался отрезанный узел %s", c.ids[oldIdx])
+	}
+	if err := lead.Put(ctx, []byte("after"), []byte("2")); err != nil {
+		t.Fatalf("Put нового ведущего: %v", err)
+	}
+	if got, err := lead.Get(ctx, []byte("before")); err != nil || string(got) != "1" {
+		t.Fatalf("Get(before) = %q, %v", got, err)
+	}
+
+	c.setDown(oldIdx, false)
+	waitFor(t, "возвращение прежнего ведущего", func() bool {
+		st := old.Status()
+		return st.State == Follower && st.Leader == c.ids[newIdx]
+	})
+	if err := lead.Put(ctx, []byte("sync"), []byte("3")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	c.waitApplied(oldIdx, lead)
+	e := old.Engine()
+	checkValue(t, e, "before", "1")
+	checkValue(t, e, "after", "2")
+	checkValue(t, e, "lost", "")
+	if _, err := lead.Get(ctx, []byte("lost")); !errors.Is(err, lsm.ErrNotFound) {
+		t.Fatalf("Get(lost) на ведущем: %v, want ErrNotFound", err)
+	}
+}
+
+func TestCluster_Snapshot(t *testing.T) {
+	c := newTestCluster(t, 3, func(cfg *Config) {
+		cfg.SnapshotThreshold = 8
+		cfg.MaxAppendEntries = 4
+	})
+	ctx := testContext(t)
+	li, lead := c.leader()
+	lagging := (li + 1) % 3
+	c.setDown(lagging, true)
+
+	for i := range 50 {
+		if err := lead.Put(ctx, []byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	waitFor(t, "усечение лога ведущего", func() bool {
+		lead.mu.Lock()
+		defer lead.mu.Unlock()
+		return lead.log.base > 0
+	})
+
+	c.setDown(lagging, false)
+	c.waitApplied(lagging, lead)
+	n := c.nodes[lagging]
+	for _, i := range []int{0, 25, 49} {
+		checkValue(t, n.Engine(), fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i))
+	}
+
+	// Узел с установленной копией перезапускается и продолжает с нее.
+	c.stop(lagging)
+	c.start(lagging)
+	if err := lead.Put(ctx, []byte("k50"), []byte("v50")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	c.waitApplied(lagging, lead)
+	checkValue(t, c.nodes[lagging].Engine(), "k50", "v50")
+	checkValue(t, c.nodes[lagging].Engine(), "k10", "v10")
+}
+
+func TestCluster_Restart(t *testing.T) {
+	c := newTestCluster(t, 3, func(cfg *Config) { cfg.SnapshotThreshold = 16 })
+	ctx := testContext(t)
+	_, lead := c.leader()
+	for i := range 40 {
+		if err := lead.Put(ctx, []byte(fmt.Sprintf("k%02d", i)), []byte("v1")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	term := lead.Status().Term
+
+	for i := range c.nodes {
+		c.stop(i)
+	}
+	for i := range c.nodes {
+		c.start(i)
+	}
+	_, lead = c.leader()
+	if st := lead.Status(); st.Term <= term {
+		t.Fatalf("срок после перезапуска %d, до %d", st.Term, term)
+	}
+	for _, k := range []string{"k00", "k20", "k39"} {
+		if got, err := lead.Get(ctx, []byte(k)); err != nil || string(got) != "v1" {
+			t.Fatalf("Get(%s) = %q, %v", k, got, err)
+		}
+	}
+	if err := lead.Put(ctx, []byte("k40"), []byte("v2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	for i := range c.nodes {
+		c.waitApplied(i, lead)
+		checkValue(t, c.nodes[i].Engine(), "k40", "v2")
+	}
+}
+
+func TestNode_SingleNode(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		ID:              "solo",
+		Peers:           []string{"solo"},
+		Dir:             dir,
+		Transport:       memTransport{net: &memNetwork{}},
+		ElectionTimeout: 50 * time.Millisecond,
+	}
+	ctx := testContext(t)
+	n, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	waitFor(t, "выборы", func() bool { return n.Status().State == Leader })
+	if err := n.PutWithTTL(ctx, []byte("ttl"), []byte("v"), time.Hour); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+	if err := n.Put(ctx, []byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := n.Put(ctx, []byte("k"), []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Put после Close: %v, want ErrClosed", err)
+	}
+
+	if n, err = Open(cfg); err != nil {
+		t.Fatalf("повторный Open: %v", err)
+	}
+	defer n.Close()
+	waitFor(t, "выборы", func() bool { return n.Status().State == Leader })
+	for _, k := range []string{"k", "ttl"} {
+		if got, err := n.Get(ctx, []byte(k)); err != nil || string(got) != "v" {
+			t.Fatalf("Get(%s) = %q, %v", k, got, err)
+		}
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	const size = 3
+	var (
+		mu    sync.Mutex
+		nodes [size]*Node
+		urls  []string
+	)
+	for i := range size {
+		srv := httptest.NewServer(http.StripPrefix("/raft", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			n := nodes[i]
+			mu.Unlock()
+			if n == nil {
+				http.Error(w, "узел не запущен", http.StatusServiceUnavailable)
+				return
+			}
+			n.ServeHTTP(w, r)
+		})))
+		t.Cleanup(srv.Close)
+		urls = append(urls, srv.URL+"/raft")
+	}
+	for i := range size {
+		n, err := Open(Config{
+			ID:                urls[i],
+			Peers:             urls,
+			Dir:               t.TempDir(),
+			Transport:         NewHTTPTransport(nil),
+			ElectionTimeout:   200 * time.Millisecond,
+			HeartbeatInterval: 40 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		t.Cleanup(func() { _ = n.Close() })
+		mu.Lock()
+		nodes[i] = n
+		mu.Unlock()
+	}
+
+	var lead *Node
+	waitFor(t, "выборы ведущего", func() bool {
+		for _, n := range nodes {
+			if n.Status().State == Leader {
+				lead = n
+				return true
+			}
+		}
+		return false
+	})
+	ctx := testContext(t)
+	if err := lead.Put(ctx, []byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	commit := lead.Status().Commit
+	for _, n := range nodes {
+		waitFor(t, "применение записи", func() bool { return n.Status().Applied >= commit })
+		checkValue(t, n.Engine(), "k", "v")
+	}
+
+	resp, err := http.Post(urls[0]+"/append", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("пустое сообщение: %s, want 400", resp.Status)
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), logFileName)
+	l, err := openLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []Entry
+	for i := uint64(1); i <= 6; i++ {
+		ents = append(ents, Entry{Index: i, Term: 1 + i/4, Mutations: []lsm.Mutation{
+			{Kind: lsm.MutationPut, ColumnFamily: "default", Key: []byte(fmt.Sprint(i)), Value: []byte("v"), ExpiresAt: time.Unix(0, int64(i))},
+		}})
+	}
+	if err := l.append(ents[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.append(ents[4:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.truncate(6); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.firstIndexOf(2, 5); got != 4 {
+		t.Fatalf("firstIndexOf = %d, want 4", got)
+	}
+	if got := l.lastIndexOf(1); got != 3 {
+		t.Fatalf("lastIndexOf = %d, want 3", got)
+	}
+	size := l.size
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Оборванная последняя запись отбрасывается.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 40, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if l, err = openLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if l.lastIndex() != 5 || l.size != size {
+		t.Fatalf("после обрыва: lastIndex %d, size %d; want 5, %d", l.lastIndex(), l.size, size)
+	}
+	if got := l.entries[2]; got.Term != 1 || string(got.Mutations[0].Key) != "3" || got.Mutations[0].ExpiresAt.UnixNano() != 3 {
+		t.Fatalf("запись 3 = %+v", got)
+	}
+
+	if err := l.compact(3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = openLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if l.base != 3 || l.baseTerm != 1 || l.lastIndex() != 5 {
+		t.Fatalf("после усечения: base %d/%d, lastIndex %d", l.base, l.baseTerm, l.lastIndex())
+	}
+	// Копия, которой нет в логе, отбрасывает его целиком.
+	if err := l.compact(9, 4); err != nil {
+		t.Fatal(err)
+	}
+	if l.base != 9 || l.lastIndex() != 9 || l.lastTerm() != 4 {
+		t.Fatalf("после копии: base %d, lastIndex %d, lastTerm %d", l.base, l.lastIndex(), l.lastTerm())
+	}
+	_ = l.close()
+
+	// Повреждение в середине лога — ошибка.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(append([]byte(nil), b...), appendRecord(nil, recordEntry, func(b []byte) []byte {
+		return appendEntry(b, Entry{Index: 10, Term: 4})
+	})...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = openLog(path); err != nil || l.lastIndex() != 10 {
+		t.Fatalf("openLog: %v", err)
+	}
+	_ = l.close()
+	b, _ = os.ReadFile(path)
+	b[recordHeaderSize+1] ^= 0xff
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openLog(path); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("openLog поврежденного лога: %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,225 @@
+package raft
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"kvschool/internal/lsm"
+)
+
+// sendSnapshot отправляет узлу peer копию базы ведущего вместо записей, которых
+// уже нет в логе; true — есть что отправить еще.
+func (n *Node) sendSnapshot(peer string, term uint64) bool {
+	tmp, err := os.MkdirTemp(n.cfg.Dir, sendDirPrefix)
+	if err != nil {
+		n.cfg.Logger.Printf("raft: %s: копия базы для %s: %v", n.cfg.ID, peer, err)
+		return false
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, dbDirName)
+
+	// Под applyMu движок не меняется: копия содержит ровно записи по index.
+	n.applyMu.Lock()
+	n.mu.Lock()
+	e := n.engine
+	index := n.applied
+	lastTerm, ok := n.log.term(index)
+	n.mu.Unlock()
+	if ok && e != nil {
+		err = e.Checkpoint(dir)
+	}
+	n.applyMu.Unlock()
+	if !ok || e == nil {
+		return false
+	}
+	if err != nil {
+		n.cfg.Logger.Printf("raft: %s: копия базы для %s: %v", n.cfg.ID, peer, err)
+		return false
+	}
+
+	n.cfg.Logger.Printf("raft: %s: отправка копии базы по записи %d узлу %s", n.cfg.ID, index, peer)
+	pr, pw := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		tw := tar.NewWriter(pw)
+		err := tw.AddFS(os.DirFS(dir))
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	ctx, cancel := context.WithTimeout(n.ctx, snapshotTimeout)
+	args := &InstallSnapshotArgs{Term: term, LeaderID: n.cfg.ID, LastIndex: index, LastTerm: lastTerm}
+	reply, err := n.cfg.Transport.InstallSnapshot(ctx, peer, args, pr)
+	cancel()
+	_ = pr.Close()
+	<-written
+	if err != nil {
+		n.cfg.Logger.Printf("raft: %s: копия базы для %s: %v", n.cfg.ID, peer, err)
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return false
+	}
+	if reply.Term > n.term {
+		n.stepDownLocked(reply.Term)
+		return false
+	}
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	if index > n.match[peer] {
+		n.match[peer] = index
+		n.advanceCommitLocked()
+	}
+	n.next[peer] = max(n.next[peer], index+1)
+	return n.next[peer] <= n.log.lastIndex()
+}
+
+// HandleInstallSnapshot устанавливает копию базы ведущего (tar с файлами
+// Engine.Checkpoint) вместо базы узла, если копия новее его зафиксированных записей.
+// Лог узла усекается по копии; движок узла заменяется новым.
+func (n *Node) HandleInstallSnapshot(args *InstallSnapshotArgs, snapshot io.Reader) (*InstallSnapshotReply, error) {
+	n.mu.Lock()
+	if n.err != nil {
+		defer n.mu.Unlock()
+		return nil, n.err
+	}
+	if args.Term < n.term {
+		defer n.mu.Unlock()
+		return &InstallSnapshotReply{Term: n.term}, nil
+	}
+	if err := n.observeLeaderLocked(args.Term, args.LeaderID); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	reply := &InstallSnapshotReply{Term: n.term}
+	if args.LastIndex <= n.commit {
+		n.mu.Unlock()
+		return reply, nil
+	}
+	if n.installing {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("raft: %s: копия базы уже устанавливается", n.cfg.ID)
+	}
+	n.installing = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.installing = false
+		n.resetDeadline()
+		n.mu.Unlock()
+	}()
+
+	n.cfg.Logger.Printf("raft: %s: установка копии базы по записи %d от %s", n.cfg.ID, args.LastIndex, args.LeaderID)
+	dir := filepath.Join(n.cfg.Dir, snapshotDirPrefix+strconv.FormatUint(args.LastIndex, 10))
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("raft: установка копии базы: %w", err)
+	}
+	if err := extract(snapshot, dir); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("raft: установка копии базы: %w", err)
+	}
+	if err := n.install(args, dir); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return reply, nil
+}
+
+// install заменяет базу узла копией dir, на которой применены записи по args.LastIndex.
+// Порядок шагов переживает сбой: пока лог не усечен, копию удалит Open; после —
+// Open закончит ее установку (finishSnapshot).
+func (n *Node) install(args *InstallSnapshotArgs, dir string) error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	if args.LastIndex <= n.commit {
+		// Записи успели прийти обычным путем.
+		return os.RemoveAll(dir)
+	}
+	if err := n.log.compact(args.LastIndex, args.LastTerm); err != nil {
+		n.failLocked(err)
+		return err
+	}
+	n.commit = args.LastIndex
+
+	if err := n.engine.Close(); err != nil {
+		n.cfg.Logger.Printf("raft: %s: закрытие движка перед установкой копии: %v", n.cfg.ID, err)
+	}
+	n.engine = nil
+	if err := swapDB(n.cfg.Dir, dir); err != nil {
+		n.failLocked(err)
+		return err
+	}
+	e, err := lsm.Open(n.cfg.Engine)
+	if err != nil {
+		n.failLocked(err)
+		return err
+	}
+	n.engine = e
+	if seq := e.LatestSequence(); seq != args.LastIndex {
+		err := fmt.Errorf("%w: копия базы на записи %d, ожидалась %d", ErrCorrupt, seq, args.LastIndex)
+		n.failLocked(err)
+		return err
+	}
+	n.applied = args.LastIndex
+	n.notifyLocked()
+	return nil
+}
+
+// extract распаковывает tar из r в новую директорию dir и делает fsync.
+func extract(r io.Reader, dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("недопустимый элемент копии %q", hdr.Name)
+		}
+		if err := writeFile(filepath.Join(dir, filepath.FromSlash(hdr.Name)), tr); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+func writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,345 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Файлы в Config.Dir.
+const (
+	logFileName   = "raft.log"
+	stateFileName = "raft.state"
+	dbDirName     = "db"
+	// snapshotDirPrefix — копия ведущего, которую узел устанавливает вместо db: snapshot-N,
+	// где N — номер последней записи копии.
+	snapshotDirPrefix = "snapshot-"
+	// sendDirPrefix — временные копии, которые ведущий отправляет отстающим узлам.
+	sendDirPrefix = "send-"
+)
+
+// ErrCorrupt — файлы узла повреждены или противоречат друг другу.
+var ErrCorrupt = errors.New("raft: файлы узла повреждены")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Журнал raft.log — последовательность записей: длина тела (4 байта), CRC32C тела
+// (4 байта), тело. Первый байт тела — тип записи.
+const (
+	// recordBase — начало журнала: номер и срок последней отброшенной записи.
+	// Есть только первой записью журнала, который уже усекали.
+	recordBase = 'B'
+	// recordEntry — запись лога (см. appendEntry).
+	recordEntry = 'E'
+)
+
+const recordHeaderSize = 8
+
+// logStore — лог узла: записи после base в памяти и в raft.log. Записи до base
+// (включительно) уже применены к движку и сохранены в его SSTable.
+type logStore struct {
+	path     string
+	f        *os.File
+	size     int64
+	base     uint64
+	baseTerm uint64
+	entries  []Entry // entries[i].Index == base+1+i
+	offs     []int64 // смещения записей entries в файле
+}
+
+// openLog читает журнал path (или создает пустой). Оборванная последняя запись
+// (сбой посреди дописывания) отбрасывается.
+func openLog(path string) (*logStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("raft: открытие лога: %w", err)
+	}
+	l := &logStore{path: path}
+	off := 0
+	for off < len(data) {
+		body, n, err := readRecord(data[off:])
+		if errors.Is(err, errTornRecord) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s, смещение %d: %w", ErrCorrupt, path, off, err)
+		}
+		if err := l.load(body, off); err != nil {
+			return nil, fmt.Errorf("%w: %s, смещение %d: %w", ErrCorrupt, path, off, err)
+		}
+		off += n
+	}
+	l.size = int64(off)
+
+	if l.f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, fmt.Errorf("raft: открытие лога: %w", err)
+	}
+	if l.size < int64(len(data)) {
+		if err := l.f.Truncate(l.size); err != nil {
+			_ = l.f.Close()
+			return nil, fmt.Errorf("raft: обрезание оборванного хвоста лога: %w", err)
+		}
+	}
+	return l, nil
+}
+
+var errTornRecord = errors.New("оборванная запись")
+
+// readRecord возвращает тело первой записи b и ее полную длину. Запись, которой
+// кончается b, с неполным телом или неверной контрольной суммой — errTornRecord.
+func readRecord(b []byte) ([]byte, int, error) {
+	if len(b) < recordHeaderSize {
+		return nil, 0, errTornRecord
+	}
+	n := int(binary.BigEndian.Uint32(b))
+	end := recordHeaderSize + n
+	if n > len(b)-recordHeaderSize {
+		return nil, 0, errTornRecord
+	}
+	body := b[recordHeaderSize:end]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(b[4:]) {
+		if end == len(b) {
+			return nil, 0, errTornRecord
+		}
+		return nil, 0, errors.New("неверная контрольная сумма")
+	}
+	return body, end, nil
+}
+
+// load добавляет в l запись журнала body со смещением off.
+func (l *logStore) load(body []byte, off int) error {
+	if len(body) == 0 {
+		return errors.New("пустая запись")
+	}
+	d := decoder{b: body[1:]}
+	switch body[0] {
+	case recordBase:
+		if off != 0 {
+			return errors.New("начало журнала не в начале файла")
+		}
+		l.base, l.baseTerm = d.uvarint(), d.uvarint()
+		return d.finish("начало журнала")
+	case recordEntry:
+		e := d.entry()
+		if err := d.finish("запись лога"); err != nil {
+			return err
+		}
+		if e.Index != l.lastIndex()+1 {
+			return fmt.Errorf("запись %d после записи %d", e.Index, l.lastIndex())
+		}
+		l.entries = append(l.entries, e)
+		l.offs = append(l.offs, int64(off))
+		return nil
+	}
+	return fmt.Errorf("неизвестный тип записи %d", body[0])
+}
+
+func appendRecord(b []byte, typ byte, body func([]byte) []byte) []byte {
+	start := len(b)
+	b = append(b, make([]byte, recordHeaderSize)...)
+	b = append(b, typ)
+	b = body(b)
+	rec := b[start:]
+	binary.BigEndian.PutUint32(rec, uint32(len(rec)-recordHeaderSize))
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(rec[recordHeaderSize:], crcTable))
+	return b
+}
+
+func (l *logStore) lastIndex() uint64 { return l.base + uint64(len(l.entries)) }
+
+func (l *logStore) lastTerm() uint64 {
+	t, _ := l.term(l.lastIndex())
+	return t
+}
+
+// term возвращает срок записи i; false — записи нет в логе (отброшена или еще не получена).
+func (l *logStore) term(i uint64) (uint64, bool) {
+	switch {
+	case i == l.base:
+		return l.baseTerm, true
+	case i < l.base || i > l.lastIndex():
+		return 0, false
+	}
+	return l.entries[i-l.base-1].Term, true
+}
+
+// slice возвращает записи с номерами из [lo, hi); они должны быть в логе.
+// Записи общие с логом: их нельзя изменять.
+func (l *logStore) slice(lo, hi uint64) []Entry {
+	return l.entries[lo-l.base-1 : hi-l.base-1 : hi-l.base-1]
+}
+
+// firstIndexOf возвращает номер первой записи лога со сроком term, начиная с i.
+func (l *logStore) firstIndexOf(term, i uint64) uint64 {
+	for i > l.base+1 && l.entries[i-l.base-2].Term == term {
+		i--
+	}
+	return i
+}
+
+// lastIndexOf возвращает номер последней записи лога со сроком term; 0 — таких нет.
+func (l *logStore) lastIndexOf(term uint64) uint64 {
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		switch t := l.entries[i].Term; {
+		case t == term:
+			return l.entries[i].Index
+		case t < term:
+			return 0
+		}
+	}
+	return 0
+}
+
+// append дописывает записи в конец лога и делает fsync.
+func (l *logStore) append(ents []Entry) error {
+	var buf []byte
+	offs := make([]int64, 0, len(ents))
+	for _, e := range ents {
+		offs = append(offs, l.size+int64(len(buf)))
+		buf = appendRecord(buf, recordEntry, func(b []byte) []byte { return appendEntry(b, e) })
+	}
+	if _, err := l.f.WriteAt(buf, l.size); err != nil {
+		return fmt.Errorf("raft: запись лога: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("raft: fsync лога: %w", err)
+	}
+	l.entries = append(l.entries, ents...)
+	l.offs = append(l.offs, offs...)
+	l.size += int64(len(buf))
+	return nil
+}
+
+// truncate отбрасывает записи с номерами от i.
+func (l *logStore) truncate(i uint64) error {
+	k := i - l.base - 1
+	off := l.offs[k]
+	if err := l.f.Truncate(off); err != nil {
+		return fmt.Errorf("raft: обрезание лога: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("raft: fsync лога: %w", err)
+	}
+	// Новая емкость: записи после k могут быть в срезах, отданных slice.
+	l.entries = l.entries[:k:k]
+	l.offs = l.offs[:k:k]
+	l.size = off
+	return nil
+}
+
+// compact отбрасывает записи до i включительно; term — срок записи i. Если в логе
+// нет записи i со сроком term (ее приносит копия ведущего), отбрасывается весь лог.
+// Журнал переписывается целиком и подменяется атомарно.
+func (l *logStore) compact(i, term uint64) error {
+	var keep []Entry
+	if t, ok := l.term(i); ok && t == term && i >= l.base {
+		keep = l.entries[i-l.base:]
+	}
+	buf := appendRecord(nil, recordBase, func(b []byte) []byte {
+		b = binary.AppendUvarint(b, i)
+		return binary.AppendUvarint(b, term)
+	})
+	offs := make([]int64, 0, len(keep))
+	for _, e := range keep {
+		offs = append(offs, int64(len(buf)))
+		buf = appendRecord(buf, recordEntry, func(b []byte) []byte { return appendEntry(b, e) })
+	}
+
+	tmp := l.path + ".tmp"
+	if err := writeFileSync(tmp, buf); err != nil {
+		return fmt.Errorf("raft: усечение лога: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("raft: усечение лога: %w", err)
+	}
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		return fmt.Errorf("raft: усечение лога: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("raft: усечение лога: %w", err)
+	}
+	_ = l.f.Close()
+	l.f, l.size = f, int64(len(buf))
+	l.base, l.baseTerm = i, term
+	l.entries, l.offs = append([]Entry(nil), keep...), offs
+	return nil
+}
+
+func (l *logStore) close() error { return l.f.Close() }
+
+// hardState — то, что узел обязан помнить между перезапусками помимо лога:
+// текущий срок и за кого он в нем голосовал.
+type hardState struct {
+	term     uint64
+	votedFor string
+}
+
+// Файл raft.state: CRC32C (4 байта), затем срок (uvarint) и голос (длина uvarint и байты).
+// Файл подменяется атомарно, поэтому оборванным быть не может.
+
+func loadState(path string) (hardState, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return hardState{}, nil
+	}
+	if err != nil {
+		return hardState{}, fmt.Errorf("raft: чтение %s: %w", path, err)
+	}
+	if len(b) < 4 || crc32.Checksum(b[4:], crcTable) != binary.BigEndian.Uint32(b) {
+		return hardState{}, fmt.Errorf("%w: %s: неверная контрольная сумма", ErrCorrupt, path)
+	}
+	d := decoder{b: b[4:]}
+	st := hardState{term: d.uvarint(), votedFor: string(d.bytes())}
+	if err := d.finish("состояние"); err != nil {
+		return hardState{}, fmt.Errorf("%w: %s: %w", ErrCorrupt, path, err)
+	}
+	return st, nil
+}
+
+func saveState(path string, st hardState) error {
+	b := make([]byte, 4, 32)
+	b = binary.AppendUvarint(b, st.term)
+	b = appendBytes(b, []byte(st.votedFor))
+	binary.BigEndian.PutUint32(b, crc32.Checksum(b[4:], crcTable))
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b); err != nil {
+		return fmt.Errorf("raft: запись состояния: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("raft: запись состояния: %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("raft: запись состояния: %w", err)
+	}
+	return nil
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
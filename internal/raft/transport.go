@@ -0,0 +1,223 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Transport доставляет сообщения Raft другим узлам группы. Получатель передает их
+// своему Node: HandleRequestVote, HandleAppendEntries, HandleInstallSnapshot.
+// Ошибка — сообщение не доставлено или узел его не принял; узел повторит позже.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error)
+	AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error)
+	// InstallSnapshot передает копию базы ведущего (tar с файлами Engine.Checkpoint).
+	InstallSnapshot(ctx context.Context, peer string, args *InstallSnapshotArgs, snapshot io.Reader) (*InstallSnapshotReply, error)
+}
+
+// RequestVoteArgs — запрос голоса кандидата. PreVote — предварительное голосование:
+// Term — срок, который кандидат начнет, если за него готово проголосовать большинство.
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+	PreVote      bool
+}
+
+// RequestVoteReply — ответ на RequestVoteArgs.
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesArgs — записи ведущего для узла (без записей — heartbeat).
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64 // номер записи перед Entries
+	PrevLogTerm  uint64 // ее срок
+	Entries      []Entry
+	LeaderCommit uint64 // номер последней зафиксированной записи ведущего
+}
+
+// AppendEntriesReply — ответ на AppendEntriesArgs. При отказе ConflictIndex и ConflictTerm
+// подсказывают ведущему, с какой записи продолжить: первая запись узла со сроком
+// ConflictTerm, расходящимся со сроком PrevLogIndex, или (ConflictTerm 0) конец лога узла.
+type AppendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+	ConflictTerm  uint64
+}
+
+// InstallSnapshotArgs сопровождает копию базы ведущего, на которой применены записи
+// по LastIndex включительно.
+type InstallSnapshotArgs struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+// InstallSnapshotReply — ответ на InstallSnapshotArgs.
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// maxMessageSize ограничивает тело сообщения HTTPTransport.
+const maxMessageSize = 256 << 20
+
+// HTTPTransport — Transport поверх HTTP. Идентификатор узла — адрес, под которым
+// смонтирован его Node (Node.ServeHTTP), например http://10.0.0.1:7071/raft.
+type HTTPTransport struct {
+	client *http.Client
+}
+
+// NewHTTPTransport создает HTTPTransport. client nil — http.DefaultClient; сроки
+// запросов задает узел через контекст.
+func NewHTTPTransport(client *http.Client) *HTTPTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPTransport{client: client}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	reply := new(RequestVoteReply)
+	if err := t.call(ctx, peer, "/vote", args, nil, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	reply := new(AppendEntriesReply)
+	if err := t.call(ctx, peer, "/append", args, nil, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// InstallSnapshot отправляет телом запроса длину сообщения (uvarint), сообщение и копию.
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, peer string, args *InstallSnapshotArgs, snapshot io.Reader) (*InstallSnapshotReply, error) {
+	reply := new(InstallSnapshotReply)
+	if err := t.call(ctx, peer, "/snapshot", args, snapshot, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (t *HTTPTransport) call(ctx context.Context, peer, path string, args encoding.BinaryMarshaler, tail io.Reader, reply encoding.BinaryUnmarshaler) error {
+	b, err := args.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var body io.Reader = bytes.NewReader(b)
+	if tail != nil {
+		body = io.MultiReader(bytes.NewReader(binary.AppendUvarint(nil, uint64(len(b)))), body, tail)
+	}
+	url := strings.TrimSuffix(peer, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return fmt.Errorf("raft: %s: %w", url, err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("raft: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return fmt.Errorf("raft: %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return reply.UnmarshalBinary(msg)
+}
+
+// ServeHTTP принимает сообщения HTTPTransport:
+//
+//	POST /vote      RequestVote
+//	POST /append    AppendEntries
+//	POST /snapshot  InstallSnapshot
+//
+// Под префиксом монтируется через http.StripPrefix:
+// mux.Handle("/raft/", http.StripPrefix("/raft", node)).
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "raft: нужен POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		reply encoding.BinaryMarshaler
+		err   error
+	)
+	switch r.URL.Path {
+	case "/vote":
+		args := new(RequestVoteArgs)
+		if err = readMessage(r.Body, args); err == nil {
+			reply, err = n.HandleRequestVote(args)
+		}
+	case "/append":
+		args := new(AppendEntriesArgs)
+		if err = readMessage(r.Body, args); err == nil {
+			reply, err = n.HandleAppendEntries(args)
+		}
+	case "/snapshot":
+		br := bufio.NewReader(r.Body)
+		args := new(InstallSnapshotArgs)
+		var size uint64
+		if size, err = binary.ReadUvarint(br); err == nil && size > maxMessageSize {
+			err = fmt.Errorf("%w: длина %d", errBadMessage, size)
+		}
+		if err == nil {
+			if err = readMessage(io.LimitReader(br, int64(size)), args); err == nil {
+				reply, err = n.HandleInstallSnapshot(args, br)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errBadMessage):
+			code = http.StatusBadRequest
+		case errors.Is(err, ErrClosed):
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	b, err := reply.MarshalBinary()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(b)
+}
+
+func readMessage(r io.Reader, m encoding.BinaryUnmarshaler) error {
+	b, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxMessageSize {
+		return fmt.Errorf("%w: больше %d байт", errBadMessage, maxMessageSize)
+	}
+	return m.UnmarshalBinary(b)
+}
@@ -0,0 +1,250 @@
+package replication
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+// ErrSnapshotRequired возвращает Follower.Run, если записей, нужных реплике, уже нет
+// в WAL ведущего: реплику нужно создать заново через Bootstrap.
+var ErrSnapshotRequired = errors.New("replication: записи удалены из WAL ведущего, нужна новая копия")
+
+const (
+	// retryInterval — пауза перед переподключением к ведущему.
+	retryInterval = time.Second
+	// leaderTimeout — сколько реплика ждет кадра, прежде чем считать соединение потерянным.
+	leaderTimeout = 5 * heartbeatInterval
+)
+
+// Bootstrap скачивает копию базы ведущего leaderURL (адрес, под которым смонтирован
+// Leader) в директорию dir, которой не должно быть. Движок, открытый на dir, —
+// начало реплики. client nil — http.DefaultClient.
+func Bootstrap(ctx context.Context, client *http.Client, leaderURL, dir string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("replication: bootstrap: %w", err)
+	}
+	if err := download(ctx, client, strings.TrimSuffix(leaderURL, "/")+"/checkpoint", dir); err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("replication: bootstrap: %w", err)
+	}
+	return nil
+}
+
+func download(ctx context.Context, client *http.Client, url, dir string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	tr := tar.NewReader(resp.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("недопустимый элемент копии %q", hdr.Name)
+		}
+		if err := writeFile(filepath.Join(dir, filepath.FromSlash(hdr.Name)), tr); err != nil {
+			return err
+		}
+	}
+	// Файлы уже на диске; fsync директории закрепляет их имена.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Follower следует за ведущим и применяет его записи к движку реплики.
+type Follower struct {
+	e      *lsm.Engine
+	url    string
+	client *http.Client
+
+	// leaderSeq — номер последней записи ведущего, о которой известно реплике.
+	leaderSeq atomic.Uint64
+	// lastErr — последняя ошибка соединения с ведущим; nil — поток идет.
+	lastErr atomic.Pointer[error]
+
+	retryInterval time.Duration
+	leaderTimeout time.Duration
+}
+
+// NewFollower создает реплику движка e, следующую за ведущим leaderURL.
+// client nil — http.DefaultClient; его Timeout должен быть нулевым: поток записей не кончается.
+func NewFollower(e *lsm.Engine, leaderURL string, client *http.Client) *Follower {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Follower{
+		e:             e,
+		url:           strings.TrimSuffix(leaderURL, "/"),
+		client:        client,
+		retryInterval: retryInterval,
+		leaderTimeout: leaderTimeout,
+	}
+}
+
+// Lag возвращает, на сколько записей реплика отстает от ведущего по последним
+// полученным от него сведениям.
+func (f *Follower) Lag() uint64 {
+	leader, applied := f.leaderSeq.Load(), f.e.LatestSequence()
+	if leader <= applied {
+		return 0
+	}
+	return leader - applied
+}
+
+// Err возвращает последнюю ошибку соединения с ведущим или nil, если поток записей идет.
+func (f *Follower) Err() error {
+	if p := f.lastErr.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Run применяет записи ведущего, пока не отменен ctx (тогда возвращает ctx.Err()).
+// При обрыве соединения Run переподключается и продолжает с LatestSequence реплики.
+// Run завершается ошибкой, если записей уже нет у ведущего (ErrSnapshotRequired)
+// или запись не удалось применить.
+func (f *Follower) Run(ctx context.Context) error {
+	for {
+		err := f.stream(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var fatal fatalError
+		if errors.As(err, &fatal) {
+			return fatal.err
+		}
+		f.lastErr.Store(&err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.retryInterval):
+		}
+	}
+}
+
+// fatalError — ошибка, после которой переподключаться бесполезно.
+type fatalError struct {
+	err error
+}
+
+func (e fatalError) Error() string { return e.err.Error() }
+
+// stream читает поток записей ведущего до обрыва или ошибки.
+func (f *Follower) stream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Ведущий, пропавший без закрытия соединения, обнаруживается по отсутствию heartbeat.
+	watchdog := time.AfterFunc(f.leaderTimeout, cancel)
+	defer watchdog.Stop()
+
+	url := f.url + "/updates?since=" + strconv.FormatUint(f.e.LatestSequence(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fatalError{err}
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return fatalError{ErrSnapshotRequired}
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("replication: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	f.lastErr.Store(nil)
+
+	br := bufio.NewReader(resp.Body)
+	for {
+		typ, body, err := readFrame(br)
+		if err != nil {
+			return fmt.Errorf("replication: поток записей: %w", err)
+		}
+		watchdog.Reset(f.leaderTimeout)
+		switch typ {
+		case frameUpdate:
+			u, err := decodeUpdate(body)
+			if err != nil {
+				return fatalError{err}
+			}
+			if err := f.e.ApplyUpdate(u); err != nil {
+				return fatalError{fmt.Errorf("replication: применение записи %d: %w", u.Seq, err)}
+			}
+			f.advanceLeader(u.Seq)
+		case frameHeartbeat:
+			seq, n := binary.Uvarint(body)
+			if n <= 0 {
+				return fatalError{fmt.Errorf("%w: heartbeat", errBadFrame)}
+			}
+			f.advanceLeader(seq)
+		}
+		// Кадры неизвестных типов пропускаются: их могут слать более новые ведущие.
+	}
+}
+
+func (f *Follower) advanceLeader(seq uint64) {
+	for {
+		cur := f.leaderSeq.Load()
+		if seq <= cur || f.leaderSeq.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
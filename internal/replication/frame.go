@@ -0,0 +1,159 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+// Поток записей ведущего — последовательность кадров: тип (байт), длина тела
+// (uvarint), тело.
+const (
+	// frameUpdate — запись: номер, затем изменения (см. appendUpdate).
+	frameUpdate = 'U'
+	// frameHeartbeat — ведущий жив; тело — номер его последней записи (uvarint).
+	frameHeartbeat = 'H'
+)
+
+// maxFrameSize ограничивает тело кадра.
+const maxFrameSize = 256 << 20
+
+var errBadFrame = errors.New("replication: некорректный кадр")
+
+func writeFrame(w *bufio.Writer, typ byte, body []byte) error {
+	if err := w.WriteByte(typ); err != nil {
+		return err
+	}
+	if _, err := w.Write(binary.AppendUvarint(w.AvailableBuffer(), uint64(len(body)))); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if n > maxFrameSize {
+		return 0, nil, fmt.Errorf("%w: длина %d", errBadFrame, n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return typ, body, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendUpdate кодирует запись: номер и число изменений (uvarint), затем каждое
+// изменение — вид (байт), пространство ключей, ключ и значение (длина uvarint и
+// байты), момент истечения в наносекундах Unix (varint, 0 — без срока).
+func appendUpdate(b []byte, u lsm.Update) []byte {
+	b = binary.AppendUvarint(b, u.Seq)
+	b = binary.AppendUvarint(b, uint64(len(u.Mutations)))
+	for _, m := range u.Mutations {
+		b = append(b, byte(m.Kind))
+		b = appendBytes(b, []byte(m.ColumnFamily))
+		b = appendBytes(b, m.Key)
+		b = appendBytes(b, m.Value)
+		var expires int64
+		if !m.ExpiresAt.IsZero() {
+			expires = m.ExpiresAt.UnixNano()
+		}
+		b = binary.AppendVarint(b, expires)
+	}
+	return b
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func decodeUpdate(b []byte) (lsm.Update, error) {
+	d := decoder{b: b}
+	u := lsm.Update{Seq: d.uvarint()}
+	n := d.uvarint()
+	if n > uint64(len(b)) {
+		return lsm.Update{}, fmt.Errorf("%w: %d изменений", errBadFrame, n)
+	}
+	u.Mutations = make([]lsm.Mutation, 0, n)
+	for range n {
+		m := lsm.Mutation{Kind: lsm.MutationKind(d.byte())}
+		m.ColumnFamily = string(d.bytes())
+		m.Key = d.bytes()
+		m.Value = d.bytes()
+		if expires := d.varint(); expires != 0 {
+			m.ExpiresAt = time.Unix(0, expires)
+		}
+		u.Mutations = append(u.Mutations, m)
+	}
+	if d.err || len(d.b) != 0 {
+		return lsm.Update{}, fmt.Errorf("%w: запись %d", errBadFrame, u.Seq)
+	}
+	return u, nil
+}
+
+// decoder читает поля из b; при нехватке байт выставляет err и дальше возвращает нули.
+type decoder struct {
+	b   []byte
+	err bool
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err, d.b = true, nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err, d.b = true, nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) == 0 {
+		d.err = true
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err, d.b = true, nil
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
@@ -0,0 +1,167 @@
+// Package replication — асинхронная репликация ведущий–ведомый пересылкой WAL.
+// Ведущий (Leader) отдает по HTTP записи своего changefeed с их номерами (LSN —
+// номера Engine.GetUpdatesSince) и согласованные копии базы; реплика (Follower)
+// применяет записи к своему движку под теми же номерами (Engine.ApplyUpdate).
+//
+// Новая реплика создается так: Bootstrap скачивает копию ведущего, движок
+// открывается на ней, и Follower.Run догоняет ведущего по хвосту WAL, начиная с
+// номера копии, а дальше следует за ним. После перезапуска реплика продолжает со
+// своего LatestSequence. Если нужные записи уже удалены из WAL ведущего, Run
+// возвращает ErrSnapshotRequired: реплику нужно создать заново.
+//
+// Реплика не должна принимать собственных записей, иначе ее номера разойдутся с
+// номерами ведущего.
+package replication
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+const (
+	// pollInterval — как часто ведущий проверяет новые записи для открытого потока.
+	pollInterval = 50 * time.Millisecond
+	// heartbeatInterval — как часто ведущий шлет heartbeat в простаивающий поток.
+	heartbeatInterval = time.Second
+)
+
+// Leader отдает по HTTP записи и копии движка для реплик:
+//
+//	GET /updates?since=N  поток кадров с записями после N; 410 Gone — их уже нет в WAL
+//	GET /checkpoint       копия базы (Engine.Checkpoint) в формате tar
+//
+// Под префиксом монтируется через http.StripPrefix:
+// mux.Handle("/replication/", http.StripPrefix("/replication", replication.NewLeader(e))).
+type Leader struct {
+	e   *lsm.Engine
+	mux *http.ServeMux
+
+	pollInterval      time.Duration
+	heartbeatInterval time.Duration
+}
+
+// NewLeader создает ведущего над e.
+func NewLeader(e *lsm.Engine) *Leader {
+	l := &Leader{e: e, mux: http.NewServeMux(), pollInterval: pollInterval, heartbeatInterval: heartbeatInterval}
+	l.mux.HandleFunc("GET /updates", l.serveUpdates)
+	l.mux.HandleFunc("GET /checkpoint", l.serveCheckpoint)
+	return l
+}
+
+func (l *Leader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mux.ServeHTTP(w, r)
+}
+
+// serveUpdates отдает записи после since, пока реплика не отключится. Пока записей
+// нет, раз в heartbeatInterval отправляется heartbeat с номером последней записи ведущего.
+func (l *Leader) serveUpdates(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "replication: некорректный since", http.StatusBadRequest)
+		return
+	}
+	// Недоступность записей выясняется до начала потока, чтобы ответить статусом.
+	it, err := l.e.GetUpdatesSince(since)
+	if err != nil {
+		updatesError(w, err)
+		return
+	}
+	u, ok, err := it.Next()
+	if err != nil {
+		_ = it.Close()
+		updatesError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(l.pollInterval)
+	defer ticker.Stop()
+	var buf []byte
+	lastFrame := time.Time{}
+	for {
+		sent := false
+		for ok {
+			buf = appendUpdate(buf[:0], u)
+			if err := writeFrame(bw, frameUpdate, buf); err != nil {
+				_ = it.Close()
+				return
+			}
+			since, sent = u.Seq, true
+			u, ok, err = it.Next()
+		}
+		_ = it.Close()
+		if err != nil {
+			// Поток уже начат: реплика переподключится и получит ошибку статусом.
+			return
+		}
+		if sent || time.Since(lastFrame) >= l.heartbeatInterval {
+			buf = binary.AppendUvarint(buf[:0], l.e.LatestSequence())
+			if err := writeFrame(bw, frameHeartbeat, buf); err != nil {
+				return
+			}
+			if err := bw.Flush(); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			lastFrame = time.Now()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if it, err = l.e.GetUpdatesSince(since); err != nil {
+			return
+		}
+		u, ok, err = it.Next()
+	}
+}
+
+func updatesError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, lsm.ErrUpdatesUnavailable):
+		code = http.StatusGone
+	case errors.Is(err, lsm.ErrClosed):
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// serveCheckpoint отдает копию базы: Checkpoint во временную директорию, упакованный в tar.
+func (l *Leader) serveCheckpoint(w http.ResponseWriter, _ *http.Request) {
+	tmp, err := os.MkdirTemp("", "kvcheckpoint")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "db")
+	if err := l.e.Checkpoint(dir); err != nil {
+		updatesError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		// Заголовок уже отправлен: оборванный архив реплика не распакует.
+		return
+	}
+	_ = tw.Close()
+}
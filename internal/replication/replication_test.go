@@ -0,0 +1,177 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+func newTestLeader(t *testing.T) (*lsm.Engine, string) {
+	t.Helper()
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	l := NewLeader(e)
+	l.pollInterval = 5 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.Handle("/replication/", http.StripPrefix("/replication", l))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+		_ = e.Close()
+	})
+	return e, srv.URL + "/replication"
+}
+
+func newTestFollower(t *testing.T, url string) (*lsm.Engine, *Follower) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "replica")
+	if err := Bootstrap(context.Background(), nil, url, dir); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	e, err := lsm.Open(lsm.Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = e.Close() })
+	f := NewFollower(e, url, nil)
+	f.retryInterval = 10 * time.Millisecond
+	return e, f
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("не дождались: %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leader, url := newTestLeader(t)
+	for i := 0; i < 10; i++ {
+		if err := leader.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := leader.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Put([]byte("tail"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	replica, f := newTestFollower(t, url)
+	if got, want := replica.LatestSequence(), leader.LatestSequence(); got != want {
+		t.Fatalf("LatestSequence копии = %d, ведущего %d", got, want)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx) }()
+
+	for i := 0; i < 10; i += 2 {
+		if err := leader.Delete([]byte(fmt.Sprintf("k%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx := leader.BeginTxn()
+	_ = tx.Put([]byte("a"), []byte("1"))
+	_ = tx.Put([]byte("b"), []byte("2"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "реплика догонит ведущего", func() bool {
+		return replica.LatestSequence() == leader.LatestSequence() && f.Lag() == 0
+	})
+
+	it := leader.Scan(nil, nil)
+	defer it.Close()
+	n := 0
+	for {
+		k, v, ok, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		n++
+		if got, err := replica.Get(k); err != nil || !bytes.Equal(got, v) {
+			t.Errorf("реплика: Get(%s) = %q, %v; у ведущего %q", k, got, err, v)
+		}
+	}
+	if _, err := replica.Get([]byte("k0")); !errors.Is(err, lsm.ErrNotFound) {
+		t.Errorf("реплика: Get(k0) после Delete: %v", err)
+	}
+	if n != 8 {
+		t.Fatalf("ключей у ведущего: %d", n)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestSnapshotRequired(t *testing.T) {
+	leader, url := newTestLeader(t)
+	if err := leader.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	_, f := newTestFollower(t, url)
+
+	// Пока реплика не работает, записи уходят из WAL ведущего в SSTable.
+	if err := leader.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.Run(ctx); !errors.Is(err, ErrSnapshotRequired) {
+		t.Fatalf("Run: %v, ожидалась ErrSnapshotRequired", err)
+	}
+}
+
+func TestUpdateEncoding(t *testing.T) {
+	u := lsm.Update{Seq: 42, Mutations: []lsm.Mutation{
+		{Kind: lsm.MutationPut, ColumnFamily: "default", Key: []byte("k"), Value: []byte("v"), ExpiresAt: time.Unix(100, 5)},
+		{Kind: lsm.MutationDelete, ColumnFamily: "cdr", Key: []byte("d"), Value: []byte{}},
+	}}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeFrame(w, frameUpdate, appendUpdate(nil, u)); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Flush()
+	typ, body, err := readFrame(bufio.NewReader(&buf))
+	if err != nil || typ != frameUpdate {
+		t.Fatalf("readFrame: %c, %v", typ, err)
+	}
+	got, err := decodeUpdate(body)
+	if err != nil {
+		t.Fatalf("decodeUpdate: %v", err)
+	}
+	if !reflect.DeepEqual(got, u) {
+		t.Fatalf("decodeUpdate = %+v, ожидалось %+v", got, u)
+	}
+	if _, err := decodeUpdate(body[:len(body)-1]); !errors.Is(err, errBadFrame) {
+		t.Fatalf("decodeUpdate обрезанной записи: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package resp
+
+import "bytes"
+
+// match сообщает, подходит ли s под glob-шаблон Redis: * — любая последовательность,
+// ? — любой байт, [abc], [^abc] и [a-z] — классы, \ экранирует следующий символ.
+//
+// Остальные элементы шаблона совпадают ровно с одним байтом, поэтому при неудаче
+// достаточно вернуться к последней * и отдать ей на байт больше: время O(len(p)*len(s))
+// при любом числе *. Рекурсия по каждой * была бы экспоненциальной, и шаблон
+// вроде "*a*a*a*a*a*b" из SCAN MATCH подвешивал бы соединение (CVE-2022-36021).
+func match(p, s []byte) bool {
+	pi, si := 0, 0
+	star, sStar := -1, 0 // позиция в p после последней * и позиция в s, с которой она продолжит
+	for si < len(s) {
+		if pi < len(p) {
+			switch p[pi] {
+			case '*':
+				pi++
+				star, sStar = pi, si
+				continue
+			case '?':
+				pi, si = pi+1, si+1
+				continue
+			case '[':
+				if n, ok := matchClass(p[pi:], s[si]); ok {
+					pi, si = pi+n, si+1
+					continue
+				}
+			default:
+				c, n := p[pi], 1
+				if c == '\\' && pi+1 < len(p) {
+					c, n = p[pi+1], 2
+				}
+				if s[si] == c {
+					pi, si = pi+n, si+1
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		sStar++
+		pi, si = star, sStar
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// matchClass сопоставляет b с классом "[...]" в начале p и возвращает длину класса.
+// Незакрытый класс, как в Redis, тянется до конца шаблона.
+func matchClass(p []byte, b byte) (int, bool) {
+	i := 1
+	neg := i < len(p) && p[i] == '^'
+	if neg {
+		i++
+	}
+	matched := false
+	for ; i < len(p) && p[i] != ']'; i++ {
+		if p[i] == '\\' && i+1 < len(p) {
+			i++
+		}
+		lo, hi := p[i], p[i]
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			i += 2
+			if p[i] == '\\' && i+1 < len(p) {
+				i++
+			}
+			hi = p[i]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= b && b <= hi {
+			matched = true
+		}
+	}
+	if i < len(p) {
+		i++
+	}
+	return i, matched != neg
+}
+
+// literalPrefix возвращает постоянный префикс шаблона — до первого спецсимвола.
+func literalPrefix(p []byte) []byte {
+	if i := bytes.IndexAny(p, `*?[\`); i >= 0 {
+		return p[:i]
+	}
+	return p
+}
+
+// prefixEnd возвращает наименьший ключ больше всех ключей с префиксом prefix;
+// nil — таких ключей нет (префикс из одних 0xff).
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
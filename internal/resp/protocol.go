@@ -0,0 +1,144 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Кодирование RESP2: команды клиента — массивы bulk-строк или inline-команды
+// (строка с аргументами через пробел, как в telnet), ответы — простые строки,
+// ошибки, целые, bulk-строки и массивы.
+
+var errProtocol = errors.New("resp: ошибка протокола")
+
+const (
+	maxBulkLen = 64 << 20 // наибольший аргумент команды
+	maxArgs    = 1 << 20  // наибольшее число аргументов
+	maxLine    = 64 << 10 // наибольшая строка заголовка или inline-команды
+)
+
+type reader struct {
+	br *bufio.Reader
+}
+
+func newReader(r io.Reader) reader {
+	return reader{br: bufio.NewReaderSize(r, maxLine)}
+}
+
+// readCommand читает команду и возвращает её аргументы; пустая inline-команда —
+// пустой срез.
+func (r reader) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// Строка лежит в буфере bufio.Reader: аргументы копируются.
+		return bytes.Fields(bytes.Clone(line)), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: некорректная длина массива %q", errProtocol, line[1:])
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: ожидалась bulk-строка, получено %q", errProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, fmt.Errorf("%w: некорректная длина bulk-строки %q", errProtocol, line[1:])
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r.br, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk-строка не завершена CRLF", errProtocol)
+		}
+		args = append(args, buf[:size:size])
+	}
+	return args, nil
+}
+
+// readLine читает строку без завершающего "\r\n" (или "\n"). Строка действительна
+// до следующего чтения.
+func (r reader) readLine() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: строка длиннее %d байт", errProtocol, maxLine)
+	}
+	if err != nil {
+		if len(line) > 0 {
+			return nil, unexpectedEOF(err)
+		}
+		return nil, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writer буферизует ответы; ошибки записи проявляются при Flush.
+type writer struct {
+	bw *bufio.Writer
+}
+
+func newWriter(w io.Writer) writer {
+	return writer{bw: bufio.NewWriter(w)}
+}
+
+func (w writer) simple(s string) {
+	w.bw.WriteByte('+')
+	w.bw.WriteString(s)
+	w.bw.WriteString("\r\n")
+}
+
+// error пишет ошибку; msg начинается с её типа, например "ERR".
+func (w writer) error(msg string) {
+	w.bw.WriteByte('-')
+	w.bw.WriteString(msg)
+	w.bw.WriteString("\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.header(':', n)
+}
+
+func (w writer) bulk(b []byte) {
+	w.header('$', int64(len(b)))
+	w.bw.Write(b)
+	w.bw.WriteString("\r\n")
+}
+
+// null пишет null bulk-строку — ответ на GET отсутствующего ключа.
+func (w writer) null() {
+	w.bw.WriteString("$-1\r\n")
+}
+
+// array пишет заголовок массива из n элементов; элементы пишутся следом.
+func (w writer) array(n int) {
+	w.header('*', int64(n))
+}
+
+func (w writer) header(typ byte, n int64) {
+	w.bw.WriteByte(typ)
+	w.bw.Write(strconv.AppendInt(w.bw.AvailableBuffer(), n, 10))
+	w.bw.WriteString("\r\n")
+}
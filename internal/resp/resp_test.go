@@ -0,0 +1,264 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+// client — минимальный клиент RESP2 для тестов.
+type client struct {
+	t  *testing.T
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func newTestClient(t *testing.T) (*client, *lsm.Engine) {
+	t.Helper()
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(e)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve: %v", err)
+		}
+		_ = e.Close()
+	})
+	return &client{t: t, c: c, br: bufio.NewReader(c)}, e
+}
+
+// do отправляет команду массивом bulk-строк и возвращает ответ: string для простой
+// строки, []byte для bulk-строки, nil для null, int64, []any или error.
+func (c *client) do(args ...string) any {
+	c.t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.c.Write([]byte(b.String())); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *client) read() any {
+	c.t.Helper()
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("чтение ответа: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return errors.New(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return buf[:n]
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]any, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("неизвестный ответ %q", line)
+	return nil
+}
+
+func TestCommands(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	check := func(got, want any) {
+		t.Helper()
+		if b, ok := got.([]byte); ok {
+			got = string(b)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("ответ %v, ожидался %v", got, want)
+		}
+	}
+	check(c.do("PING"), "PONG")
+	check(c.do("GET", "a"), nil)
+	check(c.do("SET", "a", "1"), "OK")
+	check(c.do("set", "b", "2"), "OK")
+	check(c.do("GET", "a"), "1")
+	check(c.do("DEL", "a", "b", "c"), int64(2))
+	check(c.do("GET", "a"), nil)
+	check(c.do("EXPIRE", "a", "10"), int64(0))
+
+	if err, ok := c.do("NOSUCH").(error); !ok || !strings.HasPrefix(err.Error(), "ERR ") {
+		t.Fatalf("неизвестная команда: %v", err)
+	}
+	if _, ok := c.do("GET").(error); !ok {
+		t.Fatal("GET без ключа: ожидалась ошибка")
+	}
+	if _, ok := c.do("SET", "a", "1", "NX").(error); !ok {
+		t.Fatal("SET NX: ожидалась ошибка")
+	}
+
+	// Inline-команда, как из telnet.
+	if _, err := c.c.Write([]byte("GET missing\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	check(c.read(), nil)
+}
+
+func TestTTL(t *testing.T) {
+	c, e := newTestClient(t)
+
+	if got := c.do("SET", "short", "v", "PX", "50"); got != "OK" {
+		t.Fatalf("SET PX: %v", got)
+	}
+	if err := e.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do("EXPIRE", "k", "3600"); got != int64(1) {
+		t.Fatalf("EXPIRE: %v", got)
+	}
+	if got := c.do("GET", "k"); string(got.([]byte)) != "v" {
+		t.Fatalf("GET после EXPIRE: %v", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := c.do("GET", "short"); got != nil {
+		t.Fatalf("GET истёкшего ключа: %q", got)
+	}
+	if got := c.do("EXPIRE", "k", "0"); got != int64(1) {
+		t.Fatalf("EXPIRE 0: %v", got)
+	}
+	if got := c.do("GET", "k"); got != nil {
+		t.Fatalf("GET после EXPIRE 0: %q", got)
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, e := newTestClient(t)
+	for i := 0; i < 25; i++ {
+		if err := e.Put([]byte(fmt.Sprintf("user:%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Put([]byte(fmt.Sprintf("cdr:%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanAll := func(args ...string) []string {
+		t.Helper()
+		var keys []string
+		cursor := "0"
+		for calls := 0; ; calls++ {
+			if calls > 100 {
+				t.Fatal("SCAN не завершился")
+			}
+			reply, ok := c.do(append([]string{"SCAN", cursor}, args...)...).([]any)
+			if !ok || len(reply) != 2 {
+				t.Fatalf("SCAN: %v", reply)
+			}
+			for _, k := range reply[1].([]any) {
+				keys = append(keys, string(k.([]byte)))
+			}
+			cursor = string(reply[0].([]byte))
+			if cursor == "0" {
+				return keys
+			}
+		}
+	}
+	if keys := scanAll(); len(keys) != 50 {
+		t.Fatalf("SCAN вернул %d ключей, ожидалось 50", len(keys))
+	}
+	keys := scanAll("MATCH", "user:1*", "COUNT", "3")
+	if fmt.Sprint(keys) != "[user:10 user:11 user:12 user:13 user:14 user:15 user:16 user:17 user:18 user:19]" {
+		t.Fatalf("SCAN MATCH user:1* = %v", keys)
+	}
+	if keys := scanAll("MATCH", "*:0[0-2]"); fmt.Sprint(keys) != "[cdr:00 cdr:01 cdr:02 user:00 user:01 user:02]" {
+		t.Fatalf("SCAN MATCH *:0[0-2] = %v", keys)
+	}
+	if _, ok := c.do("SCAN", "12345").(error); !ok {
+		t.Fatal("SCAN с неизвестным курсором: ожидалась ошибка")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"user/*", "user/1/2", true},
+		{"*a*b", "xaxxbyb", true},
+		{"*a*b", "xaxxbyc", false},
+		{"a*b*c", "abcbc", true},
+		{"*?*", "", false},
+		{"**a", "a", true},
+		{"*[0-9]", "cdr:x9", true},
+		{`*\*`, "ab*", true},
+		{`ab\`, `ab\`, true},
+		{"h[ae", "hallo", false},
+	} {
+		if got := match([]byte(tc.pattern), []byte(tc.s)); got != tc.want {
+			t.Errorf("match(%q, %q) = %v, ожидалось %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+
+	// Много * и длинный ключ без совпадения: рекурсивный перебор не закончился бы.
+	pattern := []byte(strings.Repeat("*a", 30) + "*b")
+	s := bytes.Repeat([]byte("a"), 10000)
+	done := make(chan bool)
+	go func() { done <- match(pattern, s) }()
+	select {
+	case got := <-done:
+		if got {
+			t.Fatal("match вернул true для ключа без b")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("match не завершился за 5 с")
+	}
+}
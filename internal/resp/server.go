@@ -0,0 +1,324 @@
+// Package resp — фронтенд движка по протоколу Redis (RESP2): подмножество команд
+// GET, SET, DEL, EXPIRE и SCAN, чтобы клиенты и инструменты Redis работали с
+// хранилищем CDR во время миграции.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kvschool/internal/lsm"
+	"kvschool/internal/tcpserver"
+)
+
+// ErrServerClosed возвращает Serve после Close.
+var ErrServerClosed = errors.New("resp: сервер закрыт")
+
+// Server обслуживает соединения клиентов Redis над движком.
+type Server struct {
+	e *lsm.Engine
+
+	// writeMu упорядочивает изменяющие команды: DEL и EXPIRE читают ключ перед записью.
+	// Запись в движок в обход Server может вклиниться между чтением и записью.
+	writeMu sync.Mutex
+
+	srv *tcpserver.Server
+}
+
+// NewServer создает сервер над e.
+func NewServer(e *lsm.Engine) *Server {
+	s := &Server{e: e}
+	s.srv = tcpserver.New(s.serveConn, ErrServerClosed)
+	return s
+}
+
+// Serve принимает соединения на l и обслуживает каждое в своей горутине, пока
+// не будет вызван Close (тогда возвращает ErrServerClosed) или Accept не вернёт ошибку.
+func (s *Server) Serve(l net.Listener) error { return s.srv.Serve(l) }
+
+// Close закрывает слушателей и соединения и дожидается завершения их обработчиков:
+// после Close движок можно закрывать.
+func (s *Server) Close() error { return s.srv.Close() }
+
+// conn — состояние соединения.
+type conn struct {
+	r reader
+	w writer
+
+	// cursors — незавершённые SCAN: курсор → ключ, с которого продолжить.
+	cursors    map[uint64][]byte
+	lastCursor uint64
+}
+
+// maxCursors ограничивает число незавершённых SCAN соединения: самые старые забываются.
+const maxCursors = 64
+
+func (s *Server) serveConn(nc net.Conn) {
+	c := &conn{r: newReader(nc), w: newWriter(nc), cursors: make(map[uint64][]byte)}
+	for {
+		args, err := c.r.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.w.error("ERR " + err.Error())
+				_ = c.w.bw.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(c, args)
+		// Ответы на конвейер команд уходят одной записью.
+		if quit || c.r.br.Buffered() == 0 {
+			if err := c.w.bw.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// command — команда: arity — число аргументов вместе с именем, отрицательное —
+// не меньше -arity; run пишет ответ или возвращает ошибку.
+type command struct {
+	arity int
+	run   func(s *Server, c *conn, args [][]byte) error
+}
+
+var commands = map[string]command{
+	"PING":   {-1, (*Server).ping},
+	"GET":    {2, (*Server).get},
+	"SET":    {-3, (*Server).set},
+	"DEL":    {-2, (*Server).del},
+	"EXPIRE": {3, (*Server).expire},
+	"SCAN":   {-2, (*Server).scan},
+}
+
+// errSyntax — ошибка в аргументах команды.
+var errSyntax = errors.New("синтаксическая ошибка")
+
+// exec выполняет команду и сообщает, что соединение нужно закрыть (QUIT).
+func (s *Server) exec(c *conn, args [][]byte) (quit bool) {
+	name := strings.ToUpper(string(args[0]))
+	if name == "QUIT" {
+		c.w.simple("OK")
+		return true
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.error(fmt.Sprintf("ERR неизвестная команда '%s'", args[0]))
+		return false
+	}
+	if cmd.arity >= 0 && len(args) != cmd.arity || len(args) < -cmd.arity {
+		c.w.error(fmt.Sprintf("ERR неверное число аргументов команды '%s'", strings.ToLower(name)))
+		return false
+	}
+	if err := cmd.run(s, c, args); err != nil {
+		c.w.error("ERR " + err.Error())
+	}
+	return false
+}
+
+func (s *Server) ping(c *conn, args [][]byte) error {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		return errSyntax
+	}
+	return nil
+}
+
+func (s *Server) get(c *conn, args [][]byte) error {
+	v, err := s.e.Get(args[1])
+	if errors.Is(err, lsm.ErrNotFound) {
+		c.w.null()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.w.bulk(v)
+	return nil
+}
+
+// set — SET key value [EX seconds | PX milliseconds].
+func (s *Server) set(c *conn, args [][]byte) error {
+	var ttl time.Duration
+	for opts := args[3:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 || ttl != 0 {
+			return errSyntax
+		}
+		n, err := strconv.ParseInt(string(opts[1]), 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("некорректное время жизни %q", opts[1])
+		}
+		switch strings.ToUpper(string(opts[0])) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			return errSyntax
+		}
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	var err error
+	if ttl > 0 {
+		err = s.e.PutWithTTL(args[1], args[2], ttl)
+	} else {
+		err = s.e.Put(args[1], args[2])
+	}
+	if err != nil {
+		return err
+	}
+	c.w.simple("OK")
+	return nil
+}
+
+// del удаляет ключи и отвечает числом удалённых — существовавших — ключей.
+func (s *Server) del(c *conn, args [][]byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	var n int64
+	for _, key := range args[1:] {
+		_, err := s.e.Get(key)
+		if errors.Is(err, lsm.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.e.Delete(key); err != nil {
+			return err
+		}
+		n++
+	}
+	c.w.integer(n)
+	return nil
+}
+
+// expire задаёт ключу время жизни в секундах, перезаписывая значение с TTL.
+// Отвечает 1, если ключ есть, и 0, если нет; неположительное время удаляет ключ.
+func (s *Server) expire(c *conn, args [][]byte) error {
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("некорректное время жизни %q", args[2])
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	v, err := s.e.Get(args[1])
+	if errors.Is(err, lsm.ErrNotFound) {
+		c.w.integer(0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if seconds <= 0 {
+		err = s.e.Delete(args[1])
+	} else {
+		err = s.e.PutWithTTL(args[1], v, time.Duration(seconds)*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	c.w.integer(1)
+	return nil
+}
+
+// scan — SCAN cursor [MATCH pattern] [COUNT count]. Ключи обходятся по возрастанию;
+// курсор — номер, под которым соединение запомнило ключ, с которого продолжить,
+// так что ключ, существующий весь обход, возвращается ровно один раз.
+func (s *Server) scan(c *conn, args [][]byte) error {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("некорректный курсор %q", args[1])
+	}
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = c.cursors[cursor]; !ok {
+			return fmt.Errorf("некорректный курсор %q", args[1])
+		}
+	}
+	var pattern []byte
+	count := 10
+	for opts := args[2:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 {
+			return errSyntax
+		}
+		switch strings.ToUpper(string(opts[0])) {
+		case "MATCH":
+			pattern = opts[1]
+		case "COUNT":
+			n, err := strconv.Atoi(string(opts[1]))
+			if err != nil || n <= 0 {
+				return errSyntax
+			}
+			count = n
+		default:
+			return errSyntax
+		}
+	}
+	delete(c.cursors, cursor)
+
+	// Ключи под шаблоном с постоянным префиксом лежат в диапазоне префикса.
+	var end []byte
+	if prefix := literalPrefix(pattern); len(prefix) > 0 {
+		if string(start) < string(prefix) {
+			start = prefix
+		}
+		end = prefixEnd(prefix)
+	}
+	it := s.e.Scan(start, end)
+	defer it.Close()
+	var keys [][]byte
+	next := uint64(0)
+	for n := 0; ; n++ {
+		key, _, ok, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if n == count {
+			next = c.saveCursor(key)
+			break
+		}
+		if pattern == nil || match(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	c.w.array(2)
+	c.w.bulk(strconv.AppendUint(nil, next, 10))
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulk(key)
+	}
+	return nil
+}
+
+// saveCursor запоминает ключ продолжения SCAN и возвращает его курсор.
+func (c *conn) saveCursor(key []byte) uint64 {
+	if len(c.cursors) >= maxCursors {
+		oldest := c.lastCursor
+		for k := range c.cursors {
+			oldest = min(oldest, k)
+		}
+		delete(c.cursors, oldest)
+	}
+	c.lastCursor++
+	c.cursors[c.lastCursor] = key
+	return c.lastCursor
+}
@@ -20,8 +20,9 @@ type Iterator interface {
 }
 
 type scanIter struct {
-	cur *Node
-	end []byte
+	cur     *Node
+	end     []byte
+	compare func(a, b []byte) int
 }
 
 func (it *scanIter) Next() (key, value []byte, ok bool, err error) {
@@ -29,7 +30,7 @@ func (it *scanIter) Next() (key, value []byte, ok bool, err error) {
 		return nil, nil, false, nil
 	}
 
-	if it.end != nil && bytes.Compare(it.cur.key, it.end) >= 0 {
+	if it.end != nil && it.compare(it.cur.key, it.end) >= 0 {
 		it.cur = nil
 		return nil, nil, false, nil
 	}
@@ -65,15 +66,22 @@ type SkipList struct {
 	MaxLevel int
 	p        float64
 	RNG      *rand.Rand
+	compare  func(a, b []byte) int
 }
 
 // New создаёт SkipList. seed требуется для детерминируемых тестов (воспроизводимость поведения при ошибках).
 func New(seed int64) *SkipList {
+	return NewWithCompare(seed, bytes.Compare)
+}
+
+// NewWithCompare создаёт SkipList с заданным порядком ключей.
+func NewWithCompare(seed int64, compare func(a, b []byte) int) *SkipList {
 	const maxLevel = 100
 	sl := &SkipList{
 		MaxLevel: maxLevel,
 		p:        0.5,
 		RNG:      rand.New(rand.NewSource(seed)),
+		compare:  compare,
 	}
 
 	sl.Head = &Node{
@@ -94,13 +102,13 @@ func (s *SkipList) Put(key, value []byte) error {
 	x := s.Head
 
 	for i := s.MaxLevel - 1; i >= 0; i-- {
-		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+		for x.next[i] != nil && s.compare(x.next[i].key, key) < 0 {
 			x = x.next[i]
 		}
 		update[i] = x
 	}
 
-	if x.next[0] != nil && bytes.Compare(x.next[0].key, key) == 0 {
+	if x.next[0] != nil && s.compare(x.next[0].key, key) == 0 {
 		v := append([]byte(nil), value...)
 		x.next[0].value = v
 		return nil
@@ -132,14 +140,14 @@ func (s *SkipList) Get(key []byte) ([]byte, error) {
 	x := s.Head
 
 	for i := s.MaxLevel - 1; i >= 0; i-- {
-		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+		for x.next[i] != nil && s.compare(x.next[i].key, key) < 0 {
 			x = x.next[i]
 		}
 	}
 
 	x = x.next[0]
 
-	if x != nil && bytes.Compare(x.key, key) == 0 {
+	if x != nil && s.compare(x.key, key) == 0 {
 
 		res := make([]byte, len(x.value))
 		copy(res, x.value)
@@ -157,14 +165,14 @@ func (s *SkipList) Delete(key []byte) error {
 	x := s.Head
 
 	for i := s.MaxLevel - 1; i >= 0; i-- {
-		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+		for x.next[i] != nil && s.compare(x.next[i].key, key) < 0 {
 			x = x.next[i]
 		}
 		update[i] = x
 	}
 
 	x = x.next[0]
-	if x == nil || bytes.Compare(x.key, key) != 0 {
+	if x == nil || s.compare(x.key, key) != 0 {
 		return ErrNotFound
 	}
 
@@ -187,7 +195,7 @@ func (s *SkipList) Scan(start, end []byte) (Iterator, error) {
 	x := s.Head
 	if start != nil {
 		for i := s.MaxLevel - 1; i >= 0; i-- {
-			for x.next[i] != nil && bytes.Compare(x.next[i].key, start) < 0 {
+			for x.next[i] != nil && s.compare(x.next[i].key, start) < 0 {
 				x = x.next[i]
 			}
 		}
@@ -200,8 +208,9 @@ func (s *SkipList) Scan(start, end []byte) (Iterator, error) {
 	}
 
 	return &scanIter{
-		cur: x,
-		end: end,
+		cur:     x,
+		end:     end,
+		compare: s.compare,
 	}, nil
 
 }
@@ -1,13 +1,32 @@
 package sstable
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"sort"
 )
 
+// blockEnd — маркер конца блока: нулевая длина ключа.
+// Пустые ключи поэтому в SSTable не допускаются.
+// За маркером следует CRC32 (Castagnoli) всех байт блока, включая маркер.
+const blockEnd = int32(0)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt возвращается, если блок не сходится с контрольной суммой или ключи в нём не упорядочены.
+// Проверки выполняются только в режиме SetParanoidChecks и в Verify.
+var ErrCorrupt = errors.New("sstable: повреждённые данные")
+
+// PropNumEntries — свойство таблицы: число записей, 8 байт big-endian.
+const PropNumEntries = "sstable.num-entries"
+
 type SparseIndex struct {
 	startKey []byte
 	endKey   []byte
@@ -24,13 +43,28 @@ type KeyValue struct {
 	Value []byte
 }
 
+// File — файл таблицы. *os.File его реализует; движок может подставить свою ФС.
+type File interface {
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
 type SSTable struct {
-	file         *os.File
+	file         File
 	sparseIndexs []SparseIndex
 	blockSize    int
+	paranoid     bool
+	compare      func(a, b []byte) int
+
+	// props — блок свойств; propsOffset < 0, если его нет (таблица старого формата).
+	props       map[string][]byte
+	propsOffset int64
 }
 
-func (s *SSTable) File() *os.File {
+func (s *SSTable) File() File {
 	return s.file
 }
 
@@ -39,14 +73,63 @@ func (s *SSTable) SparseIndexs() []SparseIndex {
 }
 
 func (s *SSTable) ReadBlockFromOffset(offset int64) ([]KeyValue, error) {
-	return s.readBlockFromOffset(offset)
+	blockData, _, err := s.readBlockFromOffset(offset)
+	return blockData, err
 }
 
-func NewSSTable(file *os.File, blockSize int) *SSTable {
+func NewSSTable(file File, blockSize int) *SSTable {
 	return &SSTable{
-		file:      file,
-		blockSize: blockSize,
+		file:        file,
+		blockSize:   blockSize,
+		propsOffset: -1,
+		compare:     bytes.Compare,
+	}
+}
+
+// Open открывает существующий файл таблицы и строит по нему sparse index.
+func Open(path string) (*SSTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSSTable(f, DefaultBlockSize)
+	if err := s.BuildSparseIndex(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Properties возвращает свойства таблицы (nil, если таблица записана без блока свойств).
+func (s *SSTable) Properties() map[string][]byte { return s.props }
+
+// SetCompare задаёт порядок ключей, которым записана таблица (по умолчанию bytes.Compare).
+func (s *SSTable) SetCompare(compare func(a, b []byte) int) { s.compare = compare }
+
+// SetParanoidChecks включает проверку контрольной суммы и порядка ключей при каждом чтении блока.
+func (s *SSTable) SetParanoidChecks(on bool) { s.paranoid = on }
+
+// Verify читает всю таблицу, проверяя контрольные суммы блоков и строгий порядок ключей.
+func (s *SSTable) Verify() error {
+	var prev []byte
+	for _, sp := range s.sparseIndexs {
+		block, _, err := s.readBlock(sp.offset, true)
+		if err != nil {
+			return err
+		}
+		if len(block) > 0 && prev != nil && s.compare(block[0].Key, prev) <= 0 {
+			return fmt.Errorf("%w: блок по смещению %d: ключи не по возрастанию", ErrCorrupt, sp.offset)
+		}
+		if len(block) > 0 {
+			prev = block[len(block)-1].Key
+		}
+	}
+	if s.propsOffset >= 0 {
+		if _, _, err := s.readBlock(s.propsOffset, true); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (s *SSTable) Close() error {
@@ -56,36 +139,46 @@ func (s *SSTable) Close() error {
 	return nil
 }
 
-func (s *SSTable) BuildSparseIndex() error {
-	_, err := s.file.Seek(0, 0)
-	if err != nil {
-		return err
+// Smallest возвращает минимальный ключ таблицы (nil для пустой таблицы).
+func (s *SSTable) Smallest() []byte {
+	if len(s.sparseIndexs) == 0 {
+		return nil
 	}
+	return s.sparseIndexs[0].startKey
+}
 
+// Largest возвращает максимальный ключ таблицы (nil для пустой таблицы).
+func (s *SSTable) Largest() []byte {
+	if len(s.sparseIndexs) == 0 {
+		return nil
+	}
+	return s.sparseIndexs[len(s.sparseIndexs)-1].endKey
+}
+
+func (s *SSTable) BuildSparseIndex() error {
 	var sparseIndex []SparseIndex
 	blockOffset := int64(0)
 
 	for {
-		blockData, err := s.readBlockFromOffset(blockOffset)
+		blockData, blockSize, err := s.readBlockFromOffset(blockOffset)
 		if err != nil {
 			return err
 		}
 
 		if len(blockData) == 0 {
+			// Пустой блок завершает данные; за ним может идти блок свойств.
+			s.props, s.propsOffset = nil, -1
+			if blockSize > 0 {
+				if err := s.readProperties(blockOffset + int64(blockSize)); err != nil {
+					return err
+				}
+			}
 			break
 		}
 
-		startKey := blockData[0].Key
-		endKey := blockData[len(blockData)-1].Key
-		blockSize := 0
-
-		for _, kv := range blockData {
-			blockSize += int(binary.Size(int32(0))) + len(kv.Key) + int(binary.Size(int32(0))) + len(kv.Value)
-		}
-
 		sparseIndex = append(sparseIndex, SparseIndex{
-			startKey: startKey,
-			endKey:   endKey,
+			startKey: blockData[0].Key,
+			endKey:   blockData[len(blockData)-1].Key,
 			size:     blockSize,
 			offset:   blockOffset,
 		})
@@ -97,75 +190,107 @@ func (s *SSTable) BuildSparseIndex() error {
 	return nil
 }
 
+func (s *SSTable) readProperties(offset int64) error {
+	block, size, err := s.readBlockFromOffset(offset)
+	if err != nil {
+		return fmt.Errorf("sstable: блок свойств: %w", err)
+	}
+	if size == 0 {
+		return nil
+	}
+	s.props = make(map[string][]byte, len(block))
+	for _, kv := range block {
+		s.props[string(kv.Key)] = kv.Value
+	}
+	s.propsOffset = offset
+	return nil
+}
+
+// WriteBlock дописывает в файл блок записей, завершая его маркером конца блока.
 func (s *SSTable) WriteBlock(blockData []KeyValue) error {
-	for _, kv := range blockData {
-		err := binary.Write(s.file, binary.BigEndian, int32(len(kv.Key)))
-		if err != nil {
-			return err
-		}
+	_, err := s.file.Write(encodeBlock(nil, blockData))
+	return err
+}
 
-		_, err = s.file.Write(kv.Key)
-		if err != nil {
-			return err
-		}
+// encodeBlock дописывает к dst записи, маркер конца и контрольную сумму.
+// dst должен содержать только записи этого же блока.
+func encodeBlock(dst []byte, blockData []KeyValue) []byte {
+	for _, kv := range blockData {
+		dst = appendEntry(dst, kv.Key, kv.Value)
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(blockEnd))
+	return binary.BigEndian.AppendUint32(dst, crc32.Checksum(dst, crcTable))
+}
 
-		err = binary.Write(s.file, binary.BigEndian, int32(len(kv.Value)))
-		if err != nil {
-			return err
-		}
+func appendEntry(dst, key, value []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(key)))
+	dst = append(dst, key...)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(value)))
+	return append(dst, value...)
+}
 
-		_, err = s.file.Write(kv.Value)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+// readBlockFromOffset читает блок, начинающийся с startOffset.
+// Возвращает записи блока и количество занятых им байт (вместе с маркером конца и контрольной суммой).
+// Файл читается через ReadAt, поэтому чтения не мешают друг другу.
+func (s *SSTable) readBlockFromOffset(startOffset int64) ([]KeyValue, int, error) {
+	return s.readBlock(startOffset, s.paranoid)
 }
 
-func (s *SSTable) readBlockFromOffset(startOffset int64) ([]KeyValue, error) {
+// readBlock читает блок; при verify сверяет контрольную сумму и порядок ключей.
+func (s *SSTable) readBlock(startOffset int64, verify bool) ([]KeyValue, int, error) {
 	var result []KeyValue
 
-	_, err := s.file.Seek(startOffset, 0)
-	if err != nil {
-		return nil, err
-	}
+	br := bufio.NewReader(io.NewSectionReader(s.file, startOffset, math.MaxInt64-startOffset))
+	crc := crc32.New(crcTable)
+	r := io.TeeReader(br, crc)
+	size := 0
 
 	for {
 		var keyLen int32
-		err = binary.Read(s.file, binary.BigEndian, &keyLen)
+		err := binary.Read(r, binary.BigEndian, &keyLen)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				return result, nil
+				return result, size, nil
 			}
-			return nil, err
+			return nil, 0, err
 		}
+		size += 4
 
 		if keyLen <= 0 {
-			return result, nil
+			var sum uint32
+			if err := binary.Read(br, binary.BigEndian, &sum); err != nil {
+				return nil, 0, err
+			}
+			size += 4
+			if verify && sum != crc.Sum32() {
+				return nil, 0, fmt.Errorf("%w: блок по смещению %d: контрольная сумма не совпадает", ErrCorrupt, startOffset)
+			}
+			return result, size, nil
 		}
 
 		key := make([]byte, keyLen)
-		_, err = s.file.Read(key)
-		if err != nil {
-			return nil, err
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, 0, err
 		}
 
 		var valueLen int32
-		err = binary.Read(s.file, binary.BigEndian, &valueLen)
-		if err != nil {
-			return nil, err
+		if err := binary.Read(r, binary.BigEndian, &valueLen); err != nil {
+			return nil, 0, err
 		}
 
 		if valueLen < 0 {
-			return result, nil
+			return result, size, nil
 		}
 
 		value := make([]byte, valueLen)
-		_, err = s.file.Read(value)
-		if err != nil {
-			return nil, err
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, 0, err
 		}
+		size += int(keyLen) + 4 + int(valueLen)
 
+		if verify && len(result) > 0 && s.compare(result[len(result)-1].Key, key) >= 0 {
+			return nil, 0, fmt.Errorf("%w: блок по смещению %d: ключи не по возрастанию", ErrCorrupt, startOffset)
+		}
 		result = append(result, KeyValue{
 			Key:   key,
 			Value: value,
@@ -173,10 +298,10 @@ func (s *SSTable) readBlockFromOffset(startOffset int64) ([]KeyValue, error) {
 	}
 }
 
-func (s *SSTable) binarySearchInBlock(sp SparseIndex, key []byte) []byte {
-	blockData, err := s.readBlockFromOffset(sp.offset)
+func (s *SSTable) binarySearchInBlock(sp SparseIndex, key []byte) ([]byte, bool, error) {
+	blockData, _, err := s.readBlockFromOffset(sp.offset)
 	if err != nil {
-		return nil
+		return nil, false, err
 	}
 
 	left := 0
@@ -184,10 +309,10 @@ func (s *SSTable) binarySearchInBlock(sp SparseIndex, key []byte) []byte {
 
 	for left <= right {
 		mid := left + (right-left)/2
-		cmp := bytes.Compare(blockData[mid].Key, key)
+		cmp := s.compare(blockData[mid].Key, key)
 
 		if cmp == 0 {
-			return blockData[mid].Value
+			return blockData[mid].Value, true, nil
 		} else if cmp < 0 {
 			left = mid + 1
 		} else {
@@ -195,14 +320,130 @@ func (s *SSTable) binarySearchInBlock(sp SparseIndex, key []byte) []byte {
 		}
 	}
 
-	return nil
+	return nil, false, nil
+}
+
+// findBlock возвращает индекс первого блока, у которого endKey >= key.
+func (s *SSTable) findBlock(key []byte) int {
+	return sort.Search(len(s.sparseIndexs), func(i int) bool {
+		return s.compare(s.sparseIndexs[i].endKey, key) >= 0
+	})
+}
+
+// Get ищет ключ в таблице. ok == false означает, что ключа в таблице нет.
+func (s *SSTable) Get(key []byte) (value []byte, ok bool, err error) {
+	i := s.findBlock(key)
+	if i == len(s.sparseIndexs) || s.compare(s.sparseIndexs[i].startKey, key) > 0 {
+		return nil, false, nil
+	}
+	return s.binarySearchInBlock(s.sparseIndexs[i], key)
+}
+
+// MultiGet ищет несколько ключей, отсортированных по возрастанию: каждый блок
+// читается один раз, даже если в нём лежит несколько искомых ключей.
+// found[i] == false означает, что keys[i] в таблице нет.
+func (s *SSTable) MultiGet(keys [][]byte) (values [][]byte, found []bool, err error) {
+	values = make([][]byte, len(keys))
+	found = make([]bool, len(keys))
+	cached := -1
+	var block []KeyValue
+	for i, key := range keys {
+		b := s.findBlock(key)
+		if b == len(s.sparseIndexs) || s.compare(s.sparseIndexs[b].startKey, key) > 0 {
+			continue
+		}
+		if b != cached {
+			if block, _, err = s.readBlockFromOffset(s.sparseIndexs[b].offset); err != nil {
+				return nil, nil, err
+			}
+			cached = b
+		}
+		j := sort.Search(len(block), func(j int) bool { return s.compare(block[j].Key, key) >= 0 })
+		if j < len(block) && s.compare(block[j].Key, key) == 0 {
+			values[i], found[i] = block[j].Value, true
+		}
+	}
+	return values, found, nil
+}
+
+// ApproximateOffsetOf возвращает примерное смещение в файле, с которого начинаются
+// ключи >= key: начало блока, который мог бы содержать key, или конец данных.
+// Считается только по sparse index, без чтения диска.
+func (s *SSTable) ApproximateOffsetOf(key []byte) int64 {
+	i := s.findBlock(key)
+	if i == len(s.sparseIndexs) {
+		return s.dataSize()
+	}
+	return s.sparseIndexs[i].offset
+}
+
+// dataSize — суммарный размер блоков данных.
+func (s *SSTable) dataSize() int64 {
+	if len(s.sparseIndexs) == 0 {
+		return 0
+	}
+	last := s.sparseIndexs[len(s.sparseIndexs)-1]
+	return last.offset + int64(last.size)
 }
 
 func (s *SSTable) GetValue(key []byte) []byte {
-	for _, sp := range s.sparseIndexs {
-		if bytes.Compare(sp.startKey, key) <= 0 && bytes.Compare(key, sp.endKey) <= 0 {
-			return s.binarySearchInBlock(sp, key)
+	v, _, _ := s.Get(key)
+	return v
+}
+
+// Iterator — последовательное чтение таблицы по диапазону [start, end).
+// Блоки подгружаются по одному по мере продвижения.
+type Iterator struct {
+	s     *SSTable
+	start []byte
+	end   []byte
+	block []KeyValue
+	pos   int
+	next  int
+	done  bool
+}
+
+// Scan возвращает итератор по ключам таблицы в диапазоне [start, end).
+// Если start == nil, считается -∞. Если end == nil, считается +∞.
+func (s *SSTable) Scan(start, end []byte) *Iterator {
+	it := &Iterator{s: s, start: start, end: end}
+	if start != nil {
+		it.next = s.findBlock(start)
+	}
+	return it
+}
+
+func (it *Iterator) Next() (key, value []byte, ok bool, err error) {
+	for !it.done {
+		if it.pos < len(it.block) {
+			kv := it.block[it.pos]
+			it.pos++
+			if it.start != nil && it.s.compare(kv.Key, it.start) < 0 {
+				continue
+			}
+			if it.end != nil && it.s.compare(kv.Key, it.end) >= 0 {
+				it.done = true
+				break
+			}
+			return kv.Key, kv.Value, true, nil
+		}
+		if it.next >= len(it.s.sparseIndexs) {
+			it.done = true
+			break
 		}
+		block, _, err := it.s.readBlockFromOffset(it.s.sparseIndexs[it.next].offset)
+		if err != nil {
+			it.done = true
+			return nil, nil, false, err
+		}
+		it.block, it.pos = block, 0
+		it.next++
 	}
+	return nil, nil, false, nil
+}
+
+func (it *Iterator) Close() error {
+	it.done = true
+	it.block = nil
 	return nil
 }
@@ -0,0 +1,199 @@
+package sstable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"kvschool/internal/skiplist"
+)
+
+// DefaultBlockSize — размер блока данных по умолчанию.
+// Один блок = одна запись sparse index, поэтому размер блока задаёт баланс
+// между памятью под индекс и объёмом чтения на один Get.
+const DefaultBlockSize = 4096
+
+// ErrOutOfOrder возвращается, если ключи подаются в Writer не по возрастанию.
+var ErrOutOfOrder = errors.New("sstable: ключи должны добавляться строго по возрастанию")
+
+// ErrEmptyKey возвращается при попытке записать пустой ключ (он зарезервирован под маркер конца блока).
+var ErrEmptyKey = errors.New("sstable: пустой ключ")
+
+// PropertyCollector подсчитывает пользовательские свойства таблицы по мере записи.
+// Properties вызывается один раз в Finish; результат попадает в блок свойств.
+type PropertyCollector interface {
+	Add(key, value []byte)
+	Properties() map[string][]byte
+}
+
+// BlockCollector — PropertyCollector, которому Writer сообщает о конце каждого блока
+// данных: FinishBlock вызывается после записи блока, когда все его ключи уже переданы
+// в Add. Так свойства по блокам (например, фильтр на блок) совпадают с блоками таблицы
+// без повторения правил, по которым Writer их делит.
+type BlockCollector interface {
+	PropertyCollector
+	FinishBlock()
+}
+
+// Limiter ограничивает скорость записи: Wait блокируется, пока не разрешено записать n байт.
+type Limiter interface {
+	Wait(n int)
+}
+
+// Writer — потоковая запись SSTable: ключи подаются по возрастанию,
+// записи копятся в блок и сбрасываются на диск, когда блок набрал blockSize байт.
+type Writer struct {
+	f          File
+	bw         *bufio.Writer
+	blockSize  int
+	block      []byte
+	lastKey    []byte
+	count      int
+	size       int64
+	limiter    Limiter
+	collectors []PropertyCollector
+	compare    func(a, b []byte) int
+}
+
+func NewWriter(f File) *Writer {
+	return NewWriterSize(f, DefaultBlockSize)
+}
+
+// NewWriterSize создаёт Writer с заданным размером блока.
+func NewWriterSize(f File, blockSize int) *Writer {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &Writer{
+		f:         f,
+		bw:        bufio.NewWriter(f),
+		blockSize: blockSize,
+		compare:   bytes.Compare,
+	}
+}
+
+// SetCompare задаёт порядок ключей (по умолчанию bytes.Compare).
+func (w *Writer) SetCompare(compare func(a, b []byte) int) { w.compare = compare }
+
+// SetLimiter задаёт ограничитель скорости записи блоков (nil — без ограничения).
+func (w *Writer) SetLimiter(l Limiter) { w.limiter = l }
+
+// AddPropertyCollector подключает сборщик свойств таблицы.
+func (w *Writer) AddPropertyCollector(c PropertyCollector) {
+	w.collectors = append(w.collectors, c)
+}
+
+// Add добавляет запись. Ключи должны идти строго по возрастанию.
+func (w *Writer) Add(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if w.lastKey != nil && w.compare(key, w.lastKey) <= 0 {
+		return ErrOutOfOrder
+	}
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.block = appendEntry(w.block, key, value)
+	w.count++
+	for _, c := range w.collectors {
+		c.Add(key, value)
+	}
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *Writer) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.block = encodeBlock(w.block, nil)
+	if w.limiter != nil {
+		w.limiter.Wait(len(w.block))
+	}
+	n, err := w.bw.Write(w.block)
+	w.size += int64(n)
+	w.block = w.block[:0]
+	for _, c := range w.collectors {
+		if bc, ok := c.(BlockCollector); ok {
+			bc.FinishBlock()
+		}
+	}
+	return err
+}
+
+// writeProperties дописывает пустой блок — конец данных — и за ним блок свойств.
+// Читатели без поддержки свойств останавливаются на пустом блоке и свойств не видят.
+func (w *Writer) writeProperties() error {
+	props := map[string][]byte{
+		PropNumEntries: binary.BigEndian.AppendUint64(nil, uint64(w.count)),
+	}
+	for _, c := range w.collectors {
+		for name, v := range c.Properties() {
+			props[name] = v
+		}
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := encodeBlock(nil, nil)
+	block := make([]KeyValue, len(names))
+	for i, name := range names {
+		block[i] = KeyValue{Key: []byte(name), Value: props[name]}
+	}
+	buf = append(buf, encodeBlock(nil, block)...)
+	n, err := w.bw.Write(buf)
+	w.size += int64(n)
+	return err
+}
+
+// Count возвращает количество добавленных записей.
+func (w *Writer) Count() int { return w.count }
+
+// Size возвращает количество байт, записанных в файл (без учёта неполного блока).
+func (w *Writer) Size() int64 { return w.size }
+
+// EstimatedSize возвращает размер файла с учётом ещё не сброшенного блока.
+func (w *Writer) EstimatedSize() int64 { return w.size + int64(len(w.block)) }
+
+// Finish дописывает последний блок, блок свойств и делает fsync. Файл остаётся открытым.
+func (w *Writer) Finish() error {
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+	if err := w.writeProperties(); err != nil {
+		return err
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// WriteFromSkipList записывает всё содержимое SkipList в таблицу и завершает её.
+func (w *Writer) WriteFromSkipList(sl *skiplist.SkipList) error {
+	it, err := sl.Scan(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for {
+		key, value, ok, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := w.Add(key, value); err != nil {
+			return err
+		}
+	}
+	return w.Finish()
+}
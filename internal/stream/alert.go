@@ -0,0 +1,118 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+// estimatingSketch — скетч с взвешенным добавлением и оценкой частоты.
+type estimatingSketch interface {
+	counterSketch
+	Estimate(key []byte) (uint64, error)
+}
+
+// Alerts оборачивает скетч (CountMinSketch, TopK, WindowedSketch, Rotator) и вызывает
+// зарегистрированные обработчики, когда оценка частоты ключа достигает порога, — для
+// обнаружения фрода и злоупотреблений прямо на пути записи. Повторно для того же ключа
+// и порога обработчик вызывается не раньше чем через debounce.
+// Методы можно вызывать параллельно, если это допускает обернутый скетч.
+type Alerts struct {
+	s estimatingSketch
+
+	mu    sync.Mutex
+	rules []*alertRule
+
+	// now — источник времени; подменяется в тестах.
+	now func() time.Time
+}
+
+type alertRule struct {
+	threshold uint64
+	debounce  time.Duration
+	fn        func(key []byte, estimate uint64)
+	// fired — когда обработчик последний раз вызывался для ключа; expiry — те же
+	// срабатывания в порядке времени, начиная с expiry[head]: по ней истекшие отметки
+	// удаляются из fired за O(1) на срабатывание, без обхода карты.
+	fired  map[string]time.Time
+	expiry []firing
+	head   int
+}
+
+type firing struct {
+	key string
+	at  time.Time
+}
+
+// expire удаляет отметки, debounce которых к now истек. Вызывается под Alerts.mu.
+func (r *alertRule) expire(now time.Time) {
+	for r.head < len(r.expiry) && now.Sub(r.expiry[r.head].at) >= r.debounce {
+		f := r.expiry[r.head]
+		r.expiry[r.head] = firing{}
+		r.head++
+		// Ключ мог сработать снова, если время шло назад: тогда отметка новее.
+		if r.fired[f.key].Equal(f.at) {
+			delete(r.fired, f.key)
+		}
+	}
+	// Прочитанное начало очереди освобождается, когда занимает больше половины.
+	if r.head > len(r.expiry)/2 {
+		r.expiry = append(r.expiry[:0], r.expiry[r.head:]...)
+		r.head = 0
+	}
+}
+
+// NewAlerts создает Alerts над скетчем s.
+func NewAlerts(s estimatingSketch) *Alerts {
+	return &Alerts{s: s, now: time.Now}
+}
+
+// OnThreshold регистрирует fn, вызываемый из Add и AddN, когда оценка ключа
+// не меньше threshold. fn не должен вызывать методы Alerts.
+func (a *Alerts) OnThreshold(threshold uint64, debounce time.Duration, fn func(key []byte, estimate uint64)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = append(a.rules, &alertRule{threshold: threshold, debounce: debounce, fn: fn, fired: make(map[string]time.Time)})
+}
+
+// Add учитывает одно появление ключа.
+func (a *Alerts) Add(key []byte) error {
+	return a.AddN(key, 1)
+}
+
+// AddN увеличивает частоту ключа на n и вызывает обработчики достигнутых порогов.
+func (a *Alerts) AddN(key []byte, n uint64) error {
+	if err := a.s.AddN(key, n); err != nil {
+		return err
+	}
+	est, err := a.s.Estimate(key)
+	if err != nil {
+		return err
+	}
+	var fire []func([]byte, uint64)
+	a.mu.Lock()
+	now := a.now()
+	for _, r := range a.rules {
+		if est < r.threshold {
+			continue
+		}
+		// Истекшие отметки больше не нужны: без этого карта росла бы с каждым ключом.
+		r.expire(now)
+		if last, ok := r.fired[string(key)]; ok && now.Sub(last) < r.debounce {
+			continue
+		}
+		r.fired[string(key)] = now
+		r.expiry = append(r.expiry, firing{key: string(key), at: now})
+		fire = append(fire, r.fn)
+	}
+	a.mu.Unlock()
+	// Обработчики вызываются без блокировки: медленный не задерживает другие потоки.
+	for _, fn := range fire {
+		fn(key, est)
+	}
+	return nil
+}
+
+// Estimate возвращает оценку частоты ключа обернутым скетчем.
+func (a *Alerts) Estimate(key []byte) (uint64, error) {
+	return a.s.Estimate(key)
+}
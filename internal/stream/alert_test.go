@@ -0,0 +1,74 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAlerts(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := NewAlerts(NewCountMinSketch(256, 4, 0))
+	a.now = func() time.Time { return now }
+	var fired []string
+	a.OnThreshold(1000, time.Minute, func(key []byte, est uint64) {
+		fired = append(fired, fmt.Sprintf("%s:%d", key, est))
+	})
+	a.OnThreshold(5000, 0, func(key []byte, est uint64) {
+		fired = append(fired, fmt.Sprintf("fraud %s:%d", key, est))
+	})
+
+	add := func(key string, n uint64) {
+		t.Helper()
+		if err := a.AddN([]byte(key), n); err != nil {
+			t.Fatalf("AddN: %v", err)
+		}
+	}
+	add("imsi-1", 600)
+	add("imsi-2", 100)
+	add("imsi-1", 600) // 1200: порог 1000 пройден
+	add("imsi-1", 600) // в пределах debounce — тишина
+	now = now.Add(2 * time.Minute)
+	add("imsi-1", 600) // 2400: debounce истек
+	add("imsi-1", 3000)
+
+	want := []string{"imsi-1:1200", "imsi-1:2400", "fraud imsi-1:5400"}
+	if fmt.Sprint(fired) != fmt.Sprint(want) {
+		t.Fatalf("сработало: %v, ожидалось %v", fired, want)
+	}
+}
+
+func TestAlerts_Expiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := NewAlerts(NewCountMinSketch(1<<14, 4, 0))
+	a.now = func() time.Time { return now }
+	fired := 0
+	a.OnThreshold(1, time.Minute, func([]byte, uint64) { fired++ })
+	r := a.rules[0]
+
+	// Отметки удаляются по мере истечения debounce, а не обходом всей карты.
+	for i := 0; i < 5000; i++ {
+		if err := a.Add([]byte(fmt.Sprintf("imsi-%d", i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	if fired != 5000 || len(r.fired) != 5000 {
+		t.Fatalf("сработало %d, отметок %d", fired, len(r.fired))
+	}
+	// Истекли отметки первых 2,5 с (2501 ключ), imsi-0 срабатывает снова.
+	now = now.Add(time.Minute - 2500*time.Millisecond)
+	if err := a.Add([]byte("imsi-0")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if fired != 5001 || len(r.fired) != 2500 || len(r.expiry)-r.head != 2500 {
+		t.Fatalf("сработало %d, отметок %d, в очереди %d", fired, len(r.fired), len(r.expiry)-r.head)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := a.Add([]byte("imsi-1")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if len(r.fired) != 1 || len(r.expiry)-r.head != 1 {
+		t.Fatalf("отметок %d, в очереди %d", len(r.fired), len(r.expiry)-r.head)
+	}
+}
@@ -1,19 +1,51 @@
 package stream
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/fnv"
+	"sort"
+	"sync/atomic"
+
+	"kvschool/internal/murmur3"
 )
 
 // ErrNotImplemented используется в заготовке практики третьего дня.
 var ErrNotImplemented = errors.New("stream: функция не реализована")
 
+// ErrIncompatible возвращает Merge для скетчей разных размеров.
+var ErrIncompatible = errors.New("stream: скетчи разных размеров")
+
+// ErrBadEncoding возвращает UnmarshalBinary для данных, которые не являются скетчем.
+var ErrBadEncoding = errors.New("stream: некорректное представление скетча")
+
+// Сериализованный CountMinSketch: magic, версия формата (1 байт), width и depth
+// (по 4 байта, BE), затем width*depth счетчиков по 8 байт (LE).
+//
+// Версия задает и распределение ключей по строкам. В версии 1 столбец строки row —
+// (FNV-1a(key) + row) mod width: ключи, столкнувшиеся в одной строке, сталкиваются
+// во всех, и минимум по строкам шум не отсекает. С версии 2 столбцы получаются
+// double hashing по Murmur3. Скетч версии 1 по-прежнему читается и считает по своей
+// схеме; MarshalBinary сохраняет его в версии 1.
+const (
+	cmsMagic     = "CMSK"
+	cmsVersion   = 2
+	cmsVersionV1 = 1
+	cmsHeaderLen = len(cmsMagic) + 1 + 4 + 4
+)
+
 // CountMinSketch — структура для поиска Top-Talkers (частых элементов).
 // Использует фиксированный объем памяти (w * d счетчиков), чтобы считать трафик миллионов абонентов.
+// Add, AddN, Estimate, Merge и MarshalBinary можно вызывать параллельно: счетчики
+// меняются атомарно, без общей блокировки. Оценка, прочитанная во время записи,
+// учитывает ее в одних строках и нет в других, но не меньше частоты, учтенной до начала
+// Estimate. UnmarshalBinary параллельно с другими методами вызывать нельзя.
 type CountMinSketch struct {
-	table []uint64
-	width uint32
-	depth uint32
+	table   []uint64
+	width   uint32
+	depth   uint32
+	version byte // версия формата: от нее зависит распределение ключей по строкам
 }
 
 // NewCountMinSketch создает скетч.
@@ -23,26 +55,25 @@ func NewCountMinSketch(width, depth uint32, _ uint64) *CountMinSketch {
 	table := make([]uint64, uint64(width)*uint64(depth))
 
 	return &CountMinSketch{
-		table: table,
-		width: width,
-		depth: depth,
+		table:   table,
+		width:   width,
+		depth:   depth,
+		version: cmsVersion,
 	}
 }
 
 // Add увеличивает счетчик для ключа (например, +1 байт трафика).
 func (c *CountMinSketch) Add(key []byte) error {
-	for row := uint32(0); row < c.depth; row++ {
-
-		h := fnv.New64a()
-		h.Reset()
-		h.Write(key)
-
-		col := uint32((h.Sum64() + uint64(row)) % uint64(c.width))
-		idx := uint64(row)*uint64(c.width) + uint64(col)
+	return c.AddN(key, 1)
+}
 
-		c.table[idx]++
+// AddN увеличивает счетчик для ключа на n — например, на объем трафика одной CDR
+// вместо n вызовов Add.
+func (c *CountMinSketch) AddN(key []byte, n uint64) error {
+	h1, h2 := c.hashes(key)
+	for row := uint32(0); row < c.depth; row++ {
+		atomic.AddUint64(&c.table[c.index(row, h1, h2)], n)
 	}
-
 	return nil
 }
 
@@ -50,20 +81,135 @@ func (c *CountMinSketch) Add(key []byte) error {
 // Гарантия: Estimate >= TrueCount (никогда не занижает).
 func (c *CountMinSketch) Estimate(key []byte) (uint64, error) {
 	var min uint64
-
+	h1, h2 := c.hashes(key)
 	for row := uint32(0); row < c.depth; row++ {
-
-		h := fnv.New64a()
-		h.Reset()
-		h.Write(key)
-
-		col := uint32((h.Sum64() + uint64(row)) % uint64(c.width))
-		idx := uint64(row)*uint64(c.width) + uint64(col)
-
-		val := c.table[idx]
+		val := atomic.LoadUint64(&c.table[c.index(row, h1, h2)])
 		if row == 0 || val < min {
 			min = val
 		}
 	}
 	return min, nil
 }
+
+// EstimateUnbiased возвращает оценку частоты ключа с поправкой Count-Mean-Min
+// (Deng, Rafiei): из счетчика каждой строки вычитается ожидаемый шум — доля
+// чужих ключей, попавших в ту же ячейку, (N - c) / (w - 1), где N — сумма строки.
+// Результат — медиана по строкам, не больше Estimate. Для ключей средней частоты
+// точнее Estimate, но гарантии "не меньше истинной" нет.
+func (c *CountMinSketch) EstimateUnbiased(key []byte) (uint64, error) {
+	upper, err := c.Estimate(key)
+	if err != nil || c.width < 2 || c.depth == 0 {
+		return upper, err
+	}
+	rows := make([]float64, c.depth)
+	h1, h2 := c.hashes(key)
+	for row := uint32(0); row < c.depth; row++ {
+		var total uint64
+		for col := uint64(0); col < uint64(c.width); col++ {
+			total += atomic.LoadUint64(&c.table[uint64(row)*uint64(c.width)+col])
+		}
+		v := float64(atomic.LoadUint64(&c.table[c.index(row, h1, h2)]))
+		rows[row] = v - (float64(total)-v)/float64(c.width-1)
+	}
+	sort.Float64s(rows)
+	med := rows[len(rows)/2]
+	if len(rows)%2 == 0 {
+		med = (rows[len(rows)/2-1] + med) / 2
+	}
+	return uint64(min(max(med, 0), float64(upper)) + 0.5), nil
+}
+
+// Reset обнуляет все счетчики.
+func (c *CountMinSketch) Reset() {
+	for i := range c.table {
+		atomic.StoreUint64(&c.table[i], 0)
+	}
+}
+
+// Merge прибавляет к c счетчики other: так скетчи шардов или минутные скетчи
+// сводятся в общий или часовой. Размеры скетчей и версии их формата должны совпадать.
+func (c *CountMinSketch) Merge(other *CountMinSketch) error {
+	if c.width != other.width || c.depth != other.depth {
+		return fmt.Errorf("%w: %dx%d и %dx%d", ErrIncompatible, c.width, c.depth, other.width, other.depth)
+	}
+	if c.hashV1() != other.hashV1() {
+		return fmt.Errorf("%w: версии формата %d и %d", ErrIncompatible, c.formatVersion(), other.formatVersion())
+	}
+	for i := range other.table {
+		atomic.AddUint64(&c.table[i], atomic.LoadUint64(&other.table[i]))
+	}
+	return nil
+}
+
+// MarshalBinary сериализует скетч, чтобы сохранить его (например, в LSM) и
+// восстановить после перезапуска через UnmarshalBinary.
+func (c *CountMinSketch) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, cmsHeaderLen+8*len(c.table))
+	b = append(b, cmsMagic...)
+	b = append(b, c.formatVersion())
+	b = binary.BigEndian.AppendUint32(b, c.width)
+	b = binary.BigEndian.AppendUint32(b, c.depth)
+	for i := range c.table {
+		b = binary.LittleEndian.AppendUint64(b, atomic.LoadUint64(&c.table[i]))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary восстанавливает скетч, сериализованный MarshalBinary.
+func (c *CountMinSketch) UnmarshalBinary(data []byte) error {
+	if len(data) < cmsHeaderLen || string(data[:len(cmsMagic)]) != cmsMagic {
+		return ErrBadEncoding
+	}
+	data = data[len(cmsMagic):]
+	version := data[0]
+	if version != cmsVersion && version != cmsVersionV1 {
+		return fmt.Errorf("%w: неизвестная версия формата %d", ErrBadEncoding, version)
+	}
+	width := binary.BigEndian.Uint32(data[1:5])
+	depth := binary.BigEndian.Uint32(data[5:9])
+	data = data[9:]
+	// Размер сверяется делением: width*depth*8 может переполнить uint64.
+	n := uint64(len(data)) / 8
+	if width == 0 || depth == 0 || len(data)%8 != 0 || n%uint64(depth) != 0 || n/uint64(depth) != uint64(width) {
+		return fmt.Errorf("%w: %dx%d счетчиков в %d байтах", ErrBadEncoding, width, depth, len(data))
+	}
+	table := make([]uint64, len(data)/8)
+	for i := range table {
+		table[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	*c = CountMinSketch{table: table, width: width, depth: depth, version: version}
+	return nil
+}
+
+// formatVersion возвращает версию формата скетча; у скетча, созданного не через
+// NewCountMinSketch, — текущую.
+func (c *CountMinSketch) formatVersion() byte {
+	if c.hashV1() {
+		return cmsVersionV1
+	}
+	return cmsVersion
+}
+
+// hashV1 сообщает, что скетч прочитан из версии 1 и распределяет ключи по ее схеме.
+func (c *CountMinSketch) hashV1() bool { return c.version == cmsVersionV1 }
+
+// hashes возвращает два хеша ключа, из которых index получает столбцы всех строк.
+// h2 нечетный, чтобы при ширине-степени двойки шаг не вырождался. Схема версии 1 —
+// тот же расчет с FNV-1a и шагом 1.
+func (c *CountMinSketch) hashes(key []byte) (h1, h2 uint64) {
+	if c.hashV1() {
+		h := fnv.New64a()
+		h.Write(key)
+		return h.Sum64(), 1
+	}
+	h1, h2 = murmur3.Sum128(key, 0)
+	return h1, h2 | 1
+}
+
+// index возвращает номер счетчика ключа с хешами h1, h2 в строке row. Столбец —
+// h1 + row*h2 (double hashing): два ключа, столкнувшиеся в одной строке, в других
+// строках, как правило, расходятся, и минимум по строкам отсекает шум.
+func (c *CountMinSketch) index(row uint32, h1, h2 uint64) uint64 {
+	col := (h1 + uint64(row)*h2) % uint64(c.width)
+	return uint64(row)*uint64(c.width) + col
+}
@@ -0,0 +1,241 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestCountMinSketch_AddN(t *testing.T) {
+	one, weighted := NewCountMinSketch(64, 4, 1), NewCountMinSketch(64, 4, 1)
+	for _, cdr := range []struct {
+		imsi  string
+		bytes uint64
+	}{{"250990000000001", 1500}, {"250990000000002", 40}, {"250990000000001", 700}} {
+		if err := weighted.AddN([]byte(cdr.imsi), cdr.bytes); err != nil {
+			t.Fatalf("AddN: %v", err)
+		}
+		for i := uint64(0); i < cdr.bytes; i++ {
+			if err := one.Add([]byte(cdr.imsi)); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+		}
+	}
+	for imsi, want := range map[string]uint64{"250990000000001": 2200, "250990000000002": 40} {
+		got, err := weighted.Estimate([]byte(imsi))
+		if err != nil {
+			t.Fatalf("Estimate: %v", err)
+		}
+		if got < want {
+			t.Fatalf("Estimate(%s) = %d, меньше %d", imsi, got, want)
+		}
+		if byOne, _ := one.Estimate([]byte(imsi)); byOne != got {
+			t.Fatalf("Estimate(%s): AddN %d, Add по одному %d", imsi, got, byOne)
+		}
+	}
+}
+
+func TestCountMinSketch_Merge(t *testing.T) {
+	shard1, shard2, all := NewCountMinSketch(64, 4, 1), NewCountMinSketch(64, 4, 1), NewCountMinSketch(64, 4, 1)
+	for i, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		shard := shard1
+		if i%2 == 1 {
+			shard = shard2
+		}
+		_ = shard.AddN([]byte(key), uint64(i+1))
+		_ = all.AddN([]byte(key), uint64(i+1))
+	}
+	if err := shard1.Merge(shard2); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		got, _ := shard1.Estimate([]byte(key))
+		want, _ := all.Estimate([]byte(key))
+		if got != want {
+			t.Fatalf("Estimate(%q) после Merge = %d, ожидалось %d", key, got, want)
+		}
+	}
+	for _, other := range []*CountMinSketch{NewCountMinSketch(32, 4, 1), NewCountMinSketch(64, 5, 1)} {
+		if err := shard1.Merge(other); !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("Merge %dx%d = %v, ожидалась ErrIncompatible", other.width, other.depth, err)
+		}
+	}
+}
+
+func TestCountMinSketch_MarshalBinary(t *testing.T) {
+	c := NewCountMinSketch(64, 4, 1)
+	for i, key := range []string{"a", "b", "c"} {
+		_ = c.AddN([]byte(key), uint64(100*(i+1)))
+	}
+	b, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var r CountMinSketch
+	if err := r.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		got, _ := r.Estimate([]byte(key))
+		want, _ := c.Estimate([]byte(key))
+		if got != want {
+			t.Fatalf("Estimate(%q) после восстановления = %d, ожидалось %d", key, got, want)
+		}
+	}
+
+	bad := append([]byte(nil), b...)
+	bad[4] = 9
+	for name, data := range map[string][]byte{
+		"пусто":        nil,
+		"чужие данные": []byte("not a count-min sketch"),
+		"версия":       bad,
+		"обрезан":      b[:len(b)-1],
+	} {
+		if err := r.UnmarshalBinary(data); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%s: UnmarshalBinary = %v, ожидалась ErrBadEncoding", name, err)
+		}
+	}
+}
+
+func TestCountMinSketch_UnmarshalBinarySizeOverflow(t *testing.T) {
+	// width*depth*8 = 2^31*2^30*8 = 2^64 переполняется в 0 и совпадает с длиной пустой таблицы.
+	data := append([]byte(cmsMagic), cmsVersion)
+	data = binary.BigEndian.AppendUint32(data, 1<<31)
+	data = binary.BigEndian.AppendUint32(data, 1<<30)
+	var c CountMinSketch
+	if err := c.UnmarshalBinary(data); !errors.Is(err, ErrBadEncoding) {
+		t.Fatalf("UnmarshalBinary = %v, ожидалась ErrBadEncoding", err)
+	}
+}
+
+func TestCountMinSketch_IndependentRows(t *testing.T) {
+	// Пары ключей, столкнувшиеся в строке 0, не должны сталкиваться во всех строках:
+	// иначе строки — копии одной хеш-функции, и глубина не уточняет оценку.
+	const width, depth = 64, 4
+	c := NewCountMinSketch(width, depth, 1)
+	byCol := map[uint64][][2]uint64{}
+	pairs, everywhere := 0, 0
+	for i := 0; i < 2000; i++ {
+		h1, h2 := c.hashes([]byte(fmt.Sprintf("25001%010d", i)))
+		col := c.index(0, h1, h2)
+		for _, other := range byCol[col] {
+			pairs++
+			same := true
+			for row := uint32(1); row < depth; row++ {
+				if c.index(row, h1, h2) != c.index(row, other[0], other[1]) {
+					same = false
+				}
+			}
+			if same {
+				everywhere++
+			}
+		}
+		byCol[col] = append(byCol[col], [2]uint64{h1, h2})
+	}
+	// При double hashing такие ключи совпадают везде, только если совпал и нечетный
+	// шаг h2 по модулю width: доля около 2/width. Схема версии 1 дала бы все пары.
+	if everywhere*10 > pairs {
+		t.Fatalf("из %d пар, столкнувшихся в строке 0, во всех строках сталкиваются %d", pairs, everywhere)
+	}
+}
+
+func TestCountMinSketch_ReadV1(t *testing.T) {
+	// Скетч версии 1, собранный по ее схеме: столбец строки row — (FNV-1a(key) + row) mod width.
+	const width, depth = 16, 3
+	table := make([]uint64, width*depth)
+	counts := map[string]uint64{"a": 5, "b": 2, "250010000000001": 7}
+	for key, n := range counts {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		for row := uint64(0); row < depth; row++ {
+			table[row*width+(h.Sum64()+row)%width] += n
+		}
+	}
+	data := append([]byte(cmsMagic), cmsVersionV1)
+	data = binary.BigEndian.AppendUint32(data, width)
+	data = binary.BigEndian.AppendUint32(data, depth)
+	for _, v := range table {
+		data = binary.LittleEndian.AppendUint64(data, v)
+	}
+
+	var c CountMinSketch
+	if err := c.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary версии 1: %v", err)
+	}
+	for key, n := range counts {
+		if est, _ := c.Estimate([]byte(key)); est < n {
+			t.Fatalf("Estimate(%q) = %d, добавлено %d", key, est, n)
+		}
+	}
+	// Скетч продолжает считать по схеме версии 1 и в ней же сохраняется.
+	if err := c.AddN([]byte("a"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if est, _ := c.Estimate([]byte("a")); est < 8 {
+		t.Fatalf("Estimate(a) после AddN = %d", est)
+	}
+	out, _ := c.MarshalBinary()
+	if out[len(cmsMagic)] != cmsVersionV1 {
+		t.Fatalf("MarshalBinary записал версию %d", out[len(cmsMagic)])
+	}
+	// Счетчики версий 1 и 2 разложены по-разному и не складываются.
+	if err := c.Merge(NewCountMinSketch(width, depth, 1)); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Merge версий 1 и 2 = %v, ожидалась ErrIncompatible", err)
+	}
+}
+
+func TestCountMinSketch_Concurrent(t *testing.T) {
+	c := NewCountMinSketch(256, 4, 1)
+	const workers, adds = 8, 1000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < adds; i++ {
+				_ = c.AddN([]byte("hot"), 2)
+				_, _ = c.Estimate([]byte("hot"))
+			}
+		}()
+	}
+	wg.Wait()
+	// Ни одно увеличение не потеряно.
+	if est, _ := c.Estimate([]byte("hot")); est < 2*workers*adds {
+		t.Fatalf("Estimate: %d, ожидалось не меньше %d", est, 2*workers*adds)
+	}
+}
+
+func TestCountMinSketch_Reset(t *testing.T) {
+	c := NewCountMinSketch(64, 4, 1)
+	_ = c.AddN([]byte("a"), 10)
+	c.Reset()
+	if est, _ := c.Estimate([]byte("a")); est != 0 {
+		t.Fatalf("Estimate после Reset: %d", est)
+	}
+}
+
+func TestCountMinSketch_EstimateUnbiased(t *testing.T) {
+	// Узкий скетч под большим фоновым трафиком: Estimate сильно завышает среднюю частоту.
+	c := NewCountMinSketch(128, 5, 1)
+	for i := 0; i < 20000; i++ {
+		_ = c.AddN([]byte(fmt.Sprintf("bg-%d", i)), 5)
+	}
+	_ = c.AddN([]byte("mid"), 2000)
+
+	est, _ := c.Estimate([]byte("mid"))
+	unb, err := c.EstimateUnbiased([]byte("mid"))
+	if err != nil {
+		t.Fatalf("EstimateUnbiased: %v", err)
+	}
+	if unb > est {
+		t.Fatalf("EstimateUnbiased %d больше Estimate %d", unb, est)
+	}
+	errEst, errUnb := math.Abs(float64(est)-2000), math.Abs(float64(unb)-2000)
+	if errUnb >= errEst || errUnb > 400 {
+		t.Fatalf("ошибка EstimateUnbiased %v, Estimate %v", errUnb, errEst)
+	}
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+// Sink получает изменения, прочитанные Consumer.
+type Sink func(m lsm.Mutation) error
+
+// counterSketch — скетч с взвешенным добавлением: CountMinSketch, TopK, SpaceSaving,
+// WindowedSketch, Rotator.
+type counterSketch interface {
+	AddN(key []byte, n uint64) error
+}
+
+// CountInto возвращает Sink, который учитывает ключи Put и Merge в скетче s с весом
+// weight(m) (nil — вес 1, например weight может вернуть объем трафика из значения CDR).
+// Удаления не учитываются.
+func CountInto(s counterSketch, weight func(m lsm.Mutation) uint64) Sink {
+	return func(m lsm.Mutation) error {
+		if m.Kind == lsm.MutationDelete {
+			return nil
+		}
+		n := uint64(1)
+		if weight != nil {
+			n = weight(m)
+		}
+		return s.AddN(m.Key, n)
+	}
+}
+
+// DistinctInto возвращает Sink, который учитывает ключи Put и Merge в HyperLogLog.
+func DistinctInto(h *HyperLogLog) Sink {
+	return func(m lsm.Mutation) error {
+		if m.Kind == lsm.MutationDelete {
+			return nil
+		}
+		return h.Add(m.Key)
+	}
+}
+
+// Consumer следует за changefeed движка (Engine.GetUpdatesSince) и передает каждое
+// изменение во все Sink по порядку: скетчи аналитики обновляются вместе с хранилищем.
+// Sink вызываются из одного потока — из Poll или Run.
+type Consumer struct {
+	e     *lsm.Engine
+	seq   uint64
+	sinks []Sink
+
+	// Первая запись после seq, переданная не целиком из-за ошибки Sink: первые done вызовов Sink
+	// (по изменениям, для каждого — по всем Sink) уже сделаны и при повторе пропускаются.
+	done int
+}
+
+// NewConsumer создает Consumer, который начнет с записей после since
+// (0 — с начала WAL, e.LatestSequence() — только новые).
+func NewConsumer(e *lsm.Engine, since uint64, sinks ...Sink) *Consumer {
+	return &Consumer{e: e, seq: since, sinks: sinks}
+}
+
+// Sequence возвращает номер последней переданной записи: его стоит сохранять вместе
+// со скетчами, чтобы после перезапуска продолжить с NewConsumer(e, seq, ...).
+func (c *Consumer) Sequence() uint64 { return c.seq }
+
+// Poll передает в Sink все записи, зафиксированные после предыдущего Poll, и
+// возвращает их число. Если записи уже удалены из WAL, возвращается
+// lsm.ErrUpdatesUnavailable: скетчи придется строить заново со снимка.
+// При ошибке Sink следующий Poll продолжит с вызова, на котором она произошла:
+// изменения, уже принятые остальными Sink, им повторно не передаются.
+func (c *Consumer) Poll() (int, error) {
+	it, err := c.e.GetUpdatesSince(c.seq)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	n := 0
+	for {
+		u, ok, err := it.Next()
+		if err != nil || !ok {
+			return n, err
+		}
+		call := 0
+		for _, m := range u.Mutations {
+			for _, sink := range c.sinks {
+				call++
+				if call <= c.done {
+					continue
+				}
+				if err := sink(m); err != nil {
+					return n, err
+				}
+				c.done = call
+			}
+		}
+		c.seq, c.done = u.Seq, 0
+		n++
+	}
+}
+
+// Run вызывает Poll каждые interval, пока не отменен ctx или Poll не вернет ошибку.
+func (c *Consumer) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := c.Poll(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
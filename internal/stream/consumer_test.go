@@ -0,0 +1,137 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"kvschool/internal/lsm"
+)
+
+func TestConsumer(t *testing.T) {
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	cms := NewCountMinSketch(256, 4, 0)
+	top := NewTopK(2, 256, 4)
+	hll := NewHyperLogLog(10)
+	// Вес — объем трафика, записанный в значении.
+	bytes := func(m lsm.Mutation) uint64 {
+		var n uint64
+		fmt.Sscan(string(m.Value), &n)
+		return n
+	}
+	c := NewConsumer(e, 0, CountInto(cms, bytes), CountInto(top, bytes), DistinctInto(hll))
+
+	put := func(key string, n int) {
+		t.Helper()
+		if err := e.Put([]byte(key), []byte(fmt.Sprint(n))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	put("imsi-1", 100)
+	put("imsi-2", 10)
+	put("imsi-3", 50)
+	if n, err := c.Poll(); err != nil || n != 3 {
+		t.Fatalf("Poll: %d, %v", n, err)
+	}
+	// Второй Poll передает только новые записи.
+	put("imsi-1", 100)
+	if err := e.Delete([]byte("imsi-3")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if n, err := c.Poll(); err != nil || n != 2 {
+		t.Fatalf("Poll: %d, %v", n, err)
+	}
+	if c.Sequence() != e.LatestSequence() {
+		t.Fatalf("Sequence %d, движок %d", c.Sequence(), e.LatestSequence())
+	}
+
+	if est, _ := cms.Estimate([]byte("imsi-1")); est != 200 {
+		t.Fatalf("CMS imsi-1: %d", est)
+	}
+	if tk := top.Top(); len(tk) != 2 || tk[0].Key != "imsi-1" || tk[1].Key != "imsi-3" {
+		t.Fatalf("TopK: %+v", tk)
+	}
+	if n := hll.Count(); n != 3 {
+		t.Fatalf("HyperLogLog: %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx, time.Millisecond) }()
+	put("imsi-4", 1)
+	// Счетчики CMS атомарны: их можно читать, пока Run пишет.
+	for est, _ := cms.Estimate([]byte("imsi-4")); est == 0; est, _ = cms.Estimate([]byte("imsi-4")) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run: %v", err)
+	}
+	if n := hll.Count(); n != 4 {
+		t.Fatalf("HyperLogLog после Run: %d", n)
+	}
+}
+
+func TestConsumer_SinkRetry(t *testing.T) {
+	e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer e.Close()
+
+	// Второй Sink один раз отказывает на втором изменении пакета. Повторный Poll
+	// не передает первому Sink уже принятые изменения: счетчики не удваиваются.
+	var first, second []string
+	errSink := errors.New("sink недоступен")
+	failed := false
+	c := NewConsumer(e, 0,
+		func(m lsm.Mutation) error {
+			first = append(first, string(m.Key))
+			return nil
+		},
+		func(m lsm.Mutation) error {
+			if string(m.Key) == "imsi-2" && !failed {
+				failed = true
+				return errSink
+			}
+			second = append(second, string(m.Key))
+			return nil
+		})
+
+	err = e.WriteBatch(context.Background(), []lsm.Mutation{
+		{Kind: lsm.MutationPut, Key: []byte("imsi-1"), Value: []byte("1")},
+		{Kind: lsm.MutationPut, Key: []byte("imsi-2"), Value: []byte("1")},
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	if n, err := c.Poll(); !errors.Is(err, errSink) || n != 0 {
+		t.Fatalf("Poll: %d, %v", n, err)
+	}
+	if c.Sequence() != 0 {
+		t.Fatalf("Sequence после ошибки: %d", c.Sequence())
+	}
+	if err := e.Put([]byte("imsi-3"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n, err := c.Poll(); err != nil || n != 2 {
+		t.Fatalf("повторный Poll: %d, %v", n, err)
+	}
+	want := "[imsi-1 imsi-2 imsi-3]"
+	if got := fmt.Sprint(first); got != want {
+		t.Fatalf("первый Sink: %s, ожидалось %s", got, want)
+	}
+	if got := fmt.Sprint(second); got != want {
+		t.Fatalf("второй Sink: %s, ожидалось %s", got, want)
+	}
+	if c.Sequence() != e.LatestSequence() {
+		t.Fatalf("Sequence %d, движок %d", c.Sequence(), e.LatestSequence())
+	}
+}
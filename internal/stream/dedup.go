@@ -0,0 +1,67 @@
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"kvschool/internal/bloom"
+)
+
+// Deduplicator отмечает повторы идентификаторов (например, CDR ID, пришедших
+// дважды) в пределах окна времени на двух фильтрах Блума: текущем и предыдущем.
+// Каждые window текущий фильтр становится предыдущим, а прежний предыдущий
+// выбрасывается, так что ID помнится не меньше window и не больше 2*window.
+// Повтор не пропускается никогда; новый ID ошибочно признается повтором с долей
+// около falsePositiveRate. Методы можно вызывать параллельно.
+type Deduplicator struct {
+	window time.Duration
+	n      uint64
+	p      float64
+
+	mu         sync.Mutex
+	cur, prev  *bloom.Filter
+	currentEnd time.Time // нулевой до первого Seen
+
+	// now — источник времени; подменяется в тестах.
+	now func() time.Time
+}
+
+// NewDeduplicator создает Deduplicator на окно window, в которое приходит
+// примерно expectedPerWindow идентификаторов.
+func NewDeduplicator(window time.Duration, expectedPerWindow uint64, falsePositiveRate float64) *Deduplicator {
+	d := &Deduplicator{window: window, n: expectedPerWindow, p: falsePositiveRate, now: time.Now}
+	d.cur = bloom.NewOptimal(d.n, d.p)
+	d.prev = bloom.NewOptimal(d.n, d.p)
+	return d
+}
+
+// Seen запоминает id и сообщает, встречался ли он в пределах окна.
+func (d *Deduplicator) Seen(id []byte) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.advance()
+	for _, f := range []*bloom.Filter{d.cur, d.prev} {
+		ok, err := f.MayContain(id)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, d.cur.Add(id)
+}
+
+// advance сменяет фильтры, если окно текущего истекло. Вызывается под d.mu.
+func (d *Deduplicator) advance() {
+	now := d.now()
+	switch {
+	case d.currentEnd.IsZero():
+		d.currentEnd = now.Add(d.window)
+	case now.Before(d.currentEnd):
+	case now.Before(d.currentEnd.Add(d.window)):
+		d.prev, d.cur = d.cur, bloom.NewOptimal(d.n, d.p)
+		d.currentEnd = d.currentEnd.Add(d.window)
+	default:
+		// Простой дольше двух окон: помнить нечего.
+		d.prev, d.cur = bloom.NewOptimal(d.n, d.p), bloom.NewOptimal(d.n, d.p)
+		d.currentEnd = now.Add(d.window)
+	}
+}
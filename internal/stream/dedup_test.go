@@ -0,0 +1,49 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := NewDeduplicator(time.Minute, 10000, 0.001)
+	d.now = func() time.Time { return now }
+	seen := func(id string) bool {
+		t.Helper()
+		dup, err := d.Seen([]byte(id))
+		if err != nil {
+			t.Fatalf("Seen: %v", err)
+		}
+		return dup
+	}
+
+	if seen("cdr-1") {
+		t.Fatal("первый cdr-1 отмечен как повтор")
+	}
+	now = now.Add(30 * time.Second)
+	if !seen("cdr-1") {
+		t.Fatal("повтор cdr-1 через 30 секунд не замечен")
+	}
+	// Через окно после первого появления ID еще помнится.
+	now = now.Add(50 * time.Second)
+	if !seen("cdr-1") {
+		t.Fatal("повтор cdr-1 через 80 секунд не замечен")
+	}
+	// Через два окна — забыт.
+	now = now.Add(2 * time.Minute)
+	if seen("cdr-1") {
+		t.Fatal("cdr-1 помнится дольше двух окон")
+	}
+
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if seen(fmt.Sprintf("new-%d", i)) {
+			fp++
+		}
+	}
+	if fp > 50 {
+		t.Fatalf("новых ID, принятых за повторы: %d из 10000", fp)
+	}
+}
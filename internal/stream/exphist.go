@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"math"
+	"math/bits"
+)
+
+// ExpHistogram — гистограмма со степенями двойки в границах корзин: 0, 1, [2, 3],
+// [4, 7], ... — для распределений объема трафика. Грубее QuantileSketch (ошибка
+// квантиля — до двух раз), зато 65 счетчиков фиксированного размера и простое слияние.
+type ExpHistogram struct {
+	// counts[i] — значения с bits.Len64(v) == i, то есть из [2^(i-1), 2^i - 1].
+	counts [65]uint64
+	count  uint64
+	sum    float64
+}
+
+// Add учитывает значение v.
+func (h *ExpHistogram) Add(v uint64) {
+	h.AddN(v, 1)
+}
+
+// AddN учитывает значение v n раз.
+func (h *ExpHistogram) AddN(v, n uint64) {
+	h.counts[bits.Len64(v)] += n
+	h.count += n
+	h.sum += float64(v) * float64(n)
+}
+
+// Count возвращает число учтенных значений.
+func (h *ExpHistogram) Count() uint64 { return h.count }
+
+// Sum возвращает сумму учтенных значений.
+func (h *ExpHistogram) Sum() float64 { return h.sum }
+
+// Merge прибавляет к h значения other.
+func (h *ExpHistogram) Merge(other *ExpHistogram) {
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// Quantile возвращает верхнюю границу корзины, в которую попадает квантиль q
+// из [0, 1]: истинное значение квантиля не больше результата и больше его половины.
+// Для пустой гистограммы возвращается 0.
+func (h *ExpHistogram) Quantile(q float64) uint64 {
+	if h.count == 0 {
+		return 0
+	}
+	q = min(max(q, 0), 1)
+	rank := uint64(q * float64(h.count-1))
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen > rank {
+			return expBucketMax(i)
+		}
+	}
+	return math.MaxUint64
+}
+
+// Buckets вызывает fn для каждой непустой корзины [lo, hi] по возрастанию.
+func (h *ExpHistogram) Buckets(fn func(lo, hi, count uint64)) {
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		lo := uint64(0)
+		if i > 0 {
+			lo = 1 << (i - 1)
+		}
+		fn(lo, expBucketMax(i), n)
+	}
+}
+
+// expBucketMax возвращает наибольшее значение корзины i: 2^i - 1.
+func expBucketMax(i int) uint64 {
+	if i == 64 {
+		return math.MaxUint64
+	}
+	return 1<<i - 1
+}
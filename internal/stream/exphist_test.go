@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestExpHistogram(t *testing.T) {
+	var a, b ExpHistogram
+	var values []uint64
+	for i := uint64(0); i < 10000; i++ {
+		v := i * i % 100000
+		values = append(values, v)
+		h := &a
+		if i%2 == 1 {
+			h = &b
+		}
+		h.Add(v)
+	}
+	a.Merge(&b)
+	if a.Count() != 10000 {
+		t.Fatalf("Count: %d", a.Count())
+	}
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+	if a.Sum() != sum {
+		t.Fatalf("Sum: %v, ожидалось %v", a.Sum(), sum)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		want := values[int(q*float64(len(values)-1))]
+		got := a.Quantile(q)
+		if got < want || (want > 0 && got > 2*want) {
+			t.Errorf("Quantile(%v) = %d, истинное %d", q, got, want)
+		}
+	}
+
+	var c ExpHistogram
+	c.AddN(0, 2)
+	c.Add(1)
+	c.AddN(5, 3)
+	c.Add(math.MaxUint64)
+	var got []string
+	c.Buckets(func(lo, hi, n uint64) { got = append(got, fmt.Sprintf("[%d,%d]:%d", lo, hi, n)) })
+	if want := "[[0,0]:2 [1,1]:1 [4,7]:3 [9223372036854775808,18446744073709551615]:1]"; fmt.Sprint(got) != want {
+		t.Fatalf("Buckets: %v, ожидалось %v", got, want)
+	}
+}
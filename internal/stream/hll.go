@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog — оценка числа различных ключей (например, IMSI в соте за интервал)
+// в фиксированной памяти: 2^precision регистров по байту. Относительная ошибка —
+// около 1.04/sqrt(2^precision): 1.6% при precision 12 (4 КиБ).
+type HyperLogLog struct {
+	registers []uint8
+	p         uint8
+}
+
+// NewHyperLogLog создает оценщик с 2^precision регистрами; precision — от 4 до 18.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < 4 || precision > 18 {
+		panic(fmt.Sprintf("stream: точность HyperLogLog %d вне [4, 18]", precision))
+	}
+	return &HyperLogLog{registers: make([]uint8, 1<<precision), p: precision}
+}
+
+// Add учитывает ключ.
+func (h *HyperLogLog) Add(key []byte) error {
+	x := hllHash(key)
+	// Старшие p бит выбирают регистр, в нем — максимум позиции первой единицы в остальных.
+	idx := x >> (64 - h.p)
+	rho := uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1))) + 1
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+	return nil
+}
+
+// Count возвращает оценку числа различных добавленных ключей.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := hllAlpha(len(h.registers)) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Мало ключей: точнее линейный подсчет по пустым регистрам.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// Merge объединяет с h оценщик other (например, другого шарда): Count дает число
+// различных ключей в объединении. Точности должны совпадать.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.p != other.p {
+		return fmt.Errorf("%w: точность HyperLogLog %d и %d", ErrIncompatible, h.p, other.p)
+	}
+	for i, r := range other.registers {
+		h.registers[i] = max(h.registers[i], r)
+	}
+	return nil
+}
+
+func hllAlpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// hllHash — FNV-1a с финальным перемешиванием MurmurHash3: HyperLogLog нужны
+// равномерные старшие биты, а у FNV на похожих ключах их нет.
+func hllHash(key []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(key)
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 100, 10000, 200000} {
+		h := NewHyperLogLog(12)
+		for i := 0; i < n; i++ {
+			// Каждый ключ дважды: повторы не считаются.
+			for j := 0; j < 2; j++ {
+				if err := h.Add([]byte(fmt.Sprintf("25099%010d", i))); err != nil {
+					t.Fatalf("Add: %v", err)
+				}
+			}
+		}
+		if got := h.Count(); float64(got) < float64(n)*0.95 || float64(got) > float64(n)*1.05 {
+			t.Errorf("Count для %d ключей: %d", n, got)
+		}
+	}
+
+	a, b := NewHyperLogLog(12), NewHyperLogLog(12)
+	for i := 0; i < 20000; i++ {
+		_ = a.Add([]byte(fmt.Sprintf("imsi-%d", i)))
+		_ = b.Add([]byte(fmt.Sprintf("imsi-%d", i+10000)))
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if got := a.Count(); got < 28500 || got > 31500 {
+		t.Fatalf("Count после Merge: %d, ожидалось около 30000", got)
+	}
+	if err := a.Merge(NewHyperLogLog(10)); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Merge с другой точностью = %v, ожидалась ErrIncompatible", err)
+	}
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrNegativeValue возвращает QuantileSketch.Add для отрицательных и NaN значений.
+var ErrNegativeValue = errors.New("stream: значение меньше нуля")
+
+// QuantileSketch — DDSketch (Masson et al.): потоковые перцентили (p50, p99
+// длительности звонков, задержки) без хранения самих значений. Значения
+// раскладываются по логарифмическим корзинам, так что любой квантиль
+// оценивается с относительной ошибкой не больше alpha.
+type QuantileSketch struct {
+	alpha    float64
+	logGamma float64
+	buckets  map[int]uint64
+	zeros    uint64
+	count    uint64
+	sum      float64
+}
+
+// NewQuantileSketch создает скетч с относительной точностью alpha из (0, 1), например 0.01.
+func NewQuantileSketch(alpha float64) *QuantileSketch {
+	if !(alpha > 0 && alpha < 1) {
+		panic(fmt.Sprintf("stream: точность %v вне интервала (0, 1)", alpha))
+	}
+	return &QuantileSketch{
+		alpha:    alpha,
+		logGamma: math.Log((1 + alpha) / (1 - alpha)),
+		buckets:  make(map[int]uint64),
+	}
+}
+
+// Add учитывает значение v >= 0.
+func (s *QuantileSketch) Add(v float64) error {
+	switch {
+	case !(v >= 0):
+		return fmt.Errorf("%w: %v", ErrNegativeValue, v)
+	case v == 0:
+		s.zeros++
+	default:
+		// Корзина i покрывает (gamma^(i-1), gamma^i].
+		s.buckets[int(math.Ceil(math.Log(v)/s.logGamma))]++
+	}
+	s.count++
+	s.sum += v
+	return nil
+}
+
+// Count возвращает число учтенных значений.
+func (s *QuantileSketch) Count() uint64 { return s.count }
+
+// Sum возвращает сумму учтенных значений.
+func (s *QuantileSketch) Sum() float64 { return s.sum }
+
+// Quantile возвращает оценку квантиля q из [0, 1] (0.99 — p99).
+// Для пустого скетча возвращается 0.
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	q = min(max(q, 0), 1)
+	// Ранг искомого значения среди отсортированных, с нуля.
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zeros {
+		return 0
+	}
+	seen := s.zeros
+	idx := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	for _, i := range idx {
+		seen += s.buckets[i]
+		if seen > rank {
+			return s.bucketValue(i)
+		}
+	}
+	return s.bucketValue(idx[len(idx)-1])
+}
+
+// bucketValue возвращает значение, которым представлена корзина i: середина
+// (gamma^(i-1), gamma^i] в относительном смысле, ошибка не больше alpha.
+func (s *QuantileSketch) bucketValue(i int) float64 {
+	return 2 * math.Exp(float64(i)*s.logGamma) / (1 + math.Exp(s.logGamma))
+}
+
+// Merge добавляет к s значения other (другого шарда или интервала).
+// Точности скетчей должны совпадать.
+func (s *QuantileSketch) Merge(other *QuantileSketch) error {
+	if s.alpha != other.alpha {
+		return fmt.Errorf("%w: точность %v и %v", ErrIncompatible, s.alpha, other.alpha)
+	}
+	for i, n := range other.buckets {
+		s.buckets[i] += n
+	}
+	s.zeros += other.zeros
+	s.count += other.count
+	s.sum += other.sum
+	return nil
+}
@@ -0,0 +1,47 @@
+package stream
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestQuantileSketch(t *testing.T) {
+	const alpha = 0.01
+	s, other := NewQuantileSketch(alpha), NewQuantileSketch(alpha)
+	var values []float64
+	// Длительности звонков от 0 до ~1 часа с тяжелым хвостом; половина — в другом шарде.
+	for i := 0; i < 10000; i++ {
+		v := math.Floor(math.Pow(float64(i%1000)/1000, 3) * 3600)
+		values = append(values, v)
+		sk := s
+		if i%2 == 1 {
+			sk = other
+		}
+		if err := sk.Add(v); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if err := s.Merge(other); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if s.Count() != uint64(len(values)) {
+		t.Fatalf("Count: %d", s.Count())
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+		want := values[int(q*float64(len(values)-1))]
+		got := s.Quantile(q)
+		if math.Abs(got-want) > alpha*want {
+			t.Errorf("Quantile(%v) = %v, ожидалось %v ± %v%%", q, got, want, alpha*100)
+		}
+	}
+
+	if err := s.Add(-1); !errors.Is(err, ErrNegativeValue) {
+		t.Fatalf("Add(-1) = %v, ожидалась ErrNegativeValue", err)
+	}
+	if err := s.Merge(NewQuantileSketch(0.02)); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Merge с другой точностью = %v, ожидалась ErrIncompatible", err)
+	}
+}
@@ -0,0 +1,73 @@
+package stream
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"sync/atomic"
+)
+
+// Report возвращает снимок TopK для выгрузки: ключи по убыванию оценки, Error —
+// граница ошибки Count-Min sketch e/width·N (N — суммарная частота), которую
+// оценка превышает лишь с вероятностью e^-depth.
+func (t *TopK) Report() []Counter {
+	bound := t.cms.errorBound()
+	top := t.Top()
+	rows := make([]Counter, len(top))
+	for i, it := range top {
+		rows[i] = Counter{Key: it.Key, Count: it.Count, Error: min(bound, it.Count)}
+	}
+	return rows
+}
+
+// Report возвращает снимок SpaceSaving для выгрузки: ключи по убыванию оценки
+// с точной границей ошибки каждой.
+func (s *SpaceSaving) Report() []Counter {
+	return s.Top()
+}
+
+// errorBound возвращает e/width·N — границу ошибки оценок скетча.
+func (c *CountMinSketch) errorBound() uint64 {
+	var total uint64
+	for col := uint64(0); col < uint64(c.width); col++ {
+		// Каждая строка таблицы в сумме дает N; берется первая.
+		total += atomic.LoadUint64(&c.table[col])
+	}
+	return uint64(math.Ceil(math.E / float64(c.width) * float64(total)))
+}
+
+// reportRow — строка отчета в JSON.
+type reportRow struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// WriteReportJSON пишет отчет массивом объектов {"key", "count", "error"}.
+func WriteReportJSON(w io.Writer, rows []Counter) error {
+	out := make([]reportRow, len(rows))
+	for i, r := range rows {
+		out[i] = reportRow(r)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// WriteReportCSV пишет отчет в CSV с заголовком key,count,error.
+func WriteReportCSV(w io.Writer, rows []Counter) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "count", "error"}); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		rec := []string{r.Key, strconv.FormatUint(r.Count, 10), strconv.FormatUint(r.Error, 10)}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,48 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	top := NewTopK(2, 272, 4)
+	_ = top.AddN([]byte("imsi-1"), 900)
+	_ = top.AddN([]byte("imsi-2"), 90)
+	_ = top.AddN([]byte("imsi-3"), 10)
+	rows := top.Report()
+	// e/272·1000 ≈ 10.
+	want := []Counter{{"imsi-1", 900, 10}, {"imsi-2", 90, 10}}
+	if fmt.Sprint(rows) != fmt.Sprint(want) {
+		t.Fatalf("Report: %+v, ожидалось %+v", rows, want)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteReportCSV(&buf, rows); err != nil {
+		t.Fatalf("WriteReportCSV: %v", err)
+	}
+	if got := buf.String(); got != "key,count,error\nimsi-1,900,10\nimsi-2,90,10\n" {
+		t.Fatalf("CSV:\n%s", got)
+	}
+
+	buf.Reset()
+	if err := WriteReportJSON(&buf, rows); err != nil {
+		t.Fatalf("WriteReportJSON: %v", err)
+	}
+	var parsed []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		t.Fatalf("JSON: %v\n%s", err, buf.String())
+	}
+	if len(parsed) != 2 || parsed[0]["key"] != "imsi-1" || parsed[0]["count"] != 900.0 || parsed[0]["error"] != 10.0 {
+		t.Fatalf("JSON: %v", parsed)
+	}
+
+	ss := NewSpaceSaving(1)
+	_ = ss.AddN([]byte("a"), 5)
+	_ = ss.AddN([]byte("b"), 3)
+	if rows := ss.Report(); fmt.Sprint(rows) != fmt.Sprint([]Counter{{"b", 8, 5}}) {
+		t.Fatalf("SpaceSaving.Report: %+v", rows)
+	}
+}
@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rotator ведет CountMinSketch по интервалам времени (минута, час): по расписанию
+// текущий скетч заменяется новым, а отработавший вместе с границами интервала
+// передается в retire — например, чтобы сохранить отчет о трафике за интервал.
+// AddN и Estimate можно вызывать параллельно, в том числе с ротацией.
+type Rotator struct {
+	cur          atomic.Pointer[CountMinSketch]
+	width, depth uint32
+	retire       func(s *CountMinSketch, start, end time.Time)
+
+	// mu упорядочивает ротации; start — начало интервала текущего скетча.
+	mu    sync.Mutex
+	start time.Time
+
+	stop chan struct{}
+	done chan struct{}
+
+	// now — источник времени; подменяется в тестах.
+	now func() time.Time
+}
+
+// NewRotator создает Rotator со скетчами width x depth. Если interval > 0, скетч
+// сменяется каждые interval в фоне до Close; иначе — только вызовом Rotate.
+func NewRotator(interval time.Duration, width, depth uint32, retire func(s *CountMinSketch, start, end time.Time)) *Rotator {
+	r := &Rotator{
+		width:  width,
+		depth:  depth,
+		retire: retire,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		now:    time.Now,
+	}
+	r.cur.Store(NewCountMinSketch(width, depth, 0))
+	r.start = r.now()
+	if interval <= 0 {
+		close(r.done)
+		return r
+	}
+	go r.loop(interval)
+	return r
+}
+
+func (r *Rotator) loop(interval time.Duration) {
+	defer close(r.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.Rotate()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Add учитывает одно появление ключа в текущем скетче.
+func (r *Rotator) Add(key []byte) error {
+	return r.AddN(key, 1)
+}
+
+// AddN увеличивает частоту ключа в текущем скетче на n.
+func (r *Rotator) AddN(key []byte, n uint64) error {
+	return r.cur.Load().AddN(key, n)
+}
+
+// Estimate возвращает оценку частоты ключа за текущий интервал.
+func (r *Rotator) Estimate(key []byte) (uint64, error) {
+	return r.cur.Load().Estimate(key)
+}
+
+// Current возвращает скетч текущего интервала.
+func (r *Rotator) Current() *CountMinSketch {
+	return r.cur.Load()
+}
+
+// Rotate заменяет текущий скетч новым и передает отработавший в retire.
+// AddN, начатый до замены, может попасть в отработавший скетч уже после
+// вызова retire: граница интервала размыта на время одной записи.
+func (r *Rotator) Rotate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	end := r.now()
+	old := r.cur.Swap(NewCountMinSketch(r.width, r.depth, 0))
+	start := r.start
+	r.start = end
+	if r.retire != nil {
+		r.retire(old, start, end)
+	}
+}
+
+// Close останавливает ротацию по расписанию. Текущий скетч в retire не передается:
+// при необходимости вызовите Rotate перед Close.
+func (r *Rotator) Close() error {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.done
+	return nil
+}
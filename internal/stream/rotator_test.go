@@ -0,0 +1,58 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotator(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	type report struct {
+		a          uint64
+		start, end time.Time
+	}
+	var reports []report
+	r := NewRotator(0, 64, 4, func(s *CountMinSketch, start, end time.Time) {
+		a, _ := s.Estimate([]byte("a"))
+		reports = append(reports, report{a, start, end})
+	})
+	defer r.Close()
+	r.now = func() time.Time { return now }
+	r.start = now
+
+	for minute := 1; minute <= 3; minute++ {
+		if err := r.AddN([]byte("a"), uint64(minute)); err != nil {
+			t.Fatalf("AddN: %v", err)
+		}
+		now = now.Add(time.Minute)
+		r.Rotate()
+	}
+	if est, _ := r.Estimate([]byte("a")); est != 0 {
+		t.Fatalf("Estimate нового интервала: %d", est)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("отчетов: %d", len(reports))
+	}
+	for i, rep := range reports {
+		if rep.a != uint64(i+1) || rep.end.Sub(rep.start) != time.Minute {
+			t.Fatalf("отчет %d: %+v", i, rep)
+		}
+	}
+
+	// По расписанию скетч сменяется сам.
+	retired := make(chan struct{}, 1)
+	bg := NewRotator(time.Millisecond, 64, 4, func(*CountMinSketch, time.Time, time.Time) {
+		select {
+		case retired <- struct{}{}:
+		default:
+		}
+	})
+	select {
+	case <-retired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ротация по расписанию не произошла")
+	}
+	if err := bg.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package stream
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Counter — ключ, отслеживаемый SpaceSaving: Count — оценка частоты сверху,
+// Error — на сколько она может быть завышена. Истинная частота — в [Count-Error, Count].
+type Counter struct {
+	Key   string
+	Count uint64
+	Error uint64
+}
+
+// SpaceSaving — сводка частых элементов по алгоритму Space-Saving (Metwally et al.):
+// хранит не больше k счетчиков; новый ключ при заполненной сводке занимает счетчик
+// самого редкого, унаследовав его значение как погрешность. В отличие от TopK
+// погрешность каждой оценки известна, а кандидаты — всегда ровно отслеживаемые ключи:
+// ключ с частотой больше Total/k гарантированно среди них.
+type SpaceSaving struct {
+	k     int
+	total uint64
+	heap  counterHeap
+}
+
+// NewSpaceSaving создает сводку на k счетчиков.
+func NewSpaceSaving(k int) *SpaceSaving {
+	return &SpaceSaving{k: k, heap: counterHeap{index: make(map[string]int)}}
+}
+
+// Add учитывает одно появление ключа.
+func (s *SpaceSaving) Add(key []byte) error {
+	return s.AddN(key, 1)
+}
+
+// AddN увеличивает частоту ключа на n.
+func (s *SpaceSaving) AddN(key []byte, n uint64) error {
+	s.total += n
+	h := &s.heap
+	if i, ok := h.index[string(key)]; ok {
+		h.items[i].Count += n
+		heap.Fix(h, i)
+		return nil
+	}
+	if len(h.items) < s.k {
+		heap.Push(h, Counter{Key: string(key), Count: n})
+		return nil
+	}
+	if s.k == 0 {
+		return nil
+	}
+	min := h.items[0]
+	delete(h.index, min.Key)
+	h.items[0] = Counter{Key: string(key), Count: min.Count + n, Error: min.Count}
+	h.index[string(key)] = 0
+	heap.Fix(h, 0)
+	return nil
+}
+
+// Estimate возвращает счетчик ключа. Для неотслеживаемого ключа ok == false:
+// его частота не больше минимального счетчика сводки.
+func (s *SpaceSaving) Estimate(key []byte) (c Counter, ok bool) {
+	i, ok := s.heap.index[string(key)]
+	if !ok {
+		return Counter{}, false
+	}
+	return s.heap.items[i], true
+}
+
+// Total возвращает сумму всех учтенных частот.
+func (s *SpaceSaving) Total() uint64 { return s.total }
+
+// Top возвращает отслеживаемые ключи по убыванию оценки частоты.
+func (s *SpaceSaving) Top() []Counter {
+	items := append([]Counter(nil), s.heap.items...)
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
+
+// counterHeap — min-куча счетчиков по Count; index — позиция ключа в куче.
+type counterHeap struct {
+	items []Counter
+	index map[string]int
+}
+
+func (h *counterHeap) Len() int           { return len(h.items) }
+func (h *counterHeap) Less(i, j int) bool { return h.items[i].Count < h.items[j].Count }
+
+func (h *counterHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].Key] = i
+	h.index[h.items[j].Key] = j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(Counter)
+	h.index[c.Key] = len(h.items)
+	h.items = append(h.items, c)
+}
+
+func (h *counterHeap) Pop() any {
+	c := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, c.Key)
+	return c
+}
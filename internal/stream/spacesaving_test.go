@@ -0,0 +1,37 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := NewSpaceSaving(10)
+	truth := make(map[string]uint64)
+	add := func(key string, n uint64) {
+		if err := s.AddN([]byte(key), n); err != nil {
+			t.Fatalf("AddN: %v", err)
+		}
+		truth[key] += n
+	}
+	for i := 0; i < 1000; i++ {
+		add(fmt.Sprintf("small-%d", i), uint64(1+i%5))
+		add("imsi-1", 10)
+		add("imsi-2", 5)
+	}
+
+	top := s.Top()
+	if len(top) != 10 || top[0].Key != "imsi-1" || top[1].Key != "imsi-2" {
+		t.Fatalf("Top: %+v", top[:2])
+	}
+	// Ключи с частотой больше Total/k гарантированно отслеживаются.
+	for key, n := range truth {
+		c, ok := s.Estimate([]byte(key))
+		if n > s.Total()/10 && !ok {
+			t.Fatalf("%s с частотой %d из %d не отслеживается", key, n, s.Total())
+		}
+		if ok && (c.Count < n || c.Count-c.Error > n) {
+			t.Fatalf("%s: истинная частота %d вне [%d, %d]", key, n, c.Count-c.Error, c.Count)
+		}
+	}
+}
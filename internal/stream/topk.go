@@ -0,0 +1,108 @@
+package stream
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Item — ключ и оценка его частоты.
+type Item struct {
+	Key   string
+	Count uint64
+}
+
+// TopK отслеживает k самых частых ключей ("top talkers"): частоты оценивает
+// CountMinSketch, а кандидаты хранятся в min-куче по оценке, которая обновляется
+// при каждом Add. Перебирать ключи самому вызывающему не нужно.
+type TopK struct {
+	cms  *CountMinSketch
+	k    int
+	heap topKHeap
+}
+
+// NewTopK создает TopK на k ключей со скетчем width x depth.
+func NewTopK(k int, width, depth uint32) *TopK {
+	return &TopK{
+		cms:  NewCountMinSketch(width, depth, 0),
+		k:    k,
+		heap: topKHeap{index: make(map[string]int)},
+	}
+}
+
+// Add учитывает одно появление ключа.
+func (t *TopK) Add(key []byte) error {
+	return t.AddN(key, 1)
+}
+
+// AddN увеличивает частоту ключа на n.
+func (t *TopK) AddN(key []byte, n uint64) error {
+	if err := t.cms.AddN(key, n); err != nil {
+		return err
+	}
+	est, err := t.cms.Estimate(key)
+	if err != nil {
+		return err
+	}
+	h := &t.heap
+	if i, ok := h.index[string(key)]; ok {
+		h.items[i].Count = est
+		heap.Fix(h, i)
+		return nil
+	}
+	switch {
+	case len(h.items) < t.k:
+		heap.Push(h, Item{Key: string(key), Count: est})
+	case t.k > 0 && est > h.items[0].Count:
+		// Вытесняется самый редкий кандидат.
+		delete(h.index, h.items[0].Key)
+		h.items[0] = Item{Key: string(key), Count: est}
+		h.index[string(key)] = 0
+		heap.Fix(h, 0)
+	}
+	return nil
+}
+
+// Estimate возвращает оценку частоты ключа.
+func (t *TopK) Estimate(key []byte) (uint64, error) {
+	return t.cms.Estimate(key)
+}
+
+// Top возвращает текущие top-k ключей по убыванию оценки частоты.
+func (t *TopK) Top() []Item {
+	items := append([]Item(nil), t.heap.items...)
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
+
+// topKHeap — min-куча кандидатов по Count; index — позиция ключа в куче.
+type topKHeap struct {
+	items []Item
+	index map[string]int
+}
+
+func (h *topKHeap) Len() int           { return len(h.items) }
+func (h *topKHeap) Less(i, j int) bool { return h.items[i].Count < h.items[j].Count }
+
+func (h *topKHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].Key] = i
+	h.index[h.items[j].Key] = j
+}
+
+func (h *topKHeap) Push(x any) {
+	it := x.(Item)
+	h.index[it.Key] = len(h.items)
+	h.items = append(h.items, it)
+}
+
+func (h *topKHeap) Pop() any {
+	it := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, it.Key)
+	return it
+}
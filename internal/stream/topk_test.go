@@ -0,0 +1,31 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	tk := NewTopK(3, 1024, 4)
+	// Три "тяжелых" абонента на фоне тысячи мелких.
+	heavy := map[string]uint64{"imsi-1": 50000, "imsi-2": 30000, "imsi-3": 20000}
+	for i := 0; i < 1000; i++ {
+		if err := tk.AddN([]byte(fmt.Sprintf("small-%d", i)), uint64(i%50)); err != nil {
+			t.Fatalf("AddN: %v", err)
+		}
+		for key, total := range heavy {
+			if err := tk.AddN([]byte(key), total/1000); err != nil {
+				t.Fatalf("AddN: %v", err)
+			}
+		}
+	}
+	top := tk.Top()
+	if len(top) != 3 {
+		t.Fatalf("Top: %v", top)
+	}
+	for i, key := range []string{"imsi-1", "imsi-2", "imsi-3"} {
+		if top[i].Key != key || top[i].Count < heavy[key] {
+			t.Fatalf("Top[%d] = %+v, ожидался %s с оценкой не меньше %d", i, top[i], key, heavy[key])
+		}
+	}
+}
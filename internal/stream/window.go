@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"fmt"
+	"time"
+)
+
+// WindowedSketch — Count-Min sketch по скользящему окну ("top talkers за последние
+// 5 минут"): окно разбито на срезы, у каждого свой CountMinSketch. Запись идет
+// в текущий срез, а когда он истекает, самый старый срез очищается и становится
+// текущим. История окна сохраняется, обнулять весь скетч не нужно; окно сдвигается
+// шагами по window/slices.
+type WindowedSketch struct {
+	slices []*CountMinSketch
+	span   time.Duration
+	// head — текущий срез, headEnd — момент, когда он истекает (нулевой до первой записи).
+	head    int
+	headEnd time.Time
+
+	// now — источник времени; подменяется в тестах.
+	now func() time.Time
+}
+
+// NewWindowedSketch создает скетч по окну window из slices срезов width x depth.
+func NewWindowedSketch(window time.Duration, slices int, width, depth uint32) *WindowedSketch {
+	if slices <= 0 || window < time.Duration(slices) {
+		panic(fmt.Sprintf("stream: окно %v нельзя разбить на %d срезов", window, slices))
+	}
+	w := &WindowedSketch{
+		slices: make([]*CountMinSketch, slices),
+		span:   window / time.Duration(slices),
+		now:    time.Now,
+	}
+	for i := range w.slices {
+		w.slices[i] = NewCountMinSketch(width, depth, 0)
+	}
+	return w
+}
+
+// Add учитывает одно появление ключа.
+func (w *WindowedSketch) Add(key []byte) error {
+	return w.AddN(key, 1)
+}
+
+// AddN увеличивает частоту ключа на n.
+func (w *WindowedSketch) AddN(key []byte, n uint64) error {
+	w.advance()
+	return w.slices[w.head].AddN(key, n)
+}
+
+// Estimate возвращает примерную частоту ключа за окно.
+// Гарантия, как у CountMinSketch: оценка не меньше истинной частоты.
+func (w *WindowedSketch) Estimate(key []byte) (uint64, error) {
+	w.advance()
+	// Сумма по срезам в каждой строке, затем минимум: точнее суммы минимумов срезов.
+	first := w.slices[0]
+	var min uint64
+	h1, h2 := first.hashes(key)
+	for row := uint32(0); row < first.depth; row++ {
+		idx := first.index(row, h1, h2)
+		var sum uint64
+		for _, s := range w.slices {
+			sum += s.table[idx]
+		}
+		if row == 0 || sum < min {
+			min = sum
+		}
+	}
+	return min, nil
+}
+
+// advance переходит к срезу текущего момента, очищая истекшие срезы.
+func (w *WindowedSketch) advance() {
+	now := w.now()
+	if w.headEnd.IsZero() {
+		w.headEnd = now.Truncate(w.span).Add(w.span)
+		return
+	}
+	for i := 0; !now.Before(w.headEnd); i++ {
+		if i == len(w.slices) {
+			// Простой дольше окна: истекли все срезы.
+			w.headEnd = now.Truncate(w.span).Add(w.span)
+			return
+		}
+		w.head = (w.head + 1) % len(w.slices)
+		clear(w.slices[w.head].table)
+		w.headEnd = w.headEnd.Add(w.span)
+	}
+}
@@ -0,0 +1,42 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowedSketch(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	w := NewWindowedSketch(5*time.Minute, 5, 256, 4)
+	w.now = func() time.Time { return now }
+	estimate := func(key string) uint64 {
+		t.Helper()
+		n, err := w.Estimate([]byte(key))
+		if err != nil {
+			t.Fatalf("Estimate: %v", err)
+		}
+		return n
+	}
+
+	// По 100 байт в минуту пять минут подряд: все в окне.
+	for i := 0; i < 5; i++ {
+		if err := w.AddN([]byte("imsi"), 100); err != nil {
+			t.Fatalf("AddN: %v", err)
+		}
+		now = now.Add(time.Minute)
+	}
+	now = now.Add(-time.Second)
+	if n := estimate("imsi"); n != 500 {
+		t.Fatalf("за окно: %d, ожидалось 500", n)
+	}
+	// Через две минуты из окна выпали две первые.
+	now = now.Add(2 * time.Minute)
+	if n := estimate("imsi"); n != 300 {
+		t.Fatalf("через 2 минуты: %d, ожидалось 300", n)
+	}
+	// Через час окно пусто.
+	now = now.Add(time.Hour)
+	if n := estimate("imsi"); n != 0 {
+		t.Fatalf("через час: %d, ожидалось 0", n)
+	}
+}
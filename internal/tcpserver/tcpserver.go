@@ -0,0 +1,100 @@
+// Package tcpserver — общая часть сетевых фронтендов движка (resp, memcache):
+// прием соединений, учет слушателей и открытых соединений и остановка по Close.
+// Протокол фронтенд реализует в обработчике соединения.
+package tcpserver
+
+import (
+	"net"
+	"sync"
+)
+
+// Server принимает соединения и передает каждое обработчику в своей горутине.
+type Server struct {
+	handle    func(net.Conn)
+	closedErr error
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// New создает сервер с обработчиком соединений handle. После возврата из handle
+// соединение закрывается. closedErr возвращает Serve после Close — у каждого
+// фронтенда своя ошибка.
+func New(handle func(net.Conn), closedErr error) *Server {
+	return &Server{
+		handle:    handle,
+		closedErr: closedErr,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve принимает соединения на l и обслуживает каждое в своей горутине, пока
+// не будет вызван Close (тогда возвращает closedErr) или Accept не вернет ошибку.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return s.closedErr
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return s.closedErr
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = c.Close()
+			return s.closedErr
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+	}()
+	s.handle(c)
+}
+
+// Close закрывает слушателей и соединения и дожидается завершения обработчиков.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
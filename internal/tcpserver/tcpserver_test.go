@@ -0,0 +1,57 @@
+package tcpserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+var errClosed = errors.New("test: сервер закрыт")
+
+func TestServer(t *testing.T) {
+	// Обработчик отвечает эхом до конца соединения.
+	s := New(func(c net.Conn) { _, _ = io.Copy(c, c) }, errClosed)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if _, err := c.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("ответ %q, %v", line, err)
+	}
+
+	// Close закрывает и слушателя, и открытое соединение, дожидаясь обработчика.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := <-done; !errors.Is(err, errClosed) {
+		t.Fatalf("Serve после Close: %v", err)
+	}
+	if _, err := br.ReadString('\n'); err == nil {
+		t.Fatal("соединение открыто после Close")
+	}
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(l2); !errors.Is(err, errClosed) {
+		t.Fatalf("Serve закрытого сервера: %v", err)
+	}
+	if _, err := net.Dial("tcp", l2.Addr().String()); err == nil {
+		t.Fatal("слушатель открыт после Serve закрытого сервера")
+	}
+}
@@ -0,0 +1,220 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInjected — ошибка, которую возвращают правила FailNth и FailAlways.
+var ErrInjected = errors.New("vfs: внедрённая ошибка")
+
+// Op — вид операции, которую может сорвать FaultFS.
+type Op int
+
+// Операции FaultFS: первые относятся к FS, начиная с OpRead — к File.
+const (
+	OpCreate Op = iota
+	OpOpen
+	OpOpenWrite
+	OpRemove
+	OpRename
+	OpTruncate
+	OpMkdirAll
+	OpList
+	OpLink
+	OpRead
+	OpWrite
+	OpSync
+	OpClose
+)
+
+var opNames = [...]string{"create", "open", "openwrite", "remove", "rename", "truncate", "mkdir", "list", "link", "read", "write", "sync", "close"}
+
+func (op Op) String() string {
+	if op >= 0 && int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return "unknown"
+}
+
+// Injector решает, сорвать ли операцию op над файлом name: ненулевая ошибка
+// возвращается вместо результата. Вызывается из любых горутин.
+type Injector func(op Op, name string) error
+
+// FailNth срывает n-ю (с единицы) операцию op над файлом, имя которого содержит substr.
+// Остальные операции проходят.
+func FailNth(op Op, substr string, n int) Injector {
+	var count atomic.Int64
+	return func(o Op, name string) error {
+		if o != op || !strings.Contains(name, substr) {
+			return nil
+		}
+		if count.Add(1) == int64(n) {
+			return ErrInjected
+		}
+		return nil
+	}
+}
+
+// FailAlways срывает все операции op над файлами, имя которых содержит substr.
+func FailAlways(op Op, substr string) Injector {
+	return func(o Op, name string) error {
+		if o == op && strings.Contains(name, substr) {
+			return ErrInjected
+		}
+		return nil
+	}
+}
+
+// FaultFS пропускает операции в нижележащую FS, но перед каждой спрашивает Injector.
+// Сорванная запись успевает записать половину буфера — как при сбое посреди write,
+// поэтому на диске остаётся оборванная запись.
+type FaultFS struct {
+	fs       FS
+	mu       sync.Mutex
+	injector Injector
+}
+
+// NewFaultFS оборачивает fs. Без Injector FaultFS ведёт себя как fs.
+func NewFaultFS(fs FS) *FaultFS { return &FaultFS{fs: fs} }
+
+// SetInjector задаёт правило срыва операций (nil — ничего не срывать).
+func (f *FaultFS) SetInjector(inj Injector) {
+	f.mu.Lock()
+	f.injector = inj
+	f.mu.Unlock()
+}
+
+func (f *FaultFS) inject(op Op, name string) error {
+	f.mu.Lock()
+	inj := f.injector
+	f.mu.Unlock()
+	if inj == nil {
+		return nil
+	}
+	if err := inj(op, name); err != nil {
+		return &os.PathError{Op: op.String(), Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	if err := f.inject(OpCreate, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	if err := f.inject(OpOpen, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) OpenWrite(name string) (File, error) {
+	if err := f.inject(OpOpenWrite, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenWrite(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.inject(OpRemove, name); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) Rename(oldname, newname string) error {
+	if err := f.inject(OpRename, newname); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldname, newname)
+}
+
+func (f *FaultFS) Link(oldname, newname string) error {
+	if err := f.inject(OpLink, newname); err != nil {
+		return err
+	}
+	return f.fs.Link(oldname, newname)
+}
+
+func (f *FaultFS) Truncate(name string, size int64) error {
+	if err := f.inject(OpTruncate, name); err != nil {
+		return err
+	}
+	return f.fs.Truncate(name, size)
+}
+
+func (f *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if err := f.inject(OpMkdirAll, dir); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(dir, perm)
+}
+
+func (f *FaultFS) List(dir string) ([]string, error) {
+	if err := f.inject(OpList, dir); err != nil {
+		return nil, err
+	}
+	return f.fs.List(dir)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.inject(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.inject(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.inject(OpWrite, f.name); err != nil {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.inject(OpSync, f.name); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Close() error {
+	if err := f.fs.inject(OpClose, f.name); err != nil {
+		_ = f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
@@ -0,0 +1,68 @@
+// Package vfs отделяет движок хранения от файловой системы: в тестах вместо
+// настоящей ФС подставляется FaultFS, которая возвращает ошибки по заданным правилам.
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// File — открытый файл. *os.File реализует его полностью.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// FS — операции с файлами, которые нужны движку.
+type FS interface {
+	// Create создаёт файл для записи (существующий обрезается).
+	Create(name string) (File, error)
+	// Open открывает файл только для чтения.
+	Open(name string) (File, error)
+	// OpenWrite открывает существующий файл для записи с начала, не обрезая его.
+	OpenWrite(name string) (File, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	// Link создаёт жёсткую ссылку newname на oldname. Если ссылку создать нельзя
+	// (например, файлы на разных ФС), возвращается ошибка, и вызывающий копирует файл.
+	Link(oldname, newname string) error
+	// Truncate обрезает файл до size байт (более короткий файл дополняется нулями).
+	Truncate(name string, size int64) error
+	MkdirAll(dir string, perm os.FileMode) error
+	// List возвращает имена файлов директории (без пути).
+	List(dir string) ([]string, error)
+}
+
+// Default — обычная файловая система ОС.
+var Default FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (File, error) { return os.Create(name) }
+func (osFS) Open(name string) (File, error)   { return os.Open(name) }
+func (osFS) OpenWrite(name string) (File, error) {
+	return os.OpenFile(name, os.O_WRONLY, 0)
+}
+func (osFS) Remove(name string) error { return os.Remove(name) }
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+func (osFS) Link(oldname, newname string) error          { return os.Link(oldname, newname) }
+func (osFS) Truncate(name string, size int64) error      { return os.Truncate(name, size) }
+func (osFS) MkdirAll(dir string, perm os.FileMode) error { return os.MkdirAll(dir, perm) }
+
+func (osFS) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
@@ -0,0 +1,101 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// TailReader читает сегмент, который ещё дописывается: дойдя до конца записанного,
+// Next не возвращает «конец лога», а ждёт новых записей, перечитывая файл раз в interval.
+// Нужен репликации и подписчикам changefeed, следящим за логом в реальном времени.
+type TailReader struct {
+	f        io.ReaderAt
+	off      int64
+	interval time.Duration
+	r        *Reader
+
+	hdr      bool // заголовок прочитан, seed и recycled известны
+	seed     uint32
+	recycled bool
+}
+
+// NewTailReader создаёт TailReader, читающий f с off — смещения записи
+// (HeaderSize для начала сегмента или LSN, возвращённый Writer.Append).
+// Заголовок сегмента Next читает сам, дожидаясь его записи.
+func NewTailReader(f io.ReaderAt, off int64, interval time.Duration) *TailReader {
+	return &TailReader{f: f, off: off, interval: interval}
+}
+
+// Offset возвращает смещение следующей записи.
+func (t *TailReader) Offset() int64 { return t.off }
+
+// Next возвращает следующую запись, при необходимости дожидаясь её появления.
+// Запись, дописанная не до конца, перечитывается целиком. Ошибка контекста возвращается
+// как есть; повреждение — как *CorruptError.
+func (t *TailReader) Next(ctx context.Context) (Record, error) {
+	for {
+		rec, ok, err := t.TryNext()
+		if err != nil || ok {
+			return rec, err
+		}
+		timer := time.NewTimer(t.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Record{}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// TryNext — Next без ожидания: ok == false, если следующая запись ещё не записана
+// целиком. Подходит читателю, который сам знает, когда в сегменте появились записи.
+func (t *TailReader) TryNext() (rec Record, ok bool, err error) {
+	if !t.hdr {
+		err := t.readHeader()
+		if err != nil && err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return Record{}, false, err
+		}
+		if !t.hdr {
+			return Record{}, false, nil
+		}
+	}
+	// Reader, уже дошедший до конца записанного, может вернуть запомненный io.EOF
+	// и не увидеть дописанного после: тогда чтение повторяется новым Reader.
+	for fresh := t.r == nil; ; fresh = true {
+		if t.r == nil {
+			t.r = NewReader(io.NewSectionReader(t.f, t.off, math.MaxInt64-t.off))
+			t.r.off, t.r.seed, t.r.recycled = t.off, t.seed, t.recycled
+		}
+		rec, ok, err = t.r.Next()
+		if ok {
+			t.off = t.r.Offset()
+			return rec, true, nil
+		}
+		// Конец записанного или запись ещё дописывается: в следующий раз читаем с её начала.
+		t.r = nil
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return Record{}, false, err
+		}
+		if fresh {
+			return Record{}, false, nil
+		}
+	}
+}
+
+// readHeader читает заголовок сегмента; io.EOF и оборванный заголовок означают,
+// что он ещё не записан.
+func (t *TailReader) readHeader() error {
+	r := NewReader(io.NewSectionReader(t.f, 0, math.MaxInt64))
+	if _, err := r.ReadHeader(); err != nil {
+		return err
+	}
+	t.hdr, t.seed, t.recycled = true, r.seed, r.recycled
+	if t.off < HeaderSize {
+		t.off = HeaderSize
+	}
+	return nil
+}
@@ -2,73 +2,623 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"time"
+
+	"github.com/golang/snappy"
 )
 
 // ErrNotImplemented используется в заготовке практики Дня 2.
 var ErrNotImplemented = errors.New("wal: функция не реализована")
 
-// OpType — тип операции в WAL (Put или Delete).
+// ErrChecksum возвращается Reader.Next для записи, байты которой не совпали с её CRC32C:
+// запись повреждена или дописана не до конца.
+var ErrChecksum = errors.New("wal: неверная контрольная сумма записи")
+
+// ErrCorrupt — общий признак повреждения лога: errors.Is(err, ErrCorrupt) верно для
+// любой *CorruptError.
+var ErrCorrupt = errors.New("wal: лог повреждён")
+
+// CorruptError описывает повреждение лога: где оно и в чём состоит.
+// Err — конкретная причина (ErrChecksum, io.ErrUnexpectedEOF, ErrBadHeader),
+// по ней политика восстановления отличает оборванный хвост от порчи данных.
+type CorruptError struct {
+	Offset int64 // смещение начала повреждённой записи (или заголовка)
+	Reason string
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("wal: повреждение по смещению %d: %s", e.Offset, e.Reason)
+}
+
+func (e *CorruptError) Unwrap() error { return e.Err }
+
+func (e *CorruptError) Is(target error) bool { return target == ErrCorrupt }
+
+// ErrNotBoundary возвращается Reader.SeekTo, если по смещению не начинается запись.
+var ErrNotBoundary = errors.New("wal: смещение не на границе записи")
+
+// ErrSeekUnsupported возвращается Reader.SeekTo поверх io.Reader без метода Seek.
+var ErrSeekUnsupported = errors.New("wal: источник не поддерживает Seek")
+
+// ErrSyncUnsupported возвращается при запросе fsync у Writer поверх io.Writer без метода Sync.
+var ErrSyncUnsupported = errors.New("wal: fsync не поддерживается")
+
+// ErrUnknownOp — тип записи, которого Reader не знает (например, записанной более новой
+// версией): её размер неизвестен, и дальше лог не читается. Reader возвращает его
+// внутри *CorruptError, Writer — при попытке записать такую запись.
+var ErrUnknownOp = errors.New("wal: неизвестный тип записи")
+
+// ErrClosed возвращается методами Writer после Close.
+var ErrClosed = errors.New("wal: Writer закрыт")
+
+// ErrBadHeader возвращается Reader.ReadHeader, если сегмент начинается не с заголовка
+// WAL или записан в неподдерживаемой версии формата.
+var ErrBadHeader = errors.New("wal: некорректный заголовок сегмента")
+
+var errNestedBatch = errors.New("wal: вложенный пакет")
+
+var errHeaderNotFirst = errors.New("wal: заголовок пишется только в начало сегмента")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errBadSequence = errors.New("wal: некорректная запись OpSequence")
+
+var errBadCheckpoint = errors.New("wal: некорректная запись OpCheckpoint")
+
+var errBadLength = errors.New("wal: некорректная длина поля")
+
+// Сегмент WAL начинается с заголовка HeaderSize байт: магическое число, версия формата
+// и флаги (по 2 байта little-endian), время создания (8 байт little-endian, наносекунды Unix)
+// и CRC32C этих 16 байт. За ним идут записи.
+const (
+	HeaderSize = 20
+
+	// FormatVersion — версия формата записей, которую пишет Writer.
+	// Версия 2 добавила сжатые значения (флаг opCompressed), версия 3 — повторно
+	// используемые сегменты (headerRecycled), версия 4 — длины полей в uvarint (флаг
+	// opVarint), версия 5 — сжатие Snappy вместо DEFLATE (флаг opSnappy); сегменты
+	// прежних версий читаются.
+	FormatVersion = 5
+
+	minFormatVersion = 1
+)
+
+// headerRecycled — флаг заголовка: сегмент записан поверх старого файла, и за концом
+// лога могут лежать записи прежнего сегмента. Контрольные суммы записей такого сегмента
+// начинаются с CRC его заголовка, поэтому старые записи не сходятся и читаются как конец лога.
+const headerRecycled = 1
+
+var headerMagic = [4]byte{'K', 'V', 'W', 'L'}
+
+// Header — заголовок сегмента WAL.
+type Header struct {
+	Version uint32
+	Created time.Time
+	// Recycled — сегмент записан поверх старого файла (см. Writer.WriteRecycledHeader).
+	Recycled bool
+}
+
+// OpType — тип записи WAL. Состав записи каждого типа задаёт opShapes.
 type OpType byte
 
 const (
 	OpPut    OpType = 1
 	OpDelete OpType = 2
+	// OpPutTTL — Put со сроком жизни: значение перестаёт быть видимым после ExpiresAt.
+	OpPutTTL OpType = 3
+	// OpMerge — операнд Merge; Value — сам операнд.
+	OpMerge OpType = 4
+	// OpBatch — атомарный пакет записей; Value — результат EncodeBatch.
+	OpBatch OpType = 5
+	// OpSequence — служебная запись в начале сегмента: Value — номер (8 байт big-endian),
+	// который получит следующая за ней запись. Остальные записи нумеруются подряд.
+	OpSequence OpType = 6
+	// OpCheckpoint — служебная запись после Flush: Value — номер (8 байт big-endian),
+	// до которого включительно все записи уже сохранены в SSTable. Номера не занимает.
+	OpCheckpoint OpType = 7
+	// OpPutRef — Put, значение которого хранится вне WAL: Value — ссылка на него
+	// в формате, который определяет вызывающий (у lsm — место в value log).
+	OpPutRef OpType = 8
+	// OpRangeDelete — удаление ключей из [Key, Value). Формат записи зарезервирован;
+	// движок её пока не пишет.
+	OpRangeDelete OpType = 9
+
+	// maxOpType — наибольший возможный тип: старшие биты байта типа заняты флагами.
+	maxOpType = 0x0f
 )
 
+// opShape — из чего состоит запись данного типа после ключа.
+type opShape uint8
+
+const (
+	shapeKnown   opShape = 1 << iota // тип известен
+	shapeExpires                     // 8 байт ExpiresAt
+	shapeValue                       // значение с длиной
+)
+
+// opShapes — состав записей известных типов. Новый тип записи добавляется сюда:
+// остальные типы Reader считает неизвестными.
+var opShapes = [maxOpType + 1]opShape{
+	OpPut:         shapeKnown | shapeValue,
+	OpDelete:      shapeKnown,
+	OpPutTTL:      shapeKnown | shapeExpires | shapeValue,
+	OpMerge:       shapeKnown | shapeValue,
+	OpBatch:       shapeKnown | shapeValue,
+	OpSequence:    shapeKnown | shapeValue,
+	OpCheckpoint:  shapeKnown | shapeValue,
+	OpPutRef:      shapeKnown | shapeValue,
+	OpRangeDelete: shapeKnown | shapeValue,
+}
+
+func (t OpType) shape() opShape {
+	if t > maxOpType {
+		return 0
+	}
+	return opShapes[t]
+}
+
+// Known сообщает, знает ли пакет тип записи t.
+func (t OpType) Known() bool { return t.shape()&shapeKnown != 0 }
+
+// opColumnFamily — флаг в байте типа: за ним следуют 4 байта id пространства ключей.
+// Записи пространства по умолчанию (id 0) пишутся без флага, как и раньше.
+const opColumnFamily = 0x80
+
+// opCompressed — флаг в байте типа: значение записи сжато DEFLATE. Так писали
+// сегменты версий 2–4; Writer его больше не ставит, Reader читает.
+const opCompressed = 0x40
+
+// opSnappy — флаг в байте типа: значение записи — блок Snappy.
+const opSnappy = 0x10
+
+// opVarint — флаг в байте типа: длины ключа и значения записаны uvarint, а не 4 байтами
+// little-endian. Writer ставит его всегда: короткий ключ IMSI так занимает байт длины
+// вместо четырёх. Флаг стоит у каждой записи, поэтому и пакеты из старых сегментов
+// разбираются без знания версии.
+const opVarint = 0x20
+
+// opFlags — все флаги байта типа.
+const opFlags = opColumnFamily | opCompressed | opVarint | opSnappy
+
+// hasValue сообщает, несёт ли запись данного типа значение.
+func (t OpType) hasValue() bool { return t.shape()&shapeValue != 0 }
+
+// hasExpires сообщает, несёт ли запись данного типа ExpiresAt.
+func (t OpType) hasExpires() bool { return t.shape()&shapeExpires != 0 }
+
 // Record — запись в логе.
 // Используется для восстановления Memtable после сбоя (Crash Recovery).
 type Record struct {
 	Type  OpType
 	Key   []byte
-	Value []byte // только для Put
+	Value []byte // только для Put, PutTTL, Merge, Batch, Sequence и Checkpoint
+
+	// ExpiresAt — момент истечения в наносекундах Unix, только для PutTTL.
+	ExpiresAt int64
+
+	// ColumnFamily — id пространства ключей (0 — пространство по умолчанию).
+	ColumnFamily uint32
+}
+
+// SequenceRecord возвращает запись OpSequence с номером seq.
+func SequenceRecord(seq uint64) Record {
+	return Record{Type: OpSequence, Value: binary.BigEndian.AppendUint64(nil, seq)}
+}
+
+// Sequence возвращает номер из записи OpSequence.
+func (r Record) Sequence() (uint64, error) {
+	if r.Type != OpSequence || len(r.Value) != 8 {
+		return 0, errBadSequence
+	}
+	return binary.BigEndian.Uint64(r.Value), nil
+}
+
+// CheckpointRecord возвращает запись OpCheckpoint: записи с номерами до seq включительно
+// сохранены в SSTable.
+func CheckpointRecord(seq uint64) Record {
+	return Record{Type: OpCheckpoint, Value: binary.BigEndian.AppendUint64(nil, seq)}
+}
+
+// Checkpoint возвращает номер из записи OpCheckpoint.
+func (r Record) Checkpoint() (uint64, error) {
+	if r.Type != OpCheckpoint || len(r.Value) != 8 {
+		return 0, errBadCheckpoint
+	}
+	return binary.BigEndian.Uint64(r.Value), nil
 }
 
 // Writer — append-only запись в лог.
 // Гарантирует, что данные записаны до того, как мы подтвердим успешность операции пользователю.
+// Каждая запись завершается CRC32C (4 байта little-endian) всех её байтов.
 type Writer struct {
-	bw *bufio.Writer
+	bw     *bufio.Writer
+	syncer interface{ Sync() error } // nil, если underlying writer не умеет fsync
+	buf    []byte
+	off    int64
+
+	// compressMin — с какой длины значения сжимаются (0 — не сжимаются).
+	compressMin int
+	zbuf        []byte
+
+	stats  WriterStats
+	seed   uint32 // начальное значение CRC записей: CRC заголовка повторно используемого сегмента
+	closed bool
+}
+
+// WriterStats — счётчики Writer с момента создания.
+type WriterStats struct {
+	Records int64 // дописано записей, включая служебные
+	Bytes   int64 // записано байт, включая заголовок
+	Flushes int64 // сбросов буфера в underlying writer (системных вызовов записи)
+	Syncs   int64 // выполнено fsync
+	Size    int64 // текущий размер лога, как Offset
+}
+
+// Stats возвращает счётчики Writer.
+func (w *Writer) Stats() WriterStats {
+	s := w.stats
+	s.Size = w.off
+	return s
 }
 
+// NewWriter создаёт Writer, пишущий лог с начала w.
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{bw: bufio.NewWriter(w)}
+	return NewWriterAt(w, 0)
+}
+
+// NewWriterAt создаёт Writer, дописывающий лог, в котором уже off байт
+// (w должен быть открыт на дозапись).
+func NewWriterAt(w io.Writer, off int64) *Writer {
+	s, _ := w.(interface{ Sync() error })
+	return &Writer{bw: bufio.NewWriter(w), syncer: s, off: off}
 }
 
-func (w *Writer) Append(rec Record) error {
+// SetCompression включает сжатие Snappy значений не короче minSize байт (0 — выключает).
+// Значение пишется сжатым, только если это его укорачивает; флаг сжатия хранится
+// в байте типа записи, так что сжатые и несжатые записи читаются одинаково.
+func (w *Writer) SetCompression(minSize int) {
+	w.compressMin = minSize
+}
 
-	if err := w.bw.WriteByte(byte(rec.Type)); err != nil {
+// WriteHeader пишет заголовок сегмента с текущей версией формата.
+// Вызывается до первой записи; смещения записей отсчитываются от начала файла.
+func (w *Writer) WriteHeader(created time.Time) error {
+	return w.writeHeader(created, 0)
+}
+
+// WriteRecycledHeader — WriteHeader для сегмента, записываемого поверх старого файла
+// без обрезания: записи прежнего сегмента за концом нового не будут прочитаны.
+func (w *Writer) WriteRecycledHeader(created time.Time) error {
+	return w.writeHeader(created, headerRecycled)
+}
+
+func (w *Writer) writeHeader(created time.Time, flags uint16) error {
+	if w.closed {
+		return ErrClosed
+	}
+	if w.off != 0 {
+		return errHeaderNotFirst
+	}
+	w.buf = append(w.buf[:0], headerMagic[:]...)
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, FormatVersion)
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, flags)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(created.UnixNano()))
+	sum := crc32.Checksum(w.buf, crcTable)
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, sum)
+	if flags&headerRecycled != 0 {
+		w.seed = sum
+	}
+	if _, err := w.bw.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.bw.Flush(); err != nil {
 		return err
 	}
+	w.off = HeaderSize
+	w.stats.Bytes += HeaderSize
+	w.stats.Flushes++
+	return nil
+}
+
+// Append дописывает запись и возвращает её смещение в логе (LSN): смещения растут
+// с каждой записью, и Reader.Offset() перед чтением записи равен её смещению.
+// Запись доходит до ОС, но не обязательно до диска — см. AppendSync и Sync.
+func (w *Writer) Append(rec Record) (int64, error) {
+	return w.AppendBatch([]Record{rec}, false)
+}
 
-	if err := writeBytes(w.bw, rec.Key); err != nil {
+// AppendSync — Append, который при sync делает fsync перед возвратом: после успешного
+// вызова запись переживает и отключение питания.
+func (w *Writer) AppendSync(rec Record, sync bool) (int64, error) {
+	return w.AppendBatch([]Record{rec}, sync)
+}
+
+// Sync делает fsync всего записанного лога. Возвращает ErrSyncUnsupported,
+// если underlying writer не умеет fsync.
+func (w *Writer) Sync() error {
+	if w.closed {
+		return ErrClosed
+	}
+	if w.syncer == nil {
+		return ErrSyncUnsupported
+	}
+	if err := w.bw.Flush(); err != nil {
 		return err
 	}
+	w.stats.Syncs++
+	return w.syncer.Sync()
+}
 
-	if rec.Type == OpPut {
-		if err := writeBytes(w.bw, rec.Value); err != nil {
-			return err
+// AppendBatch дописывает записи одной операцией записи в underlying writer (и, если sync,
+// одним fsync) и возвращает смещение первой из них; остальные идут следом подряд.
+// В отличие от OpBatch записи не атомарны: после сбоя может уцелеть только их начало.
+// Нужен при массовой загрузке, где запись на каждую операцию — основная стоимость.
+func (w *Writer) AppendBatch(recs []Record, sync bool) (int64, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if sync && w.syncer == nil {
+		return 0, ErrSyncUnsupported
+	}
+	for _, rec := range recs {
+		if !rec.Type.Known() {
+			return 0, fmt.Errorf("%w: %d", ErrUnknownOp, rec.Type)
 		}
 	}
-
+	w.buf = w.buf[:0]
+	for _, rec := range recs {
+		start := len(w.buf)
+		w.buf = w.appendRecord(w.buf, rec)
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, crc32.Update(w.seed, crcTable, w.buf[start:]))
+	}
+	if _, err := w.bw.Write(w.buf); err != nil {
+		return 0, err
+	}
 	// важно: сбросить в underlying writer, чтобы WAL реально записался
-	return w.bw.Flush()
+	if err := w.bw.Flush(); err != nil {
+		return 0, err
+	}
+	lsn := w.off
+	w.off += int64(len(w.buf))
+	w.stats.Records += int64(len(recs))
+	w.stats.Bytes += int64(len(w.buf))
+	w.stats.Flushes++
+	if sync {
+		w.stats.Syncs++
+		if err := w.syncer.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return lsn, nil
 }
 
-func (w *Writer) Close() error { return nil }
+// Offset возвращает смещение конца последней записанной записи — размер лога.
+func (w *Writer) Offset() int64 { return w.off }
+
+// appendRecord дописывает к buf запись без контрольной суммы.
+func (w *Writer) appendRecord(buf []byte, rec Record) []byte {
+	t := byte(rec.Type) | opVarint
+	if rec.ColumnFamily != 0 {
+		t |= opColumnFamily
+	}
+	if rec.Type.hasValue() {
+		if v, ok := w.compress(rec.Value); ok {
+			rec.Value = v
+			t |= opSnappy
+		}
+	}
+	buf = append(buf, t)
+	if rec.ColumnFamily != 0 {
+		buf = binary.LittleEndian.AppendUint32(buf, rec.ColumnFamily)
+	}
+	buf = appendBytes(buf, rec.Key)
+	if rec.Type.hasExpires() {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(rec.ExpiresAt))
+	}
+	if rec.Type.hasValue() {
+		buf = appendBytes(buf, rec.Value)
+	}
+	return buf
+}
+
+// compress сжимает значение, если оно достаточно длинное и сжатие его укорачивает.
+func (w *Writer) compress(v []byte) ([]byte, bool) {
+	if w.compressMin == 0 || len(v) < w.compressMin {
+		return nil, false
+	}
+	w.zbuf = snappy.Encode(w.zbuf[:cap(w.zbuf)], v)
+	if len(w.zbuf) >= len(v) {
+		return nil, false
+	}
+	return w.zbuf, true
+}
+
+// Close сбрасывает буфер и, если underlying writer умеет fsync (как *os.File), делает fsync;
+// после этого Writer непригоден: запись и Sync возвращают ErrClosed. Сам underlying writer
+// не закрывается — это забота его владельца, и делается после Close. Повторный Close
+// ничего не делает.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if w.syncer == nil {
+		return nil
+	}
+	w.stats.Syncs++
+	return w.syncer.Sync()
+}
 
 // Reader — последовательное чтение лога при старте системы.
+// Повреждения возвращаются как *CorruptError: запись, оборванная концом данных, —
+// с причиной io.ErrUnexpectedEOF, запись с неверной контрольной суммой — с ErrChecksum;
+// после ErrChecksum чтение можно продолжить со следующей записи.
 type Reader struct {
-	br *bufio.Reader
+	src io.Reader
+	br  *bufio.Reader
+	off int64
+	crc uint32 // CRC32C прочитанной части текущей записи
+	zr  io.ReadCloser
+
+	prefix []byte // см. SetKeyPrefix
+
+	// seed и recycled — из заголовка повторно используемого сегмента (см. headerRecycled).
+	seed     uint32
+	recycled bool
 }
 
+// Offset возвращает смещение конца последней целиком прочитанной записи.
+func (r *Reader) Offset() int64 { return r.off }
+
 func NewReader(r io.Reader) *Reader {
-	return &Reader{br: bufio.NewReader(r)}
+	return &Reader{src: r, br: bufio.NewReader(r)}
+}
+
+// SeekTo переставляет Reader на запись по смещению off — например, на последнюю
+// подтверждённую позицию реплики — и проверяет, что там начинается запись: она должна
+// прочитаться целиком с верной контрольной суммой, либо off — конец записанного.
+// Запись, которая ещё дописывается, тоже даёт ErrNotBoundary: SeekTo стоит повторить.
+// Смещения те же, что у Offset и LSN из Writer.Append.
+// Источник должен поддерживать io.Seeker. После ошибки позиция не определена.
+// Для повторно используемого сегмента сначала нужен ReadHeader; конец такого сегмента
+// от смещения не на границе записи не отличить, и оба дают ErrNotBoundary.
+func (r *Reader) SeekTo(off int64) error {
+	s, ok := r.src.(io.Seeker)
+	if !ok {
+		return ErrSeekUnsupported
+	}
+	if err := r.seek(s, off); err != nil {
+		return err
+	}
+	if _, _, err := r.next(); err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			return fmt.Errorf("%w (смещение %d): %w", ErrNotBoundary, off, err)
+		}
+		return err
+	}
+	return r.seek(s, off)
+}
+
+func (r *Reader) seek(s io.Seeker, off int64) error {
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	r.br.Reset(r.src)
+	r.off = off
+	return nil
+}
+
+// ReadHeader читает заголовок сегмента; вызывается до первого Next (и SeekTo).
+// Пустой сегмент — io.EOF, оборванный заголовок — *CorruptError с io.ErrUnexpectedEOF,
+// чужой файл — *CorruptError с ErrBadHeader, неизвестная версия формата — ErrBadHeader.
+func (r *Reader) ReadHeader() (Header, error) {
+	var b [HeaderSize]byte
+	if _, err := io.ReadFull(r.br, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = &CorruptError{Offset: r.off, Reason: "заголовок оборван", Err: err}
+		}
+		return Header{}, err
+	}
+	if [4]byte(b[:4]) != headerMagic {
+		return Header{}, &CorruptError{Offset: r.off, Reason: "нет магического числа", Err: ErrBadHeader}
+	}
+	sum := binary.LittleEndian.Uint32(b[16:])
+	if crc32.Checksum(b[:16], crcTable) != sum {
+		return Header{}, &CorruptError{Offset: r.off, Reason: "неверная контрольная сумма заголовка", Err: ErrBadHeader}
+	}
+	flags := binary.LittleEndian.Uint16(b[6:])
+	h := Header{
+		Version:  uint32(binary.LittleEndian.Uint16(b[4:])),
+		Created:  time.Unix(0, int64(binary.LittleEndian.Uint64(b[8:]))),
+		Recycled: flags&headerRecycled != 0,
+	}
+	if h.Version < minFormatVersion || h.Version > FormatVersion {
+		return Header{}, fmt.Errorf("%w: версия формата %d, поддерживаются %d–%d",
+			ErrBadHeader, h.Version, minFormatVersion, FormatVersion)
+	}
+	if flags&^headerRecycled != 0 {
+		return Header{}, fmt.Errorf("%w: неизвестные флаги %#x", ErrBadHeader, flags)
+	}
+	r.off += HeaderSize
+	if h.Recycled {
+		r.seed, r.recycled = sum, true
+	}
+	return h, nil
+}
+
+// SetKeyPrefix оставляет в выдаче Next только записи с ключами, начинающимися с prefix
+// (nil — все записи): так WAL одного узла раскладывается по новым шардам.
+// Пакет OpBatch сокращается до подходящих записей или пропускается целиком;
+// служебные OpSequence и OpCheckpoint возвращаются всегда.
+func (r *Reader) SetKeyPrefix(prefix []byte) {
+	r.prefix = prefix
 }
 
 func (r *Reader) Next() (Record, bool, error) {
+	for {
+		start := r.off
+		rec, ok, err := r.next()
+		if err != nil && r.recycled && errors.Is(err, ErrCorrupt) {
+			// В повторно используемом сегменте за концом лога — записи прежнего сегмента,
+			// поэтому повреждение неотличимо от конца лога.
+			r.off = start
+			return Record{}, false, nil
+		}
+		if !ok || err != nil || r.prefix == nil {
+			return rec, ok, err
+		}
+		rec, ok, err = r.filter(rec)
+		if err != nil {
+			return Record{}, false, &CorruptError{Offset: start, Reason: "пакет не разбирается", Err: err}
+		}
+		if ok {
+			return rec, true, nil
+		}
+	}
+}
 
+// filter применяет SetKeyPrefix к записи.
+func (r *Reader) filter(rec Record) (Record, bool, error) {
+	switch rec.Type {
+	case OpSequence, OpCheckpoint:
+		return rec, true, nil
+	case OpBatch:
+		recs, err := DecodeBatch(rec.Value)
+		if err != nil {
+			return Record{}, false, err
+		}
+		var kept []Record
+		for _, b := range recs {
+			if bytes.HasPrefix(b.Key, r.prefix) {
+				kept = append(kept, b)
+			}
+		}
+		if len(kept) == 0 {
+			return Record{}, false, nil
+		}
+		if len(kept) < len(recs) {
+			if rec.Value, err = EncodeBatch(kept); err != nil {
+				return Record{}, false, err
+			}
+		}
+		return rec, true, nil
+	}
+	return rec, bytes.HasPrefix(rec.Key, r.prefix), nil
+}
+
+func (r *Reader) next() (Record, bool, error) {
 	t, err := r.br.ReadByte()
 	if err == io.EOF {
 		return Record{}, false, nil
@@ -76,43 +626,202 @@ func (r *Reader) Next() (Record, bool, error) {
 	if err != nil {
 		return Record{}, false, err
 	}
+	if t == 0 {
+		// Нулевой тип — незаписанная часть предвыделенного сегмента: лог кончился.
+		return Record{}, false, nil
+	}
+	if op := OpType(t &^ opFlags); !op.Known() {
+		return Record{}, false, &CorruptError{Offset: r.off, Reason: fmt.Sprintf("неизвестный тип записи %d", op), Err: ErrUnknownOp}
+	}
+	r.crc = crc32.Update(r.seed, crcTable, []byte{t})
+	rec, n, err := r.readRecord(t)
+	if err == nil {
+		var sum [4]byte
+		if _, err = io.ReadFull(r.br, sum[:]); err == nil {
+			n += 4
+			if binary.LittleEndian.Uint32(sum[:]) != r.crc {
+				start := r.off
+				r.off += n
+				return Record{}, false, &CorruptError{Offset: start, Reason: "неверная контрольная сумма", Err: ErrChecksum}
+			}
+			if t&(opCompressed|opSnappy) != 0 {
+				if rec.Value, err = r.decompress(t, rec.Value); err != nil {
+					start := r.off
+					r.off += n
+					return Record{}, false, &CorruptError{Offset: start, Reason: "значение не распаковывается", Err: err}
+				}
+			}
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Тип записи прочитан, а остальное нет — запись оборвана.
+		return Record{}, false, &CorruptError{Offset: r.off, Reason: "запись оборвана концом данных", Err: io.ErrUnexpectedEOF}
+	}
+	if err == errBadLength {
+		return Record{}, false, &CorruptError{Offset: r.off, Reason: "некорректная длина поля", Err: err}
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	r.off += n
+	return rec, true, nil
+}
+
+// readRecord читает запись после байта типа t и возвращает её размер в логе без контрольной суммы.
+func (r *Reader) readRecord(t byte) (Record, int64, error) {
+	n := int64(1)
 
-	rec := Record{Type: OpType(t)}
+	rec := Record{Type: OpType(t &^ opFlags)}
+	varint := t&opVarint != 0
+	if t&opColumnFamily != 0 {
+		var cfBuf [4]byte
+		if err := r.readFull(cfBuf[:]); err != nil {
+			return Record{}, 0, err
+		}
+		rec.ColumnFamily = binary.LittleEndian.Uint32(cfBuf[:])
+		n += 4
+	}
 
-	key, err := readBytes(r.br)
+	key, kn, err := r.readBytes(varint)
 	if err != nil {
-		return Record{}, false, err
+		return Record{}, 0, err
 	}
 	rec.Key = key
+	n += kn
 
-	if rec.Type == OpPut {
-		val, err := readBytes(r.br)
+	if rec.Type.hasExpires() {
+		var tsBuf [8]byte
+		if err := r.readFull(tsBuf[:]); err != nil {
+			return Record{}, 0, err
+		}
+		rec.ExpiresAt = int64(binary.LittleEndian.Uint64(tsBuf[:]))
+		n += 8
+	}
+
+	if rec.Type.hasValue() {
+		val, vn, err := r.readBytes(varint)
 		if err != nil {
-			return Record{}, false, err
+			return Record{}, 0, err
 		}
 		rec.Value = val
+		n += vn
 	}
 
-	return rec, true, nil
+	return rec, n, nil
 }
 
-func writeBytes(w *bufio.Writer, b []byte) error {
-	var lenBuf [4]byte
-	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(b)))
-	if _, err := w.Write(lenBuf[:]); err != nil {
+// decompress распаковывает сжатое значение записи с байтом типа t.
+func (r *Reader) decompress(t byte, b []byte) ([]byte, error) {
+	if t&opSnappy != 0 {
+		return snappy.Decode(nil, b)
+	}
+	if r.zr == nil {
+		r.zr = flate.NewReader(bytes.NewReader(b))
+	} else if err := r.zr.(flate.Resetter).Reset(bytes.NewReader(b), nil); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r.zr)
+}
+
+// readFull читает len(b) байт записи, обновляя её контрольную сумму.
+func (r *Reader) readFull(b []byte) error {
+	if _, err := io.ReadFull(r.br, b); err != nil {
 		return err
 	}
-	_, err := w.Write(b)
-	return err
+	r.crc = crc32.Update(r.crc, crcTable, b)
+	return nil
 }
 
-func readBytes(r *bufio.Reader) ([]byte, error) {
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
-		return nil, err
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// readBytes читает поле с длиной (uvarint при varint, иначе 4 байта little-endian)
+// и возвращает его вместе с числом прочитанных байт.
+func (r *Reader) readBytes(varint bool) ([]byte, int64, error) {
+	var n uint64
+	var ln int64
+	if varint {
+		var err error
+		if n, ln, err = r.readUvarint(); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		var lenBuf [4]byte
+		if err := r.readFull(lenBuf[:]); err != nil {
+			return nil, 0, err
+		}
+		n, ln = uint64(binary.LittleEndian.Uint32(lenBuf[:])), 4
+	}
+	if n <= maxPrealloc {
+		b := make([]byte, int(n))
+		return b, ln + int64(n), r.readFull(b)
+	}
+	// Длина может быть мусором повреждённой записи: память выделяется
+	// по мере чтения, а не сразу на заявленные до 4 ГиБ.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r.br, int64(n)); err != nil {
+		return nil, 0, err
+	}
+	r.crc = crc32.Update(r.crc, crcTable, buf.Bytes())
+	return buf.Bytes(), ln + int64(n), nil
+}
+
+// readUvarint читает длину поля в uvarint; длины больше 4 ГиБ, как и в старом формате, нет.
+func (r *Reader) readUvarint() (uint64, int64, error) {
+	var x uint64
+	for i := 0; i < 5; i++ {
+		b, err := r.br.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		r.crc = crc32.Update(r.crc, crcTable, []byte{b})
+		x |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			if x > math.MaxUint32 {
+				return 0, 0, errBadLength
+			}
+			return x, int64(i + 1), nil
+		}
+	}
+	return 0, 0, errBadLength
+}
+
+// maxPrealloc — до какой длины поля буфер выделяется сразу.
+const maxPrealloc = 1 << 20
+
+// EncodeBatch кодирует записи в Value записи OpBatch: записи пакета пишутся
+// в том же формате, что и в лог. Вложенные пакеты не допускаются.
+func EncodeBatch(recs []Record) ([]byte, error) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, rec := range recs {
+		if rec.Type == OpBatch {
+			return nil, errNestedBatch
+		}
+		if _, err := w.Append(rec); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBatch разбирает Value записи OpBatch.
+func DecodeBatch(b []byte) ([]Record, error) {
+	r := NewReader(bytes.NewReader(b))
+	var recs []Record
+	for {
+		rec, ok, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return recs, nil
+		}
+		if rec.Type == OpBatch {
+			return nil, errNestedBatch
+		}
+		recs = append(recs, rec)
 	}
-	n := binary.LittleEndian.Uint32(lenBuf[:])
-	b := make([]byte, int(n))
-	_, err := io.ReadFull(r, b)
-	return b, err
 }
@@ -0,0 +1,559 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWAL_AppendOffsets(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var lsns []int64
+	for _, k := range []string{"a", "bb", "ccc"} {
+		lsn, err := w.Append(Record{Type: OpPut, Key: []byte(k), Value: []byte("v")})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		lsns = append(lsns, lsn)
+	}
+	if w.Offset() != int64(buf.Len()) || lsns[0] != 0 {
+		t.Fatalf("Offset = %d, LSN = %v, размер лога %d", w.Offset(), lsns, buf.Len())
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	for i := 0; ; i++ {
+		off := r.Offset()
+		_, ok, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if off != lsns[i] {
+			t.Fatalf("запись %d: смещение %d, LSN %d", i, off, lsns[i])
+		}
+	}
+}
+
+// countingWriter считает вызовы Write и Sync.
+type countingWriter struct {
+	bytes.Buffer
+	writes, syncs int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func (w *countingWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestWAL_AppendBatch(t *testing.T) {
+	cw := &countingWriter{}
+	w := NewWriter(cw)
+	recs := make([]Record, 100)
+	for i := range recs {
+		recs[i] = Record{Type: OpPut, Key: []byte(fmt.Sprintf("k%03d", i)), Value: []byte("v")}
+	}
+	if _, err := w.Append(recs[0]); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	lsn, err := w.AppendBatch(recs[1:], true)
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if cw.writes != 2 || cw.syncs != 1 {
+		t.Fatalf("writes = %d, syncs = %d", cw.writes, cw.syncs)
+	}
+
+	r := NewReader(bytes.NewReader(cw.Bytes()))
+	for i := 0; ; i++ {
+		if i == 1 && r.Offset() != lsn {
+			t.Fatalf("LSN пакета = %d, смещение записи %d", lsn, r.Offset())
+		}
+		rec, ok, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			if i != len(recs) {
+				t.Fatalf("прочитано %d записей из %d", i, len(recs))
+			}
+			break
+		}
+		if !bytes.Equal(rec.Key, recs[i].Key) {
+			t.Fatalf("запись %d: ключ %q", i, rec.Key)
+		}
+	}
+
+	// Без Sync у underlying writer fsync запросить нельзя.
+	if _, err := NewWriter(&bytes.Buffer{}).AppendBatch(recs, true); !errors.Is(err, ErrSyncUnsupported) {
+		t.Fatalf("AppendBatch с sync поверх bytes.Buffer: %v", err)
+	}
+}
+
+func TestWAL_Sync(t *testing.T) {
+	cw := &countingWriter{}
+	w := NewWriter(cw)
+	if _, err := w.AppendSync(Record{Type: OpPut, Key: []byte("a"), Value: []byte("1")}, false); err != nil {
+		t.Fatalf("AppendSync: %v", err)
+	}
+	if cw.syncs != 0 {
+		t.Fatalf("fsync без запроса: %d", cw.syncs)
+	}
+	if _, err := w.AppendSync(Record{Type: OpDelete, Key: []byte("a")}, true); err != nil {
+		t.Fatalf("AppendSync: %v", err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if cw.syncs != 2 {
+		t.Fatalf("syncs = %d, ожидалось 2", cw.syncs)
+	}
+	if err := NewWriter(&bytes.Buffer{}).Sync(); !errors.Is(err, ErrSyncUnsupported) {
+		t.Fatalf("Sync поверх bytes.Buffer: %v", err)
+	}
+}
+
+func TestWAL_Close(t *testing.T) {
+	cw := &countingWriter{}
+	w := NewWriter(cw)
+	if _, err := w.Append(Record{Type: OpPut, Key: []byte("a"), Value: []byte("1")}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Close(); err != nil || cw.syncs != 1 {
+		t.Fatalf("Close: %v, syncs = %d", err, cw.syncs)
+	}
+	if _, err := w.Append(Record{Type: OpDelete, Key: []byte("a")}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Append после Close: %v", err)
+	}
+	if err := w.Sync(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Sync после Close: %v", err)
+	}
+	if err := w.Close(); err != nil || cw.syncs != 1 {
+		t.Fatalf("повторный Close: %v, syncs = %d", err, cw.syncs)
+	}
+	if err := NewWriter(&bytes.Buffer{}).Close(); err != nil {
+		t.Fatalf("Close поверх bytes.Buffer: %v", err)
+	}
+}
+
+func TestWAL_CorruptError(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var lsns []int64
+	for _, v := range []string{"first", "second", "third"} {
+		lsn, err := w.Append(Record{Type: OpPut, Key: []byte("k"), Value: []byte(v)})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		lsns = append(lsns, lsn)
+	}
+	data := buf.Bytes()
+
+	// Неверная контрольная сумма: смещение — начало записи, чтение продолжается дальше.
+	bad := bytes.Clone(data)
+	bad[bytes.Index(bad, []byte("second"))] ^= 0xff
+	r := NewReader(bytes.NewReader(bad))
+	if _, _, err := r.Next(); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	_, _, err := r.Next()
+	var ce *CorruptError
+	if !errors.As(err, &ce) || ce.Offset != lsns[1] || !errors.Is(err, ErrChecksum) || !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Next повреждённой записи: %v", err)
+	}
+	if r.Offset() != lsns[2] {
+		t.Fatalf("Offset после повреждённой записи = %d, ожидалось %d", r.Offset(), lsns[2])
+	}
+	if rec, ok, err := r.Next(); err != nil || !ok || string(rec.Value) != "third" {
+		t.Fatalf("Next после повреждения = %q, %v, %v", rec.Value, ok, err)
+	}
+
+	// Оборванная запись, в том числе с мусорной длиной поля.
+	huge := binary.LittleEndian.AppendUint32(bytes.Clone(data[:lsns[2]+1]), 0xfffffff0)
+	for name, log := range map[string][]byte{"torn": data[:len(data)-1], "huge length": huge} {
+		r := NewReader(bytes.NewReader(log))
+		var err error
+		for ok := true; ok && err == nil; {
+			_, ok, err = r.Next()
+		}
+		if !errors.As(err, &ce) || ce.Offset != lsns[2] || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestWAL_TailReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal_1.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := NewWriter(f)
+	if err := w.WriteHeader(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tail := NewTailReader(r, HeaderSize, time.Millisecond)
+	got := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			rec, err := tail.Next(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			got <- string(rec.Key)
+		}
+	}()
+
+	for _, k := range []string{"a", "b"} {
+		if _, err := w.Append(Record{Type: OpPut, Key: []byte(k), Value: []byte("v")}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case key := <-got:
+			if key != k {
+				t.Fatalf("TailReader: %q, ожидалось %q", key, k)
+			}
+		case err := <-errs:
+			t.Fatalf("TailReader: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("TailReader не дождался записи %q", k)
+		}
+	}
+
+	// Запись, дописанная наполовину, читается после того, как появится целиком.
+	var rec bytes.Buffer
+	if _, err := NewWriter(&rec).Append(Record{Type: OpDelete, Key: []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	half := rec.Len() / 2
+	if _, err := f.Write(rec.Bytes()[:half]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := f.Write(rec.Bytes()[half:]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case key := <-got:
+		if key != "c" {
+			t.Fatalf("TailReader: %q", key)
+		}
+	case err := <-errs:
+		t.Fatalf("TailReader: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("TailReader не дождался дописанной записи")
+	}
+	if want := w.Offset() + int64(rec.Len()); tail.Offset() != want {
+		t.Fatalf("Offset = %d, ожидалось %d", tail.Offset(), want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewTailReader(r, tail.Offset(), time.Millisecond).Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Next по истечении контекста: %v", err)
+	}
+
+	// TryNext не ждёт: в конце записанного ok == false, а дописанные записи читаются,
+	// в том числе сразу после прочитанной.
+	try := NewTailReader(r, tail.Offset(), time.Hour)
+	if _, ok, err := try.TryNext(); ok || err != nil {
+		t.Fatalf("TryNext в конце сегмента: %v, %v", ok, err)
+	}
+	for _, k := range []string{"d", "e"} {
+		if _, err := w.Append(Record{Type: OpPut, Key: []byte(k), Value: []byte("v")}); err != nil {
+			t.Fatal(err)
+		}
+		if rec, ok, err := try.TryNext(); !ok || err != nil || string(rec.Key) != k {
+			t.Fatalf("TryNext = %q, %v, %v, ожидалось %q", rec.Key, ok, err, k)
+		}
+	}
+}
+
+func TestWAL_VarintLengths(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	key, value := []byte("250011234567890"), []byte("cdr-0001")
+	if _, err := w.Append(Record{Type: OpPut, Key: key, Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	// Тип, по байту длины на ключ и значение, CRC.
+	if want := 1 + 1 + len(key) + 1 + len(value) + 4; buf.Len() != want {
+		t.Fatalf("размер записи %d, ожидался %d", buf.Len(), want)
+	}
+
+	// Запись старого формата — с 4-байтовыми длинами — читается по-прежнему.
+	old := []byte{byte(OpPut)}
+	old = binary.LittleEndian.AppendUint32(old, uint32(len(key)))
+	old = append(old, key...)
+	old = binary.LittleEndian.AppendUint32(old, uint32(len(value)))
+	old = append(old, value...)
+	old = binary.LittleEndian.AppendUint32(old, crc32.Checksum(old, crc32.MakeTable(crc32.Castagnoli)))
+	buf.Write(old)
+	r := NewReader(&buf)
+	for i := 0; i < 2; i++ {
+		rec, ok, err := r.Next()
+		if err != nil || !ok || !bytes.Equal(rec.Key, key) || !bytes.Equal(rec.Value, value) {
+			t.Fatalf("запись %d: %+v, %v, %v", i, rec, ok, err)
+		}
+	}
+	if _, ok, err := r.Next(); ok || err != nil {
+		t.Fatalf("после двух записей: %v, %v", ok, err)
+	}
+}
+
+func TestWAL_UnknownOp(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if _, err := w.Append(Record{Type: 17, Key: []byte("k")}); !errors.Is(err, ErrUnknownOp) || buf.Len() != 0 {
+		t.Fatalf("Append неизвестного типа: %v, записано %d байт", err, buf.Len())
+	}
+	// Зарезервированный тип пишется и читается со значением.
+	rd := Record{Type: OpRangeDelete, Key: []byte("a"), Value: []byte("b")}
+	if _, err := w.Append(rd); err != nil {
+		t.Fatal(err)
+	}
+	end := w.Offset()
+	// Запись типа, которого Reader не знает (например, от более новой версии).
+	buf.Write([]byte{15, 1, 'k', 0, 0, 0, 0})
+
+	r := NewReader(&buf)
+	rec, ok, err := r.Next()
+	if err != nil || !ok || rec.Type != OpRangeDelete || string(rec.Value) != "b" {
+		t.Fatalf("Next = %+v, %v, %v", rec, ok, err)
+	}
+	_, ok, err = r.Next()
+	var ce *CorruptError
+	if ok || !errors.Is(err, ErrUnknownOp) || !errors.As(err, &ce) || ce.Offset != end {
+		t.Fatalf("Next неизвестного типа: %v, %v", ok, err)
+	}
+}
+
+func TestWAL_Verify(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteHeader(time.Unix(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := EncodeBatch([]Record{
+		{Type: OpPut, Key: []byte("b"), Value: []byte("2")},
+		{Type: OpDelete, Key: []byte("c")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lsns []int64
+	for _, rec := range []Record{
+		SequenceRecord(1),
+		{Type: OpPut, Key: []byte("a"), Value: []byte("1")},
+		{Type: OpPut, Key: []byte("x"), Value: []byte("broken")},
+		{Type: OpBatch, Value: batch},
+	} {
+		lsn, err := w.Append(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lsns = append(lsns, lsn)
+	}
+	end := w.Offset()
+	data := append(buf.Bytes(), make([]byte, 64)...) // нули предвыделения
+	data[lsns[3]-5] ^= 0xff                          // последний байт значения "broken"
+
+	rep, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if rep.Header.Created.Unix() != 1 || rep.Records != 3 || rep.ByType[OpPut] != 1 ||
+		rep.ByType[OpBatch] != 1 || rep.Batched != 2 || rep.Bytes != end || rep.Corrupted != 1 {
+		t.Fatalf("Verify = %+v", rep)
+	}
+	if rep.First == nil || rep.First.Offset != lsns[2] || !errors.Is(rep.First, ErrChecksum) {
+		t.Fatalf("первое повреждение: %v", rep.First)
+	}
+
+	// Данные за концом лога — повреждение, на котором проверка останавливается.
+	data[len(data)-1] = 1
+	data[lsns[3]-5] ^= 0xff
+	if rep, err = Verify(bytes.NewReader(data)); err != nil || rep.Records != 4 || rep.First == nil || rep.First.Offset != end {
+		t.Fatalf("Verify = %+v, %v", rep, err)
+	}
+}
+
+func TestWAL_KeyPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	batch, err := EncodeBatch([]Record{
+		{Type: OpPut, Key: []byte("a2"), Value: []byte("v")},
+		{Type: OpPut, Key: []byte("b2"), Value: []byte("v")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := EncodeBatch([]Record{{Type: OpDelete, Key: []byte("b3")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []Record{
+		SequenceRecord(1),
+		{Type: OpPut, Key: []byte("a1"), Value: []byte("v")},
+		{Type: OpPut, Key: []byte("b1"), Value: []byte("v")},
+		{Type: OpBatch, Value: batch},
+		{Type: OpBatch, Value: other},
+	} {
+		if _, err := w.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	r.SetKeyPrefix([]byte("a"))
+	var got []string
+	for {
+		rec, ok, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		switch rec.Type {
+		case OpSequence:
+			got = append(got, "seq")
+		case OpBatch:
+			recs, err := DecodeBatch(rec.Value)
+			if err != nil {
+				t.Fatalf("DecodeBatch: %v", err)
+			}
+			for _, b := range recs {
+				got = append(got, "batch:"+string(b.Key))
+			}
+		default:
+			got = append(got, string(rec.Key))
+		}
+	}
+	if s := strings.Join(got, ","); s != "seq,a1,batch:a2" {
+		t.Fatalf("записи с префиксом a: %s", s)
+	}
+	if r.Offset() != int64(buf.Len()) {
+		t.Fatalf("Offset = %d, размер лога %d", r.Offset(), buf.Len())
+	}
+}
+
+func TestWAL_SeekTo(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteHeader(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var lsns []int64
+	for _, k := range []string{"a", "b", "c"} {
+		lsn, err := w.Append(Record{Type: OpPut, Key: []byte(k), Value: []byte("v")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lsns = append(lsns, lsn)
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	if err := r.SeekTo(lsns[2]); err != nil {
+		t.Fatalf("SeekTo: %v", err)
+	}
+	if rec, ok, err := r.Next(); err != nil || !ok || string(rec.Key) != "c" {
+		t.Fatalf("Next после SeekTo = %q, %v, %v", rec.Key, ok, err)
+	}
+	if r.Offset() != w.Offset() {
+		t.Fatalf("Offset = %d, ожидалось %d", r.Offset(), w.Offset())
+	}
+
+	// Смещение внутри записи не проходит проверку контрольной суммой.
+	if err := r.SeekTo(lsns[1] + 1); !errors.Is(err, ErrNotBoundary) {
+		t.Fatalf("SeekTo внутрь записи: %v", err)
+	}
+	if err := r.SeekTo(lsns[1]); err != nil {
+		t.Fatalf("SeekTo: %v", err)
+	}
+	if rec, ok, err := r.Next(); err != nil || !ok || string(rec.Key) != "b" {
+		t.Fatalf("Next после SeekTo = %q, %v, %v", rec.Key, ok, err)
+	}
+
+	// Реплика, прочитавшая всё, встаёт в конец.
+	if err := r.SeekTo(w.Offset()); err != nil {
+		t.Fatalf("SeekTo в конец: %v", err)
+	}
+	if _, ok, err := r.Next(); ok || err != nil {
+		t.Fatalf("Next в конце = %v, %v", ok, err)
+	}
+
+	if err := NewReader(io.MultiReader(&buf)).SeekTo(0); !errors.Is(err, ErrSeekUnsupported) {
+		t.Fatalf("SeekTo без io.Seeker: %v", err)
+	}
+}
+
+func TestWAL_Compression(t *testing.T) {
+	value := bytes.Repeat([]byte("IMSI=250011234567890;MSISDN=79001234567;DUR=60;"), 20)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetCompression(64)
+	if _, err := w.Append(Record{Type: OpPut, Key: []byte("k"), Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	if t0 := buf.Bytes()[0]; t0&opSnappy == 0 || t0&opCompressed != 0 || buf.Len() >= len(value) {
+		t.Fatalf("тип 0x%x, запись %d байт при значении %d", t0, buf.Len(), len(value))
+	}
+
+	// Запись сегмента версии 4 со значением, сжатым DEFLATE, читается по-прежнему.
+	var z bytes.Buffer
+	zw, _ := flate.NewWriter(&z, flate.BestSpeed)
+	zw.Write(value)
+	zw.Close()
+	old := []byte{byte(OpPut) | opVarint | opCompressed}
+	old = appendBytes(old, []byte("old"))
+	old = appendBytes(old, z.Bytes())
+	old = binary.LittleEndian.AppendUint32(old, crc32.Checksum(old, crcTable))
+	buf.Write(old)
+
+	// Блок Snappy, собранный вручную по описанию формата: длина 30 (uvarint 0x1e),
+	// литерал "a" (0x00 'a') и копия длины 29 со смещением 1 (tagCopy2: 0x72 0x01 0x00).
+	ref := []byte{byte(OpPut) | opVarint | opSnappy}
+	ref = appendBytes(ref, []byte("ref"))
+	ref = appendBytes(ref, []byte{0x1e, 0x00, 'a', 0x72, 0x01, 0x00})
+	ref = binary.LittleEndian.AppendUint32(ref, crc32.Checksum(ref, crcTable))
+	buf.Write(ref)
+
+	r := NewReader(&buf)
+	for _, key := range []string{"k", "old"} {
+		rec, ok, err := r.Next()
+		if err != nil || !ok || string(rec.Key) != key || !bytes.Equal(rec.Value, value) {
+			t.Fatalf("запись %s: %q, %v, %v", key, rec.Key, ok, err)
+		}
+	}
+	rec, ok, err := r.Next()
+	if err != nil || !ok || string(rec.Key) != "ref" || string(rec.Value) != strings.Repeat("a", 30) {
+		t.Fatalf("запись ref: %q=%q, %v, %v", rec.Key, rec.Value, ok, err)
+	}
+}
@@ -0,0 +1,330 @@
+// Package client — клиент группы серверов kvserver, между которыми ключи разделены
+// на шарды. Шард ключа выбирает Router: консистентное хеширование (Ring) или
+// диапазоны ключей (Ranges, например по префиксам IMSI). К каждому шарду клиент
+// держит пул соединений gRPC, а запросы, не дошедшие до сервера или отвергнутые
+// им из-за временной перегрузки, повторяет.
+//
+// Get, Put, Delete и Batch идемпотентны, поэтому повтор запроса, ответ на который
+// потерян, безопасен.
+package client
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"kvschool/internal/kvrpc"
+)
+
+var (
+	// ErrNotFound возвращает Get, если ключа нет.
+	ErrNotFound = kvrpc.ErrNotFound
+	// ErrCrossShard возвращает Batch, если изменения относятся к разным шардам:
+	// атомарен пакет только в пределах шарда.
+	ErrCrossShard = errors.New("client: изменения пакета на разных шардах")
+)
+
+// maxRetryBackoff ограничивает паузу между повторами.
+const maxRetryBackoff = 2 * time.Second
+
+// Options — параметры клиента.
+type Options struct {
+	// PoolSize — соединений на шард; запросы распределяются по ним по кругу.
+	// По умолчанию 2.
+	PoolSize int
+	// MaxRetries — сколько раз повторяется неудавшийся запрос. По умолчанию 3;
+	// отрицательное — без повторов.
+	MaxRetries int
+	// RetryBackoff — пауза перед первым повтором; перед каждым следующим она
+	// удваивается (не больше 2 с). По умолчанию 50 мс.
+	RetryBackoff time.Duration
+	// RequestTimeout ограничивает одну попытку Get, Put, Delete и Batch
+	// (0 — только контекстом вызова).
+	RequestTimeout time.Duration
+	// DialOptions передаются kvrpc.Dial. По умолчанию — соединение без TLS.
+	DialOptions []grpc.DialOption
+}
+
+func (o Options) withDefaults() Options {
+	if o.PoolSize <= 0 {
+		o.PoolSize = 2
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = 50 * time.Millisecond
+	}
+	if o.DialOptions == nil {
+		o.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	return o
+}
+
+// Client — клиент шардированной группы серверов. Безопасен для одновременного
+// использования из нескольких горутин.
+type Client struct {
+	router Router
+	opts   Options
+	pools  map[string]*pool
+}
+
+// pool — соединения с одним шардом.
+type pool struct {
+	conns []*kvrpc.Client
+	next  atomic.Uint64
+}
+
+func (p *pool) get() *kvrpc.Client {
+	return p.conns[p.next.Add(1)%uint64(len(p.conns))]
+}
+
+// Dial создает клиент шардов router. Соединения устанавливаются при первом запросе.
+func Dial(router Router, opts Options) (*Client, error) {
+	opts = opts.withDefaults()
+	c := &Client{router: router, opts: opts, pools: make(map[string]*pool)}
+	for _, shard := range router.Shards(nil, nil) {
+		p := &pool{}
+		c.pools[shard] = p
+		for range opts.PoolSize {
+			conn, err := kvrpc.Dial(shard, opts.DialOptions...)
+			if err != nil {
+				_ = c.Close()
+				return nil, fmt.Errorf("client: шард %s: %w", shard, err)
+			}
+			p.conns = append(p.conns, conn)
+		}
+	}
+	if len(c.pools) == 0 {
+		return nil, errors.New("client: нет шардов")
+	}
+	return c, nil
+}
+
+// Close закрывает соединения со всеми шардами.
+func (c *Client) Close() error {
+	var errs []error
+	for _, p := range c.pools {
+		for _, conn := range p.conns {
+			errs = append(errs, conn.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Get возвращает значение ключа или ErrNotFound.
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
+	var v []byte
+	err := c.do(ctx, c.router.Shard(key), true, func(ctx context.Context, conn *kvrpc.Client) error {
+		var err error
+		v, err = conn.Get(ctx, key)
+		return err
+	})
+	return v, err
+}
+
+// Put записывает значение ключа.
+func (c *Client) Put(ctx context.Context, key, value []byte) error {
+	return c.do(ctx, c.router.Shard(key), true, func(ctx context.Context, conn *kvrpc.Client) error {
+		return conn.Put(ctx, key, value)
+	})
+}
+
+// Delete удаляет ключ.
+func (c *Client) Delete(ctx context.Context, key []byte) error {
+	return c.do(ctx, c.router.Shard(key), true, func(ctx context.Context, conn *kvrpc.Client) error {
+		return conn.Delete(ctx, key)
+	})
+}
+
+// Batch атомарно применяет изменения. Все ключи пакета должны быть на одном шарде,
+// иначе ErrCrossShard.
+func (c *Client) Batch(ctx context.Context, mutations []kvrpc.Mutation) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+	shard := c.router.Shard(mutations[0].Key)
+	for _, m := range mutations[1:] {
+		if s := c.router.Shard(m.Key); s != shard {
+			return fmt.Errorf("%w: %q на %s, %q на %s", ErrCrossShard, mutations[0].Key, shard, m.Key, s)
+		}
+	}
+	return c.do(ctx, shard, true, func(ctx context.Context, conn *kvrpc.Client) error {
+		return conn.Batch(ctx, mutations)
+	})
+}
+
+// Scan вызывает fn для ключей диапазона [start, end) по возрастанию, не больше limit
+// (0 — без ограничения), со всех шардов, где они могут быть (Router.Shards).
+// Шарды читаются одновременно, и их ключи сливаются по порядку. Оборванное чтение
+// шарда повторяется с ключа, следующего за последним полученным.
+// Ошибка fn прерывает Scan и возвращается.
+func (c *Client) Scan(ctx context.Context, start, end []byte, limit int, fn func(key, value []byte) error) error {
+	shards := c.router.Shards(start, end)
+	if len(shards) == 1 {
+		return c.scanShard(ctx, shards[0], start, end, limit, fn)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	streams := make([]*shardStream, len(shards))
+	for i, shard := range shards {
+		s := &shardStream{ch: make(chan keyValue, 64)}
+		streams[i] = s
+		go func() {
+			defer close(s.ch)
+			s.err = c.scanShard(ctx, shard, start, end, limit, func(key, value []byte) error {
+				select {
+				case s.ch <- keyValue{key, value}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+
+	h := make(mergeHeap, 0, len(streams))
+	for _, s := range streams {
+		if err := s.advance(); err != nil {
+			return err
+		}
+		if s.ok {
+			h = append(h, s)
+		}
+	}
+	heap.Init(&h)
+	for n := 0; len(h) > 0 && (limit <= 0 || n < limit); n++ {
+		s := h[0]
+		if err := fn(s.head.key, s.head.value); err != nil {
+			return err
+		}
+		if err := s.advance(); err != nil {
+			return err
+		}
+		if s.ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+// scanShard читает диапазон одного шарда, возобновляя чтение после обрыва.
+func (c *Client) scanShard(ctx context.Context, shard string, start, end []byte, limit int, fn func(key, value []byte) error) error {
+	var (
+		last []byte
+		read int
+	)
+	return c.do(ctx, shard, false, func(ctx context.Context, conn *kvrpc.Client) error {
+		from, rest := start, 0
+		if last != nil {
+			from = append(bytes.Clone(last), 0)
+		}
+		if limit > 0 {
+			if rest = limit - read; rest == 0 {
+				return nil
+			}
+		}
+		return conn.Scan(ctx, from, end, rest, func(key, value []byte) error {
+			if err := fn(key, value); err != nil {
+				return err
+			}
+			last = key
+			read++
+			return nil
+		})
+	})
+}
+
+type keyValue struct {
+	key, value []byte
+}
+
+// shardStream — ключи одного шарда для слияния в Scan.
+type shardStream struct {
+	ch   chan keyValue
+	err  error // ошибка чтения; читается после закрытия ch
+	head keyValue
+	ok   bool
+}
+
+// advance читает следующий ключ шарда в head; ok false — ключи кончились.
+func (s *shardStream) advance() error {
+	s.head, s.ok = <-s.ch
+	if !s.ok {
+		return s.err
+	}
+	return nil
+}
+
+// mergeHeap — шарды, упорядоченные по очередному ключу.
+type mergeHeap []*shardStream
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return bytes.Compare(h[i].head.key, h[j].head.key) < 0 }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.(*shardStream)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// do выполняет call на соединении шарда, повторяя его при временных ошибках.
+// timeout — ограничить попытку Options.RequestTimeout.
+func (c *Client) do(ctx context.Context, shard string, timeout bool, call func(context.Context, *kvrpc.Client) error) error {
+	p, ok := c.pools[shard]
+	if !ok {
+		return fmt.Errorf("client: неизвестный шард %q", shard)
+	}
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout && c.opts.RequestTimeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, c.opts.RequestTimeout)
+		}
+		err := call(actx, p.get())
+		cancel()
+		if err == nil || errors.Is(err, ErrNotFound) || attempt >= c.opts.MaxRetries || !retryable(ctx, err) {
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				err = fmt.Errorf("client: шард %s: %w", shard, err)
+			}
+			return err
+		}
+		// Случайная добавка разводит повторы клиентов, отвергнутых одновременно.
+		pause := backoff/2 + rand.N(backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("client: шард %s: %w", shard, ctx.Err())
+		case <-time.After(pause):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// retryable сообщает, стоит ли повторить запрос, завершившийся ошибкой err:
+// сервер недоступен, перегружен или отверг запрос из-за конфликта блокировок,
+// либо истекло время попытки (но не вызова ctx).
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
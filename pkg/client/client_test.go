@@ -0,0 +1,306 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"kvschool/internal/kvrpc"
+	"kvschool/internal/lsm"
+)
+
+// testShards запускает серверы kvrpc в памяти и возвращает их движки по адресам
+// и параметры клиента, соединяющегося с ними. failures — сколько первых запросов
+// каждого сервера (Scan — после двух отправленных ключей) отвергается с Unavailable.
+func testShards(t *testing.T, names []string, failures int32) (map[string]*lsm.Engine, Options) {
+	t.Helper()
+	engines := make(map[string]*lsm.Engine)
+	listeners := make(map[string]*bufconn.Listener)
+	for _, name := range names {
+		e, err := lsm.Open(lsm.Options{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		var left atomic.Int32
+		left.Store(failures)
+		srv := kvrpc.NewServer(e,
+			grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, h grpc.UnaryHandler) (any, error) {
+				if left.Add(-1) >= 0 {
+					return nil, status.Error(codes.Unavailable, "перегрузка")
+				}
+				return h(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+				if left.Add(-1) >= 0 {
+					return h(srv, &failingStream{ServerStream: ss, left: 2})
+				}
+				return h(srv, ss)
+			}))
+		lis := bufconn.Listen(1 << 20)
+		go srv.Serve(lis)
+		t.Cleanup(func() {
+			srv.Stop()
+			_ = e.Close()
+		})
+		engines["passthrough:///"+name] = e
+		listeners[name] = lis
+	}
+	opts := Options{
+		RetryBackoff: 1,
+		DialOptions: []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				return listeners[addr].DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+	}
+	return engines, opts
+}
+
+// failingStream обрывает поток Scan после left ключей.
+type failingStream struct {
+	grpc.ServerStream
+	left int
+}
+
+func (s *failingStream) SendMsg(m any) error {
+	if s.left == 0 {
+		return status.Error(codes.Unavailable, "обрыв")
+	}
+	s.left--
+	return s.ServerStream.SendMsg(m)
+}
+
+func shardNames(engines map[string]*lsm.Engine) []string {
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestRing(t *testing.T) {
+	shards := []string{"a:7070", "b:7070", "c:7070"}
+	r, err := NewRing(shards, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 30000
+	counts := make(map[string]int)
+	for i := range n {
+		counts[r.Shard([]byte(fmt.Sprintf("25001%010d", i)))]++
+	}
+	for _, s := range shards {
+		// Ключи с общим префиксом расходятся по шардам примерно поровну.
+		if c := counts[s]; c < n/4 || c > n/2 {
+			t.Fatalf("шард %s: %d ключей из %d", s, c, n)
+		}
+	}
+
+	// Порядок шардов не влияет на кольцо, а удаление шарда перемещает только его ключи.
+	r2, _ := NewRing([]string{"c:7070", "b:7070", "a:7070"}, 0)
+	r3, _ := NewRing([]string{"a:7070", "c:7070"}, 0)
+	for i := range 1000 {
+		key := []byte(fmt.Sprintf("key%d", i))
+		s := r.Shard(key)
+		if got := r2.Shard(key); got != s {
+			t.Fatalf("%s: %s после перестановки шардов, было %s", key, got, s)
+		}
+		if got := r3.Shard(key); s != "b:7070" && got != s {
+			t.Fatalf("%s: перемещен с %s на %s", key, s, got)
+		}
+	}
+	if _, err := NewRing([]string{"a", "a"}, 0); err == nil {
+		t.Fatal("NewRing с повтором шарда")
+	}
+}
+
+func TestPrefixRanges(t *testing.T) {
+	r, err := PrefixRanges(map[string]string{"25001": "mts", "25002": "megafon", "25099": "beeline"}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"250010000000001": "mts",
+		"25001":           "mts",
+		"250020000000001": "megafon",
+		"250030000000001": "other",
+		"250990000000001": "beeline",
+		"":                "other",
+		"9":               "other",
+	} {
+		if got := r.Shard([]byte(key)); got != want {
+			t.Errorf("Shard(%q) = %s, want %s", key, got, want)
+		}
+	}
+	if got := r.Shards([]byte("25001"), []byte("25002")); !slices.Equal(got, []string{"mts"}) {
+		t.Errorf("Shards(25001, 25002) = %v", got)
+	}
+	if got := r.Shards([]byte("25001"), []byte("250021")); !slices.Equal(got, []string{"mts", "megafon"}) {
+		t.Errorf("Shards(25001, 250021) = %v", got)
+	}
+	if got := r.Shards(nil, nil); !slices.Equal(got, []string{"other", "mts", "megafon", "beeline"}) {
+		t.Errorf("Shards(nil, nil) = %v", got)
+	}
+	if _, err := PrefixRanges(map[string]string{"250": "a", "2501": "b"}, "c"); err == nil {
+		t.Error("PrefixRanges с вложенными префиксами")
+	}
+	if _, err := NewRanges(Range{Start: []byte("a"), Shard: "x"}); err == nil {
+		t.Error("NewRanges без начального диапазона")
+	}
+}
+
+func TestClient(t *testing.T) {
+	engines, opts := testShards(t, []string{"s0", "s1", "s2"}, 0)
+	ring, err := NewRing(shardNames(engines), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial(ring, opts)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	var keys []string
+	for i := range 60 {
+		key := fmt.Sprintf("k%02d", i)
+		keys = append(keys, key)
+		if err := c.Put(ctx, []byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	for _, key := range keys {
+		// Ключ лежит на своем шарде и только на нем.
+		for name, e := range engines {
+			_, err := e.Get([]byte(key))
+			if own := ring.Shard([]byte(key)) == name; own != (err == nil) {
+				t.Fatalf("%s на шарде %s: %v", key, name, err)
+			}
+		}
+		if v, err := c.Get(ctx, []byte(key)); err != nil || string(v) != "v"+key {
+			t.Fatalf("Get(%s) = %q, %v", key, v, err)
+		}
+	}
+	if err := c.Delete(ctx, []byte("k07")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := c.Get(ctx, []byte("k07")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get удаленного ключа: %v", err)
+	}
+
+	var got []string
+	err = c.Scan(ctx, []byte("k05"), []byte("k50"), 0, func(key, _ []byte) error {
+		got = append(got, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	want := slices.DeleteFunc(slices.Clone(keys[5:50]), func(k string) bool { return k == "k07" })
+	if !slices.Equal(got, want) {
+		t.Fatalf("Scan = %v, want %v", got, want)
+	}
+	got = got[:0]
+	if err := c.Scan(ctx, nil, nil, 10, func(key, _ []byte) error { got = append(got, string(key)); return nil }); err != nil {
+		t.Fatalf("Scan с limit: %v", err)
+	}
+	if want := append(slices.Clone(keys[:7]), keys[8:11]...); !slices.Equal(got, want) {
+		t.Fatalf("Scan с limit = %v", got)
+	}
+	stop := errors.New("stop")
+	if err := c.Scan(ctx, nil, nil, 0, func(_, _ []byte) error { return stop }); !errors.Is(err, stop) {
+		t.Fatalf("Scan с ошибкой fn: %v", err)
+	}
+
+	// Пакет атомарен в пределах шарда; ключи разных шардов отвергаются.
+	var same []kvrpc.Mutation
+	for _, key := range keys {
+		if ring.Shard([]byte(key)) == ring.Shard([]byte("k00")) {
+			same = append(same, kvrpc.Mutation{Op: kvrpc.OpPut, Key: []byte(key), Value: []byte("batch")})
+		}
+	}
+	if err := c.Batch(ctx, same); err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	cross := []kvrpc.Mutation{{Op: kvrpc.OpDelete, Key: []byte("k00")}}
+	for _, key := range keys {
+		if ring.Shard([]byte(key)) != ring.Shard([]byte("k00")) {
+			cross = append(cross, kvrpc.Mutation{Op: kvrpc.OpDelete, Key: []byte(key)})
+			break
+		}
+	}
+	if err := c.Batch(ctx, cross); !errors.Is(err, ErrCrossShard) {
+		t.Fatalf("Batch на разные шарды: %v", err)
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	engines, opts := testShards(t, []string{"s0", "s1"}, 2)
+	ranges, err := NewRanges(Range{Shard: "passthrough:///s0"}, Range{Start: []byte("m"), Shard: "passthrough:///s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial(ranges, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	// Первые два запроса каждого шарда отвергаются, третий проходит.
+	if err := c.Put(ctx, []byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if v, err := engines["passthrough:///s0"].Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("значение на шарде: %q, %v", v, err)
+	}
+	for i := range 5 {
+		if err := c.Put(ctx, []byte(fmt.Sprintf("a%d", i)), []byte("1")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	// Чтение шарда s1 обрывается дважды после двух ключей и продолжается с места обрыва.
+	for i := range 8 {
+		if err := engines["passthrough:///s1"].Put([]byte(fmt.Sprintf("m%d", i)), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	err = c.Scan(ctx, []byte("a3"), nil, 0, func(key, _ []byte) error {
+		got = append(got, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	want := []string{"a3", "a4", "m0", "m1", "m2", "m3", "m4", "m5", "m6", "m7"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Scan = %v, want %v", got, want)
+	}
+
+	_, opts = testShards(t, []string{"s0"}, 1)
+	opts.MaxRetries = -1
+	ranges, _ = NewRanges(Range{Shard: "passthrough:///s0"})
+	c2, err := Dial(ranges, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if err := c2.Put(ctx, []byte("a"), []byte("1")); status.Code(errors.Unwrap(err)) != codes.Unavailable {
+		t.Fatalf("Put без повторов: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Router распределяет ключи по шардам — адресам серверов kvserver.
+type Router interface {
+	// Shard возвращает шард ключа.
+	Shard(key []byte) string
+	// Shards возвращает шарды, в которых могут быть ключи диапазона [start, end)
+	// (nil или пустая граница — без ограничения с этой стороны), без повторов.
+	// Shards(nil, nil) — все шарды.
+	Shards(start, end []byte) []string
+}
+
+// DefaultVirtualNodes — число точек шарда на кольце Ring по умолчанию.
+const DefaultVirtualNodes = 128
+
+// Ring — консистентное хеширование: каждый шард занимает на кольце хешей
+// несколько точек, и ключ принадлежит шарду первой точки не меньше хеша ключа.
+// Добавление или удаление шарда перемещает только ключи соседних с его точками
+// участков — в среднем 1/N всех ключей. Соседние ключи попадают на разные шарды,
+// поэтому Scan опрашивает все шарды.
+type Ring struct {
+	points []uint64 // по возрастанию
+	owners []string // owners[i] — шард точки points[i]
+	shards []string
+}
+
+// NewRing строит кольцо из шардов shards, по vnodes точек на шард (0 —
+// DefaultVirtualNodes). Точки зависят только от адресов шардов: кольцо одинаково
+// у всех клиентов с тем же списком.
+func NewRing(shards []string, vnodes int) (*Ring, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("client: нет шардов")
+	}
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{}
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	var points []point
+	for _, s := range shards {
+		if slices.Contains(r.shards, s) {
+			return nil, fmt.Errorf("client: шард %q указан дважды", s)
+		}
+		r.shards = append(r.shards, s)
+		for i := range vnodes {
+			points = append(points, point{hashKey([]byte(s + "#" + strconv.Itoa(i))), s})
+		}
+	}
+	// Совпавшие хеши точек упорядочиваются по адресу, чтобы кольцо не зависело
+	// от порядка shards.
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r, nil
+}
+
+// hashKey — хеш ключа на кольце. Он не должен меняться между версиями: от него
+// зависит размещение ключей.
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	// FNV плохо перемешивает последние байты: ключи с общим префиксом (IMSI одного
+	// оператора) легли бы на кольцо кучно. Финальное перемешивание из splitmix64.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (r *Ring) Shard(key []byte) string {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func (r *Ring) Shards(_, _ []byte) []string {
+	return slices.Clone(r.shards)
+}
+
+// Range — диапазон ключей шарда: от Start до Start следующего диапазона.
+type Range struct {
+	Start []byte
+	Shard string
+}
+
+// Ranges делит ключи на непрерывные диапазоны, например по префиксам IMSI
+// (код страны и оператора): ключи абонентов одного оператора лежат на одном шарде,
+// и Scan по префиксу опрашивает только его.
+type Ranges struct {
+	ranges []Range // по возрастанию Start; первый начинается с пустого ключа
+}
+
+// NewRanges строит Ranges. Диапазоны упорядочиваются по Start; один из них должен
+// начинаться с пустого ключа, чтобы шард был у любого ключа. Шард может владеть
+// несколькими диапазонами.
+func NewRanges(ranges ...Range) (*Ranges, error) {
+	rs := slices.Clone(ranges)
+	slices.SortFunc(rs, func(a, b Range) int { return bytes.Compare(a.Start, b.Start) })
+	if len(rs) == 0 || len(rs[0].Start) != 0 {
+		return nil, errors.New("client: нет диапазона, начинающегося с пустого ключа")
+	}
+	for i, r := range rs {
+		if r.Shard == "" {
+			return nil, fmt.Errorf("client: у диапазона %q нет шарда", r.Start)
+		}
+		if i > 0 && bytes.Equal(r.Start, rs[i-1].Start) {
+			return nil, fmt.Errorf("client: диапазон %q указан дважды", r.Start)
+		}
+	}
+	return &Ranges{ranges: rs}, nil
+}
+
+// find возвращает номер диапазона ключа.
+func (r *Ranges) find(key []byte) int {
+	return sort.Search(len(r.ranges), func(i int) bool { return bytes.Compare(r.ranges[i].Start, key) > 0 }) - 1
+}
+
+func (r *Ranges) Shard(key []byte) string {
+	return r.ranges[r.find(key)].Shard
+}
+
+func (r *Ranges) Shards(start, end []byte) []string {
+	var shards []string
+	for i := r.find(start); i < len(r.ranges); i++ {
+		if len(end) > 0 && bytes.Compare(r.ranges[i].Start, end) >= 0 {
+			break
+		}
+		if !slices.Contains(shards, r.ranges[i].Shard) {
+			shards = append(shards, r.ranges[i].Shard)
+		}
+	}
+	return shards
+}
+
+// PrefixRanges строит Ranges по префиксам ключей: ключи с префиксом prefix —
+// на шарде shards[prefix], остальные — на шарде fallback. Префиксы не должны быть
+// префиксами друг друга.
+func PrefixRanges(shards map[string]string, fallback string) (*Ranges, error) {
+	prefixes := make([]string, 0, len(shards))
+	for p := range shards {
+		prefixes = append(prefixes, p)
+	}
+	slices.Sort(prefixes)
+	ranges := []Range{{Start: nil, Shard: fallback}}
+	for i, p := range prefixes {
+		if p == "" {
+			return nil, errors.New("client: пустой префикс")
+		}
+		for _, q := range prefixes[:i] {
+			if bytes.HasPrefix([]byte(p), []byte(q)) {
+				return nil, fmt.Errorf("client: префикс %q продолжает префикс %q", p, q)
+			}
+		}
+		ranges = append(ranges, Range{Start: []byte(p), Shard: shards[p]})
+		if end := prefixEnd([]byte(p)); end != nil {
+			ranges = append(ranges, Range{Start: end, Shard: fallback})
+		}
+	}
+	// Конец одного префикса может совпасть с началом следующего: тогда
+	// диапазон fallback между ними пуст.
+	out := ranges[:0]
+	for _, r := range ranges {
+		if n := len(out); n > 0 && bytes.Equal(out[n-1].Start, r.Start) {
+			out[n-1] = r
+			continue
+		}
+		out = append(out, r)
+	}
+	return NewRanges(out...)
+}
+
+// prefixEnd возвращает наименьший ключ больше всех ключей с префиксом p;
+// nil — таких нет (p из одних 0xff).
+func prefixEnd(p []byte) []byte {
+	end := bytes.Clone(p)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}